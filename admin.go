@@ -0,0 +1,83 @@
+package zentinel
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// AdminServer serves a runner's admin endpoints over HTTP, along with pprof
+// under /debug/pprof/ and expvar at /debug/vars. It is opt-in and has no
+// authentication, so it should listen on a loopback or otherwise private
+// address.
+type AdminServer struct {
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+}
+
+// NewAdminServer creates an admin server that will listen on addr.
+func NewAdminServer(addr string) *AdminServer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return &AdminServer{
+		mux: mux,
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Handle serves handler at pattern, as http.ServeMux does.
+func (s *AdminServer) Handle(pattern string, handler http.Handler) *AdminServer {
+	s.mux.Handle(pattern, handler)
+	return s
+}
+
+// Start listens and serves in the background, with logger in each
+// request's context.
+func (s *AdminServer) Start(logger *zerolog.Logger) error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address %s: %w", s.server.Addr, err)
+	}
+	s.listener = listener
+	s.server.BaseContext = func(net.Listener) context.Context {
+		return logger.WithContext(context.Background())
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("Admin server failed")
+		}
+	}()
+	logger.Info().Str("address", listener.Addr().String()).Msg("Admin endpoint listening")
+	return nil
+}
+
+// Addr returns the address the server listens on, or nil before Start.
+func (s *AdminServer) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops the server.
+func (s *AdminServer) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,386 @@
+package agenttest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// HeaderOp is a decoded header operation.
+type HeaderOp struct {
+	Operation string
+	Name      string
+	Value     string
+}
+
+// BodyMutation is a decoded body mutation.
+type BodyMutation struct {
+	// Data is the replacement chunk. nil means the chunk passes through unchanged.
+	Data       []byte
+	ChunkIndex int
+}
+
+// Decision is an agent decision decoded from the wire.
+type Decision struct {
+	// Action is one of v2.ActionAllow, v2.ActionBlock, v2.ActionRedirect or
+	// v2.ActionChallenge.
+	Action string
+
+	// Status is the block or redirect status code.
+	Status int
+
+	// Body is the block response body.
+	Body string
+
+	// BlockHeaders are the headers attached to the block response.
+	BlockHeaders map[string]string
+
+	// RedirectURL is the redirect target.
+	RedirectURL string
+
+	// ChallengeType is the challenge type.
+	ChallengeType string
+
+	// ChallengeParams are the challenge parameters.
+	ChallengeParams map[string]interface{}
+
+	// RequestHeaders are the header operations for the upstream request.
+	RequestHeaders []HeaderOp
+
+	// ResponseHeaders are the header operations for the client response.
+	ResponseHeaders []HeaderOp
+
+	// RoutingMetadata is the routing metadata (v1 only).
+	RoutingMetadata map[string]string
+
+	// Audit is the audit metadata.
+	Audit zentinel.AuditMetadata
+
+	// NeedsMore is set when the agent asked for more body data.
+	NeedsMore bool
+
+	// RequestBodyMutation is the request body mutation (v1 only).
+	RequestBodyMutation *BodyMutation
+
+	// ResponseBodyMutation is the response body mutation (v1 only).
+	ResponseBodyMutation *BodyMutation
+
+	// Raw is the undecoded response payload.
+	Raw json.RawMessage
+}
+
+// DecodeV1Decision decodes a v1 AgentResponse JSON document.
+func DecodeV1Decision(data []byte) (*Decision, error) {
+	var resp struct {
+		Decision             json.RawMessage         `json:"decision"`
+		RequestHeaders       []map[string]wireHeader `json:"request_headers"`
+		ResponseHeaders      []map[string]wireHeader `json:"response_headers"`
+		RoutingMetadata      map[string]string       `json:"routing_metadata"`
+		Audit                zentinel.AuditMetadata  `json:"audit"`
+		NeedsMore            bool                    `json:"needs_more"`
+		RequestBodyMutation  *wireBodyMutation       `json:"request_body_mutation"`
+		ResponseBodyMutation *wireBodyMutation       `json:"response_body_mutation"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode agent response: %w", err)
+	}
+
+	d := &Decision{
+		RoutingMetadata: resp.RoutingMetadata,
+		Audit:           resp.Audit,
+		NeedsMore:       resp.NeedsMore,
+		Raw:             data,
+	}
+	if err := d.decodeAction(resp.Decision); err != nil {
+		return nil, err
+	}
+
+	for _, op := range resp.RequestHeaders {
+		d.RequestHeaders = append(d.RequestHeaders, decodeV1HeaderOp(op))
+	}
+	for _, op := range resp.ResponseHeaders {
+		d.ResponseHeaders = append(d.ResponseHeaders, decodeV1HeaderOp(op))
+	}
+
+	var err error
+	if d.RequestBodyMutation, err = resp.RequestBodyMutation.decode(); err != nil {
+		return nil, err
+	}
+	if d.ResponseBodyMutation, err = resp.ResponseBodyMutation.decode(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DecodeV2Decision decodes a v2 Decision message payload.
+func DecodeV2Decision(data []byte) (*Decision, error) {
+	parsed, err := v2.ParseDecision(data)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Decision{
+		RoutingMetadata: map[string]string{},
+		Audit:           parsed.Audit,
+		NeedsMore:       parsed.NeedsMore,
+		Raw:             data,
+	}
+	d.setAction(parsed)
+	for _, op := range parsed.RequestHeaders {
+		d.RequestHeaders = append(d.RequestHeaders, decodeV2HeaderOp(op))
+	}
+	for _, op := range parsed.ResponseHeaders {
+		d.ResponseHeaders = append(d.ResponseHeaders, decodeV2HeaderOp(op))
+	}
+	return d, nil
+}
+
+type wireHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func decodeV2HeaderOp(op v2.V2HeaderOp) HeaderOp {
+	value := ""
+	if op.Value != nil {
+		value = *op.Value
+	}
+	return HeaderOp{Operation: op.Operation, Name: op.Name, Value: value}
+}
+
+func decodeV1HeaderOp(op map[string]wireHeader) HeaderOp {
+	for operation, header := range op {
+		return HeaderOp{Operation: operation, Name: header.Name, Value: header.Value}
+	}
+	return HeaderOp{}
+}
+
+type wireBodyMutation struct {
+	Data       *string `json:"data"`
+	ChunkIndex int     `json:"chunk_index"`
+}
+
+func (m *wireBodyMutation) decode() (*BodyMutation, error) {
+	if m == nil {
+		return nil, nil
+	}
+	mutation := &BodyMutation{ChunkIndex: m.ChunkIndex}
+	if m.Data != nil {
+		data, err := base64.StdEncoding.DecodeString(*m.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode body mutation: %w", err)
+		}
+		mutation.Data = data
+	}
+	return mutation, nil
+}
+
+// decodeAction decodes the decision field, which v1 encodes as v2 does, so
+// it is parsed with v2.ParseDecision.
+func (d *Decision) decodeAction(raw json.RawMessage) error {
+	payload, err := json.Marshal(struct {
+		Decision json.RawMessage `json:"decision"`
+	}{raw})
+	if err != nil {
+		return fmt.Errorf("failed to decode decision %s: %w", string(raw), err)
+	}
+	parsed, err := v2.ParseDecision(payload)
+	if err != nil {
+		return err
+	}
+	d.setAction(parsed)
+	return nil
+}
+
+// setAction copies the action and its parameters from a parsed decision.
+func (d *Decision) setAction(parsed *v2.ClientDecision) {
+	d.Action = parsed.Action
+	d.Status = parsed.Status
+	d.Body = parsed.Body
+	d.BlockHeaders = parsed.BlockHeaders
+	d.RedirectURL = parsed.RedirectURL
+	d.ChallengeType = parsed.ChallengeType
+	d.ChallengeParams = parsed.ChallengeParams
+}
+
+// Result is the decision returned for one event, with assertion helpers.
+// Every Expect method reports failures through the test and returns the
+// Result so expectations can be chained.
+type Result struct {
+	tb    testing.TB
+	phase string
+
+	// Decision is the decoded decision.
+	Decision *Decision
+}
+
+func (r *Result) errorf(format string, args ...interface{}) {
+	r.tb.Helper()
+	r.tb.Errorf("%s: %s", r.phase, fmt.Sprintf(format, args...))
+}
+
+// ExpectAllowed asserts that the request was allowed.
+func (r *Result) ExpectAllowed() *Result {
+	r.tb.Helper()
+	if r.Decision.Action != v2.ActionAllow {
+		r.errorf("expected allow, got %s", r.describe())
+	}
+	return r
+}
+
+// ExpectBlocked asserts that the request was blocked with the given status.
+func (r *Result) ExpectBlocked(status int) *Result {
+	r.tb.Helper()
+	if r.Decision.Action != v2.ActionBlock || r.Decision.Status != status {
+		r.errorf("expected block %d, got %s", status, r.describe())
+	}
+	return r
+}
+
+// ExpectBlockBody asserts the body of a block decision.
+func (r *Result) ExpectBlockBody(body string) *Result {
+	r.tb.Helper()
+	if r.Decision.Body != body {
+		r.errorf("expected block body %q, got %q", body, r.Decision.Body)
+	}
+	return r
+}
+
+// ExpectRedirect asserts a redirect to url with the given status.
+func (r *Result) ExpectRedirect(url string, status int) *Result {
+	r.tb.Helper()
+	if r.Decision.Action != v2.ActionRedirect || r.Decision.RedirectURL != url || r.Decision.Status != status {
+		r.errorf("expected redirect %d to %s, got %s", status, url, r.describe())
+	}
+	return r
+}
+
+// ExpectChallenge asserts a challenge of the given type.
+func (r *Result) ExpectChallenge(challengeType string) *Result {
+	r.tb.Helper()
+	if r.Decision.Action != v2.ActionChallenge || r.Decision.ChallengeType != challengeType {
+		r.errorf("expected %s challenge, got %s", challengeType, r.describe())
+	}
+	return r
+}
+
+// ExpectNeedsMore asserts that the agent asked for more body data.
+func (r *Result) ExpectNeedsMore() *Result {
+	r.tb.Helper()
+	if !r.Decision.NeedsMore {
+		r.errorf("expected needs_more, got %s", r.describe())
+	}
+	return r
+}
+
+// ExpectHeaderSet asserts that a request header is set on the upstream request.
+func (r *Result) ExpectHeaderSet(name string) *Result {
+	r.tb.Helper()
+	if findHeaderOp(r.Decision.RequestHeaders, "set", name) == nil {
+		r.errorf("expected request header %q to be set, got %v", name, r.Decision.RequestHeaders)
+	}
+	return r
+}
+
+// ExpectHeaderValue asserts that a request header is set to value.
+func (r *Result) ExpectHeaderValue(name, value string) *Result {
+	r.tb.Helper()
+	op := findHeaderOp(r.Decision.RequestHeaders, "set", name)
+	if op == nil || op.Value != value {
+		r.errorf("expected request header %q set to %q, got %v", name, value, r.Decision.RequestHeaders)
+	}
+	return r
+}
+
+// ExpectHeaderRemoved asserts that a request header is removed.
+func (r *Result) ExpectHeaderRemoved(name string) *Result {
+	r.tb.Helper()
+	if findHeaderOp(r.Decision.RequestHeaders, "remove", name) == nil {
+		r.errorf("expected request header %q to be removed, got %v", name, r.Decision.RequestHeaders)
+	}
+	return r
+}
+
+// ExpectResponseHeaderSet asserts that a header is set on the client response.
+func (r *Result) ExpectResponseHeaderSet(name string) *Result {
+	r.tb.Helper()
+	if findHeaderOp(r.Decision.ResponseHeaders, "set", name) == nil {
+		r.errorf("expected response header %q to be set, got %v", name, r.Decision.ResponseHeaders)
+	}
+	return r
+}
+
+// ExpectResponseHeaderRemoved asserts that a header is removed from the client response.
+func (r *Result) ExpectResponseHeaderRemoved(name string) *Result {
+	r.tb.Helper()
+	if findHeaderOp(r.Decision.ResponseHeaders, "remove", name) == nil {
+		r.errorf("expected response header %q to be removed, got %v", name, r.Decision.ResponseHeaders)
+	}
+	return r
+}
+
+// ExpectTag asserts that the audit metadata contains tag.
+func (r *Result) ExpectTag(tag string) *Result {
+	r.tb.Helper()
+	if !contains(r.Decision.Audit.Tags, tag) {
+		r.errorf("expected audit tag %q, got %v", tag, r.Decision.Audit.Tags)
+	}
+	return r
+}
+
+// ExpectRuleID asserts that the audit metadata contains ruleID.
+func (r *Result) ExpectRuleID(ruleID string) *Result {
+	r.tb.Helper()
+	if !contains(r.Decision.Audit.RuleIDs, ruleID) {
+		r.errorf("expected rule ID %q, got %v", ruleID, r.Decision.Audit.RuleIDs)
+	}
+	return r
+}
+
+// ExpectReasonCode asserts that the audit metadata contains code.
+func (r *Result) ExpectReasonCode(code string) *Result {
+	r.tb.Helper()
+	if !contains(r.Decision.Audit.ReasonCodes, code) {
+		r.errorf("expected reason code %q, got %v", code, r.Decision.Audit.ReasonCodes)
+	}
+	return r
+}
+
+func (r *Result) describe() string {
+	d := r.Decision
+	switch d.Action {
+	case v2.ActionBlock:
+		return fmt.Sprintf("block %d", d.Status)
+	case v2.ActionRedirect:
+		return fmt.Sprintf("redirect %d to %s", d.Status, d.RedirectURL)
+	case v2.ActionChallenge:
+		return fmt.Sprintf("%s challenge", d.ChallengeType)
+	}
+	if d.NeedsMore {
+		return d.Action + " (needs_more)"
+	}
+	return d.Action
+}
+
+func findHeaderOp(ops []HeaderOp, operation, name string) *HeaderOp {
+	for i := range ops {
+		if ops[i].Operation == operation && strings.EqualFold(ops[i].Name, name) {
+			return &ops[i]
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
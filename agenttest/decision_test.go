@@ -0,0 +1,105 @@
+package agenttest
+
+import (
+	"encoding/json"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+func TestDecodeV1Decision_Block(t *testing.T) {
+	data, err := json.Marshal(zentinel.Block(429).
+		WithBody("slow down").
+		WithBlockHeader("Retry-After", "30").
+		WithTag("rate-limit").
+		Build())
+	if err != nil {
+		t.Fatalf("failed to marshal response: %v", err)
+	}
+
+	d, err := DecodeV1Decision(data)
+	if err != nil {
+		t.Fatalf("failed to decode decision: %v", err)
+	}
+
+	if d.Action != v2.ActionBlock || d.Status != 429 {
+		t.Errorf("expected block 429, got %s %d", d.Action, d.Status)
+	}
+	if d.Body != "slow down" {
+		t.Errorf("expected body 'slow down', got %q", d.Body)
+	}
+	if d.BlockHeaders["Retry-After"] != "30" {
+		t.Errorf("expected Retry-After header, got %v", d.BlockHeaders)
+	}
+	if len(d.Audit.Tags) != 1 || d.Audit.Tags[0] != "rate-limit" {
+		t.Errorf("expected rate-limit tag, got %v", d.Audit.Tags)
+	}
+}
+
+func TestDecodeV1Decision_HeadersAndMutations(t *testing.T) {
+	data, err := json.Marshal(zentinel.Allow().
+		AddRequestHeader("X-User", "alice").
+		RemoveResponseHeader("Server").
+		WithRoutingMetadata("pool", "canary").
+		WithRequestBodyMutation([]byte("redacted"), 2).
+		WithResponseBodyMutation(nil, 0).
+		Build())
+	if err != nil {
+		t.Fatalf("failed to marshal response: %v", err)
+	}
+
+	d, err := DecodeV1Decision(data)
+	if err != nil {
+		t.Fatalf("failed to decode decision: %v", err)
+	}
+
+	if len(d.RequestHeaders) != 1 || d.RequestHeaders[0] != (HeaderOp{Operation: "set", Name: "X-User", Value: "alice"}) {
+		t.Errorf("unexpected request header ops: %v", d.RequestHeaders)
+	}
+	if len(d.ResponseHeaders) != 1 || d.ResponseHeaders[0] != (HeaderOp{Operation: "remove", Name: "Server"}) {
+		t.Errorf("unexpected response header ops: %v", d.ResponseHeaders)
+	}
+	if d.RoutingMetadata["pool"] != "canary" {
+		t.Errorf("expected routing metadata pool=canary, got %v", d.RoutingMetadata)
+	}
+	if d.RequestBodyMutation == nil || string(d.RequestBodyMutation.Data) != "redacted" || d.RequestBodyMutation.ChunkIndex != 2 {
+		t.Errorf("unexpected request body mutation: %+v", d.RequestBodyMutation)
+	}
+	if d.ResponseBodyMutation == nil || d.ResponseBodyMutation.Data != nil {
+		t.Errorf("expected pass-through response body mutation, got %+v", d.ResponseBodyMutation)
+	}
+}
+
+func TestDecodeV2Decision(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   string
+		action    string
+		status    int
+		needsMore bool
+	}{
+		{"allow", `{"request_id":1,"decision":"allow"}`, v2.ActionAllow, 0, false},
+		{"needs more", `{"request_id":1,"decision":{"needs_more":true}}`, v2.ActionAllow, 0, true},
+		{"block", `{"request_id":1,"decision":{"block":{"status":403}}}`, v2.ActionBlock, 403, false},
+		{"redirect", `{"request_id":1,"decision":{"redirect":{"url":"/login","status":302}}}`, v2.ActionRedirect, 302, false},
+		{"challenge", `{"request_id":1,"decision":{"challenge":{"challenge_type":"captcha"}}}`, v2.ActionChallenge, 0, false},
+	}
+
+	for _, tt := range tests {
+		d, err := DecodeV2Decision([]byte(tt.payload))
+		if err != nil {
+			t.Errorf("%s: failed to decode: %v", tt.name, err)
+			continue
+		}
+		if d.Action != tt.action || d.Status != tt.status || d.NeedsMore != tt.needsMore {
+			t.Errorf("%s: got action=%s status=%d needs_more=%v", tt.name, d.Action, d.Status, d.NeedsMore)
+		}
+	}
+}
+
+func TestDecodeV2Decision_Unknown(t *testing.T) {
+	if _, err := DecodeV2Decision([]byte(`{"decision":{"explode":{}}}`)); err == nil {
+		t.Error("expected error for unknown decision")
+	}
+}
@@ -0,0 +1,46 @@
+// Package agenttest provides a fake Zentinel proxy for testing agents.
+//
+// Calling OnRequest directly skips everything the SDK does between the wire
+// and the agent: event parsing, body chunk accumulation, base64 decoding,
+// request/response correlation and decision serialization. The Proxy in this
+// package drives an agent through the real AgentHandler (v1) or
+// AgentHandlerV2 (v2) and decodes the decisions exactly as the proxy would.
+//
+// # Quick Start
+//
+//	func TestBlocksAdmin(t *testing.T) {
+//	    proxy := agenttest.New(t, &MyAgent{})
+//
+//	    proxy.Request("GET", "/admin").
+//	        Header("x-api-key", "secret").
+//	        SendHeaders().
+//	        ExpectBlocked(403)
+//	}
+//
+// For v2 agents, use NewV2. The handshake is performed when the proxy is
+// created:
+//
+//	proxy := agenttest.NewV2(t, NewMyAgentV2())
+//
+//	req := proxy.Request("POST", "/api/upload").Header("content-type", "application/json")
+//	req.SendHeaders().ExpectAllowed()
+//	req.SendBody([]byte(`{"a":`), []byte(`1}`)).ExpectAllowed().ExpectHeaderSet("x-inspected")
+//	req.SendResponseHeaders(200, nil).ExpectAllowed()
+//	req.Complete(200, 12)
+//
+// # Over the Wire
+//
+// StartUDS, StartGRPC and StartReverse run the real AgentRunnerV2 on a
+// temporary socket, a free local port or against a reverse listener, and
+// play the proxy over the connection. Connect returns a Proxy with the same
+// Exchange API; Dial and Accept return a Conn for sending raw frames and
+// inspecting every recorded message:
+//
+//	loopback := agenttest.StartUDS(t, NewMyAgentV2())
+//	loopback.Connect().Request("GET", "/admin").SendHeaders().ExpectBlocked(403)
+//
+//	conn := loopback.Dial()
+//	conn.Handshake(v2.NewHandshakeRequest("test"))
+//	loopback.Runner().Shutdown()
+//	conn.ExpectClosed()
+package agenttest
@@ -0,0 +1,303 @@
+package agenttest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// driver delivers proxy events to a protocol handler and decodes its replies.
+type driver interface {
+	configure(ctx context.Context, event *zentinel.ConfigureEvent) (bool, string, error)
+	requestHeaders(ctx context.Context, id uint64, event *zentinel.RequestHeadersEvent) (*Decision, error)
+	requestBodyChunk(ctx context.Context, id uint64, event *zentinel.RequestBodyChunkEvent) (*Decision, error)
+	responseHeaders(ctx context.Context, id uint64, event *zentinel.ResponseHeadersEvent) (*Decision, error)
+	responseBodyChunk(ctx context.Context, id uint64, event *zentinel.ResponseBodyChunkEvent) (*Decision, error)
+	requestComplete(ctx context.Context, id uint64, event *zentinel.RequestCompleteEvent) error
+	cancel(ctx context.Context, id uint64) error
+}
+
+func encodeChunk(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// v1Driver drives a zentinel.AgentHandler with v1 JSON events.
+type v1Driver struct {
+	handler *zentinel.AgentHandler
+}
+
+func newV1Driver(handler *zentinel.AgentHandler) *v1Driver {
+	return &v1Driver{handler: handler}
+}
+
+// send round-trips the event through JSON, exactly as it would travel over
+// the socket, and returns the JSON-encoded response.
+func (d *v1Driver) send(ctx context.Context, eventType zentinel.EventType, payload interface{}) ([]byte, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	var payloadMap map[string]interface{}
+	if err := json.Unmarshal(payloadBytes, &payloadMap); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+
+	event := map[string]interface{}{
+		"event_type": string(eventType),
+		"payload":    payloadMap,
+	}
+
+	response, err := d.handler.HandleEvent(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(response)
+}
+
+func (d *v1Driver) decision(ctx context.Context, eventType zentinel.EventType, payload interface{}) (*Decision, error) {
+	data, err := d.send(ctx, eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeV1Decision(data)
+}
+
+func (d *v1Driver) configure(ctx context.Context, event *zentinel.ConfigureEvent) (bool, string, error) {
+	data, err := d.send(ctx, zentinel.EventTypeConfigure, event)
+	if err != nil {
+		return false, "", err
+	}
+	var resp struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return false, "", fmt.Errorf("failed to decode configure response: %w", err)
+	}
+	return resp.Success, resp.Error, nil
+}
+
+func (d *v1Driver) requestHeaders(ctx context.Context, id uint64, event *zentinel.RequestHeadersEvent) (*Decision, error) {
+	return d.decision(ctx, zentinel.EventTypeRequestHeaders, event)
+}
+
+func (d *v1Driver) requestBodyChunk(ctx context.Context, id uint64, event *zentinel.RequestBodyChunkEvent) (*Decision, error) {
+	return d.decision(ctx, zentinel.EventTypeRequestBodyChunk, event)
+}
+
+func (d *v1Driver) responseHeaders(ctx context.Context, id uint64, event *zentinel.ResponseHeadersEvent) (*Decision, error) {
+	return d.decision(ctx, zentinel.EventTypeResponseHeaders, event)
+}
+
+func (d *v1Driver) responseBodyChunk(ctx context.Context, id uint64, event *zentinel.ResponseBodyChunkEvent) (*Decision, error) {
+	return d.decision(ctx, zentinel.EventTypeResponseBodyChunk, event)
+}
+
+func (d *v1Driver) requestComplete(ctx context.Context, id uint64, event *zentinel.RequestCompleteEvent) error {
+	_, err := d.send(ctx, zentinel.EventTypeRequestComplete, event)
+	return err
+}
+
+func (d *v1Driver) cancel(ctx context.Context, id uint64) error {
+	return fmt.Errorf("cancellation is not part of the v1 protocol")
+}
+
+// messageTransport carries v2 messages to an agent and returns its replies.
+type messageTransport interface {
+	// roundTrip sends msg and returns the reply, or nil for messages the
+	// agent does not answer.
+	roundTrip(ctx context.Context, msg *v2.V2Message) (*v2.V2Message, error)
+	configure(ctx context.Context, event *zentinel.ConfigureEvent) (bool, string, error)
+}
+
+// expectsReply reports whether the agent answers a message of the given type.
+func expectsReply(msgType byte) bool {
+	switch msgType {
+	case v2.MsgTypeRequestComplete, v2.MsgTypeCancelRequest, v2.MsgTypeCancelAll:
+		return false
+	}
+	return true
+}
+
+// handlerTransport hands messages directly to an AgentHandlerV2.
+type handlerTransport struct {
+	handler *v2.AgentHandlerV2
+}
+
+// roundTrip encodes the message on the wire format and back before handing
+// it to the handler, so payloads are exercised exactly as the runner sees them.
+func (t handlerTransport) roundTrip(ctx context.Context, msg *v2.V2Message) (*v2.V2Message, error) {
+	var buf bytes.Buffer
+	if err := v2.WriteMessageV2(&buf, msg); err != nil {
+		return nil, err
+	}
+	wireMsg, err := v2.ReadMessageV2(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return t.handler.HandleMessage(ctx, wireMsg)
+}
+
+// configure goes through the handler's legacy event path, which is how the
+// v2 handler receives configuration outside of gRPC.
+func (t handlerTransport) configure(ctx context.Context, event *zentinel.ConfigureEvent) (bool, string, error) {
+	resp, err := t.handler.HandleLegacyEvent(ctx, map[string]interface{}{
+		"event_type": string(zentinel.EventTypeConfigure),
+		"payload": map[string]interface{}{
+			"agent_id": event.AgentID,
+			"config":   event.Config,
+		},
+	})
+	if err != nil {
+		return false, "", err
+	}
+	result, _ := resp.(map[string]interface{})
+	success, _ := result["success"].(bool)
+	reason, _ := result["error"].(string)
+	return success, reason, nil
+}
+
+// v2Driver drives a v2 agent with binary protocol messages.
+type v2Driver struct {
+	transport messageTransport
+}
+
+func newV2Driver(transport messageTransport) *v2Driver {
+	return &v2Driver{transport: transport}
+}
+
+func (d *v2Driver) send(ctx context.Context, msgType byte, payload interface{}) (*v2.V2Message, error) {
+	msg, err := v2.NewV2Message(msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	return d.transport.roundTrip(ctx, msg)
+}
+
+func (d *v2Driver) decision(ctx context.Context, msgType byte, payload interface{}) (*Decision, error) {
+	resp, err := d.send(ctx, msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("agent sent no response")
+	}
+	if resp.Type != v2.MsgTypeDecision {
+		return nil, fmt.Errorf("expected Decision, got %s", resp.TypeName())
+	}
+	return DecodeV2Decision(resp.Payload)
+}
+
+func (d *v2Driver) handshake(ctx context.Context, req *v2.HandshakeRequest) (*v2.HandshakeResponse, error) {
+	resp, err := d.send(ctx, v2.MsgTypeHandshakeRequest, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Type != v2.MsgTypeHandshakeResponse {
+		return nil, fmt.Errorf("expected HandshakeResponse")
+	}
+	return v2.UnmarshalHandshakeResponse(resp.Payload)
+}
+
+func (d *v2Driver) health(ctx context.Context) (*v2.HealthStatus, error) {
+	resp, err := d.send(ctx, v2.MsgTypeHealthRequest, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Type != v2.MsgTypeHealthResponse {
+		return nil, fmt.Errorf("expected HealthResponse")
+	}
+	var status v2.HealthStatus
+	if err := resp.ParsePayload(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (d *v2Driver) metrics(ctx context.Context) (*v2.MetricsReport, error) {
+	resp, err := d.send(ctx, v2.MsgTypeMetricsRequest, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Type != v2.MsgTypeMetricsResponse {
+		return nil, fmt.Errorf("expected MetricsResponse")
+	}
+	var report v2.MetricsReport
+	if err := resp.ParsePayload(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (d *v2Driver) configure(ctx context.Context, event *zentinel.ConfigureEvent) (bool, string, error) {
+	return d.transport.configure(ctx, event)
+}
+
+func (d *v2Driver) requestHeaders(ctx context.Context, id uint64, event *zentinel.RequestHeadersEvent) (*Decision, error) {
+	md := event.Metadata
+	return d.decision(ctx, v2.MsgTypeRequestHeaders, v2.V2RequestHeaders{
+		RequestID: id,
+		Method:    event.Method,
+		URI:       event.URI,
+		Headers:   event.Headers,
+		HasBody:   true,
+		Metadata: v2.V2RequestMetadata{
+			CorrelationID: md.CorrelationID,
+			ClientIP:      md.ClientIP,
+			ClientPort:    md.ClientPort,
+			ServerName:    md.ServerName,
+			Protocol:      md.Protocol,
+			TLSVersion:    md.TLSVersion,
+			RouteID:       md.RouteID,
+			UpstreamID:    md.UpstreamID,
+			Traceparent:   md.Traceparent,
+		},
+	})
+}
+
+func (d *v2Driver) requestBodyChunk(ctx context.Context, id uint64, event *zentinel.RequestBodyChunkEvent) (*Decision, error) {
+	return d.decision(ctx, v2.MsgTypeRequestBodyChunk, v2.V2RequestBodyChunk{
+		RequestID:  id,
+		ChunkIndex: uint32(event.ChunkIndex),
+		Data:       event.Data,
+		IsLast:     event.IsLast,
+	})
+}
+
+func (d *v2Driver) responseHeaders(ctx context.Context, id uint64, event *zentinel.ResponseHeadersEvent) (*Decision, error) {
+	return d.decision(ctx, v2.MsgTypeResponseHeaders, v2.V2ResponseHeaders{
+		RequestID:  id,
+		StatusCode: uint16(event.Status),
+		Headers:    event.Headers,
+		HasBody:    true,
+	})
+}
+
+func (d *v2Driver) responseBodyChunk(ctx context.Context, id uint64, event *zentinel.ResponseBodyChunkEvent) (*Decision, error) {
+	return d.decision(ctx, v2.MsgTypeResponseBodyChunk, v2.V2ResponseBodyChunk{
+		RequestID:  id,
+		ChunkIndex: uint32(event.ChunkIndex),
+		Data:       event.Data,
+		IsLast:     event.IsLast,
+	})
+}
+
+func (d *v2Driver) requestComplete(ctx context.Context, id uint64, event *zentinel.RequestCompleteEvent) error {
+	_, err := d.send(ctx, v2.MsgTypeRequestComplete, v2.V2RequestComplete{
+		RequestID:  id,
+		StatusCode: uint16(event.Status),
+		DurationMS: uint64(event.DurationMS),
+		Error:      event.Error,
+	})
+	return err
+}
+
+func (d *v2Driver) cancel(ctx context.Context, id uint64) error {
+	_, err := d.send(ctx, v2.MsgTypeCancelRequest, v2.CancelRequestMessage{RequestID: id})
+	return err
+}
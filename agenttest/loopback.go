@@ -0,0 +1,494 @@
+package agenttest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultTimeout bounds every wait on a loopback connection or runner.
+const DefaultTimeout = 5 * time.Second
+
+// RunnerOption customizes the runner started by a Loopback.
+type RunnerOption func(*v2.AgentRunnerV2)
+
+// Loopback runs a real AgentRunnerV2 on a local transport and plays the proxy
+// side over the wire. Everything sent and received on its connections is
+// recorded.
+type Loopback struct {
+	tb        testing.TB
+	runner    *v2.AgentRunnerV2
+	transport v2.TransportType
+	address   string
+	listener  net.Listener
+	done      chan error
+	runErr    error
+	stopped   bool
+}
+
+// StartUDS starts the agent on a Unix socket in a temporary directory and
+// waits until it accepts connections.
+func StartUDS(tb testing.TB, agent v2.AgentV2, opts ...RunnerOption) *Loopback {
+	tb.Helper()
+
+	path := filepath.Join(tempDir(tb), "agent.sock")
+	l := newLoopback(tb, agent, v2.TransportUDS, func(r *v2.AgentRunnerV2) { r.WithSocket(path) }, opts)
+	l.address = path
+	l.waitReady()
+	return l
+}
+
+// StartGRPC starts the agent on a free local gRPC port and waits until it
+// accepts connections.
+func StartGRPC(tb testing.TB, agent v2.AgentV2, opts ...RunnerOption) *Loopback {
+	tb.Helper()
+
+	l := newLoopback(tb, agent, v2.TransportGRPC, func(r *v2.AgentRunnerV2) { r.WithGRPC("127.0.0.1:0") }, opts)
+	l.waitReady()
+	l.address = l.runner.Addr().String()
+	return l
+}
+
+// StartReverse listens on a Unix socket as the proxy and starts the agent
+// with reverse transport pointed at it. Use Accept to take the agent's
+// registration.
+func StartReverse(tb testing.TB, agent v2.AgentV2, opts ...RunnerOption) *Loopback {
+	tb.Helper()
+
+	path := filepath.Join(tempDir(tb), "proxy.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		tb.Fatalf("agenttest: failed to listen on %s: %v", path, err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	l := newLoopback(tb, agent, v2.TransportReverse, func(r *v2.AgentRunnerV2) {
+		r.WithReverse(path).WithReconnectInterval(50 * time.Millisecond)
+	}, opts)
+	l.address = path
+	l.listener = listener
+	return l
+}
+
+func newLoopback(tb testing.TB, agent v2.AgentV2, transport v2.TransportType, setup RunnerOption, opts []RunnerOption) *Loopback {
+	runner := v2.NewAgentRunnerV2(agent).
+		WithLogLevel("warn").
+		WithDrainTimeout(time.Second)
+	setup(runner)
+	for _, opt := range opts {
+		opt(runner)
+	}
+
+	l := &Loopback{
+		tb:        tb,
+		runner:    runner,
+		transport: transport,
+		done:      make(chan error, 1),
+	}
+	go func() { l.done <- runner.Run() }()
+	tb.Cleanup(func() { l.shutdown() })
+	return l
+}
+
+func tempDir(tb testing.TB) string {
+	tb.Helper()
+
+	// Unix socket paths are limited to about 100 bytes, which deeply nested
+	// test directories can exceed, so use a short directory of our own.
+	dir, err := os.MkdirTemp("", "agenttest")
+	if err != nil {
+		tb.Fatalf("agenttest: failed to create temp dir: %v", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func (l *Loopback) waitReady() {
+	l.tb.Helper()
+
+	select {
+	case <-l.runner.Ready():
+	case err := <-l.done:
+		l.stopped = true
+		l.tb.Fatalf("agenttest: runner exited before it was ready: %v", err)
+	case <-time.After(DefaultTimeout):
+		l.tb.Fatalf("agenttest: runner not ready after %s", DefaultTimeout)
+	}
+}
+
+// Runner returns the runner under test.
+func (l *Loopback) Runner() *v2.AgentRunnerV2 {
+	return l.runner
+}
+
+// Address returns the socket path, gRPC address or reverse listener path.
+func (l *Loopback) Address() string {
+	return l.address
+}
+
+// Dial opens a connection to a UDS or gRPC agent without performing the
+// handshake.
+func (l *Loopback) Dial() *Conn {
+	l.tb.Helper()
+
+	conn, err := l.DialErr()
+	if err != nil {
+		l.tb.Fatalf("agenttest: dial %s: %v", l.address, err)
+	}
+	return conn
+}
+
+// DialErr is like Dial but returns the error instead of failing the test.
+func (l *Loopback) DialErr() (*Conn, error) {
+	switch l.transport {
+	case v2.TransportUDS:
+		raw, err := net.Dial("unix", l.address)
+		if err != nil {
+			return nil, err
+		}
+		return newConn(l.tb, v2.NewProxyConn(raw), raw), nil
+	case v2.TransportGRPC:
+		conn, err := v2.DialGRPC(context.Background(), l.address)
+		if err != nil {
+			return nil, err
+		}
+		return newConn(l.tb, conn, nil), nil
+	default:
+		return nil, fmt.Errorf("cannot dial a %s agent, use Accept", l.transport)
+	}
+}
+
+// Accept waits for the reverse agent to connect, reads its registration and
+// accepts it.
+func (l *Loopback) Accept() (*Conn, *v2.RegistrationRequest) {
+	l.tb.Helper()
+
+	return l.AcceptWith(&v2.RegistrationResponse{Accepted: true, AssignedID: "agenttest"})
+}
+
+// AcceptWith waits for the reverse agent to connect, reads its registration
+// and answers with resp. The connection is returned even when resp rejects
+// the registration.
+func (l *Loopback) AcceptWith(resp *v2.RegistrationResponse) (*Conn, *v2.RegistrationRequest) {
+	l.tb.Helper()
+
+	if l.listener == nil {
+		l.tb.Fatalf("agenttest: Accept requires a reverse loopback")
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		raw, err := l.listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- raw
+	}()
+
+	var raw net.Conn
+	select {
+	case raw = <-accepted:
+		if raw == nil {
+			l.tb.Fatalf("agenttest: reverse listener closed")
+		}
+	case <-time.After(DefaultTimeout):
+		l.tb.Fatalf("agenttest: no reverse connection after %s", DefaultTimeout)
+	}
+
+	conn := newConn(l.tb, v2.NewProxyConn(raw), raw)
+	msg := conn.Recv()
+	if msg.Type != v2.MsgTypeRegistration {
+		l.tb.Fatalf("agenttest: expected Registration, got %s", msg.TypeName())
+	}
+	var reg v2.RegistrationRequest
+	if err := msg.ParsePayload(&reg); err != nil {
+		l.tb.Fatalf("agenttest: failed to parse registration: %v", err)
+	}
+
+	ack, err := v2.NewV2Message(v2.MsgTypeRegistrationAck, resp)
+	if err != nil {
+		l.tb.Fatalf("agenttest: failed to build registration ack: %v", err)
+	}
+	conn.Send(ack)
+	return conn, &reg
+}
+
+// Connect opens a connection ready for requests and returns a Proxy that
+// drives the agent over it. UDS and gRPC connections perform the handshake;
+// reverse connections accept the agent's registration.
+func (l *Loopback) Connect() *Proxy {
+	l.tb.Helper()
+
+	if l.transport == v2.TransportReverse {
+		conn, _ := l.Accept()
+		return conn.Proxy()
+	}
+
+	conn := l.Dial()
+	p := conn.Proxy()
+	p.performHandshake()
+	return p
+}
+
+// Shutdown stops the runner as SIGTERM would and returns the error from Run.
+// The test fails if Run does not return within DefaultTimeout after the
+// drain timeout.
+func (l *Loopback) Shutdown() error {
+	l.tb.Helper()
+
+	if err := l.shutdown(); err != nil {
+		return err
+	}
+	return l.runErr
+}
+
+func (l *Loopback) shutdown() error {
+	if l.stopped {
+		return nil
+	}
+	l.runner.Shutdown()
+
+	select {
+	case l.runErr = <-l.done:
+		l.stopped = true
+		return nil
+	case <-time.After(time.Second + DefaultTimeout):
+		err := errors.New("agenttest: runner did not stop")
+		l.tb.Error(err)
+		return err
+	}
+}
+
+// Direction tells whether a message was sent to or received from the agent.
+type Direction string
+
+const (
+	// Sent marks messages sent by the proxy to the agent.
+	Sent Direction = "sent"
+
+	// Received marks messages received from the agent.
+	Received Direction = "received"
+)
+
+// Record is a message recorded on a Conn.
+type Record struct {
+	Direction Direction
+	Time      time.Time
+	Message   *v2.V2Message
+}
+
+type incoming struct {
+	msg *v2.V2Message
+	err error
+}
+
+// Conn is a recorded proxy-side connection to a loopback agent.
+type Conn struct {
+	tb       testing.TB
+	conn     v2.ProxyConn
+	raw      net.Conn
+	timeout  time.Duration
+	incoming chan incoming
+	closed   bool
+
+	mu      sync.Mutex
+	records []Record
+}
+
+func newConn(tb testing.TB, conn v2.ProxyConn, raw net.Conn) *Conn {
+	c := &Conn{
+		tb:       tb,
+		conn:     conn,
+		raw:      raw,
+		timeout:  DefaultTimeout,
+		incoming: make(chan incoming, 64),
+	}
+	go c.readLoop()
+	tb.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+func (c *Conn) readLoop() {
+	for {
+		msg, err := c.conn.Recv()
+		if err != nil {
+			c.incoming <- incoming{err: err}
+			close(c.incoming)
+			return
+		}
+		c.record(Received, msg)
+		c.incoming <- incoming{msg: msg}
+	}
+}
+
+func (c *Conn) record(direction Direction, msg *v2.V2Message) {
+	c.mu.Lock()
+	c.records = append(c.records, Record{Direction: direction, Time: time.Now(), Message: msg})
+	c.mu.Unlock()
+}
+
+// WithTimeout sets how long Recv and Next wait for a message.
+func (c *Conn) WithTimeout(timeout time.Duration) *Conn {
+	c.timeout = timeout
+	return c
+}
+
+// Records returns every message sent and received so far, in order.
+func (c *Conn) Records() []Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Record(nil), c.records...)
+}
+
+// Send sends a message to the agent, failing the test on error.
+func (c *Conn) Send(msg *v2.V2Message) {
+	c.tb.Helper()
+
+	if err := c.SendErr(msg); err != nil {
+		c.tb.Fatalf("agenttest: send %s: %v", msg.TypeName(), err)
+	}
+}
+
+// SendErr sends a message to the agent and returns any error.
+func (c *Conn) SendErr(msg *v2.V2Message) error {
+	c.record(Sent, msg)
+	return c.conn.Send(msg)
+}
+
+// SendRaw writes raw bytes to the agent, bypassing message framing. It is
+// only available on UDS and reverse connections.
+func (c *Conn) SendRaw(data []byte) {
+	c.tb.Helper()
+
+	if c.raw == nil {
+		c.tb.Fatalf("agenttest: raw writes are not available on gRPC connections")
+	}
+	if _, err := c.raw.Write(data); err != nil {
+		c.tb.Fatalf("agenttest: raw write: %v", err)
+	}
+}
+
+// Next waits for the next message from the agent. It returns io.EOF once
+// the agent has closed the connection.
+func (c *Conn) Next() (*v2.V2Message, error) {
+	if c.closed {
+		return nil, io.EOF
+	}
+
+	select {
+	case in, ok := <-c.incoming:
+		if !ok {
+			c.closed = true
+			return nil, io.EOF
+		}
+		if in.err != nil {
+			c.closed = true
+			if isClosedErr(in.err) {
+				return nil, io.EOF
+			}
+			return nil, in.err
+		}
+		return in.msg, nil
+	case <-time.After(c.timeout):
+		return nil, fmt.Errorf("no message after %s", c.timeout)
+	}
+}
+
+// Recv waits for the next message from the agent, failing the test if none
+// arrives.
+func (c *Conn) Recv() *v2.V2Message {
+	c.tb.Helper()
+
+	msg, err := c.Next()
+	if err != nil {
+		c.tb.Fatalf("agenttest: receive: %v", err)
+	}
+	return msg
+}
+
+// ExpectClosed waits for the agent to close the connection, failing the test
+// if another message arrives first.
+func (c *Conn) ExpectClosed() {
+	c.tb.Helper()
+
+	msg, err := c.Next()
+	if err == nil {
+		c.tb.Fatalf("agenttest: expected connection to close, got %s", msg.TypeName())
+	}
+	if err != io.EOF {
+		c.tb.Fatalf("agenttest: expected connection to close, got %v", err)
+	}
+}
+
+// Handshake sends a handshake request and returns the agent's response.
+func (c *Conn) Handshake(req *v2.HandshakeRequest) *v2.HandshakeResponse {
+	c.tb.Helper()
+
+	msg, err := v2.NewV2Message(v2.MsgTypeHandshakeRequest, req)
+	if err != nil {
+		c.tb.Fatalf("agenttest: failed to build handshake: %v", err)
+	}
+	c.Send(msg)
+
+	reply := c.Recv()
+	if reply.Type != v2.MsgTypeHandshakeResponse {
+		c.tb.Fatalf("agenttest: expected HandshakeResponse, got %s", reply.TypeName())
+	}
+	resp, err := v2.UnmarshalHandshakeResponse(reply.Payload)
+	if err != nil {
+		c.tb.Fatalf("agenttest: failed to parse handshake response: %v", err)
+	}
+	return resp
+}
+
+// Proxy returns a Proxy that drives the agent over this connection, so the
+// Exchange and Result helpers work end to end. No handshake is performed.
+func (c *Conn) Proxy() *Proxy {
+	return newV2Proxy(c.tb, c)
+}
+
+// Close closes the connection.
+func (c *Conn) Close() {
+	c.conn.Close()
+}
+
+func (c *Conn) roundTrip(ctx context.Context, msg *v2.V2Message) (*v2.V2Message, error) {
+	if err := c.SendErr(msg); err != nil {
+		return nil, err
+	}
+	if !expectsReply(msg.Type) {
+		return nil, nil
+	}
+	return c.Next()
+}
+
+func (c *Conn) configure(ctx context.Context, event *zentinel.ConfigureEvent) (bool, string, error) {
+	return false, "", fmt.Errorf("configuration is not carried by the v2 message protocol")
+}
+
+// isClosedErr reports whether err means the connection went away, which the
+// transports report in different ways.
+func isClosedErr(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Canceled:
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
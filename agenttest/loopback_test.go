@@ -0,0 +1,271 @@
+package agenttest
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// wireAgent is safe to call from the runner's goroutines.
+type wireAgent struct {
+	v2.BaseAgentV2
+
+	mu        sync.Mutex
+	completed []int
+	drained   bool
+}
+
+func (a *wireAgent) Name() string {
+	return "wire-agent"
+}
+
+func (a *wireAgent) Capabilities() *v2.AgentCapabilities {
+	return v2.NewAgentCapabilities().All()
+}
+
+func (a *wireAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	if request.PathStartsWith("/admin") {
+		return zentinel.Deny().WithTag("admin")
+	}
+	return zentinel.Allow().AddRequestHeader("x-agent", "wire")
+}
+
+func (a *wireAgent) OnRequestBody(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	if strings.Contains(request.BodyString(), "DROP TABLE") {
+		return zentinel.Block(400)
+	}
+	return zentinel.Allow()
+}
+
+func (a *wireAgent) OnRequestComplete(ctx context.Context, request *zentinel.Request, status int, durationMS int) {
+	a.mu.Lock()
+	a.completed = append(a.completed, status)
+	a.mu.Unlock()
+}
+
+func (a *wireAgent) OnDrain(ctx context.Context) {
+	a.mu.Lock()
+	a.drained = true
+	a.mu.Unlock()
+}
+
+func (a *wireAgent) completions() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]int(nil), a.completed...)
+}
+
+func (a *wireAgent) wasDrained() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.drained
+}
+
+func loopbacks() map[string]func(testing.TB, v2.AgentV2, ...RunnerOption) *Loopback {
+	return map[string]func(testing.TB, v2.AgentV2, ...RunnerOption) *Loopback{
+		"uds":     StartUDS,
+		"grpc":    StartGRPC,
+		"reverse": StartReverse,
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(DefaultTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoopback_RequestLifecycle(t *testing.T) {
+	for name, start := range loopbacks() {
+		t.Run(name, func(t *testing.T) {
+			agent := &wireAgent{}
+			proxy := start(t, agent).Connect()
+
+			proxy.Request("GET", "/admin").SendHeaders().ExpectBlocked(403).ExpectTag("admin")
+
+			req := proxy.Request("POST", "/api/query")
+			req.SendHeaders().ExpectAllowed().ExpectHeaderValue("x-agent", "wire")
+			req.SendBody([]byte("SELECT 1; "), []byte("DROP TABLE users")).ExpectBlocked(400)
+			req.Complete(400, 3)
+
+			waitFor(t, "request completion", func() bool {
+				completed := agent.completions()
+				return len(completed) == 1 && completed[0] == 400
+			})
+		})
+	}
+}
+
+func TestLoopbackUDS_Framing(t *testing.T) {
+	loopback := StartUDS(t, &wireAgent{})
+	conn := loopback.Dial()
+	if hs := conn.Handshake(v2.NewHandshakeRequest("agenttest")); !hs.Accepted {
+		t.Fatalf("expected accepted handshake, got %+v", hs)
+	}
+
+	ping := func() []byte {
+		payload := []byte(`{"timestamp":1}`)
+		frame := make([]byte, 5, 5+len(payload))
+		binary.BigEndian.PutUint32(frame, uint32(1+len(payload)))
+		frame[4] = v2.MsgTypePing
+		return append(frame, payload...)
+	}
+
+	// Two frames in a single write, then one frame split across writes.
+	conn.SendRaw(append(ping(), ping()...))
+	frame := ping()
+	conn.SendRaw(frame[:3])
+	conn.SendRaw(frame[3:])
+
+	for i := 0; i < 3; i++ {
+		if msg := conn.Recv(); msg.Type != v2.MsgTypePong {
+			t.Fatalf("expected Pong, got %s", msg.TypeName())
+		}
+	}
+
+	// Unknown message types are answered with a protocol error and the
+	// connection stays open.
+	conn.SendRaw([]byte{0, 0, 0, 3, 0x7F, '{', '}'})
+	conn.SendRaw(ping())
+	if msg := conn.Recv(); msg.Type != v2.MsgTypeProtocolError {
+		t.Fatalf("expected ProtocolError for unknown message, got %s", msg.TypeName())
+	}
+	if msg := conn.Recv(); msg.Type != v2.MsgTypePong {
+		t.Fatalf("expected Pong after unknown message, got %s", msg.TypeName())
+	}
+
+	// An oversized length prefix closes the connection.
+	oversized := make([]byte, 4)
+	binary.BigEndian.PutUint32(oversized, v2.MaxMessageSizeV2+1)
+	conn.SendRaw(oversized)
+	conn.ExpectClosed()
+
+	var sent, received int
+	for _, record := range conn.Records() {
+		switch record.Direction {
+		case Sent:
+			sent++
+		case Received:
+			received++
+		}
+	}
+	if sent != 1 || received != 6 {
+		t.Errorf("expected 1 framed message sent and 6 received, got %d and %d", sent, received)
+	}
+}
+
+func TestLoopbackUDS_HandshakeRejected(t *testing.T) {
+	loopback := StartUDS(t, &wireAgent{})
+
+	conn := loopback.Dial()
+	req := v2.NewHandshakeRequest("agenttest")
+	req.ProtocolVersion = 1
+	if hs := conn.Handshake(req); hs.Accepted {
+		t.Fatal("expected handshake with protocol version 1 to be rejected")
+	}
+	conn.ExpectClosed()
+
+	// A connection that skips the handshake is closed without a reply.
+	conn = loopback.Dial()
+	msg, _ := v2.NewV2Message(v2.MsgTypePing, v2.PingMessage{})
+	conn.Send(msg)
+	conn.ExpectClosed()
+}
+
+func TestLoopbackReverse_RegistrationRejected(t *testing.T) {
+	loopback := StartReverse(t, &wireAgent{})
+
+	conn, reg := loopback.AcceptWith(&v2.RegistrationResponse{Accepted: false, Error: "unknown agent"})
+	if reg.AgentID != "wire-agent" {
+		t.Errorf("expected agent ID 'wire-agent', got %s", reg.AgentID)
+	}
+	if reg.Capabilities == nil || !reg.Capabilities.HandlesRequestBody {
+		t.Errorf("expected capabilities in registration, got %+v", reg.Capabilities)
+	}
+	conn.ExpectClosed()
+
+	// The agent retries and is accepted on the next attempt.
+	conn, _ = loopback.Accept()
+	conn.Proxy().Request("GET", "/").SendHeaders().ExpectAllowed()
+}
+
+func TestLoopback_Drain(t *testing.T) {
+	for _, name := range []string{"uds", "grpc"} {
+		t.Run(name, func(t *testing.T) {
+			agent := &wireAgent{}
+			loopback := loopbacks()[name](t, agent)
+			conn := loopback.Dial()
+			conn.Handshake(v2.NewHandshakeRequest("agenttest"))
+
+			loopback.Runner().Shutdown()
+			if !agent.wasDrained() {
+				t.Error("expected OnDrain to be called")
+			}
+			if _, err := loopback.DialErr(); err == nil && name == "uds" {
+				t.Error("expected new connections to be refused while draining")
+			}
+
+			// The in-flight connection is answered once more, then closed.
+			conn.Proxy().Request("GET", "/").SendHeaders().ExpectAllowed()
+			conn.ExpectClosed()
+
+			if err := loopback.Shutdown(); err != nil {
+				t.Fatalf("expected clean shutdown, got %v", err)
+			}
+			if name == "uds" {
+				if _, err := os.Stat(loopback.Address()); !os.IsNotExist(err) {
+					t.Errorf("expected socket to be removed, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoopbackReverse_Shutdown(t *testing.T) {
+	loopback := StartReverse(t, &wireAgent{})
+	conn, _ := loopback.Accept()
+
+	if err := loopback.Shutdown(); err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+	conn.ExpectClosed()
+}
+
+func TestLoopbackUDS_MalformedInputClose(t *testing.T) {
+	loopback := StartUDS(t, &wireAgent{}, func(r *v2.AgentRunnerV2) {
+		r.WithMalformedInput(zentinel.MalformedClose)
+	})
+	conn := loopback.Dial()
+	if hs := conn.Handshake(v2.NewHandshakeRequest("agenttest")); !hs.Accepted {
+		t.Fatalf("expected accepted handshake, got %+v", hs)
+	}
+
+	payload := []byte(`{"request_id":7,"method":`)
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(1+len(payload)))
+	frame[4] = v2.MsgTypeRequestHeaders
+	conn.SendRaw(append(frame, payload...))
+
+	msg := conn.Recv()
+	var protocolErr v2.ProtocolErrorMessage
+	if err := msg.ParsePayload(&protocolErr); err != nil || msg.Type != v2.MsgTypeProtocolError {
+		t.Fatalf("expected ProtocolError, got %s", msg.TypeName())
+	}
+	if protocolErr.RequestID == nil || *protocolErr.RequestID != 7 {
+		t.Errorf("expected request ID 7, got %v", protocolErr.RequestID)
+	}
+	conn.ExpectClosed()
+}
@@ -0,0 +1,331 @@
+package agenttest
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// Proxy is an in-process fake proxy that drives an agent through the SDK's
+// protocol handlers.
+type Proxy struct {
+	tb        testing.TB
+	ctx       context.Context
+	driver    driver
+	nextID    atomic.Uint64
+	handshake *v2.HandshakeResponse
+}
+
+// New creates a fake proxy that drives the agent through the v1 AgentHandler.
+func New(tb testing.TB, agent zentinel.Agent) *Proxy {
+	return &Proxy{
+		tb:     tb,
+		ctx:    context.Background(),
+		driver: newV1Driver(zentinel.NewAgentHandler(agent)),
+	}
+}
+
+// NewV2 creates a fake proxy that drives the agent through AgentHandlerV2.
+// The v2 handshake is performed immediately and the test fails if the agent
+// rejects it.
+func NewV2(tb testing.TB, agent v2.AgentV2) *Proxy {
+	return NewV2WithHandler(tb, v2.NewAgentHandlerV2(agent))
+}
+
+// NewV2WithHandler creates a fake proxy around an existing v2 handler.
+// Use this when the handler needs to be configured before it is driven.
+func NewV2WithHandler(tb testing.TB, handler *v2.AgentHandlerV2) *Proxy {
+	tb.Helper()
+
+	p := newV2Proxy(tb, handlerTransport{handler: handler})
+	p.performHandshake()
+	return p
+}
+
+func newV2Proxy(tb testing.TB, transport messageTransport) *Proxy {
+	return &Proxy{
+		tb:     tb,
+		ctx:    context.Background(),
+		driver: newV2Driver(transport),
+	}
+}
+
+func (p *Proxy) performHandshake() {
+	p.tb.Helper()
+
+	resp, err := p.driver.(*v2Driver).handshake(p.ctx, v2.NewHandshakeRequest("agenttest"))
+	if err != nil {
+		p.tb.Fatalf("agenttest: handshake failed: %v", err)
+	}
+	if !resp.Accepted {
+		p.tb.Fatalf("agenttest: handshake rejected: %s", resp.Error)
+	}
+	p.handshake = resp
+}
+
+// WithContext sets the context passed to the handler for subsequent events.
+func (p *Proxy) WithContext(ctx context.Context) *Proxy {
+	p.ctx = ctx
+	return p
+}
+
+// Handshake returns the handshake response received from a v2 agent.
+// It returns nil for v1 proxies.
+func (p *Proxy) Handshake() *v2.HandshakeResponse {
+	return p.handshake
+}
+
+// Configure sends a configure event and returns the error reported by the
+// agent, if any.
+func (p *Proxy) Configure(config map[string]interface{}) error {
+	p.tb.Helper()
+
+	accepted, reason, err := p.driver.configure(p.ctx, &zentinel.ConfigureEvent{
+		AgentID: "agenttest",
+		Config:  config,
+	})
+	if err != nil {
+		p.tb.Fatalf("agenttest: configure: %v", err)
+	}
+	if !accepted {
+		return fmt.Errorf("configuration rejected: %s", reason)
+	}
+	return nil
+}
+
+// Request starts a new exchange with the given method and URI. Nothing is
+// sent to the agent until one of the Send methods is called.
+func (p *Proxy) Request(method, uri string) *Exchange {
+	id := p.nextID.Add(1)
+	return &Exchange{
+		proxy: p,
+		id:    id,
+		headers: zentinel.RequestHeadersEvent{
+			Metadata: zentinel.RequestMetadata{
+				CorrelationID: fmt.Sprintf("agenttest-%d", id),
+				RequestID:     fmt.Sprintf("agenttest-%d", id),
+				ClientIP:      "127.0.0.1",
+				ClientPort:    40000,
+				Protocol:      "HTTP/1.1",
+			},
+			Method:  method,
+			URI:     uri,
+			Headers: map[string][]string{},
+		},
+	}
+}
+
+// Health requests the health status of a v2 agent.
+func (p *Proxy) Health() *v2.HealthStatus {
+	p.tb.Helper()
+
+	d, ok := p.driver.(*v2Driver)
+	if !ok {
+		p.tb.Fatalf("agenttest: health checks are not part of the v1 protocol")
+	}
+	status, err := d.health(p.ctx)
+	if err != nil {
+		p.tb.Fatalf("agenttest: health: %v", err)
+	}
+	return status
+}
+
+// Metrics requests the metrics report of a v2 agent.
+func (p *Proxy) Metrics() *v2.MetricsReport {
+	p.tb.Helper()
+
+	d, ok := p.driver.(*v2Driver)
+	if !ok {
+		p.tb.Fatalf("agenttest: metrics are not part of the v1 protocol")
+	}
+	report, err := d.metrics(p.ctx)
+	if err != nil {
+		p.tb.Fatalf("agenttest: metrics: %v", err)
+	}
+	return report
+}
+
+// Exchange is a single request flowing through the fake proxy.
+type Exchange struct {
+	proxy   *Proxy
+	id      uint64
+	headers zentinel.RequestHeadersEvent
+
+	requestChunks  int
+	responseChunks int
+	responseStatus int
+}
+
+// ID returns the v2 request ID used for this exchange.
+func (e *Exchange) ID() uint64 {
+	return e.id
+}
+
+// CorrelationID returns the correlation ID used for this exchange.
+func (e *Exchange) CorrelationID() string {
+	return e.headers.Metadata.CorrelationID
+}
+
+// Header adds a request header.
+func (e *Exchange) Header(name, value string) *Exchange {
+	e.headers.Headers[name] = append(e.headers.Headers[name], value)
+	return e
+}
+
+// WithCorrelationID overrides the generated correlation ID.
+func (e *Exchange) WithCorrelationID(id string) *Exchange {
+	e.headers.Metadata.CorrelationID = id
+	e.headers.Metadata.RequestID = id
+	return e
+}
+
+// WithClientIP sets the client IP address.
+func (e *Exchange) WithClientIP(ip string) *Exchange {
+	e.headers.Metadata.ClientIP = ip
+	return e
+}
+
+// WithRouteID sets the route ID.
+func (e *Exchange) WithRouteID(routeID string) *Exchange {
+	e.headers.Metadata.RouteID = &routeID
+	return e
+}
+
+// WithUpstreamID sets the upstream ID.
+func (e *Exchange) WithUpstreamID(upstreamID string) *Exchange {
+	e.headers.Metadata.UpstreamID = &upstreamID
+	return e
+}
+
+// WithTraceparent sets the W3C traceparent.
+func (e *Exchange) WithTraceparent(traceparent string) *Exchange {
+	e.headers.Metadata.Traceparent = &traceparent
+	return e
+}
+
+// WithMetadata lets the caller edit any request metadata field.
+func (e *Exchange) WithMetadata(fn func(*zentinel.RequestMetadata)) *Exchange {
+	fn(&e.headers.Metadata)
+	return e
+}
+
+// SendHeaders sends the request headers event and returns the decision.
+func (e *Exchange) SendHeaders() *Result {
+	e.proxy.tb.Helper()
+
+	decision, err := e.proxy.driver.requestHeaders(e.proxy.ctx, e.id, &e.headers)
+	return e.result("request headers", decision, err)
+}
+
+// SendBody sends the request body as one chunk per argument. The decision for
+// the final chunk is returned; every intermediate chunk is expected to be
+// answered with needs_more and the test fails otherwise.
+func (e *Exchange) SendBody(chunks ...[]byte) *Result {
+	e.proxy.tb.Helper()
+
+	if len(chunks) == 0 {
+		chunks = [][]byte{{}}
+	}
+
+	var last *Result
+	for i, chunk := range chunks {
+		isLast := i == len(chunks)-1
+		decision, err := e.proxy.driver.requestBodyChunk(e.proxy.ctx, e.id, &zentinel.RequestBodyChunkEvent{
+			CorrelationID: e.CorrelationID(),
+			Data:          encodeChunk(chunk),
+			ChunkIndex:    e.requestChunks,
+			IsLast:        isLast,
+			BytesReceived: len(chunk),
+		})
+		e.requestChunks++
+
+		last = e.result("request body chunk", decision, err)
+		if !isLast {
+			last.ExpectNeedsMore()
+		}
+	}
+	return last
+}
+
+// SendResponseHeaders sends the upstream response headers and returns the
+// decision.
+func (e *Exchange) SendResponseHeaders(status int, headers map[string][]string) *Result {
+	e.proxy.tb.Helper()
+
+	if headers == nil {
+		headers = map[string][]string{}
+	}
+	e.responseStatus = status
+
+	decision, err := e.proxy.driver.responseHeaders(e.proxy.ctx, e.id, &zentinel.ResponseHeadersEvent{
+		CorrelationID: e.CorrelationID(),
+		Status:        status,
+		Headers:       headers,
+	})
+	return e.result("response headers", decision, err)
+}
+
+// SendResponseBody sends the response body as one chunk per argument, with
+// the same needs_more expectations as SendBody.
+func (e *Exchange) SendResponseBody(chunks ...[]byte) *Result {
+	e.proxy.tb.Helper()
+
+	if len(chunks) == 0 {
+		chunks = [][]byte{{}}
+	}
+
+	var last *Result
+	for i, chunk := range chunks {
+		isLast := i == len(chunks)-1
+		decision, err := e.proxy.driver.responseBodyChunk(e.proxy.ctx, e.id, &zentinel.ResponseBodyChunkEvent{
+			CorrelationID: e.CorrelationID(),
+			Data:          encodeChunk(chunk),
+			ChunkIndex:    e.responseChunks,
+			IsLast:        isLast,
+			BytesReceived: len(chunk),
+		})
+		e.responseChunks++
+
+		last = e.result("response body chunk", decision, err)
+		if !isLast {
+			last.ExpectNeedsMore()
+		}
+	}
+	return last
+}
+
+// Complete sends the request complete event.
+func (e *Exchange) Complete(status int, durationMS int) {
+	e.proxy.tb.Helper()
+
+	err := e.proxy.driver.requestComplete(e.proxy.ctx, e.id, &zentinel.RequestCompleteEvent{
+		CorrelationID: e.CorrelationID(),
+		Status:        status,
+		DurationMS:    durationMS,
+	})
+	if err != nil {
+		e.proxy.tb.Fatalf("agenttest: request complete: %v", err)
+	}
+}
+
+// Cancel cancels the request. Cancellation only exists in the v2 protocol.
+func (e *Exchange) Cancel() {
+	e.proxy.tb.Helper()
+
+	if err := e.proxy.driver.cancel(e.proxy.ctx, e.id); err != nil {
+		e.proxy.tb.Fatalf("agenttest: cancel: %v", err)
+	}
+}
+
+func (e *Exchange) result(phase string, decision *Decision, err error) *Result {
+	e.proxy.tb.Helper()
+
+	if err != nil {
+		e.proxy.tb.Fatalf("agenttest: %s: %v", phase, err)
+	}
+	return &Result{tb: e.proxy.tb, phase: phase, Decision: decision}
+}
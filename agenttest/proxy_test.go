@@ -0,0 +1,194 @@
+package agenttest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// inspectingAgent blocks admin paths, inspects bodies and records completions.
+type inspectingAgent struct {
+	v2.BaseAgentV2
+	configured map[string]interface{}
+	completed  []int
+	cancelled  []uint64
+}
+
+func (a *inspectingAgent) Name() string {
+	return "inspecting-agent"
+}
+
+func (a *inspectingAgent) OnConfigure(ctx context.Context, config map[string]interface{}) error {
+	if _, ok := config["invalid"]; ok {
+		return errors.New("invalid key")
+	}
+	a.configured = config
+	return nil
+}
+
+func (a *inspectingAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	if request.PathStartsWith("/admin") {
+		return zentinel.Deny().WithBody("Forbidden").WithTag("admin")
+	}
+	return zentinel.Allow().AddRequestHeader("x-agent", "inspected")
+}
+
+func (a *inspectingAgent) OnRequestBody(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	if strings.Contains(request.BodyString(), "DROP TABLE") {
+		return zentinel.Block(400).WithRuleID("sqli-1")
+	}
+	return zentinel.Allow().AddRequestHeader("x-body-size", strconv.Itoa(len(request.Body())))
+}
+
+func (a *inspectingAgent) OnResponse(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	return zentinel.Allow().RemoveResponseHeader("server")
+}
+
+func (a *inspectingAgent) OnResponseBody(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	if strings.Contains(response.BodyString(), "secret") {
+		return zentinel.Block(502)
+	}
+	return zentinel.Allow()
+}
+
+func (a *inspectingAgent) OnRequestComplete(ctx context.Context, request *zentinel.Request, status int, durationMS int) {
+	a.completed = append(a.completed, status)
+}
+
+func (a *inspectingAgent) OnCancel(ctx context.Context, requestID uint64) {
+	a.cancelled = append(a.cancelled, requestID)
+}
+
+func proxies(t *testing.T) map[string]func(*inspectingAgent) *Proxy {
+	return map[string]func(*inspectingAgent) *Proxy{
+		"v1": func(a *inspectingAgent) *Proxy { return New(t, a) },
+		"v2": func(a *inspectingAgent) *Proxy { return NewV2(t, a) },
+	}
+}
+
+func TestProxy_RequestHeaders(t *testing.T) {
+	for name, newProxy := range proxies(t) {
+		t.Run(name, func(t *testing.T) {
+			proxy := newProxy(&inspectingAgent{})
+
+			proxy.Request("GET", "/admin/users").
+				SendHeaders().
+				ExpectBlocked(403).
+				ExpectBlockBody("Forbidden").
+				ExpectTag("admin")
+
+			proxy.Request("GET", "/api/users").
+				SendHeaders().
+				ExpectAllowed().
+				ExpectHeaderValue("x-agent", "inspected")
+		})
+	}
+}
+
+func TestProxy_ChunkedBody(t *testing.T) {
+	for name, newProxy := range proxies(t) {
+		t.Run(name, func(t *testing.T) {
+			proxy := newProxy(&inspectingAgent{})
+
+			req := proxy.Request("POST", "/api/query")
+			req.SendHeaders().ExpectAllowed()
+			req.SendBody([]byte("SELECT 1; "), []byte("DROP "), []byte("TABLE users")).
+				ExpectBlocked(400).
+				ExpectRuleID("sqli-1")
+
+			req = proxy.Request("POST", "/api/query")
+			req.SendHeaders().ExpectAllowed()
+			req.SendBody([]byte("hello "), []byte("world")).
+				ExpectAllowed().
+				ExpectHeaderValue("x-body-size", "11")
+		})
+	}
+}
+
+func TestProxy_ResponsePhases(t *testing.T) {
+	for name, newProxy := range proxies(t) {
+		t.Run(name, func(t *testing.T) {
+			agent := &inspectingAgent{}
+			proxy := newProxy(agent)
+
+			req := proxy.Request("GET", "/api/data")
+			req.SendHeaders().ExpectAllowed()
+			req.SendResponseHeaders(200, map[string][]string{"server": {"nginx"}}).
+				ExpectAllowed().
+				ExpectResponseHeaderRemoved("server")
+			req.SendResponseBody([]byte("top "), []byte("secret")).ExpectBlocked(502)
+			req.Complete(502, 5)
+
+			if len(agent.completed) != 1 || agent.completed[0] != 502 {
+				t.Errorf("expected one completion with status 502, got %v", agent.completed)
+			}
+		})
+	}
+}
+
+func TestProxy_Configure(t *testing.T) {
+	for name, newProxy := range proxies(t) {
+		t.Run(name, func(t *testing.T) {
+			agent := &inspectingAgent{}
+			proxy := newProxy(agent)
+
+			if err := proxy.Configure(map[string]interface{}{"mode": "strict"}); err != nil {
+				t.Fatalf("expected configuration to be accepted, got %v", err)
+			}
+			if agent.configured["mode"] != "strict" {
+				t.Errorf("expected mode 'strict', got %v", agent.configured["mode"])
+			}
+
+			if err := proxy.Configure(map[string]interface{}{"invalid": true}); err == nil {
+				t.Error("expected configuration to be rejected")
+			}
+		})
+	}
+}
+
+func TestProxyV2_CancelMidBody(t *testing.T) {
+	agent := &inspectingAgent{}
+	proxy := NewV2(t, agent)
+
+	req := proxy.Request("POST", "/api/upload")
+	req.SendHeaders().ExpectAllowed()
+	req.SendBody([]byte("partial"), []byte("ignored")).ExpectAllowed()
+
+	cancelled := proxy.Request("POST", "/api/upload")
+	cancelled.SendHeaders().ExpectAllowed()
+	cancelled.Cancel()
+
+	if len(agent.cancelled) != 1 || agent.cancelled[0] != cancelled.ID() {
+		t.Errorf("expected request %d to be cancelled, got %v", cancelled.ID(), agent.cancelled)
+	}
+
+	// The cancelled request state is gone, so completion reaches no request.
+	cancelled.Complete(499, 1)
+	if len(agent.completed) != 0 {
+		t.Errorf("expected no completions after cancel, got %v", agent.completed)
+	}
+}
+
+func TestProxyV2_HandshakeHealthMetrics(t *testing.T) {
+	proxy := NewV2(t, &inspectingAgent{})
+
+	hs := proxy.Handshake()
+	if hs == nil || !hs.Accepted {
+		t.Fatalf("expected accepted handshake, got %+v", hs)
+	}
+	if hs.AgentName != "inspecting-agent" {
+		t.Errorf("expected agent name 'inspecting-agent', got %s", hs.AgentName)
+	}
+
+	if health := proxy.Health(); !health.IsHealthy() {
+		t.Errorf("expected healthy status, got %s", health.State)
+	}
+	if metrics := proxy.Metrics(); metrics == nil {
+		t.Error("expected metrics report")
+	}
+}
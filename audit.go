@@ -0,0 +1,297 @@
+package zentinel
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// AuditRecord is one decision as written to an audit sink.
+type AuditRecord struct {
+	// Time is when the decision was made.
+	Time time.Time `json:"time"`
+
+	// Hook is the hook that made the decision, or empty for a decision the
+	// handler made for input it could not parse.
+	Hook Hook `json:"hook"`
+
+	CorrelationID string `json:"correlation_id"`
+	ClientIP      string `json:"client_ip"`
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	RouteID       string `json:"route_id,omitempty"`
+
+	// Decision is the decision as sent to the proxy.
+	Decision AgentResponse `json:"decision"`
+}
+
+// AuditSink keeps a local record of decisions. WriteAudit is called from
+// the hook that made the decision, so it must be safe for concurrent use.
+type AuditSink interface {
+	WriteAudit(record *AuditRecord) error
+}
+
+// AuditMiddleware returns middleware that writes the decisions it wraps to
+// sink: every decision that does not allow the request, including those
+// shadow mode allowed, or every decision if all is set. Write errors are
+// logged and do not affect the decision.
+func AuditMiddleware(sink AuditSink, all bool) Middleware {
+	return func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		decision := next(ctx, call)
+		AuditDecision(ctx, sink, all, call.Hook, call.Request, decision)
+		return decision
+	}
+}
+
+// AuditDecision writes decision to sink as AuditMiddleware does. The
+// handlers call it for the decisions they send in place of the agent's, on a
+// hook failure or malformed input, which no middleware sees. request is nil
+// if the input could not be tied to one.
+func AuditDecision(ctx context.Context, sink AuditSink, all bool, hook Hook, request *Request, decision *Decision) {
+	if decision == nil || (!all && decision.IsAllow() && !decision.hasTag("would_block")) {
+		return
+	}
+
+	record := &AuditRecord{
+		Time:     time.Now().UTC(),
+		Hook:     hook,
+		Decision: decision.Build(),
+	}
+	if request != nil {
+		record.CorrelationID = request.CorrelationID()
+		record.ClientIP = request.ClientIP()
+		record.Method = request.Method()
+		record.Path = request.PathOnly()
+		if routeID := request.Metadata().RouteID; routeID != nil {
+			record.RouteID = *routeID
+		}
+	}
+	if err := sink.WriteAudit(record); err != nil {
+		LoggerFrom(ctx).Warn().Err(err).Msg("Failed to write audit record")
+	}
+}
+
+// hasTag reports whether the decision carries the audit tag.
+func (d *Decision) hasTag(tag string) bool {
+	for _, t := range d.audit.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditConfig configures the audit log a runner writes.
+type AuditConfig struct {
+	// Path is the JSONL file records are appended to. Empty disables the
+	// audit log.
+	Path string `json:"path"`
+
+	// AllDecisions records allow decisions as well.
+	AllDecisions bool `json:"all_decisions,omitempty"`
+
+	// MaxSize rotates the file before it grows past this many bytes. Zero
+	// means no limit.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// RotateEvery rotates the file once it has been open this long. Zero
+	// means no limit.
+	RotateEvery time.Duration `json:"rotate_every,omitempty"`
+
+	// MaxBackups is the number of rotated files kept. Zero keeps all of them.
+	MaxBackups int `json:"max_backups,omitempty"`
+
+	// Compress gzips rotated files.
+	Compress bool `json:"compress,omitempty"`
+}
+
+// AuditLog is an AuditSink that appends records to a JSONL file, rotating it
+// by size and age. A rotated file is renamed with the time of rotation
+// appended, e.g. "audit.jsonl.20240115T103000.000", and optionally
+// compressed. It is safe for concurrent use.
+type AuditLog struct {
+	mu     sync.Mutex
+	config AuditConfig
+	file   *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+	logger *zerolog.Logger
+}
+
+// NewAuditLog opens config.Path for appending.
+func NewAuditLog(config AuditConfig) (*AuditLog, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("audit log requires a path")
+	}
+	l := &AuditLog{config: config, now: time.Now, logger: &log.Logger}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// WithLogger sets the logger that failures to compress or remove rotated
+// files are reported to. It is the global logger by default.
+func (l *AuditLog) WithLogger(logger zerolog.Logger) *AuditLog {
+	l.logger = &logger
+	return l
+}
+
+// WriteAudit appends record as one JSON line, rotating the file first if
+// the record would take it past MaxSize or it is older than RotateEvery.
+func (l *AuditLog) WriteAudit(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	if l.needsRotation(int64(len(line))) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Rotate rotates the file now.
+func (l *AuditLog) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	return l.rotate()
+}
+
+// Close closes the file.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *AuditLog) needsRotation(size int64) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.config.MaxSize > 0 && l.size+size > l.config.MaxSize {
+		return true
+	}
+	return l.config.RotateEvery > 0 && l.now().Sub(l.opened) >= l.config.RotateEvery
+}
+
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l.file = f
+	l.size = info.Size()
+	l.opened = l.now()
+	return nil
+}
+
+// rotate renames the current file aside and opens a new one. l.mu must be
+// held.
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	l.file = nil
+
+	rotated := l.config.Path + "." + l.now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(l.config.Path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if l.config.Compress {
+		if err := compressFile(rotated); err != nil {
+			l.logger.Warn().Err(err).Str("file", rotated).Msg("Failed to compress audit log")
+		}
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups deletes the oldest rotated files beyond MaxBackups.
+func (l *AuditLog) removeOldBackups() {
+	if l.config.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(l.config.Path + ".*")
+	if err != nil || len(backups) <= l.config.MaxBackups {
+		return
+	}
+	// Timestamps sort in rotation order
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-l.config.MaxBackups] {
+		if err := os.Remove(backup); err != nil {
+			l.logger.Warn().Err(err).Str("file", backup).Msg("Failed to remove old audit log")
+		}
+	}
+}
+
+// compressFile replaces path with a gzipped copy at path + ".gz".
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
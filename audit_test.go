@@ -0,0 +1,153 @@
+package zentinel
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryAuditSink keeps the records written to it.
+type memoryAuditSink struct {
+	mu      sync.Mutex
+	records []*AuditRecord
+}
+
+func (s *memoryAuditSink) WriteAudit(record *AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	sink := &memoryAuditSink{}
+	agent := Wrap(&CustomAgent{}, AuditMiddleware(sink, false))
+
+	agent.OnRequest(context.Background(), newTestRequest("GET", "/"))
+	agent.OnRequest(context.Background(), newTestRequest("POST", "/blocked?x=1"))
+
+	if len(sink.records) != 1 {
+		t.Fatalf("expected only the block to be recorded, got %d records", len(sink.records))
+	}
+	record := sink.records[0]
+	if record.Hook != HookRequest || record.CorrelationID != "req-1" || record.Method != "POST" || record.Path != "/blocked" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if decision, _ := record.Decision.Decision.(map[string]interface{}); decision["block"] == nil {
+		t.Errorf("expected the block decision, got %v", record.Decision.Decision)
+	}
+
+	all := &memoryAuditSink{}
+	Wrap(&CustomAgent{}, AuditMiddleware(all, true)).OnRequest(context.Background(), newTestRequest("GET", "/"))
+	if len(all.records) != 1 {
+		t.Errorf("expected allow decisions to be recorded, got %d records", len(all.records))
+	}
+}
+
+func TestAuditMiddleware_Shadow(t *testing.T) {
+	quietLogs(t)
+	sink := &memoryAuditSink{}
+	shadow := NewShadowMode(ShadowConfig{Enabled: true})
+	agent := Wrap(&CustomAgent{}, AuditMiddleware(sink, false), shadow.Middleware())
+
+	agent.OnRequest(context.Background(), newTestRequest("GET", "/blocked"))
+	if len(sink.records) != 1 || sink.records[0].Decision.Decision != "allow" {
+		t.Fatalf("expected the shadowed allow to be recorded, got %v", sink.records)
+	}
+}
+
+func readAuditLines(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		r = gz
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestAuditLog_RotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	record := &AuditRecord{CorrelationID: "req-1", Decision: Deny().Build()}
+	line, _ := json.Marshal(record)
+
+	audit, err := NewAuditLog(AuditConfig{Path: path, MaxSize: int64(len(line)+1) * 2, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer audit.Close()
+	now := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	audit.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := audit.WriteAudit(record); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if lines := readAuditLines(t, path); len(lines) != 2 {
+		t.Errorf("expected 2 records in the current file, got %d", len(lines))
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups kept, got %v", backups)
+	}
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".gz") {
+			t.Errorf("expected %s to be compressed", backup)
+		}
+		if lines := readAuditLines(t, backup); len(lines) != 2 {
+			t.Errorf("expected 2 records in %s, got %d", backup, len(lines))
+		}
+	}
+}
+
+func TestAuditLog_RotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLog(AuditConfig{Path: path, RotateEvery: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer audit.Close()
+	now := time.Now()
+	audit.now = func() time.Time { return now }
+
+	record := &AuditRecord{CorrelationID: "req-1", Decision: Deny().Build()}
+	audit.WriteAudit(record)
+	audit.WriteAudit(record)
+	now = now.Add(time.Hour)
+	audit.WriteAudit(record)
+
+	if lines := readAuditLines(t, path); len(lines) != 1 {
+		t.Errorf("expected 1 record after rotation, got %d", len(lines))
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 || len(readAuditLines(t, backups[0])) != 2 {
+		t.Errorf("expected one backup with 2 records, got %v", backups)
+	}
+}
@@ -0,0 +1,259 @@
+package zentinel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture protocols.
+const (
+	CaptureProtocolV1 = "v1"
+	CaptureProtocolV2 = "v2"
+)
+
+// RedactedValue replaces redacted header values.
+const RedactedValue = "[REDACTED]"
+
+// DefaultSensitiveHeaders are the headers redacted by captures created from
+// runner configuration.
+var DefaultSensitiveHeaders = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+	"set-cookie",
+	"x-api-key",
+}
+
+// HeaderRedactor returns the values to record for a header.
+type HeaderRedactor func(name string, values []string) []string
+
+// BodyRedactor returns the bytes to record for a body chunk.
+type BodyRedactor func(data []byte) []byte
+
+// RedactHeaders returns a HeaderRedactor that replaces the values of the named
+// headers, matched case-insensitively, with RedactedValue.
+func RedactHeaders(names ...string) HeaderRedactor {
+	redacted := make(map[string]bool, len(names))
+	for _, name := range names {
+		redacted[strings.ToLower(name)] = true
+	}
+	return func(name string, values []string) []string {
+		if !redacted[strings.ToLower(name)] {
+			return values
+		}
+		out := make([]string, len(values))
+		for i := range out {
+			out[i] = RedactedValue
+		}
+		return out
+	}
+}
+
+// CaptureRecord is one inbound message and the agent's reply, as written to a
+// capture file.
+type CaptureRecord struct {
+	// Time is when the message was handled.
+	Time time.Time `json:"time"`
+
+	// Protocol is CaptureProtocolV1 or CaptureProtocolV2.
+	Protocol string `json:"protocol"`
+
+	// Stream identifies the connection the message arrived on.
+	Stream string `json:"stream,omitempty"`
+
+	// EventType is the v1 event type.
+	EventType string `json:"event_type,omitempty"`
+
+	// MessageType is the v2 message type.
+	MessageType byte `json:"message_type,omitempty"`
+
+	// Payload is the message payload, after redaction.
+	Payload json.RawMessage `json:"payload"`
+
+	// ResponseType is the v2 message type of the reply.
+	ResponseType byte `json:"response_type,omitempty"`
+
+	// Response is the agent's reply. It is not redacted, and is absent for
+	// messages the agent did not answer.
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// Capture writes inbound protocol messages to a JSONL stream. It is safe for
+// concurrent use.
+type Capture struct {
+	mu           sync.Mutex
+	w            io.Writer
+	closer       io.Closer
+	redactHeader HeaderRedactor
+	redactBody   BodyRedactor
+}
+
+// NewCapture creates a capture that writes to w.
+func NewCapture(w io.Writer) *Capture {
+	return &Capture{w: w}
+}
+
+// CreateCapture opens path for appending and captures to it. Values of
+// DefaultSensitiveHeaders are redacted; use WithHeaderRedactor to change this.
+func CreateCapture(path string) (*Capture, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	c := NewCapture(f).WithHeaderRedactor(RedactHeaders(DefaultSensitiveHeaders...))
+	c.closer = f
+	return c, nil
+}
+
+// WithHeaderRedactor sets the redaction hook for request and response headers.
+func (c *Capture) WithHeaderRedactor(fn HeaderRedactor) *Capture {
+	c.redactHeader = fn
+	return c
+}
+
+// WithBodyRedactor sets the redaction hook for body chunks.
+func (c *Capture) WithBodyRedactor(fn BodyRedactor) *Capture {
+	c.redactBody = fn
+	return c
+}
+
+// RecordV1 records a v1 event and the agent's response.
+func (c *Capture) RecordV1(stream string, event map[string]interface{}, response interface{}) error {
+	eventType, _ := event["event_type"].(string)
+	payload, err := c.redact(event["payload"])
+	if err != nil {
+		return err
+	}
+
+	record := &CaptureRecord{
+		Time:      time.Now(),
+		Protocol:  CaptureProtocolV1,
+		Stream:    stream,
+		EventType: eventType,
+		Payload:   payload,
+	}
+	if response != nil {
+		if record.Response, err = json.Marshal(response); err != nil {
+			return fmt.Errorf("failed to marshal response: %w", err)
+		}
+	}
+	return c.write(record)
+}
+
+// RecordV2 records a v2 message and the agent's reply. responseType is zero
+// when the agent did not reply.
+func (c *Capture) RecordV2(stream string, msgType byte, payload []byte, responseType byte, response []byte) error {
+	var decoded interface{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		// Malformed payloads are recorded as a JSON string so they replay as-is.
+		decoded = string(payload)
+	}
+	redacted, err := c.redact(decoded)
+	if err != nil {
+		return err
+	}
+
+	record := &CaptureRecord{
+		Time:         time.Now(),
+		Protocol:     CaptureProtocolV2,
+		Stream:       stream,
+		MessageType:  msgType,
+		Payload:      redacted,
+		ResponseType: responseType,
+	}
+	if responseType != 0 {
+		record.Response = json.RawMessage(response)
+	}
+	return c.write(record)
+}
+
+// Close closes the underlying file, if the capture opened it.
+func (c *Capture) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+func (c *Capture) write(record *CaptureRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal capture record: %w", err)
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.w.Write(line)
+	return err
+}
+
+// redact applies the redaction hooks to the "headers" and "data" fields of a
+// payload, which hold the headers and base64 body chunks in both protocols.
+func (c *Capture) redact(payload interface{}) (json.RawMessage, error) {
+	if fields, ok := payload.(map[string]interface{}); ok && (c.redactHeader != nil || c.redactBody != nil) {
+		redacted := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			redacted[k] = v
+		}
+
+		if headers, ok := fields["headers"].(map[string]interface{}); ok && c.redactHeader != nil {
+			out := make(map[string]interface{}, len(headers))
+			for name, raw := range headers {
+				var values []string
+				if list, ok := raw.([]interface{}); ok {
+					for _, v := range list {
+						if s, ok := v.(string); ok {
+							values = append(values, s)
+						}
+					}
+				}
+				out[name] = c.redactHeader(name, values)
+			}
+			redacted["headers"] = out
+		}
+
+		if data, ok := fields["data"].(string); ok && c.redactBody != nil {
+			if decoded, err := base64.StdEncoding.DecodeString(data); err == nil {
+				redacted["data"] = base64.StdEncoding.EncodeToString(c.redactBody(decoded))
+			}
+		}
+		payload = redacted
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return data, nil
+}
+
+// ReadCapture reads a capture stream and calls fn for each record, stopping at
+// the first error.
+func ReadCapture(r io.Reader, fn func(*CaptureRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("capture line %d: %w", line, err)
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,103 @@
+package zentinel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCapture_RedactsHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	capture := NewCapture(&buf).WithHeaderRedactor(RedactHeaders("Authorization"))
+
+	event := map[string]interface{}{
+		"event_type": "request_headers",
+		"payload": map[string]interface{}{
+			"uri": "/",
+			"headers": map[string]interface{}{
+				"authorization": []interface{}{"Bearer secret"},
+				"accept":        []interface{}{"*/*"},
+			},
+		},
+	}
+	if err := capture.RecordV1("conn-1", event, Allow().Build()); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("capture contains redacted value: %s", buf.String())
+	}
+
+	var records []*CaptureRecord
+	err := ReadCapture(&buf, func(r *CaptureRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d, %v", len(records), err)
+	}
+
+	var payload struct {
+		Headers map[string][]string `json:"headers"`
+	}
+	json.Unmarshal(records[0].Payload, &payload)
+	if got := payload.Headers["authorization"]; len(got) != 1 || got[0] != RedactedValue {
+		t.Errorf("expected redacted authorization, got %v", got)
+	}
+	if got := payload.Headers["accept"]; len(got) != 1 || got[0] != "*/*" {
+		t.Errorf("expected accept to be kept, got %v", got)
+	}
+	if records[0].EventType != "request_headers" || records[0].Stream != "conn-1" {
+		t.Errorf("unexpected record: %+v", records[0])
+	}
+
+	// The event passed to the agent is not modified.
+	headers := event["payload"].(map[string]interface{})["headers"].(map[string]interface{})
+	if headers["authorization"].([]interface{})[0] != "Bearer secret" {
+		t.Error("redaction modified the original event")
+	}
+}
+
+func TestCapture_RedactsBody(t *testing.T) {
+	var buf bytes.Buffer
+	capture := NewCapture(&buf).WithBodyRedactor(func(data []byte) []byte {
+		return bytes.ReplaceAll(data, []byte("hunter2"), []byte("*******"))
+	})
+
+	payload := []byte(`{"request_id":1,"data":"` + base64.StdEncoding.EncodeToString([]byte("password=hunter2")) + `"}`)
+	if err := capture.RecordV2("uds-1", 0x11, payload, 0, nil); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	var record CaptureRecord
+	json.Unmarshal(buf.Bytes(), &record)
+	var chunk struct {
+		Data string `json:"data"`
+	}
+	json.Unmarshal(record.Payload, &chunk)
+	data, _ := base64.StdEncoding.DecodeString(chunk.Data)
+	if string(data) != "password=*******" {
+		t.Errorf("expected redacted body, got %q", data)
+	}
+	if record.Response != nil {
+		t.Errorf("expected no response, got %s", record.Response)
+	}
+}
+
+func TestCapture_MalformedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewCapture(&buf).RecordV2("uds-1", 0x10, []byte("{not json"), 0x20, []byte(`{}`)); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	var record CaptureRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("capture line is not valid JSON: %v", err)
+	}
+	var raw string
+	if err := json.Unmarshal(record.Payload, &raw); err != nil || raw != "{not json" {
+		t.Errorf("expected payload recorded as string, got %s", record.Payload)
+	}
+}
@@ -0,0 +1,109 @@
+// Command zentinel-agent-conformance runs the protocol conformance scenarios
+// against a v2 agent binary.
+//
+// The agent is launched with --socket for the UDS run and with --grpc for the
+// gRPC run, once per transport, since the drain scenario stops it:
+//
+//	zentinel-agent-conformance --agent ./my-agent --transport all --json
+//
+// Extra arguments are passed with --agent-arg. The exit status is 1 when any
+// scenario fails and 2 when the agent could not be started.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/conformance"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/agentproc"
+)
+
+func main() {
+	agentPath := pflag.String("agent", "", "Agent binary to test")
+	agentArgs := pflag.StringArray("agent-arg", nil, "Extra argument for the agent (repeatable)")
+	transport := pflag.String("transport", conformance.TransportUDS, "Transport to test (uds, grpc, all)")
+	timeout := pflag.Duration("timeout", conformance.DefaultTimeout, "Timeout for each reply from the agent")
+	exitTimeout := pflag.Duration("exit-timeout", conformance.DefaultExitTimeout, "Time allowed for the agent to exit after SIGTERM")
+	jsonOutput := pflag.Bool("json", false, "Print the report as JSON")
+	verbose := pflag.Bool("verbose", false, "Show the agent's output")
+	pflag.Parse()
+
+	if *agentPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: zentinel-agent-conformance --agent BINARY [--transport uds|grpc|all] [--agent-arg ARG]...")
+		os.Exit(2)
+	}
+
+	var transports []string
+	switch *transport {
+	case conformance.TransportUDS, conformance.TransportGRPC:
+		transports = []string{*transport}
+	case "all":
+		transports = []string{conformance.TransportUDS, conformance.TransportGRPC}
+	default:
+		fmt.Fprintf(os.Stderr, "zentinel-agent-conformance: unknown transport %q\n", *transport)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var output io.Writer
+	if *verbose {
+		output = os.Stderr
+	}
+
+	report := &conformance.Report{Results: []conformance.Result{}}
+	for _, t := range transports {
+		proc, err := agentproc.Start(ctx, *agentPath, agentproc.Options{
+			Args:   *agentArgs,
+			GRPC:   t == conformance.TransportGRPC,
+			Output: output,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "zentinel-agent-conformance: %v\n", err)
+			os.Exit(2)
+		}
+
+		address := proc.SocketPath
+		if t == conformance.TransportGRPC {
+			address = proc.GRPCAddress
+		}
+		report.Merge(conformance.Run(ctx, conformance.Target{
+			Transport:   t,
+			Address:     address,
+			Timeout:     *timeout,
+			ExitTimeout: *exitTimeout,
+			Terminate: func() <-chan struct{} {
+				proc.Signal(syscall.SIGTERM)
+				return proc.Exited()
+			},
+		}))
+		proc.Stop(time.Second)
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, result := range report.Results {
+			line := fmt.Sprintf("%-4s  %-5s %s", result.Status, result.Transport, result.Scenario)
+			if result.Detail != "" {
+				line += ": " + result.Detail
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("%d passed, %d failed, %d skipped\n", report.Passed, report.Failed, report.Skipped)
+	}
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,86 @@
+// Command zentinel-agent-replay replays a traffic capture against an agent
+// binary and reports decisions that differ from the recorded ones.
+//
+// Record traffic by running an agent with --capture:
+//
+//	my-agent --socket /tmp/agent.sock --capture traffic.jsonl
+//
+// Then replay it against a new build:
+//
+//	zentinel-agent-replay --capture traffic.jsonl --agent ./my-agent
+//
+// The agent is started with --socket pointing at a temporary socket. Extra
+// arguments are passed with --agent-arg. The exit status is 1 when any
+// decision differs and 2 when the replay could not run.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/pflag"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/replay"
+)
+
+func main() {
+	capturePath := pflag.String("capture", "", "Capture file to replay (JSONL)")
+	agentPath := pflag.String("agent", "", "Agent binary to replay against")
+	agentArgs := pflag.StringArray("agent-arg", nil, "Extra argument for the agent (repeatable)")
+	jsonOutput := pflag.Bool("json", false, "Print the report as JSON")
+	verbose := pflag.Bool("verbose", false, "Show the agent's output")
+	pflag.Parse()
+
+	if *capturePath == "" || *agentPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: zentinel-agent-replay --capture FILE --agent BINARY [--agent-arg ARG]...")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := run(ctx, *capturePath, *agentPath, *agentArgs, *verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zentinel-agent-replay: %v\n", err)
+		os.Exit(2)
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, diff := range report.Diffs {
+			fmt.Println(diff)
+		}
+		fmt.Printf("%d records replayed, %d/%d responses matched\n",
+			report.Records, report.Matched, report.Compared)
+	}
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, capturePath, agentPath string, agentArgs []string, verbose bool) (*replay.Report, error) {
+	f, err := os.Open(capturePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	opts := replay.BinaryOptions{Args: agentArgs}
+	if verbose {
+		opts.Output = os.Stderr
+	}
+	target, err := replay.StartBinary(ctx, agentPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	return replay.Run(ctx, f, target)
+}
@@ -0,0 +1,263 @@
+// Package conformance checks that a v2 agent follows the wire protocol the
+// proxy expects: handshake rules, framing limits, body chunk sequencing,
+// cancellation, keep-alives, health and metrics, and draining on shutdown.
+//
+// The scenarios talk to a running agent over its Unix socket or gRPC address,
+// so they work for agents built with any version of this SDK. The
+// zentinel-agent-conformance command launches an agent binary and runs them:
+//
+//	zentinel-agent-conformance --agent ./my-agent --transport all --json
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// Transports.
+const (
+	TransportUDS  = "uds"
+	TransportGRPC = "grpc"
+)
+
+// DefaultTimeout bounds each wait for the agent.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultExitTimeout bounds how long the agent may take to exit once
+// terminated and its connections are closed.
+const DefaultExitTimeout = 30 * time.Second
+
+// Status is the outcome of a scenario.
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+	StatusSkip Status = "skip"
+)
+
+// Target is a running agent.
+type Target struct {
+	// Transport is TransportUDS or TransportGRPC.
+	Transport string
+
+	// Address is the socket path or gRPC address.
+	Address string
+
+	// Terminate asks the agent to shut down, as SIGTERM does, and returns a
+	// channel that is closed when it has exited. Without it the drain
+	// scenario is skipped.
+	Terminate func() <-chan struct{}
+
+	// Timeout overrides DefaultTimeout.
+	Timeout time.Duration
+
+	// ExitTimeout overrides DefaultExitTimeout.
+	ExitTimeout time.Duration
+}
+
+// Result is the outcome of one scenario.
+type Result struct {
+	Scenario   string `json:"scenario"`
+	Transport  string `json:"transport"`
+	Status     Status `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Report is the outcome of a conformance run.
+type Report struct {
+	Results []Result `json:"results"`
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+	Skipped int      `json:"skipped"`
+}
+
+// OK reports whether no scenario failed.
+func (r *Report) OK() bool {
+	return r.Failed == 0
+}
+
+// Add appends a result and updates the totals.
+func (r *Report) Add(result Result) {
+	r.Results = append(r.Results, result)
+	switch result.Status {
+	case StatusPass:
+		r.Passed++
+	case StatusFail:
+		r.Failed++
+	case StatusSkip:
+		r.Skipped++
+	}
+}
+
+// Merge adds the results of other to r.
+func (r *Report) Merge(other *Report) {
+	for _, result := range other.Results {
+		r.Add(result)
+	}
+}
+
+// Scenario is a single protocol check.
+type Scenario struct {
+	// Name identifies the scenario in reports.
+	Name string
+
+	// Description says what the agent must do to pass.
+	Description string
+
+	run func(s *session) error
+}
+
+// Scenarios returns the scenarios in the order Run executes them. The drain
+// scenario terminates the agent and is always last.
+func Scenarios() []Scenario {
+	return []Scenario{
+		{"handshake", "accepts a v2 handshake and reports its name", scenarioHandshake},
+		{"handshake_version_mismatch", "rejects a handshake for an unsupported protocol version", scenarioVersionMismatch},
+		{"handshake_required", "closes connections that send messages before the handshake", scenarioHandshakeRequired},
+		{"ping_pong", "answers a ping with a pong carrying the same timestamp", scenarioPingPong},
+		{"unknown_message_type", "answers an unknown message type with a protocol error and keeps serving", scenarioUnknownType},
+		{"malformed_payload", "answers a payload that is not valid JSON as its malformed-input policy says and keeps serving", scenarioMalformedPayload},
+		{"oversized_frame", "closes the connection on a frame larger than 16MB without reading it", scenarioOversizedFrame},
+		{"body_chunk_sequence", "asks for more on every body chunk but the last and decides on the last", scenarioBodyChunks},
+		{"cancel_mid_body", "drops the rest of a body cancelled between chunks and keeps serving", scenarioCancelMidBody},
+		{"health", "answers a health request with a valid state", scenarioHealth},
+		{"metrics", "answers a metrics request with a consistent metrics report", scenarioMetrics},
+		{"drain_on_sigterm", "stops accepting connections on SIGTERM and exits once drained", scenarioDrain},
+	}
+}
+
+// errSkip marks a scenario that does not apply to the target.
+type errSkip string
+
+func (e errSkip) Error() string {
+	return string(e)
+}
+
+// Run executes every scenario against target.
+func Run(ctx context.Context, target Target) *Report {
+	if target.Timeout == 0 {
+		target.Timeout = DefaultTimeout
+	}
+	if target.ExitTimeout == 0 {
+		target.ExitTimeout = DefaultExitTimeout
+	}
+
+	report := &Report{Results: []Result{}}
+	for _, scenario := range Scenarios() {
+		result := Result{Scenario: scenario.Name, Transport: target.Transport}
+		if err := ctx.Err(); err != nil {
+			result.Status = StatusSkip
+			result.Detail = err.Error()
+			report.Add(result)
+			continue
+		}
+
+		s := &session{ctx: ctx, target: target}
+		start := time.Now()
+		err := scenario.run(s)
+		s.closeAll()
+		result.DurationMS = time.Since(start).Milliseconds()
+
+		var skip errSkip
+		switch {
+		case errors.As(err, &skip):
+			result.Status = StatusSkip
+			result.Detail = skip.Error()
+		case err != nil:
+			result.Status = StatusFail
+			result.Detail = err.Error()
+		default:
+			result.Status = StatusPass
+		}
+		report.Add(result)
+	}
+	return report
+}
+
+// session holds the connections opened by one scenario.
+type session struct {
+	ctx    context.Context
+	target Target
+	conns  []*conn
+}
+
+func (s *session) uds() bool {
+	return s.target.Transport == TransportUDS
+}
+
+// requireUDS skips scenarios that need raw frames or message types the gRPC
+// service does not carry.
+func (s *session) requireUDS() error {
+	if !s.uds() {
+		return errSkip("not applicable to " + s.target.Transport)
+	}
+	return nil
+}
+
+func (s *session) dial() (*conn, error) {
+	switch s.target.Transport {
+	case TransportUDS:
+		raw, err := net.DialTimeout("unix", s.target.Address, s.target.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect: %w", err)
+		}
+		c := newConn(v2.NewProxyConn(raw), raw, nil, s.target.Timeout)
+		s.conns = append(s.conns, c)
+		return c, nil
+	case TransportGRPC:
+		// The stream lives as long as ctx, so it is cancelled on close.
+		ctx, cancel := context.WithCancel(s.ctx)
+		pc, err := v2.DialGRPC(ctx, s.target.Address)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to connect: %w", err)
+		}
+		c := newConn(pc, nil, cancel, s.target.Timeout)
+		s.conns = append(s.conns, c)
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", s.target.Transport)
+	}
+}
+
+// connect dials and completes an accepted handshake.
+func (s *session) connect() (*conn, error) {
+	c, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.handshake(v2.NewHandshakeRequest("zentinel-agent-conformance"))
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Accepted {
+		return nil, fmt.Errorf("handshake rejected: %s", resp.Error)
+	}
+	return c, nil
+}
+
+// alive checks that the agent still serves new connections.
+func (s *session) alive() error {
+	c, err := s.connect()
+	if err != nil {
+		return fmt.Errorf("agent stopped serving: %w", err)
+	}
+	if err := c.ping(); err != nil {
+		return fmt.Errorf("agent stopped serving: %w", err)
+	}
+	return nil
+}
+
+func (s *session) closeAll() {
+	for _, c := range s.conns {
+		c.close()
+	}
+	s.conns = nil
+}
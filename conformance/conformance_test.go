@@ -0,0 +1,114 @@
+package conformance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/agenttest"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+type conformingAgent struct {
+	v2.BaseAgentV2
+}
+
+func (a *conformingAgent) Name() string {
+	return "conforming-agent"
+}
+
+func (a *conformingAgent) Capabilities() *v2.AgentCapabilities {
+	return v2.NewAgentCapabilities().All()
+}
+
+func (a *conformingAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	return zentinel.Allow().AddRequestHeader("x-conformance", request.Path()).WithTag("conformance")
+}
+
+func target(loopback *agenttest.Loopback, transport string) Target {
+	return Target{
+		Transport: transport,
+		Address:   loopback.Address(),
+		Timeout:   2 * time.Second,
+		Terminate: func() <-chan struct{} {
+			exited := make(chan struct{})
+			go func() {
+				loopback.Shutdown()
+				close(exited)
+			}()
+			return exited
+		},
+	}
+}
+
+// The SDK's own runner must pass every scenario that applies to it.
+func TestRun_SDKConforms(t *testing.T) {
+	tests := []struct {
+		transport string
+		start     func(testing.TB, v2.AgentV2, ...agenttest.RunnerOption) *agenttest.Loopback
+		skipped   int
+	}{
+		{TransportUDS, agenttest.StartUDS, 0},
+		{TransportGRPC, agenttest.StartGRPC, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.transport, func(t *testing.T) {
+			report := Run(context.Background(), target(tt.start(t, &conformingAgent{}), tt.transport))
+
+			for _, result := range report.Results {
+				if result.Status == StatusFail {
+					t.Errorf("%s failed: %s", result.Scenario, result.Detail)
+				}
+			}
+			if len(report.Results) != len(Scenarios()) {
+				t.Errorf("expected %d results, got %d", len(Scenarios()), len(report.Results))
+			}
+			if report.Skipped != tt.skipped {
+				t.Errorf("expected %d skipped scenarios, got %d", tt.skipped, report.Skipped)
+			}
+		})
+	}
+}
+
+func TestRun_ReportsFailures(t *testing.T) {
+	// Nothing listens here, so every applicable scenario fails.
+	report := Run(context.Background(), Target{
+		Transport: TransportUDS,
+		Address:   "/nonexistent/agent.sock",
+		Timeout:   100 * time.Millisecond,
+	})
+	if report.OK() {
+		t.Fatal("expected failures")
+	}
+	if report.Skipped != 1 || report.Failed != len(Scenarios())-1 {
+		t.Errorf("expected drain skipped and the rest failed, got %+v", report)
+	}
+}
+
+func TestCheckDecision(t *testing.T) {
+	value := "1"
+	confidence := 1.5
+	tests := []struct {
+		name     string
+		decision v2.ClientDecision
+		ok       bool
+	}{
+		{"allow", v2.ClientDecision{Action: v2.ActionAllow, RequestHeaders: []v2.V2HeaderOp{{Operation: "set", Name: "x-a", Value: &value}}}, true},
+		{"block", v2.ClientDecision{Action: v2.ActionBlock, Status: 403}, true},
+		{"remove", v2.ClientDecision{Action: v2.ActionAllow, ResponseHeaders: []v2.V2HeaderOp{{Operation: "remove", Name: "server"}}}, true},
+		{"unknown action", v2.ClientDecision{Action: "maybe"}, false},
+		{"block without status", v2.ClientDecision{Action: v2.ActionBlock}, false},
+		{"redirect without url", v2.ClientDecision{Action: v2.ActionRedirect, Status: 302}, false},
+		{"challenge without type", v2.ClientDecision{Action: v2.ActionChallenge}, false},
+		{"set without value", v2.ClientDecision{Action: v2.ActionAllow, RequestHeaders: []v2.V2HeaderOp{{Operation: "set", Name: "x-a"}}}, false},
+		{"unnamed header", v2.ClientDecision{Action: v2.ActionAllow, ResponseHeaders: []v2.V2HeaderOp{{Operation: "remove"}}}, false},
+		{"empty tag", v2.ClientDecision{Action: v2.ActionAllow, Audit: zentinel.AuditMetadata{Tags: []string{""}}}, false},
+		{"confidence", v2.ClientDecision{Action: v2.ActionAllow, Audit: zentinel.AuditMetadata{Confidence: &confidence}}, false},
+	}
+	for _, tt := range tests {
+		if err := checkDecision(&tt.decision); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package conformance
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// errClosed is returned by recv when the agent closed the connection.
+var errClosed = errors.New("connection closed by agent")
+
+// conn is a proxy-side connection to the agent under test. Messages are read
+// in the background so that every wait is bounded by the scenario timeout.
+type conn struct {
+	pc      v2.ProxyConn
+	raw     net.Conn
+	cancel  context.CancelFunc
+	timeout time.Duration
+
+	msgs   chan *v2.V2Message
+	done   chan struct{}
+	closed chan struct{}
+}
+
+func newConn(pc v2.ProxyConn, raw net.Conn, cancel context.CancelFunc, timeout time.Duration) *conn {
+	c := &conn{
+		pc:      pc,
+		raw:     raw,
+		cancel:  cancel,
+		timeout: timeout,
+		msgs:    make(chan *v2.V2Message, 16),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *conn) readLoop() {
+	defer close(c.done)
+	for {
+		msg, err := c.pc.Recv()
+		if err != nil {
+			return
+		}
+		select {
+		case c.msgs <- msg:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *conn) send(msgType byte, payload interface{}) error {
+	msg, err := v2.NewV2Message(msgType, payload)
+	if err != nil {
+		return err
+	}
+	if err := c.pc.Send(msg); err != nil {
+		return fmt.Errorf("failed to send %s: %w", msg.TypeName(), err)
+	}
+	return nil
+}
+
+// sendFrame writes a v2 frame with an arbitrary type and payload. Only UDS
+// connections support it.
+func (c *conn) sendFrame(msgType byte, payload []byte) error {
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(1+len(payload)))
+	frame[4] = msgType
+	return c.sendRaw(append(frame, payload...))
+}
+
+func (c *conn) sendRaw(data []byte) error {
+	if c.raw == nil {
+		return errors.New("raw frames are not supported on this transport")
+	}
+	if _, err := c.raw.Write(data); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+func (c *conn) recv() (*v2.V2Message, error) {
+	select {
+	case msg := <-c.msgs:
+		return msg, nil
+	case <-c.done:
+		// Drain messages that arrived before the close.
+		select {
+		case msg := <-c.msgs:
+			return msg, nil
+		default:
+		}
+		return nil, errClosed
+	case <-time.After(c.timeout):
+		return nil, fmt.Errorf("no reply within %s", c.timeout)
+	}
+}
+
+// expect receives the next message and checks its type.
+func (c *conn) expect(msgType byte) (*v2.V2Message, error) {
+	msg, err := c.recv()
+	if err != nil {
+		return nil, fmt.Errorf("expected %s: %w", typeName(msgType), err)
+	}
+	if msg.Type != msgType {
+		return nil, fmt.Errorf("expected %s, got %s", typeName(msgType), msg.TypeName())
+	}
+	return msg, nil
+}
+
+// expectDecision receives the next message and checks that it is a decision
+// for requestID that the proxy can act on.
+func (c *conn) expectDecision(requestID uint64) (*v2.ClientDecision, error) {
+	msg, err := c.expect(v2.MsgTypeDecision)
+	if err != nil {
+		return nil, err
+	}
+	return decisionFor(msg, requestID)
+}
+
+// decisionFor parses a decision message and checks that it is for requestID
+// and one the proxy can act on.
+func decisionFor(msg *v2.V2Message, requestID uint64) (*v2.ClientDecision, error) {
+	decision, err := v2.ParseDecision(msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid decision payload: %w", err)
+	}
+	if decision.RequestID != requestID {
+		return nil, fmt.Errorf("expected decision for request %d, got %d", requestID, decision.RequestID)
+	}
+	if err := checkDecision(decision); err != nil {
+		return nil, fmt.Errorf("decision for request %d: %w", requestID, err)
+	}
+	return decision, nil
+}
+
+// expectNeedsMore receives a decision for requestID that asks for more body
+// data and changes nothing yet.
+func (c *conn) expectNeedsMore(requestID uint64) error {
+	decision, err := c.expectDecision(requestID)
+	if err != nil {
+		return err
+	}
+	if !decision.NeedsMore {
+		return fmt.Errorf("expected needs_more for request %d, got %s", requestID, decision.Action)
+	}
+	if len(decision.RequestHeaders) != 0 || len(decision.ResponseHeaders) != 0 {
+		return fmt.Errorf("needs_more decision for request %d carries header operations", requestID)
+	}
+	return nil
+}
+
+// expectFinal receives a decision for requestID that settles the request
+// rather than asking for more body data.
+func (c *conn) expectFinal(requestID uint64) (*v2.ClientDecision, error) {
+	decision, err := c.expectDecision(requestID)
+	if err != nil {
+		return nil, err
+	}
+	if decision.NeedsMore {
+		return nil, fmt.Errorf("expected a final decision for request %d, got needs_more", requestID)
+	}
+	return decision, nil
+}
+
+// expectProtocolError receives the next message and checks that it is a
+// protocol error with code for a message of msgType.
+func (c *conn) expectProtocolError(msgType byte, code string) (*v2.ProtocolErrorMessage, error) {
+	msg, err := c.expect(v2.MsgTypeProtocolError)
+	if err != nil {
+		return nil, err
+	}
+	return protocolErrorFor(msg, msgType, code)
+}
+
+// protocolErrorFor parses a protocol error message and checks that it has
+// code and names a message of msgType.
+func protocolErrorFor(msg *v2.V2Message, msgType byte, code string) (*v2.ProtocolErrorMessage, error) {
+	var protocolErr v2.ProtocolErrorMessage
+	if err := msg.ParsePayload(&protocolErr); err != nil {
+		return nil, fmt.Errorf("invalid protocol error payload: %w", err)
+	}
+	if protocolErr.Code != code || protocolErr.MessageType != msgType {
+		return nil, fmt.Errorf("expected protocol error %q for %s, got %q for %s",
+			code, typeName(msgType), protocolErr.Code, typeName(protocolErr.MessageType))
+	}
+	return &protocolErr, nil
+}
+
+// checkDecision checks that a decision carries what its action needs and
+// that its header operations are well formed.
+func checkDecision(d *v2.ClientDecision) error {
+	switch d.Action {
+	case v2.ActionAllow:
+	case v2.ActionBlock:
+		if d.Status < 100 || d.Status > 599 {
+			return fmt.Errorf("block decision has status %d", d.Status)
+		}
+	case v2.ActionRedirect:
+		if d.RedirectURL == "" || d.Status < 300 || d.Status > 399 {
+			return fmt.Errorf("redirect decision to %q has status %d", d.RedirectURL, d.Status)
+		}
+	case v2.ActionChallenge:
+		if d.ChallengeType == "" {
+			return fmt.Errorf("challenge decision has no challenge type")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", d.Action)
+	}
+
+	for _, op := range append(append([]v2.V2HeaderOp(nil), d.RequestHeaders...), d.ResponseHeaders...) {
+		switch {
+		case op.Name == "":
+			return fmt.Errorf("%s header operation has no name", op.Operation)
+		case op.Operation == "remove":
+		case op.Operation != "set" && op.Operation != "add":
+			return fmt.Errorf("unknown header operation %q on %s", op.Operation, op.Name)
+		case op.Value == nil:
+			return fmt.Errorf("%s of header %s has no value", op.Operation, op.Name)
+		}
+	}
+	for _, tag := range d.Audit.Tags {
+		if tag == "" {
+			return fmt.Errorf("decision has an empty audit tag")
+		}
+	}
+	if confidence := d.Audit.Confidence; confidence != nil && (*confidence < 0 || *confidence > 1) {
+		return fmt.Errorf("audit confidence %v is outside 0 to 1", *confidence)
+	}
+	return nil
+}
+
+// skipUntil receives messages until one of msgType arrives.
+func (c *conn) skipUntil(msgType byte) (*v2.V2Message, error) {
+	for {
+		msg, err := c.recv()
+		if err != nil {
+			return nil, fmt.Errorf("expected %s: %w", typeName(msgType), err)
+		}
+		if msg.Type == msgType {
+			return msg, nil
+		}
+	}
+}
+
+// expectClosed waits for the agent to close the connection, ignoring any
+// messages sent before it does.
+func (c *conn) expectClosed() error {
+	deadline := time.After(c.timeout)
+	for {
+		select {
+		case <-c.msgs:
+		case <-c.done:
+			return nil
+		case <-deadline:
+			return fmt.Errorf("connection still open after %s", c.timeout)
+		}
+	}
+}
+
+func (c *conn) handshake(req *v2.HandshakeRequest) (*v2.HandshakeResponse, error) {
+	if err := c.send(v2.MsgTypeHandshakeRequest, req); err != nil {
+		return nil, err
+	}
+	msg, err := c.expect(v2.MsgTypeHandshakeResponse)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v2.UnmarshalHandshakeResponse(msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid handshake response: %w", err)
+	}
+	return resp, nil
+}
+
+// metrics requests the agent's metrics report.
+func (c *conn) metrics() (*v2.MetricsReport, error) {
+	if err := c.send(v2.MsgTypeMetricsRequest, struct{}{}); err != nil {
+		return nil, err
+	}
+	msg, err := c.expect(v2.MsgTypeMetricsResponse)
+	if err != nil {
+		return nil, err
+	}
+	var report v2.MetricsReport
+	if err := msg.ParsePayload(&report); err != nil {
+		return nil, fmt.Errorf("invalid metrics payload: %w", err)
+	}
+	return &report, nil
+}
+
+func (c *conn) ping() error {
+	if err := c.send(v2.MsgTypePing, v2.PingMessage{Timestamp: time.Now().UnixNano()}); err != nil {
+		return err
+	}
+	_, err := c.skipUntil(v2.MsgTypePong)
+	return err
+}
+
+func (c *conn) close() {
+	close(c.closed)
+	c.pc.Close()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+func typeName(msgType byte) string {
+	return (&v2.V2Message{Type: msgType}).TypeName()
+}
@@ -0,0 +1,405 @@
+package conformance
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+func scenarioHandshake(s *session) error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	resp, err := c.handshake(v2.NewHandshakeRequest("zentinel-agent-conformance"))
+	if err != nil {
+		return err
+	}
+	if !resp.Accepted {
+		return fmt.Errorf("handshake rejected: %s", resp.Error)
+	}
+	if resp.ProtocolVersion != v2.ProtocolVersionV2 {
+		return fmt.Errorf("expected protocol version %d, got %d", v2.ProtocolVersionV2, resp.ProtocolVersion)
+	}
+	if resp.AgentName == "" && s.uds() {
+		return fmt.Errorf("handshake response has no agent name")
+	}
+	return nil
+}
+
+func scenarioVersionMismatch(s *session) error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	req := v2.NewHandshakeRequest("zentinel-agent-conformance")
+	req.ProtocolVersion = 99
+	resp, err := c.handshake(req)
+	if err != nil {
+		return err
+	}
+	if resp.Accepted {
+		return fmt.Errorf("handshake for protocol version 99 was accepted")
+	}
+	if resp.Error == "" && s.uds() {
+		return fmt.Errorf("rejected handshake has no error message")
+	}
+	if s.uds() {
+		return c.expectClosed()
+	}
+	return nil
+}
+
+func scenarioHandshakeRequired(s *session) error {
+	if err := s.requireUDS(); err != nil {
+		return err
+	}
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	if err := c.send(v2.MsgTypePing, v2.PingMessage{Timestamp: 1}); err != nil {
+		return err
+	}
+	if msg, err := c.recv(); err == nil {
+		return fmt.Errorf("expected connection to be closed, got %s", msg.TypeName())
+	} else if err != errClosed {
+		return err
+	}
+	return nil
+}
+
+func scenarioPingPong(s *session) error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().UnixNano()
+	if err := c.send(v2.MsgTypePing, v2.PingMessage{Timestamp: timestamp}); err != nil {
+		return err
+	}
+	msg, err := c.expect(v2.MsgTypePong)
+	if err != nil {
+		return err
+	}
+	var pong v2.PongMessage
+	if err := msg.ParsePayload(&pong); err != nil {
+		return fmt.Errorf("invalid pong payload: %w", err)
+	}
+	if pong.Timestamp != timestamp {
+		return fmt.Errorf("expected pong timestamp %d, got %d", timestamp, pong.Timestamp)
+	}
+	return nil
+}
+
+func scenarioUnknownType(s *session) error {
+	if err := s.requireUDS(); err != nil {
+		return err
+	}
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if err := c.sendFrame(0x7F, []byte(`{}`)); err != nil {
+		return err
+	}
+	if _, err := c.expectProtocolError(0x7F, "unknown_message"); err != nil {
+		return err
+	}
+	if err := c.ping(); err != nil {
+		return fmt.Errorf("connection unusable after unknown message type: %w", err)
+	}
+	return nil
+}
+
+func scenarioMalformedPayload(s *session) error {
+	if err := s.requireUDS(); err != nil {
+		return err
+	}
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if err := c.sendFrame(v2.MsgTypeRequestHeaders, []byte(`{"request_id":1,"method":`)); err != nil {
+		return err
+	}
+	if err := expectMalformedReply(c, 1); err != nil {
+		return err
+	}
+	return s.alive()
+}
+
+// expectMalformedReply checks the reply to a malformed message for
+// requestID under any --malformed-input policy: a decision tagged
+// "malformed" (allow or block), or a protocol error before the connection
+// is closed (close).
+func expectMalformedReply(c *conn, requestID uint64) error {
+	msg, err := c.recv()
+	if err != nil {
+		return fmt.Errorf("no reply to a malformed payload: %w", err)
+	}
+	switch msg.Type {
+	case v2.MsgTypeDecision:
+		decision, err := decisionFor(msg, requestID)
+		if err != nil {
+			return err
+		}
+		if decision.Action != v2.ActionAllow && decision.Action != v2.ActionBlock {
+			return fmt.Errorf("expected allow or block for a malformed payload, got %s", decision.Action)
+		}
+		if !hasTag(decision, "malformed") {
+			return fmt.Errorf("expected the decision to be tagged malformed, got %v", decision.Audit.Tags)
+		}
+		return nil
+	case v2.MsgTypeProtocolError:
+		protocolErr, err := protocolErrorFor(msg, v2.MsgTypeRequestHeaders, "malformed")
+		if err != nil {
+			return err
+		}
+		if protocolErr.RequestID == nil || *protocolErr.RequestID != requestID {
+			return fmt.Errorf("expected the protocol error to name request %d", requestID)
+		}
+		return c.expectClosed()
+	default:
+		return fmt.Errorf("expected a decision or protocol error, got %s", msg.TypeName())
+	}
+}
+
+func hasTag(decision *v2.ClientDecision, tag string) bool {
+	for _, t := range decision.Audit.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func scenarioOversizedFrame(s *session) error {
+	if err := s.requireUDS(); err != nil {
+		return err
+	}
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix, v2.MaxMessageSizeV2+1)
+	prefix[4] = v2.MsgTypeRequestHeaders
+	if err := c.sendRaw(prefix); err != nil {
+		return err
+	}
+	if err := c.expectClosed(); err != nil {
+		return err
+	}
+	return s.alive()
+}
+
+func requestHeaders(requestID uint64, method, uri string, hasBody bool) *v2.V2RequestHeaders {
+	return &v2.V2RequestHeaders{
+		RequestID: requestID,
+		Method:    method,
+		URI:       uri,
+		Headers:   map[string][]string{"host": {"conformance.test"}},
+		HasBody:   hasBody,
+		Metadata: v2.V2RequestMetadata{
+			CorrelationID: fmt.Sprintf("conformance-%d", requestID),
+			ClientIP:      "127.0.0.1",
+			ClientPort:    40000,
+			Protocol:      "HTTP/1.1",
+		},
+	}
+}
+
+func bodyChunk(requestID uint64, index uint32, data string, last bool) *v2.V2RequestBodyChunk {
+	return &v2.V2RequestBodyChunk{
+		RequestID:  requestID,
+		ChunkIndex: index,
+		Data:       base64.StdEncoding.EncodeToString([]byte(data)),
+		IsLast:     last,
+	}
+}
+
+func scenarioBodyChunks(s *session) error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	const requestID = 100
+	if err := c.send(v2.MsgTypeRequestHeaders, requestHeaders(requestID, "POST", "/conformance/body", true)); err != nil {
+		return err
+	}
+	if _, err := c.expectFinal(requestID); err != nil {
+		return fmt.Errorf("request headers: %w", err)
+	}
+
+	// Without streaming negotiated the agent buffers the body and decides on
+	// the last chunk.
+	chunks := []string{"first ", "second ", "third"}
+	for i, data := range chunks {
+		last := i == len(chunks)-1
+		if err := c.send(v2.MsgTypeRequestBodyChunk, bodyChunk(requestID, uint32(i), data, last)); err != nil {
+			return err
+		}
+		if last {
+			if _, err := c.expectFinal(requestID); err != nil {
+				return fmt.Errorf("last body chunk: %w", err)
+			}
+		} else if err := c.expectNeedsMore(requestID); err != nil {
+			return fmt.Errorf("body chunk %d: %w", i, err)
+		}
+	}
+
+	complete := &v2.V2RequestComplete{RequestID: requestID, StatusCode: 200, DurationMS: 1}
+	if err := c.send(v2.MsgTypeRequestComplete, complete); err != nil {
+		return err
+	}
+	// Request complete has no reply; the next message must be the pong.
+	if err := c.send(v2.MsgTypePing, v2.PingMessage{Timestamp: 1}); err != nil {
+		return err
+	}
+	if _, err := c.expect(v2.MsgTypePong); err != nil {
+		return fmt.Errorf("after request complete: %w", err)
+	}
+	return nil
+}
+
+func scenarioCancelMidBody(s *session) error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	const requestID = 200
+	if err := c.send(v2.MsgTypeRequestHeaders, requestHeaders(requestID, "POST", "/conformance/cancel", true)); err != nil {
+		return err
+	}
+	if _, err := c.expectFinal(requestID); err != nil {
+		return fmt.Errorf("request headers: %w", err)
+	}
+	if err := c.send(v2.MsgTypeRequestBodyChunk, bodyChunk(requestID, 0, "partial", false)); err != nil {
+		return err
+	}
+	if err := c.expectNeedsMore(requestID); err != nil {
+		return fmt.Errorf("body chunk: %w", err)
+	}
+
+	reason := "client disconnected"
+	if err := c.send(v2.MsgTypeCancelRequest, v2.CancelRequestMessage{RequestID: requestID, Reason: &reason}); err != nil {
+		return err
+	}
+	if err := c.ping(); err != nil {
+		return fmt.Errorf("after cancel: %w", err)
+	}
+
+	// The rest of the cancelled body is dropped, not decided on. Over gRPC
+	// the reply cannot be matched to a cancelled request, so this is UDS only.
+	if s.uds() {
+		if err := c.send(v2.MsgTypeRequestBodyChunk, bodyChunk(requestID, 1, " rest", true)); err != nil {
+			return err
+		}
+		if err := c.expectNeedsMore(requestID); err != nil {
+			return fmt.Errorf("body chunk after cancel: %w", err)
+		}
+	}
+
+	// A new request on the same connection is still served.
+	if err := c.send(v2.MsgTypeRequestHeaders, requestHeaders(requestID+1, "GET", "/conformance/after-cancel", false)); err != nil {
+		return err
+	}
+	if _, err := c.expectFinal(requestID + 1); err != nil {
+		return fmt.Errorf("request after cancel: %w", err)
+	}
+	return nil
+}
+
+func scenarioHealth(s *session) error {
+	if err := s.requireUDS(); err != nil {
+		return err
+	}
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if err := c.send(v2.MsgTypeHealthRequest, struct{}{}); err != nil {
+		return err
+	}
+	msg, err := c.expect(v2.MsgTypeHealthResponse)
+	if err != nil {
+		return err
+	}
+	var health v2.HealthStatus
+	if err := msg.ParsePayload(&health); err != nil {
+		return fmt.Errorf("invalid health payload: %w", err)
+	}
+	switch health.State {
+	case v2.HealthStateHealthy, v2.HealthStateDegraded, v2.HealthStateUnhealthy:
+		return nil
+	default:
+		return fmt.Errorf("unknown health state %q", health.State)
+	}
+}
+
+func scenarioMetrics(s *session) error {
+	if err := s.requireUDS(); err != nil {
+		return err
+	}
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	metrics, err := c.metrics()
+	if err != nil {
+		return err
+	}
+
+	// The report is the agent's own, so only its consistency is checked.
+	if decided := metrics.RequestsAllowed + metrics.RequestsBlocked; decided > metrics.RequestsTotal {
+		return fmt.Errorf("%d allowed and %d blocked exceed requests_total %d", metrics.RequestsAllowed, metrics.RequestsBlocked, metrics.RequestsTotal)
+	}
+	if metrics.RequestsErrored > metrics.RequestsTotal {
+		return fmt.Errorf("requests_errored %d exceeds requests_total %d", metrics.RequestsErrored, metrics.RequestsTotal)
+	}
+	return nil
+}
+
+func scenarioDrain(s *session) error {
+	if s.target.Terminate == nil {
+		return errSkip("target cannot be terminated")
+	}
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	exited := s.target.Terminate()
+
+	if s.uds() {
+		// New connections are refused once draining starts.
+		deadline := time.Now().Add(s.target.Timeout)
+		for {
+			raw, err := net.DialTimeout("unix", s.target.Address, s.target.Timeout)
+			if err != nil {
+				break
+			}
+			raw.Close()
+			if time.Now().After(deadline) {
+				return fmt.Errorf("agent still accepts connections %s after SIGTERM", s.target.Timeout)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// Closing the last connection lets the agent finish draining.
+	c.close()
+	s.conns = nil
+
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(s.target.ExitTimeout):
+		return fmt.Errorf("agent did not exit within %s of SIGTERM", s.target.ExitTimeout)
+	}
+}
@@ -0,0 +1,40 @@
+package zentinel
+
+import "time"
+
+// HookDeadlines bounds how long each hook may run. The context passed to the
+// hook expires at the deadline; if the hook has not returned by then, the
+// failure policy's decision is sent in its place, tagged "timeout", and the
+// hook's late result is discarded.
+//
+// Example:
+//
+//	deadlines := zentinel.HookDeadlines{Default: 50 * time.Millisecond}.
+//	    WithHook(zentinel.HookRequestBody, 200*time.Millisecond)
+type HookDeadlines struct {
+	// Default applies to hooks without an entry in Hooks. Zero means no
+	// deadline.
+	Default time.Duration
+
+	// Hooks overrides Default for individual hooks.
+	Hooks map[Hook]time.Duration
+}
+
+// WithHook returns a copy of the deadlines with timeout set for hook.
+func (d HookDeadlines) WithHook(hook Hook, timeout time.Duration) HookDeadlines {
+	hooks := make(map[Hook]time.Duration, len(d.Hooks)+1)
+	for h, t := range d.Hooks {
+		hooks[h] = t
+	}
+	hooks[hook] = timeout
+	d.Hooks = hooks
+	return d
+}
+
+// Timeout returns how long hook may run, or zero for no deadline.
+func (d HookDeadlines) Timeout(hook Hook) time.Duration {
+	if timeout, ok := d.Hooks[hook]; ok {
+		return timeout
+	}
+	return d.Default
+}
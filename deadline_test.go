@@ -0,0 +1,91 @@
+package zentinel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// slowAgent blocks in OnRequest until release is closed, ignoring its context.
+type slowAgent struct {
+	BaseAgent
+	release     chan struct{}
+	hasDeadline chan bool
+}
+
+func (a *slowAgent) Name() string {
+	return "slow-agent"
+}
+
+func (a *slowAgent) OnRequest(ctx context.Context, request *Request) *Decision {
+	_, ok := ctx.Deadline()
+	a.hasDeadline <- ok
+	<-a.release
+	return Deny()
+}
+
+func (a *slowAgent) OnConfigure(ctx context.Context, config map[string]interface{}) error {
+	<-a.release
+	return nil
+}
+
+func TestHookDeadlines_Timeout(t *testing.T) {
+	deadlines := HookDeadlines{Default: time.Second}.WithHook(HookRequestBody, 0)
+	if deadlines.Timeout(HookRequest) != time.Second {
+		t.Errorf("expected default timeout, got %v", deadlines.Timeout(HookRequest))
+	}
+	if deadlines.Timeout(HookRequestBody) != 0 {
+		t.Errorf("expected no timeout for request body, got %v", deadlines.Timeout(HookRequestBody))
+	}
+}
+
+func TestAgentHandler_DeadlineSendsFallback(t *testing.T) {
+	quietLogs(t)
+	agent := &slowAgent{release: make(chan struct{}), hasDeadline: make(chan bool, 1)}
+	defer close(agent.release)
+
+	handler := NewAgentHandler(agent).
+		WithDeadlines(HookDeadlines{Default: 20 * time.Millisecond}).
+		WithFailurePolicy(FailurePolicy{Default: FailClosed})
+
+	start := time.Now()
+	response, err := handler.HandleEvent(context.Background(), mustDecode(fuzzEvents[1]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fallback took %v", elapsed)
+	}
+	if !<-agent.hasDeadline {
+		t.Error("expected hook context to carry a deadline")
+	}
+
+	agentResponse := response.(AgentResponse)
+	decision, ok := agentResponse.Decision.(map[string]interface{})
+	if !ok || decision["block"].(map[string]interface{})["status"] != 500 {
+		t.Errorf("expected block 500, got %v", agentResponse.Decision)
+	}
+	if len(agentResponse.Audit.Tags) != 1 || agentResponse.Audit.Tags[0] != "timeout" {
+		t.Errorf("expected timeout tag, got %v", agentResponse.Audit.Tags)
+	}
+}
+
+func TestAgentHandler_ConfigureDeadline(t *testing.T) {
+	quietLogs(t)
+	agent := &slowAgent{release: make(chan struct{})}
+	defer close(agent.release)
+
+	handler := NewAgentHandler(agent).WithDeadlines(HookDeadlines{}.WithHook(HookConfigure, 20*time.Millisecond))
+	event := mustDecode(`{"event_type":"configure","payload":{"agent_id":"slow","config":{}}}`)
+	response, err := handler.HandleEvent(context.Background(), event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result := response.(map[string]interface{})
+	if result["success"] != false || result["error"] != "configuration handler timed out" {
+		t.Errorf("expected a timed out configuration, got %v", result)
+	}
+	if handler.Failures()[FailureTimeout] != 1 {
+		t.Errorf("expected one timeout, got %v", handler.Failures())
+	}
+}
@@ -0,0 +1,305 @@
+package zentinel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DebugSettings are the logging settings a DebugControl switches at runtime.
+type DebugSettings struct {
+	// Level is the log level, e.g. "debug". Empty means the configured
+	// level.
+	Level string `json:"level,omitempty"`
+
+	// DumpCorrelationID dumps the payloads of the request with this
+	// correlation ID.
+	DumpCorrelationID string `json:"dump_correlation_id,omitempty"`
+
+	// DumpClientIP dumps the payloads of requests from this client IP.
+	DumpClientIP string `json:"dump_client_ip,omitempty"`
+}
+
+// DebugControl changes a runner's logging while it runs: the log level, and
+// payload dumps for the requests of one correlation ID or client IP. Changes
+// revert to the configured level, without dumps, once their TTL expires. It
+// is safe for concurrent use.
+//
+// The runners switch it on SIGUSR1, which cycles the level, on the admin
+// endpoint, and, for v2 gRPC, on ControlStream log messages.
+type DebugControl struct {
+	level    atomic.Int32
+	dumps    atomic.Pointer[DebugSettings]
+	mu       sync.Mutex
+	base     zerolog.Level
+	ttl      time.Duration
+	revert   *time.Timer
+	expires  time.Time
+	revision uint64
+}
+
+// NewDebugControl creates a control at info level that reverts changes
+// after ttl, or never if ttl is zero.
+func NewDebugControl(ttl time.Duration) *DebugControl {
+	c := &DebugControl{base: zerolog.InfoLevel, ttl: ttl}
+	c.level.Store(int32(zerolog.InfoLevel))
+	c.dumps.Store(&DebugSettings{})
+	return c
+}
+
+// WithTTL sets how long changes last when none is given.
+func (c *DebugControl) WithTTL(ttl time.Duration) *DebugControl {
+	c.mu.Lock()
+	c.ttl = ttl
+	c.mu.Unlock()
+	return c
+}
+
+// Logger returns logger with its level under c's control. The logger's own
+// level becomes the configured level changes revert to. Any sampler the
+// logger had is replaced.
+func (c *DebugControl) Logger(logger zerolog.Logger) zerolog.Logger {
+	c.mu.Lock()
+	c.base = logger.GetLevel()
+	c.level.Store(int32(c.base))
+	c.mu.Unlock()
+	return logger.Level(zerolog.TraceLevel).Sample(c)
+}
+
+// Sample implements zerolog.Sampler, passing events at or above the
+// current level.
+func (c *DebugControl) Sample(level zerolog.Level) bool {
+	return level >= c.Level()
+}
+
+// Level returns the current log level.
+func (c *DebugControl) Level() zerolog.Level {
+	return zerolog.Level(c.level.Load())
+}
+
+// Settings returns the current settings and when they revert, which is
+// zero if they do not.
+func (c *DebugControl) Settings() (DebugSettings, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	settings := *c.dumps.Load()
+	settings.Level = c.Level().String()
+	return settings, c.expires
+}
+
+// Set applies settings until ttl expires, or the default TTL if ttl is
+// zero. Settings equal to the configured ones never expire.
+func (c *DebugControl) Set(settings DebugSettings, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	level := c.base
+	if settings.Level != "" {
+		parsed, err := zerolog.ParseLevel(settings.Level)
+		if err != nil || parsed == zerolog.NoLevel {
+			return fmt.Errorf("invalid log level %q", settings.Level)
+		}
+		level = parsed
+	}
+	c.apply(level, settings, ttl)
+	return nil
+}
+
+// Cycle lowers the level one step, from the configured level down to
+// trace and round again, keeping any dumps. It returns the new level.
+func (c *DebugControl) Cycle() zerolog.Level {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	level := c.Level() - 1
+	if level < zerolog.TraceLevel {
+		level = c.base
+	}
+	c.apply(level, *c.dumps.Load(), 0)
+	return level
+}
+
+// Reset reverts to the configured level, without dumps.
+func (c *DebugControl) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apply(c.base, DebugSettings{}, 0)
+}
+
+// apply switches to level and the dumps in settings, scheduling the revert.
+// c.mu must be held.
+func (c *DebugControl) apply(level zerolog.Level, settings DebugSettings, ttl time.Duration) {
+	c.level.Store(int32(level))
+	c.dumps.Store(&DebugSettings{
+		DumpCorrelationID: settings.DumpCorrelationID,
+		DumpClientIP:      settings.DumpClientIP,
+	})
+
+	c.revision++
+	if c.revert != nil {
+		c.revert.Stop()
+		c.revert = nil
+	}
+	c.expires = time.Time{}
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	if ttl <= 0 || (level == c.base && settings.DumpCorrelationID == "" && settings.DumpClientIP == "") {
+		return
+	}
+
+	// A revert scheduled before a later change must not undo it
+	revision := c.revision
+	c.expires = time.Now().Add(ttl)
+	c.revert = time.AfterFunc(ttl, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.revision == revision {
+			c.apply(c.base, DebugSettings{}, 0)
+		}
+	})
+}
+
+// dumpsRequest reports whether request's payloads are dumped.
+func (c *DebugControl) dumpsRequest(request *Request) bool {
+	settings := c.dumps.Load()
+	return (settings.DumpCorrelationID != "" && settings.DumpCorrelationID == request.CorrelationID()) ||
+		(settings.DumpClientIP != "" && settings.DumpClientIP == request.ClientIP())
+}
+
+// Middleware returns middleware that dumps the payloads and decisions of
+// the requests selected by the settings. Dumps are logged whatever the
+// level.
+func (c *DebugControl) Middleware() Middleware {
+	return func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		decision := next(ctx, call)
+		request := call.Request
+		if !c.dumpsRequest(request) {
+			return decision
+		}
+
+		event := LoggerFrom(ctx).Log().
+			Str("hook", string(call.Hook)).
+			Str("client_ip", request.ClientIP()).
+			Str("method", request.Method()).
+			Str("uri", request.URI()).
+			Interface("headers", request.Headers())
+		if body := request.Body(); len(body) > 0 {
+			event = event.Bytes("body", body)
+		}
+		if response := call.Response; response != nil {
+			event = event.Int("status", response.StatusCode()).
+				Interface("response_headers", response.Headers())
+			if body := response.Body(); len(body) > 0 {
+				event = event.Bytes("response_body", body)
+			}
+		}
+		if decision != nil {
+			event = event.Interface("decision", decision.Build())
+		}
+		event.Msg("Payload dump")
+		return decision
+	}
+}
+
+// WatchSignals cycles the level on SIGUSR1, logging each change to logger,
+// until stop is called. It does nothing on platforms without SIGUSR1.
+func (c *DebugControl) WatchSignals(logger *zerolog.Logger) (stop func()) {
+	if len(levelSignals) == 0 {
+		return func() {}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigChan, levelSignals...)
+	go func() {
+		for {
+			select {
+			case <-sigChan:
+				level := c.Cycle()
+				_, expires := c.Settings()
+				event := logger.Log().Str("level", level.String())
+				if !expires.IsZero() {
+					event = event.Time("expires", expires)
+				}
+				event.Msg("Log level changed")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(sigChan)
+			close(done)
+		})
+	}
+}
+
+// debugStatus is the admin endpoint's view of the settings.
+type debugStatus struct {
+	DebugSettings
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// debugRequest is the body of an admin endpoint change.
+type debugRequest struct {
+	DebugSettings
+	TTL string `json:"ttl,omitempty"`
+}
+
+// ServeHTTP serves the settings as JSON. GET returns them, PUT or POST
+// replaces them with the body, e.g.
+//
+//	{"level": "debug", "dump_client_ip": "10.0.0.1", "ttl": "5m"}
+//
+// and DELETE reverts them.
+func (c *DebugControl) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body debugRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if body.TTL != "" {
+			parsed, err := time.ParseDuration(body.TTL)
+			if err != nil || parsed < 0 {
+				http.Error(w, fmt.Sprintf("invalid ttl %q", body.TTL), http.StatusBadRequest)
+				return
+			}
+			ttl = parsed
+		}
+		if err := c.Set(body.DebugSettings, ttl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		LoggerFrom(req.Context()).Log().Interface("settings", body.DebugSettings).Msg("Debug settings changed")
+	case http.MethodDelete:
+		c.Reset()
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, expires := c.Settings()
+	status := debugStatus{DebugSettings: settings}
+	if !expires.IsZero() {
+		status.Expires = &expires
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package zentinel
+
+import "os"
+
+// levelSignals cycle a DebugControl's log level. There are none without
+// SIGUSR1.
+var levelSignals []os.Signal
@@ -0,0 +1,146 @@
+package zentinel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestDebugControl_Level(t *testing.T) {
+	var buf bytes.Buffer
+	control := NewDebugControl(0)
+	logger := control.Logger(zerolog.New(&buf).Level(zerolog.InfoLevel))
+	child := logger.With().Str("stream_id", "conn-1").Logger()
+
+	child.Debug().Msg("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("expected debug to be filtered at info, got %q", buf.String())
+	}
+
+	if err := control.Set(DebugSettings{Level: "debug"}, time.Hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	child.Debug().Msg("shown")
+	if !strings.Contains(buf.String(), "shown") {
+		t.Errorf("expected an existing child logger to follow the new level, got %q", buf.String())
+	}
+	if _, expires := control.Settings(); expires.IsZero() {
+		t.Error("expected the change to expire")
+	}
+
+	control.Reset()
+	buf.Reset()
+	child.Debug().Msg("hidden")
+	if buf.Len() != 0 || control.Level() != zerolog.InfoLevel {
+		t.Errorf("expected reset to restore info, got %q", buf.String())
+	}
+
+	if err := control.Set(DebugSettings{Level: "loud"}, 0); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
+
+func TestDebugControl_Reverts(t *testing.T) {
+	control := NewDebugControl(0)
+	control.Logger(zerolog.New(nil).Level(zerolog.WarnLevel))
+
+	control.Set(DebugSettings{Level: "debug", DumpClientIP: "10.0.0.1"}, 20*time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for control.Level() != zerolog.WarnLevel && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	settings, expires := control.Settings()
+	if settings.Level != "warn" || settings.DumpClientIP != "" || !expires.IsZero() {
+		t.Errorf("expected the settings to revert, got %+v until %v", settings, expires)
+	}
+
+	// A later change outlives an earlier one's TTL
+	control.Set(DebugSettings{Level: "debug"}, 20*time.Millisecond)
+	control.Set(DebugSettings{Level: "trace"}, time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	if control.Level() != zerolog.TraceLevel {
+		t.Errorf("expected trace to remain, got %s", control.Level())
+	}
+}
+
+func TestDebugControl_Cycle(t *testing.T) {
+	control := NewDebugControl(time.Hour)
+	control.Logger(zerolog.New(nil).Level(zerolog.InfoLevel))
+
+	var levels []string
+	for i := 0; i < 4; i++ {
+		levels = append(levels, control.Cycle().String())
+	}
+	if got := strings.Join(levels, ","); got != "debug,trace,info,debug" {
+		t.Errorf("unexpected cycle %s", got)
+	}
+}
+
+func TestDebugControl_Dumps(t *testing.T) {
+	var buf bytes.Buffer
+	control := NewDebugControl(time.Hour)
+	logger := control.Logger(zerolog.New(&buf).Level(zerolog.ErrorLevel))
+	ctx := logger.WithContext(context.Background())
+	agent := Wrap(&CustomAgent{}, control.Middleware())
+
+	agent.OnRequest(ctx, newTestRequest("GET", "/blocked"))
+	if buf.Len() != 0 {
+		t.Fatalf("expected no dump without a selection, got %q", buf.String())
+	}
+
+	control.Set(DebugSettings{DumpCorrelationID: "req-1"}, 0)
+	agent.OnRequest(ctx, newTestRequest("GET", "/blocked"))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one dump at error level, got %q", buf.String())
+	}
+	if entry["hook"] != "request" || entry["uri"] != "/blocked" || entry["decision"] == nil {
+		t.Errorf("unexpected dump %v", entry)
+	}
+
+	buf.Reset()
+	control.Set(DebugSettings{DumpClientIP: "192.0.2.1"}, 0)
+	agent.OnRequest(ctx, newTestRequest("GET", "/"))
+	if buf.Len() != 0 {
+		t.Errorf("expected no dump for another client, got %q", buf.String())
+	}
+}
+
+func TestDebugControl_ServeHTTP(t *testing.T) {
+	quietLogs(t)
+	control := NewDebugControl(0)
+	control.Logger(zerolog.New(nil).Level(zerolog.InfoLevel))
+
+	body := `{"level": "debug", "dump_correlation_id": "req-1", "ttl": "5m"}`
+	recorder := httptest.NewRecorder()
+	control.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/debug/logging", strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var status debugStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("unexpected response %q", recorder.Body.String())
+	}
+	if status.Level != "debug" || status.DumpCorrelationID != "req-1" || status.Expires == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	recorder = httptest.NewRecorder()
+	control.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/debug/logging", strings.NewReader(`{"ttl": "soon"}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad request for an invalid ttl, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	control.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/debug/logging", nil))
+	if control.Level() != zerolog.InfoLevel {
+		t.Errorf("expected delete to revert, got %s", control.Level())
+	}
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package zentinel
+
+import (
+	"os"
+	"syscall"
+)
+
+// levelSignals cycle a DebugControl's log level.
+var levelSignals = []os.Signal{syscall.SIGUSR1}
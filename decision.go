@@ -259,6 +259,53 @@ func (d *Decision) WithResponseBodyMutation(data []byte, chunkIndex int) *Decisi
 	return d
 }
 
+// IsAllow reports whether the decision allows the request.
+func (d *Decision) IsAllow() bool {
+	return d.decision == "allow"
+}
+
+// Merge folds other into d, for combining the decisions of several agents.
+// Header operations, audit tags, rule IDs and reason codes are appended in
+// order; routing metadata, custom audit metadata, confidence and body
+// mutations set by other replace those of d. If other does not allow the
+// request, or d has no action, its action replaces that of d.
+func (d *Decision) Merge(other *Decision) *Decision {
+	if !other.IsAllow() || d.decision == nil {
+		d.decision = other.decision
+	}
+	if d.requestHeaders == nil {
+		d.requestHeaders = []HeaderOp{}
+	}
+	if d.responseHeaders == nil {
+		d.responseHeaders = []HeaderOp{}
+	}
+	if d.routingMetadata == nil {
+		d.routingMetadata = map[string]string{}
+	}
+	d.requestHeaders = append(d.requestHeaders, other.requestHeaders...)
+	d.responseHeaders = append(d.responseHeaders, other.responseHeaders...)
+	for key, value := range other.routingMetadata {
+		d.routingMetadata[key] = value
+	}
+	d.audit.Tags = append(d.audit.Tags, other.audit.Tags...)
+	d.audit.RuleIDs = append(d.audit.RuleIDs, other.audit.RuleIDs...)
+	d.audit.ReasonCodes = append(d.audit.ReasonCodes, other.audit.ReasonCodes...)
+	if other.audit.Confidence != nil {
+		d.audit.Confidence = other.audit.Confidence
+	}
+	for key, value := range other.audit.Custom {
+		d.WithMetadata(key, value)
+	}
+	d.needsMore = d.needsMore || other.needsMore
+	if other.requestBodyMutation != nil {
+		d.requestBodyMutation = other.requestBodyMutation
+	}
+	if other.responseBodyMutation != nil {
+		d.responseBodyMutation = other.responseBodyMutation
+	}
+	return d
+}
+
 // Build builds the AgentResponse.
 func (d *Decision) Build() AgentResponse {
 	return AgentResponse{
@@ -323,3 +323,38 @@ func TestDecision_WithReasonCode(t *testing.T) {
 		t.Errorf("expected reason_codes ['IP_BLOCKED'], got %v", response.Audit.ReasonCodes)
 	}
 }
+
+func TestDecision_Merge(t *testing.T) {
+	merged := Allow().AddRequestHeader("X-First", "1").WithTag("first").WithRoutingMetadata("pool", "a").
+		Merge(Deny().WithBody("no").AddRequestHeader("X-Second", "2").WithTag("second").WithRoutingMetadata("pool", "b"))
+	response := merged.Build()
+
+	if merged.IsAllow() {
+		t.Fatal("expected the merged decision to block")
+	}
+	decision := response.Decision.(map[string]interface{})["block"].(map[string]interface{})
+	if decision["status"] != 403 || decision["body"] != "no" {
+		t.Errorf("expected 403 with body, got %v", decision)
+	}
+	if len(response.RequestHeaders) != 2 || response.RequestHeaders[0].Name != "X-First" || response.RequestHeaders[1].Name != "X-Second" {
+		t.Errorf("expected headers in order, got %v", response.RequestHeaders)
+	}
+	if len(response.Audit.Tags) != 2 || response.Audit.Tags[0] != "first" || response.Audit.Tags[1] != "second" {
+		t.Errorf("expected tags in order, got %v", response.Audit.Tags)
+	}
+	if response.RoutingMetadata["pool"] != "b" {
+		t.Errorf("expected later routing metadata to win, got %v", response.RoutingMetadata)
+	}
+}
+
+func TestDecision_MergeIntoZero(t *testing.T) {
+	merged := (&Decision{}).Merge(Allow().WithRoutingMetadata("pool", "a").WithMetadata("score", 3))
+	response := merged.Build()
+
+	if !merged.IsAllow() || response.RoutingMetadata["pool"] != "a" || response.Audit.Custom["score"] != 3 {
+		t.Errorf("expected the allow to be merged, got %+v", response)
+	}
+	if response.RequestHeaders == nil || response.ResponseHeaders == nil {
+		t.Errorf("expected empty header operations, got %v and %v", response.RequestHeaders, response.ResponseHeaders)
+	}
+}
@@ -0,0 +1,238 @@
+package zentinel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Hook identifies an agent callback, for per-hook policies and logging.
+type Hook string
+
+const (
+	HookConfigure        Hook = "configure"
+	HookRequest          Hook = "request"
+	HookRequestBody      Hook = "request_body"
+	HookResponse         Hook = "response"
+	HookResponseBody     Hook = "response_body"
+	HookRequestComplete  Hook = "request_complete"
+	HookGuardrailInspect Hook = "guardrail_inspect"
+)
+
+// FailureMode is what the proxy is told when a hook fails to produce a
+// decision, for example because it panicked.
+type FailureMode string
+
+const (
+	// FailOpen allows the request.
+	FailOpen FailureMode = "open"
+
+	// FailClosed blocks the request with status 500.
+	FailClosed FailureMode = "closed"
+)
+
+// ParseFailureMode returns the failure mode named s, "open" or "closed".
+func ParseFailureMode(s string) (FailureMode, error) {
+	switch mode := FailureMode(s); mode {
+	case FailOpen, FailClosed:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown failure mode %q (want open or closed)", s)
+}
+
+// String returns the mode's name. With Set and Type, it makes *FailureMode a
+// pflag.Value, so --failure-mode rejects unknown modes.
+func (m *FailureMode) String() string {
+	return string(*m)
+}
+
+// Set sets the mode from its name.
+func (m *FailureMode) Set(s string) error {
+	mode, err := ParseFailureMode(s)
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// Type returns the flag's value type for usage messages.
+func (m *FailureMode) Type() string {
+	return "string"
+}
+
+// FailurePolicy chooses the failure mode for each hook. It applies when a
+// hook panics and when it misses its deadline (see HookDeadlines).
+//
+// Example:
+//
+//	policy := zentinel.DefaultFailurePolicy().
+//	    WithHook(zentinel.HookRequestBody, zentinel.FailClosed)
+type FailurePolicy struct {
+	// Default applies to hooks without an entry in Hooks. The zero value
+	// fails open.
+	Default FailureMode
+
+	// Hooks overrides Default for individual hooks.
+	Hooks map[Hook]FailureMode
+}
+
+// DefaultFailurePolicy returns a policy that fails open for every hook.
+func DefaultFailurePolicy() FailurePolicy {
+	return FailurePolicy{Default: FailOpen}
+}
+
+// WithHook returns a copy of the policy with mode set for hook.
+func (p FailurePolicy) WithHook(hook Hook, mode FailureMode) FailurePolicy {
+	hooks := make(map[Hook]FailureMode, len(p.Hooks)+1)
+	for h, m := range p.Hooks {
+		hooks[h] = m
+	}
+	hooks[hook] = mode
+	p.Hooks = hooks
+	return p
+}
+
+// Mode returns the failure mode for hook.
+func (p FailurePolicy) Mode(hook Hook) FailureMode {
+	if mode, ok := p.Hooks[hook]; ok {
+		return mode
+	}
+	if p.Default == "" {
+		return FailOpen
+	}
+	return p.Default
+}
+
+// Decision returns the decision to send when hook fails: Allow when failing
+// open, Block(500) when failing closed.
+func (p FailurePolicy) Decision(hook Hook) *Decision {
+	if p.Mode(hook) == FailClosed {
+		return Block(500)
+	}
+	return Allow()
+}
+
+// GuardrailResponse returns the response to send when guardrail inspection
+// fails: nothing detected when failing open, a high severity detection when
+// failing closed.
+func (p FailurePolicy) GuardrailResponse() *GuardrailResponse {
+	if p.Mode(HookGuardrailInspect) == FailClosed {
+		return NewGuardrailResponseWithDetection(
+			NewGuardrailDetection("agent_error", "guardrail inspection failed").
+				WithSeverity(DetectionSeverityHigh))
+	}
+	return NewGuardrailResponse()
+}
+
+// ErrMalformedInput is returned by the handlers, wrapped, for input that could
+// not be parsed when the malformed input action is MalformedClose. Runners
+// close the connection when they see it.
+var ErrMalformedInput = errors.New("malformed input")
+
+// MalformedInputAction is what a handler does with an event or message whose
+// payload cannot be parsed.
+type MalformedInputAction string
+
+const (
+	// MalformedAllow allows the request, tagged with the failure class in
+	// audit.
+	MalformedAllow MalformedInputAction = "allow"
+
+	// MalformedBlock blocks the request with status 500, tagged with the
+	// failure class in audit.
+	MalformedBlock MalformedInputAction = "block"
+
+	// MalformedClose closes the connection.
+	MalformedClose MalformedInputAction = "close"
+)
+
+// ParseMalformedInputAction returns the action named s, "allow", "block" or
+// "close".
+func ParseMalformedInputAction(s string) (MalformedInputAction, error) {
+	switch action := MalformedInputAction(s); action {
+	case MalformedAllow, MalformedBlock, MalformedClose:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown malformed input action %q (want allow, block or close)", s)
+}
+
+// String returns the action's name. With Set and Type, it makes
+// *MalformedInputAction a pflag.Value, so --malformed-input rejects unknown
+// actions.
+func (a *MalformedInputAction) String() string {
+	return string(*a)
+}
+
+// Set sets the action from its name.
+func (a *MalformedInputAction) Set(s string) error {
+	action, err := ParseMalformedInputAction(s)
+	if err != nil {
+		return err
+	}
+	*a = action
+	return nil
+}
+
+// Type returns the flag's value type for usage messages.
+func (a *MalformedInputAction) Type() string {
+	return "string"
+}
+
+// Decision returns the decision to send for malformed input of class under
+// the action, tagged with the class. The zero value allows.
+func (a MalformedInputAction) Decision(class FailureClass) *Decision {
+	if a == MalformedBlock {
+		return Block(500).WithTag(string(class))
+	}
+	return Allow().WithTag(string(class))
+}
+
+// FailureClass names a kind of failure counted by the handlers.
+type FailureClass string
+
+const (
+	// FailureMalformedPayload is an event or message that could not be parsed.
+	FailureMalformedPayload FailureClass = "malformed"
+
+	// FailureInvalidBody is a body chunk whose data is not valid base64.
+	FailureInvalidBody FailureClass = "invalid_body"
+
+	// FailureUnknownMessage is an event or message of an unknown type.
+	FailureUnknownMessage FailureClass = "unknown_message"
+
+	// FailurePanic is a hook that panicked.
+	FailurePanic FailureClass = "panic"
+
+	// FailureTimeout is a hook that missed its deadline.
+	FailureTimeout FailureClass = "timeout"
+)
+
+// FailureCounts counts failures by class. It is safe for concurrent use.
+type FailureCounts struct {
+	mu     sync.Mutex
+	counts map[FailureClass]uint64
+}
+
+// Add counts one failure of class.
+func (c *FailureCounts) Add(class FailureClass) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[FailureClass]uint64)
+	}
+	c.counts[class]++
+}
+
+// Snapshot returns the current counts.
+func (c *FailureCounts) Snapshot() map[FailureClass]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[FailureClass]uint64, len(c.counts))
+	for class, n := range c.counts {
+		counts[class] = n
+	}
+	return counts
+}
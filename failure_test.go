@@ -0,0 +1,230 @@
+package zentinel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+type panickingAgent struct {
+	BaseAgent
+}
+
+func (a *panickingAgent) Name() string {
+	return "panicking-agent"
+}
+
+func (a *panickingAgent) OnRequest(ctx context.Context, request *Request) *Decision {
+	panic("boom")
+}
+
+func (a *panickingAgent) OnRequestBody(ctx context.Context, request *Request) *Decision {
+	panic("boom")
+}
+
+func (a *panickingAgent) OnConfigure(ctx context.Context, config map[string]interface{}) error {
+	panic("boom")
+}
+
+func (a *panickingAgent) OnGuardrailInspect(ctx context.Context, event *GuardrailInspectEvent) *GuardrailResponse {
+	panic("boom")
+}
+
+func TestFailurePolicy_Mode(t *testing.T) {
+	var zero FailurePolicy
+	if zero.Mode(HookRequest) != FailOpen {
+		t.Error("expected zero policy to fail open")
+	}
+
+	policy := DefaultFailurePolicy().WithHook(HookRequestBody, FailClosed)
+	if policy.Mode(HookRequest) != FailOpen {
+		t.Error("expected request hook to fail open")
+	}
+	if policy.Mode(HookRequestBody) != FailClosed {
+		t.Error("expected request body hook to fail closed")
+	}
+
+	// WithHook must not modify the policy it was called on
+	policy.WithHook(HookRequest, FailClosed)
+	if policy.Mode(HookRequest) != FailOpen {
+		t.Error("WithHook modified the original policy")
+	}
+}
+
+func TestParseFailureMode(t *testing.T) {
+	for _, name := range []string{"open", "closed"} {
+		if mode, err := ParseFailureMode(name); err != nil || string(mode) != name {
+			t.Errorf("ParseFailureMode(%q) = %q, %v", name, mode, err)
+		}
+	}
+	for _, name := range []string{"close", "Closed", "", "deny"} {
+		if _, err := ParseFailureMode(name); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	mode := FailOpen
+	flags.Var(&mode, "failure-mode", "")
+	if err := flags.Parse([]string{"--failure-mode=close"}); err == nil || mode != FailOpen {
+		t.Errorf("expected --failure-mode=close to be rejected, got %q, %v", mode, err)
+	}
+	if err := flags.Parse([]string{"--failure-mode=closed"}); err != nil || mode != FailClosed {
+		t.Errorf("expected --failure-mode=closed to set closed, got %q, %v", mode, err)
+	}
+}
+
+func TestAgentHandler_RecoversPanic(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandler(&panickingAgent{})
+
+	response, err := handler.HandleEvent(context.Background(), mustDecode(fuzzEvents[1]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	agentResponse := response.(AgentResponse)
+	if agentResponse.Decision != "allow" {
+		t.Errorf("expected allow, got %v", agentResponse.Decision)
+	}
+	if len(agentResponse.Audit.Tags) != 1 || agentResponse.Audit.Tags[0] != "panic" {
+		t.Errorf("expected panic tag, got %v", agentResponse.Audit.Tags)
+	}
+}
+
+func TestAgentHandler_RecoversPanicFailClosed(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandler(&panickingAgent{}).
+		WithFailurePolicy(DefaultFailurePolicy().WithHook(HookRequestBody, FailClosed))
+
+	response, _ := handler.HandleEvent(context.Background(), mustDecode(fuzzEvents[1]))
+	if response.(AgentResponse).Decision != "allow" {
+		t.Errorf("expected request hook to fail open, got %v", response.(AgentResponse).Decision)
+	}
+
+	response, _ = handler.HandleEvent(context.Background(), mustDecode(fuzzEvents[2]))
+	decision, ok := response.(AgentResponse).Decision.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected block decision, got %v", response.(AgentResponse).Decision)
+	}
+	block := decision["block"].(map[string]interface{})
+	if block["status"] != 500 {
+		t.Errorf("expected status 500, got %v", block["status"])
+	}
+}
+
+func TestAgentHandler_AuditsFallbacks(t *testing.T) {
+	quietLogs(t)
+	sink := &memoryAuditSink{}
+	handler := NewAgentHandler(&panickingAgent{}).
+		WithFailurePolicy(FailurePolicy{Default: FailClosed}).
+		WithMalformedInput(MalformedBlock).
+		WithAudit(sink, false)
+
+	handler.HandleEvent(context.Background(), mustDecode(fuzzEvents[1]))
+	handler.HandleEvent(context.Background(), mustDecode(`{"event_type":"request_headers","payload":{"metadata":"oops"}}`))
+
+	if len(sink.records) != 2 {
+		t.Fatalf("expected the panic and malformed blocks to be recorded, got %d records", len(sink.records))
+	}
+	if record := sink.records[0]; record.Hook != HookRequest || record.Decision.Audit.Tags[0] != "panic" {
+		t.Errorf("unexpected panic record %+v", record)
+	}
+	if record := sink.records[1]; record.Hook != "" || record.Decision.Audit.Tags[0] != "malformed" {
+		t.Errorf("unexpected malformed record %+v", record)
+	}
+}
+
+func TestAgentHandler_RecoversConfigureAndGuardrailPanics(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandler(&panickingAgent{}).
+		WithFailurePolicy(FailurePolicy{Default: FailClosed})
+
+	response, err := handler.HandleEvent(context.Background(), mustDecode(fuzzEvents[0]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.(map[string]interface{})["success"] != false {
+		t.Errorf("expected configure to fail, got %v", response)
+	}
+
+	response, err = handler.HandleEvent(context.Background(), mustDecode(fuzzEvents[6]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if guardrail := response.(*GuardrailResponse); !guardrail.Detected {
+		t.Error("expected failing closed guardrail inspection to report a detection")
+	}
+}
+
+func TestAgentHandler_MalformedInput(t *testing.T) {
+	quietLogs(t)
+	malformed := mustDecode(`{"event_type":"request_headers","payload":{"metadata":"oops"}}`)
+
+	response, err := NewAgentHandler(&BaseAgent{}).HandleEvent(context.Background(), malformed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if agentResponse := response.(AgentResponse); agentResponse.Decision != "allow" || agentResponse.Audit.Tags[0] != "malformed" {
+		t.Errorf("expected allow tagged malformed, got %+v", agentResponse)
+	}
+
+	handler := NewAgentHandler(&BaseAgent{}).WithMalformedInput(MalformedBlock)
+	response, _ = handler.HandleEvent(context.Background(), malformed)
+	if _, ok := response.(AgentResponse).Decision.(map[string]interface{}); !ok {
+		t.Errorf("expected block decision, got %v", response.(AgentResponse).Decision)
+	}
+
+	handler = NewAgentHandler(&BaseAgent{}).WithMalformedInput(MalformedClose)
+	if _, err := handler.HandleEvent(context.Background(), malformed); !errors.Is(err, ErrMalformedInput) {
+		t.Errorf("expected ErrMalformedInput, got %v", err)
+	}
+	if handler.Failures()[FailureMalformedPayload] != 1 {
+		t.Errorf("expected one malformed failure, got %v", handler.Failures())
+	}
+}
+
+func TestAgentHandler_UnknownEvent(t *testing.T) {
+	quietLogs(t)
+	unknown := mustDecode(`{"event_type":"not_an_event","payload":{}}`)
+
+	handler := NewAgentHandler(&BaseAgent{}).WithMalformedInput(MalformedBlock)
+	response, err := handler.HandleEvent(context.Background(), unknown)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if agentResponse := response.(AgentResponse); agentResponse.Audit.Tags[0] != "unknown_message" {
+		t.Errorf("expected a decision tagged unknown_message, got %+v", agentResponse)
+	} else if _, ok := agentResponse.Decision.(map[string]interface{}); !ok {
+		t.Errorf("expected block decision, got %v", agentResponse.Decision)
+	}
+
+	handler = NewAgentHandler(&BaseAgent{}).WithMalformedInput(MalformedClose)
+	if _, err := handler.HandleEvent(context.Background(), unknown); !errors.Is(err, ErrMalformedInput) {
+		t.Errorf("expected ErrMalformedInput, got %v", err)
+	}
+	if handler.Failures()[FailureUnknownMessage] != 1 {
+		t.Errorf("expected one unknown message failure, got %v", handler.Failures())
+	}
+}
+
+func TestParseMalformedInputAction(t *testing.T) {
+	for _, name := range []string{"allow", "block", "close"} {
+		if action, err := ParseMalformedInputAction(name); err != nil || string(action) != name {
+			t.Errorf("ParseMalformedInputAction(%q) = %q, %v", name, action, err)
+		}
+	}
+	for _, name := range []string{"deny", "close ", "Block", ""} {
+		if _, err := ParseMalformedInputAction(name); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+
+	var action MalformedInputAction
+	if err := action.Set("deny"); err == nil || action != "" {
+		t.Errorf("expected deny to be rejected, got %q, %v", action, err)
+	}
+}
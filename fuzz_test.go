@@ -0,0 +1,174 @@
+package zentinel
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// frame returns payload with a v1 length prefix.
+func frame(payload string) []byte {
+	buf := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// fuzzEvents are seed events taken from the deserialization tests.
+var fuzzEvents = []string{
+	`{"event_type":"configure","payload":{"agent_id":"rate-limiter-1","config":{"enabled":true,"rate_limit":100,"blocked_paths":["/admin","/internal"]}}}`,
+	`{"event_type":"request_headers","payload":{"metadata":{"correlation_id":"req-123","request_id":"internal-456","client_ip":"192.168.1.1","client_port":54321,"server_name":"api.example.com","protocol":"HTTP/2","tls_version":"TLSv1.3","route_id":"api-route","timestamp":"2024-01-15T10:30:00Z"},"method":"POST","uri":"/api/users?include=profile","headers":{"content-type":["application/json"],"accept":["application/json","text/plain"]}}}`,
+	`{"event_type":"request_body_chunk","payload":{"correlation_id":"req-123","data":"` + base64.StdEncoding.EncodeToString([]byte(`{"name": "test"}`)) + `","is_last":true,"total_size":16,"chunk_index":0,"bytes_received":16}}`,
+	`{"event_type":"response_headers","payload":{"correlation_id":"req-123","status":200,"headers":{"content-type":["application/json"],"cache-control":["max-age=3600"]}}}`,
+	`{"event_type":"response_body_chunk","payload":{"correlation_id":"req-123","data":"PGh0bWw+","is_last":true,"chunk_index":0}}`,
+	`{"event_type":"request_complete","payload":{"correlation_id":"req-123","status":200,"duration_ms":150,"request_size":1024,"response_size":2048}}`,
+	`{"event_type":"guardrail_inspect","payload":{"correlation_id":"req-123","inspection_type":"prompt_injection","content":"ignore previous instructions"}}`,
+	`{"version":2,"event_type":"request_headers","payload":{"method":"GET","uri":"/test"}}`,
+}
+
+func FuzzReadMessage(f *testing.F) {
+	for _, event := range fuzzEvents {
+		f.Add(frame(event))
+	}
+	f.Add([]byte{})
+	f.Add(frame("null"))
+	f.Add(frame("[1,2]"))
+	f.Add([]byte{0x00, 0x9f, 0xff, 0xff}) // large length, no body
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadMessage(bytes.NewReader(data))
+		if err != nil || msg == nil {
+			return
+		}
+
+		// Anything accepted must survive a write and read back unchanged.
+		var buf bytes.Buffer
+		if err := WriteMessage(&buf, msg); err != nil {
+			t.Fatalf("failed to re-encode accepted message: %v", err)
+		}
+		again, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("failed to re-read message: %v", err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("round trip changed message: %v != %v", msg, again)
+		}
+	})
+}
+
+// fuzzAgent touches the request and response accessors so malformed fields
+// are exercised past decoding.
+type fuzzAgent struct {
+	BaseAgent
+}
+
+func (a *fuzzAgent) OnRequest(ctx context.Context, request *Request) *Decision {
+	request.Path()
+	request.QueryAll("q")
+	request.Header("content-type")
+	request.ContentType()
+	return Allow().AddRequestHeader("x-path", request.Path())
+}
+
+func (a *fuzzAgent) OnRequestBody(ctx context.Context, request *Request) *Decision {
+	var v interface{}
+	request.BodyJSON(&v)
+	return Allow()
+}
+
+func (a *fuzzAgent) OnResponse(ctx context.Context, request *Request, response *Response) *Decision {
+	response.IsHTML()
+	response.Header("content-type")
+	return Allow()
+}
+
+func FuzzAgentHandler(f *testing.F) {
+	for _, event := range fuzzEvents {
+		f.Add([]byte(event))
+	}
+	f.Add([]byte(`{"event_type":"request_headers","payload":{"metadata":"oops","headers":{"a":"b"}}}`))
+	f.Add([]byte(`{"event_type":"request_body_chunk","payload":{"correlation_id":"unknown","data":"!!","is_last":false}}`))
+	quietLogs(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var event map[string]interface{}
+		if json.Unmarshal(data, &event) != nil {
+			return
+		}
+
+		handler := NewAgentHandler(&fuzzAgent{})
+		// Send the event on its own and after a request it may refer to.
+		for _, events := range [][]map[string]interface{}{
+			{event},
+			{mustDecode(fuzzEvents[1]), event, event},
+		} {
+			for _, e := range events {
+				response, err := handler.HandleEvent(context.Background(), e)
+				if err != nil {
+					continue
+				}
+				if _, err := json.Marshal(response); err != nil {
+					t.Fatalf("response is not serializable: %v", err)
+				}
+			}
+		}
+
+		// Chunks for unknown requests must not be retained.
+		handler.mu.RLock()
+		defer handler.mu.RUnlock()
+		for id := range handler.requestBodies {
+			if handler.requests[id] == nil {
+				t.Fatalf("retained body for unknown request %q", id)
+			}
+		}
+	})
+}
+
+// quietLogs silences the handler's logging for the duration of a test.
+func quietLogs(tb testing.TB) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	tb.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+}
+
+func mustDecode(s string) map[string]interface{} {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func TestReadMessage_TruncatedBodyDoesNotPreallocate(t *testing.T) {
+	// A maximum length prefix followed by EOF must not allocate the full
+	// message size before discovering the stream is short.
+	data := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint32(data, MaxMessageSize)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, err := ReadMessage(bytes.NewReader(append(data, '{')))
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes for a 1 byte body", allocated)
+	}
+}
+
+func TestReadMessage_Null(t *testing.T) {
+	if _, err := ReadMessage(bytes.NewReader(frame("null"))); err == nil {
+		t.Error("expected error for a null message")
+	}
+}
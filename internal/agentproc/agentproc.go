@@ -0,0 +1,172 @@
+// Package agentproc launches agent binaries built on this SDK for the
+// command-line tools.
+package agentproc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// DefaultStartTimeout is how long Start waits for the agent to listen.
+const DefaultStartTimeout = 10 * time.Second
+
+// Options configures how an agent binary is launched.
+type Options struct {
+	// Args are passed to the agent before the transport flag.
+	Args []string
+
+	// GRPC launches the agent with --grpc on a free local port instead of
+	// --socket.
+	GRPC bool
+
+	// Output receives the agent's stdout and stderr. Nil discards it.
+	Output io.Writer
+
+	// StartTimeout overrides DefaultStartTimeout.
+	StartTimeout time.Duration
+}
+
+// Process is a running agent binary.
+type Process struct {
+	// SocketPath is the Unix socket the agent listens on, for UDS.
+	SocketPath string
+
+	// GRPCAddress is the address the agent listens on, for gRPC.
+	GRPCAddress string
+
+	cmd    *exec.Cmd
+	dir    string
+	exited chan struct{}
+	err    error
+}
+
+// Start launches the agent at path and waits until it accepts connections.
+func Start(ctx context.Context, path string, opts Options) (*Process, error) {
+	dir, err := os.MkdirTemp("", "zentinel-agent")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+
+	p := &Process{dir: dir, exited: make(chan struct{})}
+	args := append([]string(nil), opts.Args...)
+	if opts.GRPC {
+		addr, err := freeAddress()
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		p.GRPCAddress = addr
+		args = append(args, "--grpc", addr)
+	} else {
+		p.SocketPath = filepath.Join(dir, "agent.sock")
+		args = append(args, "--socket", p.SocketPath)
+	}
+
+	p.cmd = exec.CommandContext(ctx, path, args...)
+	p.cmd.Stdout = opts.Output
+	p.cmd.Stderr = opts.Output
+	if err := p.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start %s: %w", path, err)
+	}
+	go func() {
+		p.err = p.cmd.Wait()
+		close(p.exited)
+	}()
+
+	timeout := opts.StartTimeout
+	if timeout == 0 {
+		timeout = DefaultStartTimeout
+	}
+	if err := p.waitListening(timeout); err != nil {
+		p.Stop(time.Second)
+		return nil, err
+	}
+	return p, nil
+}
+
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func (p *Process) waitListening(timeout time.Duration) error {
+	network, address := "unix", p.SocketPath
+	if p.GRPCAddress != "" {
+		network, address = "tcp", p.GRPCAddress
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-p.exited:
+			return fmt.Errorf("agent exited before listening: %v", p.err)
+		default:
+		}
+
+		// Probe with a plain connection; UDS agents close it when no
+		// handshake follows.
+		conn, err := net.DialTimeout(network, address, 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("agent not listening on %s after %s", address, timeout)
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+}
+
+// Signal sends sig to the agent.
+func (p *Process) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+// Exited returns a channel that is closed when the agent exits.
+func (p *Process) Exited() <-chan struct{} {
+	return p.exited
+}
+
+// Err returns the agent's exit error once it has exited.
+func (p *Process) Err() error {
+	select {
+	case <-p.exited:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// Stop sends SIGTERM, waits up to timeout for the agent to exit, kills it
+// otherwise, and removes its temporary files.
+func (p *Process) Stop(timeout time.Duration) error {
+	defer os.RemoveAll(p.dir)
+
+	select {
+	case <-p.exited:
+		return nil
+	default:
+	}
+
+	p.Signal(syscall.SIGTERM)
+	select {
+	case <-p.exited:
+		return nil
+	case <-time.After(timeout):
+		p.cmd.Process.Kill()
+		<-p.exited
+		return fmt.Errorf("agent did not exit within %s and was killed", timeout)
+	}
+}
@@ -0,0 +1,93 @@
+// Package hooks runs agent callbacks on behalf of the v1 and v2 handlers.
+package hooks
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"time"
+
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/logging"
+)
+
+// Outcome is how a hook run by Run finished.
+type Outcome int
+
+const (
+	// Completed means the hook returned normally.
+	Completed Outcome = iota
+
+	// Panicked means the hook panicked and the panic was recovered.
+	Panicked
+
+	// TimedOut means the hook was still running when its deadline passed.
+	TimedOut
+)
+
+// Call runs fn and recovers a panic in it. A panic is logged to ctx's logger
+// with its stack and the correlation ID, and Call returns true so the caller
+// can substitute a fallback result.
+func Call(ctx context.Context, hook, correlationID string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.From(ctx).Error().
+				Str("hook", hook).
+				Str("correlation_id", correlationID).
+				Interface("panic", r).
+				Str("stack", string(debug.Stack())).
+				Msg("Agent hook panicked")
+			panicked = true
+		}
+	}()
+	fn()
+	return false
+}
+
+// Run calls fn with a context that expires after timeout, recovering a panic
+// as Call does. If the deadline passes first, Run returns TimedOut without
+// waiting; fn keeps running in the background and its result is discarded.
+// A timeout of zero or less runs fn inline with ctx unchanged.
+func Run[T any](ctx context.Context, hook, correlationID string, timeout time.Duration, fn func(ctx context.Context) T) (T, Outcome) {
+	var value T
+	if timeout <= 0 {
+		if Call(ctx, hook, correlationID, func() { value = fn(ctx) }) {
+			return value, Panicked
+		}
+		return value, Completed
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- Call(ctx, hook, correlationID, func() { value = fn(hookCtx) })
+	}()
+
+	var panicked bool
+	select {
+	case panicked = <-done:
+	case <-hookCtx.Done():
+		select {
+		case panicked = <-done:
+			// Finished as the deadline passed
+		default:
+			if !errors.Is(hookCtx.Err(), context.DeadlineExceeded) {
+				// Cancelled by the caller rather than timed out
+				panicked = <-done
+				break
+			}
+			logging.From(ctx).Warn().
+				Str("hook", hook).
+				Str("correlation_id", correlationID).
+				Dur("timeout", timeout).
+				Msg("Agent hook exceeded its deadline")
+			var zero T
+			return zero, TimedOut
+		}
+	}
+	if panicked {
+		return value, Panicked
+	}
+	return value, Completed
+}
@@ -0,0 +1,20 @@
+// Package logging finds the logger the runners place in a hook's context.
+package logging
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// disabled is what zerolog.Ctx returns for a context without a logger.
+var disabled = zerolog.Ctx(context.Background())
+
+// From returns the logger in ctx, or the global logger if there is none.
+func From(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger != disabled {
+		return logger
+	}
+	return &log.Logger
+}
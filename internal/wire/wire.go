@@ -0,0 +1,36 @@
+// Package wire holds helpers shared by the v1 and v2 frame decoders.
+package wire
+
+import (
+	"bytes"
+	"io"
+)
+
+// chunkSize bounds how much ReadN allocates ahead of the bytes it has
+// actually received.
+const chunkSize = 64 * 1024
+
+// ReadN reads exactly n bytes from r. Unlike allocating n bytes up front and
+// calling io.ReadFull, memory grows with the data received, so a large length
+// prefix followed by a short stream costs little. A stream that ends early
+// returns io.ErrUnexpectedEOF.
+func ReadN(r io.Reader, n int) ([]byte, error) {
+	if n <= chunkSize {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(chunkSize)
+	read, err := io.Copy(&buf, io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if read < int64(n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,56 @@
+package zentinel
+
+import (
+	"context"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/logging"
+)
+
+// LoggerFrom returns the logger for ctx. In a hook called by a runner it is
+// the runner's logger with the request's correlation ID, request ID, stream
+// ID and route attached; elsewhere it is the global zerolog logger.
+//
+// Example:
+//
+//	func (a *MyAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+//	    zentinel.LoggerFrom(ctx).Debug().Str("path", request.Path()).Msg("Checking request")
+//	    return zentinel.Allow()
+//	}
+func LoggerFrom(ctx context.Context) *zerolog.Logger {
+	return logging.From(ctx)
+}
+
+// NewLogger builds a logger as the runners do from their log flags. backend
+// is LogBackendZerolog, the default, or LogBackendSlog; jsonLogs chooses
+// JSON over console or text output; level is a level name such as "debug",
+// defaulting to info.
+func NewLogger(backend string, jsonLogs bool, level string) zerolog.Logger {
+	parsed, err := zerolog.ParseLevel(level)
+	if err != nil || parsed == zerolog.NoLevel {
+		parsed = zerolog.InfoLevel
+	}
+
+	switch {
+	case backend == LogBackendSlog:
+		return NewSlogLogger(newSlogHandler(jsonLogs)).Level(parsed)
+	case jsonLogs:
+		return zerolog.New(os.Stdout).Level(parsed).With().Timestamp().Logger()
+	default:
+		return zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout}).Level(parsed).With().Timestamp().Logger()
+	}
+}
+
+// requestContext returns ctx with a child logger for request.
+func requestContext(ctx context.Context, request *Request) context.Context {
+	metadata := request.Metadata()
+	logCtx := LoggerFrom(ctx).With().Str("correlation_id", metadata.CorrelationID)
+	if metadata.RequestID != "" {
+		logCtx = logCtx.Str("request_id", metadata.RequestID)
+	}
+	if metadata.RouteID != nil {
+		logCtx = logCtx.Str("route_id", *metadata.RouteID)
+	}
+	return logCtx.Logger().WithContext(ctx)
+}
@@ -0,0 +1,81 @@
+package zentinel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// loggingAgent logs from OnRequest through the context's logger.
+type loggingAgent struct {
+	BaseAgent
+}
+
+func (a *loggingAgent) Name() string {
+	return "logging-agent"
+}
+
+func (a *loggingAgent) OnRequest(ctx context.Context, request *Request) *Decision {
+	LoggerFrom(ctx).Info().Msg("checked")
+	return Allow()
+}
+
+func TestLoggerFrom_Default(t *testing.T) {
+	if LoggerFrom(context.Background()) != &log.Logger {
+		t.Error("expected the global logger for a context without one")
+	}
+}
+
+func TestAgentHandler_RequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).With().Str("stream_id", "conn-1").Logger()
+	ctx := logger.WithContext(context.Background())
+
+	handler := NewAgentHandler(&loggingAgent{})
+	if _, err := handler.HandleEvent(ctx, mustDecode(fuzzEvents[1])); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one log entry, got %q", buf.String())
+	}
+	for key, want := range map[string]string{
+		"stream_id":      "conn-1",
+		"correlation_id": "req-123",
+		"request_id":     "internal-456",
+		"route_id":       "api-route",
+		"message":        "checked",
+	} {
+		if entry[key] != want {
+			t.Errorf("expected %s %q, got %v", key, want, entry[key])
+		}
+	}
+}
+
+func TestAgentRunner_OwnsLogger(t *testing.T) {
+	global := log.Logger
+	level := zerolog.GlobalLevel()
+	runner := NewAgentRunner(&loggingAgent{}).WithLogLevel("debug").WithJSONLogs()
+	runner.setupLogging()
+
+	if runner.Logger() == &log.Logger || runner.DebugControl().Level() != zerolog.DebugLevel {
+		t.Error("expected the runner to build its own debug logger")
+	}
+	if !reflect.DeepEqual(log.Logger, global) || zerolog.GlobalLevel() != level {
+		t.Error("expected the global logger to be left alone")
+	}
+
+	var buf bytes.Buffer
+	injected := NewAgentRunner(&loggingAgent{}).WithLogger(zerolog.New(&buf))
+	injected.setupLogging()
+	injected.Logger().Info().Msg("hello")
+	if buf.Len() == 0 {
+		t.Error("expected the injected logger to be used")
+	}
+}
@@ -0,0 +1,138 @@
+package zentinel
+
+import (
+	"context"
+	"time"
+
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/hooks"
+)
+
+// HookCall describes one call of a decision hook: OnRequest, OnRequestBody,
+// OnResponse or OnResponseBody.
+type HookCall struct {
+	// Hook is the hook being called.
+	Hook Hook
+
+	// Request is the request being processed. Middleware may replace it
+	// before calling the next handler.
+	Request *Request
+
+	// Response is the upstream response, or nil for the request hooks.
+	// Middleware may replace it before calling the next handler.
+	Response *Response
+}
+
+// HookHandler runs the rest of a middleware chain, ending in the agent's hook.
+type HookHandler func(ctx context.Context, call *HookCall) *Decision
+
+// Middleware wraps the decision hooks of an agent, in the manner of a gRPC
+// interceptor. It may inspect or change the call before passing it to next,
+// return a decision of its own without calling next, or inspect and change
+// the decision next returns. Other hooks are not passed through middleware.
+//
+// Example:
+//
+//	func requireAPIKey(ctx context.Context, call *zentinel.HookCall, next zentinel.HookHandler) *zentinel.Decision {
+//	    if call.Hook == zentinel.HookRequest && call.Request.Header("x-api-key") == "" {
+//	        return zentinel.Unauthorized()
+//	    }
+//	    return next(ctx, call)
+//	}
+type Middleware func(ctx context.Context, call *HookCall, next HookHandler) *Decision
+
+// Wrap returns an agent whose decision hooks run through mws. The first
+// middleware is the outermost. All other methods are the agent's own.
+func Wrap(agent Agent, mws ...Middleware) Agent {
+	if len(mws) == 0 {
+		return agent
+	}
+	return &wrappedAgent{Agent: agent, handler: chain(agent, mws)}
+}
+
+// chain builds the handler that runs mws around the agent's hooks.
+func chain(agent Agent, mws []Middleware) HookHandler {
+	handler := func(ctx context.Context, call *HookCall) *Decision {
+		switch call.Hook {
+		case HookRequestBody:
+			return agent.OnRequestBody(ctx, call.Request)
+		case HookResponse:
+			return agent.OnResponse(ctx, call.Request, call.Response)
+		case HookResponseBody:
+			return agent.OnResponseBody(ctx, call.Request, call.Response)
+		default:
+			return agent.OnRequest(ctx, call.Request)
+		}
+	}
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, next := mws[i], handler
+		handler = func(ctx context.Context, call *HookCall) *Decision {
+			return mw(ctx, call, next)
+		}
+	}
+	return handler
+}
+
+// wrappedAgent routes the decision hooks of an agent through a middleware
+// chain.
+type wrappedAgent struct {
+	Agent
+	handler HookHandler
+}
+
+func (a *wrappedAgent) OnRequest(ctx context.Context, request *Request) *Decision {
+	return a.handler(ctx, &HookCall{Hook: HookRequest, Request: request})
+}
+
+func (a *wrappedAgent) OnRequestBody(ctx context.Context, request *Request) *Decision {
+	return a.handler(ctx, &HookCall{Hook: HookRequestBody, Request: request})
+}
+
+func (a *wrappedAgent) OnResponse(ctx context.Context, request *Request, response *Response) *Decision {
+	return a.handler(ctx, &HookCall{Hook: HookResponse, Request: request, Response: response})
+}
+
+func (a *wrappedAgent) OnResponseBody(ctx context.Context, request *Request, response *Response) *Decision {
+	return a.handler(ctx, &HookCall{Hook: HookResponseBody, Request: request, Response: response})
+}
+
+// LoggingMiddleware logs each decision hook at debug level to the context's
+// logger with the decision and how long the hook took.
+func LoggingMiddleware() Middleware {
+	return func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		start := time.Now()
+		decision := next(ctx, call)
+		response := decision.Build()
+		LoggerFrom(ctx).Debug().
+			Str("hook", string(call.Hook)).
+			Interface("decision", response.Decision).
+			Strs("tags", response.Audit.Tags).
+			Dur("elapsed", time.Since(start)).
+			Msg("Hook completed")
+		return decision
+	}
+}
+
+// RecoveryMiddleware recovers a panic in the rest of the chain and returns
+// the failure policy's decision for the hook, tagged "panic". The handlers
+// already recover panics; this lets middleware placed before it see the
+// fallback decision.
+func RecoveryMiddleware(policy FailurePolicy) Middleware {
+	return func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		var decision *Decision
+		if hooks.Call(ctx, string(call.Hook), call.Request.CorrelationID(), func() { decision = next(ctx, call) }) {
+			return policy.Decision(call.Hook).WithTag(string(FailurePanic))
+		}
+		return decision
+	}
+}
+
+// LatencyMiddleware calls observe with the time each decision hook took and
+// the decision it returned.
+func LatencyMiddleware(observe func(hook Hook, elapsed time.Duration, decision *Decision)) Middleware {
+	return func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		start := time.Now()
+		decision := next(ctx, call)
+		observe(call.Hook, time.Since(start), decision)
+		return decision
+	}
+}
@@ -0,0 +1,116 @@
+package zentinel
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingMiddleware appends name to trace before and after the rest of the
+// chain.
+func recordingMiddleware(name string, trace *[]string) Middleware {
+	return func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		*trace = append(*trace, name+" before")
+		decision := next(ctx, call)
+		*trace = append(*trace, name+" after")
+		return decision
+	}
+}
+
+func newTestRequest(method, uri string) *Request {
+	return NewRequest(&RequestHeadersEvent{
+		Metadata: RequestMetadata{CorrelationID: "req-1"},
+		Method:   method,
+		URI:      uri,
+		Headers:  map[string][]string{},
+	}, nil)
+}
+
+func TestWrap_Order(t *testing.T) {
+	var trace []string
+	agent := Wrap(&CustomAgent{}, recordingMiddleware("outer", &trace), recordingMiddleware("inner", &trace))
+
+	agent.OnRequest(context.Background(), newTestRequest("GET", "/"))
+
+	want := []string{"outer before", "inner before", "inner after", "outer after"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("expected %v, got %v", want, trace)
+	}
+}
+
+func TestWrap_NoMiddleware(t *testing.T) {
+	agent := &CustomAgent{}
+	if Wrap(agent) != Agent(agent) {
+		t.Error("expected Wrap without middleware to return the agent")
+	}
+}
+
+func TestWrap_ShortCircuit(t *testing.T) {
+	auth := func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		if call.Request.Header("x-api-key") == "" {
+			return Unauthorized()
+		}
+		return next(ctx, call)
+	}
+	agent := Wrap(&CustomAgent{}, auth)
+
+	response := agent.OnRequest(context.Background(), newTestRequest("GET", "/")).Build()
+	block, ok := response.Decision.(map[string]interface{})["block"].(map[string]interface{})
+	if !ok || block["status"] != 401 {
+		t.Errorf("expected 401, got %v", response.Decision)
+	}
+}
+
+func TestWrap_ChangesRequestAndDecision(t *testing.T) {
+	rewrite := func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		call.Request = newTestRequest("GET", "/blocked/users")
+		return next(ctx, call).WithTag("rewritten")
+	}
+	agent := Wrap(&CustomAgent{}, rewrite)
+
+	// CustomAgent blocks /blocked paths
+	response := agent.OnRequest(context.Background(), newTestRequest("GET", "/public")).Build()
+	if _, ok := response.Decision.(map[string]interface{}); !ok {
+		t.Errorf("expected the rewritten request to be blocked, got %v", response.Decision)
+	}
+	if len(response.Audit.Tags) == 0 || response.Audit.Tags[len(response.Audit.Tags)-1] != "rewritten" {
+		t.Errorf("expected rewritten tag, got %v", response.Audit.Tags)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	quietLogs(t)
+	var seen *Decision
+	observe := func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		seen = next(ctx, call)
+		return seen
+	}
+	agent := Wrap(&panickingAgent{}, observe, RecoveryMiddleware(FailurePolicy{Default: FailClosed}))
+
+	agent.OnRequest(context.Background(), newTestRequest("GET", "/"))
+	if seen == nil {
+		t.Fatal("expected outer middleware to see the fallback decision")
+	}
+	if tags := seen.Build().Audit.Tags; len(tags) != 1 || tags[0] != "panic" {
+		t.Errorf("expected panic tag, got %v", tags)
+	}
+}
+
+func TestLatencyMiddleware(t *testing.T) {
+	var hooks []Hook
+	agent := Wrap(&CustomAgent{}, LatencyMiddleware(func(hook Hook, elapsed time.Duration, decision *Decision) {
+		if elapsed < 0 || decision == nil {
+			t.Errorf("unexpected observation %v %v", elapsed, decision)
+		}
+		hooks = append(hooks, hook)
+	}))
+
+	request := newTestRequest("GET", "/")
+	agent.OnRequest(context.Background(), request)
+	agent.OnResponse(context.Background(), request, NewResponse(&ResponseHeadersEvent{Status: 200}, nil))
+
+	if !reflect.DeepEqual(hooks, []Hook{HookRequest, HookResponse}) {
+		t.Errorf("unexpected hooks %v", hooks)
+	}
+}
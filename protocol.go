@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/wire"
 )
 
 // ProtocolVersion is the version of the Zentinel agent protocol.
@@ -330,8 +332,8 @@ func ReadMessage(r io.Reader) (map[string]interface{}, error) {
 	}
 
 	// Read message body
-	msgBuf := make([]byte, length)
-	if _, err := io.ReadFull(r, msgBuf); err != nil {
+	msgBuf, err := wire.ReadN(r, int(length))
+	if err != nil {
 		return nil, fmt.Errorf("failed to read message body: %w", err)
 	}
 
@@ -339,6 +341,10 @@ func ReadMessage(r io.Reader) (map[string]interface{}, error) {
 	if err := json.Unmarshal(msgBuf, &result); err != nil {
 		return nil, fmt.Errorf("failed to parse message JSON: %w", err)
 	}
+	// A JSON null decodes to a nil map, which callers would take for EOF.
+	if result == nil {
+		return nil, fmt.Errorf("message is not a JSON object")
+	}
 
 	return result, nil
 }
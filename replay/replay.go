@@ -0,0 +1,177 @@
+// Package replay replays captured agent traffic against an agent and reports
+// where its decisions differ from the recorded ones.
+//
+// Captures are written by runners configured with a capture path (the
+// --capture flag) or a zentinel.Capture:
+//
+//	target := replay.AgentV2Target(NewMyAgent())
+//	report, err := replay.Run(ctx, f, target)
+//	if err == nil && !report.OK() {
+//	    for _, diff := range report.Diffs {
+//	        fmt.Println(diff)
+//	    }
+//	}
+//
+// The zentinel-agent-replay command does the same against an agent binary.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// Diff describes a replayed message whose outcome differs from the capture.
+type Diff struct {
+	// Record is the 1-based index of the record in the capture.
+	Record int `json:"record"`
+
+	// Stream is the captured stream the message belongs to.
+	Stream string `json:"stream,omitempty"`
+
+	// Message is the v1 event type or v2 message type name.
+	Message string `json:"message"`
+
+	// Recorded is the captured response.
+	Recorded json.RawMessage `json:"recorded,omitempty"`
+
+	// Replayed is the response from the target.
+	Replayed json.RawMessage `json:"replayed,omitempty"`
+
+	// Error is set when the message could not be replayed.
+	Error string `json:"error,omitempty"`
+}
+
+func (d Diff) String() string {
+	if d.Error != "" {
+		return fmt.Sprintf("record %d (%s %s): %s", d.Record, d.Stream, d.Message, d.Error)
+	}
+	return fmt.Sprintf("record %d (%s %s):\n  recorded: %s\n  replayed: %s",
+		d.Record, d.Stream, d.Message, d.Recorded, d.Replayed)
+}
+
+// Report summarizes a replay.
+type Report struct {
+	// Records is the number of records replayed.
+	Records int `json:"records"`
+
+	// Compared is the number of responses compared with the capture.
+	Compared int `json:"compared"`
+
+	// Matched is the number of compared responses that were equal.
+	Matched int `json:"matched"`
+
+	// Diffs lists the mismatches and replay errors.
+	Diffs []Diff `json:"diffs"`
+}
+
+// OK reports whether every message replayed without a difference.
+func (r *Report) OK() bool {
+	return len(r.Diffs) == 0
+}
+
+// Run replays every record in the capture read from r against target, in
+// order, and compares the responses.
+//
+// v1 responses and v2 handshake responses and decisions are compared. Pong,
+// health and metrics replies carry timestamps and are not.
+func Run(ctx context.Context, r io.Reader, target Target) (*Report, error) {
+	report := &Report{Diffs: []Diff{}}
+
+	err := zentinel.ReadCapture(r, func(record *zentinel.CaptureRecord) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.Records++
+		report.replay(ctx, target, record)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func (r *Report) replay(ctx context.Context, target Target, record *zentinel.CaptureRecord) {
+	diff := Diff{Record: r.Records, Stream: record.Stream, Recorded: record.Response}
+
+	switch record.Protocol {
+	case zentinel.CaptureProtocolV1:
+		diff.Message = record.EventType
+		response, err := target.SendV1(ctx, record.Stream, record.EventType, record.Payload)
+		if err != nil {
+			diff.Error = err.Error()
+			r.Diffs = append(r.Diffs, diff)
+			return
+		}
+		diff.Replayed = response
+		r.compare(diff)
+
+	case zentinel.CaptureProtocolV2:
+		diff.Message = (&v2.V2Message{Type: record.MessageType}).TypeName()
+		response, err := target.SendV2(ctx, record.Stream, record.MessageType, v2Payload(record.Payload), record.ResponseType != 0)
+		if err != nil {
+			diff.Error = err.Error()
+			r.Diffs = append(r.Diffs, diff)
+			return
+		}
+		if response != nil {
+			diff.Replayed = response.Payload
+		}
+		if record.ResponseType == 0 {
+			return
+		}
+		if response == nil || response.Type != record.ResponseType {
+			got := "no reply"
+			if response != nil {
+				got = response.TypeName()
+			}
+			diff.Error = fmt.Sprintf("expected %s reply, got %s",
+				(&v2.V2Message{Type: record.ResponseType}).TypeName(), got)
+			r.Diffs = append(r.Diffs, diff)
+			return
+		}
+		if record.ResponseType == v2.MsgTypeDecision || record.ResponseType == v2.MsgTypeHandshakeResponse {
+			r.compare(diff)
+		}
+
+	default:
+		diff.Error = fmt.Sprintf("unknown protocol %q", record.Protocol)
+		r.Diffs = append(r.Diffs, diff)
+	}
+}
+
+func (r *Report) compare(diff Diff) {
+	r.Compared++
+	if jsonEqual(diff.Recorded, diff.Replayed) {
+		r.Matched++
+		return
+	}
+	r.Diffs = append(r.Diffs, diff)
+}
+
+// v2Payload returns the wire payload for a captured v2 message. Payloads that
+// were not valid JSON are captured as a JSON string of the original bytes.
+func v2Payload(payload json.RawMessage) []byte {
+	if bytes.HasPrefix(bytes.TrimSpace(payload), []byte(`"`)) {
+		var raw string
+		if err := json.Unmarshal(payload, &raw); err == nil {
+			return []byte(raw)
+		}
+	}
+	return payload
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
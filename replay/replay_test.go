@@ -0,0 +1,173 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/agenttest"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// pathAgent blocks requests under prefix.
+type pathAgent struct {
+	v2.BaseAgentV2
+	prefix string
+}
+
+func (a *pathAgent) Name() string {
+	return "path-agent"
+}
+
+func (a *pathAgent) Capabilities() *v2.AgentCapabilities {
+	return v2.NewAgentCapabilities().All()
+}
+
+func (a *pathAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	if request.PathStartsWith(a.prefix) {
+		return zentinel.Deny().WithTag("blocked")
+	}
+	return zentinel.Allow()
+}
+
+func (a *pathAgent) OnRequestBody(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	if strings.Contains(request.BodyString(), "DROP TABLE") {
+		return zentinel.Block(400)
+	}
+	return zentinel.Allow()
+}
+
+// v1PathAgent is the v1 equivalent of pathAgent.
+type v1PathAgent struct {
+	zentinel.BaseAgent
+	prefix string
+}
+
+func (a *v1PathAgent) Name() string {
+	return "path-agent"
+}
+
+func (a *v1PathAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	if request.PathStartsWith(a.prefix) {
+		return zentinel.Deny()
+	}
+	return zentinel.Allow()
+}
+
+// syncBuffer lets the runner's connection goroutines share a capture buffer
+// with the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func captureV2(t *testing.T) []byte {
+	t.Helper()
+
+	var buf syncBuffer
+	capture := zentinel.NewCapture(&buf)
+	loopback := agenttest.StartUDS(t, &pathAgent{prefix: "/admin"}, func(r *v2.AgentRunnerV2) {
+		r.WithCapture(capture)
+	})
+
+	proxy := loopback.Connect()
+	proxy.Request("GET", "/admin/users").SendHeaders().ExpectBlocked(403)
+	req := proxy.Request("POST", "/api/query")
+	req.SendHeaders().ExpectAllowed()
+	req.SendBody([]byte("DROP TABLE users")).ExpectBlocked(400)
+	req.Complete(400, 1)
+	proxy.Request("GET", "/private").SendHeaders().ExpectAllowed()
+
+	if err := loopback.Shutdown(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRun_V2Match(t *testing.T) {
+	captured := captureV2(t)
+
+	report, err := Run(context.Background(), bytes.NewReader(captured), AgentV2Target(&pathAgent{prefix: "/admin"}))
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("expected no diffs, got %v", report.Diffs)
+	}
+	// Handshake, three request headers, one body chunk and request complete.
+	if report.Records != 6 || report.Compared != 5 || report.Matched != 5 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestRun_V2Diff(t *testing.T) {
+	captured := captureV2(t)
+
+	report, err := Run(context.Background(), bytes.NewReader(captured), AgentV2Target(&pathAgent{prefix: "/private"}))
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(report.Diffs) != 2 {
+		t.Fatalf("expected 2 diffs, got %v", report.Diffs)
+	}
+	for _, diff := range report.Diffs {
+		if diff.Message != "RequestHeaders" || diff.Error != "" {
+			t.Errorf("unexpected diff: %v", diff)
+		}
+	}
+}
+
+func TestRun_V1(t *testing.T) {
+	var buf bytes.Buffer
+	capture := zentinel.NewCapture(&buf)
+	handler := zentinel.NewAgentHandler(&v1PathAgent{prefix: "/admin"})
+
+	for i, uri := range []string{"/admin", "/"} {
+		event := map[string]interface{}{
+			"event_type": string(zentinel.EventTypeRequestHeaders),
+			"payload": map[string]interface{}{
+				"metadata": map[string]interface{}{"correlation_id": string(rune('a' + i))},
+				"method":   "GET",
+				"uri":      uri,
+				"headers":  map[string]interface{}{},
+			},
+		}
+		response, err := handler.HandleEvent(context.Background(), event)
+		if err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+		capture.RecordV1("conn-1", event, response)
+	}
+
+	report, err := Run(context.Background(), bytes.NewReader(buf.Bytes()), AgentTarget(&v1PathAgent{prefix: "/admin"}))
+	if err != nil || !report.OK() || report.Matched != 2 {
+		t.Fatalf("expected 2 matches, got %+v, %v", report, err)
+	}
+
+	report, err = Run(context.Background(), bytes.NewReader(buf.Bytes()), AgentTarget(&v1PathAgent{prefix: "/nothing"}))
+	if err != nil || len(report.Diffs) != 1 || report.Diffs[0].Record != 1 {
+		t.Fatalf("expected a diff for record 1, got %+v, %v", report, err)
+	}
+}
+
+func TestRun_InvalidCapture(t *testing.T) {
+	_, err := Run(context.Background(), strings.NewReader("not json\n"), AgentTarget(&v1PathAgent{}))
+	if err == nil {
+		t.Fatal("expected error for invalid capture")
+	}
+}
@@ -0,0 +1,252 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/agentproc"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/v2"
+)
+
+// Target is an agent that captured messages are replayed against. Messages
+// with the same stream are sent in order over the same connection.
+type Target interface {
+	// SendV1 sends a v1 event and returns the agent's response.
+	SendV1(ctx context.Context, stream, eventType string, payload json.RawMessage) (json.RawMessage, error)
+
+	// SendV2 sends a v2 message and, if expectReply is set, returns the
+	// agent's reply.
+	SendV2(ctx context.Context, stream string, msgType byte, payload []byte, expectReply bool) (*v2.V2Message, error)
+
+	// Close releases the target's connections.
+	Close() error
+}
+
+// AgentTarget replays against an in-process v1 agent. Each stream gets its
+// own handler, as each connection does in AgentRunner.
+func AgentTarget(agent zentinel.Agent) Target {
+	return &agentTarget{agent: agent, handlers: make(map[string]*zentinel.AgentHandler)}
+}
+
+type agentTarget struct {
+	agent    zentinel.Agent
+	handlers map[string]*zentinel.AgentHandler
+}
+
+func (t *agentTarget) SendV1(ctx context.Context, stream, eventType string, payload json.RawMessage) (json.RawMessage, error) {
+	handler, ok := t.handlers[stream]
+	if !ok {
+		handler = zentinel.NewAgentHandler(t.agent)
+		t.handlers[stream] = handler
+	}
+
+	event, err := decodeEvent(eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+	response, err := handler.HandleEvent(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(response)
+}
+
+func (t *agentTarget) SendV2(ctx context.Context, stream string, msgType byte, payload []byte, expectReply bool) (*v2.V2Message, error) {
+	return nil, errors.New("v1 agent cannot replay v2 messages")
+}
+
+func (t *agentTarget) Close() error {
+	return nil
+}
+
+// AgentV2Target replays against an in-process v2 agent. v1 events are
+// handled as legacy events.
+func AgentV2Target(agent v2.AgentV2) Target {
+	return &agentV2Target{handler: v2.NewAgentHandlerV2(agent)}
+}
+
+type agentV2Target struct {
+	handler *v2.AgentHandlerV2
+}
+
+func (t *agentV2Target) SendV1(ctx context.Context, stream, eventType string, payload json.RawMessage) (json.RawMessage, error) {
+	event, err := decodeEvent(eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.handler.HandleLegacyEvent(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(response)
+}
+
+func (t *agentV2Target) SendV2(ctx context.Context, stream string, msgType byte, payload []byte, expectReply bool) (*v2.V2Message, error) {
+	return t.handler.HandleMessage(ctx, &v2.V2Message{Type: msgType, Payload: payload})
+}
+
+func (t *agentV2Target) Close() error {
+	return nil
+}
+
+// BinaryOptions configures an agent binary launched by StartBinary.
+type BinaryOptions struct {
+	// Args are passed to the agent in addition to --socket.
+	Args []string
+
+	// Output receives the agent's stdout and stderr. Nil discards it.
+	Output io.Writer
+
+	// Timeout bounds each exchange with the agent. Zero means 10 seconds.
+	Timeout time.Duration
+}
+
+// BinaryTarget replays against an agent binary over its Unix socket. It
+// speaks v1 or v2 framing per message, following the capture.
+type BinaryTarget struct {
+	proc    *agentproc.Process
+	timeout time.Duration
+
+	mu      sync.Mutex
+	v1Conns map[string]net.Conn
+	v2Conns map[string]v2.ProxyConn
+}
+
+// StartBinary launches the agent at path with --socket and waits for it to
+// listen.
+func StartBinary(ctx context.Context, path string, opts BinaryOptions) (*BinaryTarget, error) {
+	proc, err := agentproc.Start(ctx, path, agentproc.Options{Args: opts.Args, Output: opts.Output})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &BinaryTarget{
+		proc:    proc,
+		timeout: timeout,
+		v1Conns: make(map[string]net.Conn),
+		v2Conns: make(map[string]v2.ProxyConn),
+	}, nil
+}
+
+// SendV1 sends a v1 event over the stream's connection.
+func (t *BinaryTarget) SendV1(ctx context.Context, stream, eventType string, payload json.RawMessage) (json.RawMessage, error) {
+	t.mu.Lock()
+	conn, ok := t.v1Conns[stream]
+	if !ok {
+		var err error
+		if conn, err = net.Dial("unix", t.proc.SocketPath); err != nil {
+			t.mu.Unlock()
+			return nil, fmt.Errorf("failed to connect: %w", err)
+		}
+		t.v1Conns[stream] = conn
+	}
+	t.mu.Unlock()
+
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	event := map[string]interface{}{"event_type": eventType, "payload": payload}
+	if err := zentinel.WriteMessage(conn, event); err != nil {
+		return nil, err
+	}
+	response, err := zentinel.ReadMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(response)
+}
+
+// SendV2 sends a v2 message over the stream's connection. Streams that were
+// captured without a handshake, such as gRPC streams, are opened with one.
+func (t *BinaryTarget) SendV2(ctx context.Context, stream string, msgType byte, payload []byte, expectReply bool) (*v2.V2Message, error) {
+	conn, err := t.v2Conn(stream, msgType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Send(&v2.V2Message{Type: msgType, Payload: payload}); err != nil {
+		return nil, err
+	}
+	if !expectReply {
+		return nil, nil
+	}
+	return t.recv(conn)
+}
+
+func (t *BinaryTarget) v2Conn(stream string, msgType byte) (v2.ProxyConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if conn, ok := t.v2Conns[stream]; ok {
+		return conn, nil
+	}
+	conn, err := v2.DialUDS(t.proc.SocketPath)
+	if err != nil {
+		return nil, err
+	}
+	t.v2Conns[stream] = conn
+
+	if msgType != v2.MsgTypeHandshakeRequest {
+		hs, err := v2.NewV2Message(v2.MsgTypeHandshakeRequest, v2.NewHandshakeRequest("zentinel-agent-replay"))
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Send(hs); err != nil {
+			return nil, err
+		}
+		if _, err := t.recv(conn); err != nil {
+			return nil, fmt.Errorf("handshake failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (t *BinaryTarget) recv(conn v2.ProxyConn) (*v2.V2Message, error) {
+	type result struct {
+		msg *v2.V2Message
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		msg, err := conn.Recv()
+		done <- result{msg, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.msg, r.err
+	case <-time.After(t.timeout):
+		conn.Close()
+		return nil, fmt.Errorf("no reply within %s", t.timeout)
+	}
+}
+
+// Close closes all connections and stops the agent.
+func (t *BinaryTarget) Close() error {
+	t.mu.Lock()
+	for _, conn := range t.v1Conns {
+		conn.Close()
+	}
+	for _, conn := range t.v2Conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	return t.proc.Stop(5 * time.Second)
+}
+
+func decodeEvent(eventType string, payload json.RawMessage) (map[string]interface{}, error) {
+	var decoded interface{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	return map[string]interface{}{"event_type": eventType, "payload": decoded}, nil
+}
@@ -13,6 +13,7 @@ type Request struct {
 	body        []byte
 	parsedURL   *url.URL
 	queryParams url.Values
+	state       *State
 }
 
 // NewRequest creates a Request from a RequestHeadersEvent.
@@ -22,6 +23,7 @@ func NewRequest(event *RequestHeadersEvent, body []byte) *Request {
 		event:     event,
 		body:      body,
 		parsedURL: parsedURL,
+		state:     &State{},
 	}
 }
 
@@ -30,6 +32,11 @@ func (r *Request) Metadata() *RequestMetadata {
 	return &r.event.Metadata
 }
 
+// State returns the request's state, shared by every phase of the request.
+func (r *Request) State() *State {
+	return r.state
+}
+
 // CorrelationID returns the correlation ID for request tracing.
 func (r *Request) CorrelationID() string {
 	return r.event.Metadata.CorrelationID
@@ -232,6 +239,7 @@ func (r *Request) WithBody(body []byte) *Request {
 		body:        body,
 		parsedURL:   r.parsedURL,
 		queryParams: r.queryParams,
+		state:       r.state,
 	}
 }
 
@@ -296,3 +296,26 @@ func TestRequest_Metadata_Full(t *testing.T) {
 		t.Errorf("expected Metadata().ClientPort 12345, got %d", metadata.ClientPort)
 	}
 }
+
+func TestRequest_State(t *testing.T) {
+	key := NewStateKey[int]("score")
+	request := NewRequest(&RequestHeadersEvent{Method: "GET", URI: "/"}, nil)
+
+	if _, ok := key.Get(request); ok {
+		t.Error("expected no value before Set")
+	}
+	key.Set(request, 42)
+
+	// Phases with a body see the same state.
+	if score, ok := key.Get(request.WithBody([]byte("x"))); !ok || score != 42 {
+		t.Errorf("expected 42, got %d", score)
+	}
+	if other := NewStateKey[int]("score"); func() bool { _, ok := other.Get(request); return ok }() {
+		t.Error("expected keys with the same name to be distinct")
+	}
+
+	request.State().Clear()
+	if _, ok := key.Get(request); ok {
+		t.Error("expected no value after Clear")
+	}
+}
@@ -3,17 +3,23 @@ package zentinel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/pflag"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/hooks"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // RunnerConfig contains configuration for the agent runner.
@@ -22,6 +28,42 @@ type RunnerConfig struct {
 	Name       string
 	JSONLogs   bool
 	LogLevel   string
+
+	// LogBackend is LogBackendZerolog or LogBackendSlog.
+	LogBackend string
+
+	// CapturePath, if set, is a JSONL file that every inbound event and its
+	// response are appended to.
+	CapturePath string
+
+	// FailurePolicy decides the decision sent when a hook panics or misses
+	// its deadline.
+	FailurePolicy FailurePolicy
+
+	// Deadlines bounds how long each hook may run.
+	Deadlines HookDeadlines
+
+	// MalformedInput is what is done with events that cannot be parsed.
+	MalformedInput MalformedInputAction
+
+	// Shadow configures shadow mode at startup.
+	Shadow ShadowConfig
+
+	// Tracing configures the span exporter. Tracing is off unless an
+	// exporter is set or a tracer provider is given to the runner.
+	Tracing TracingConfig
+
+	// Audit configures the local audit log of decisions.
+	Audit AuditConfig
+
+	// DebugTTL is how long a runtime change of the log level or payload
+	// dumps lasts. Zero keeps changes until they are reverted.
+	DebugTTL time.Duration
+
+	// AdminAddress, if set, is the host:port an admin HTTP endpoint listens
+	// on. It serves the debug settings at /debug/logging, and pprof and
+	// expvar.
+	AdminAddress string
 }
 
 // DefaultRunnerConfig returns the default runner configuration.
@@ -31,6 +73,11 @@ func DefaultRunnerConfig() RunnerConfig {
 		Name:       "agent",
 		JSONLogs:   false,
 		LogLevel:   "info",
+		LogBackend: LogBackendZerolog,
+		DebugTTL:   15 * time.Minute,
+
+		FailurePolicy:  DefaultFailurePolicy(),
+		MalformedInput: MalformedAllow,
 	}
 }
 
@@ -42,6 +89,14 @@ type AgentHandler struct {
 	responseBodies map[string][]byte
 	responseEvents map[string]*ResponseHeadersEvent
 	mu             sync.RWMutex
+	failurePolicy  FailurePolicy
+	deadlines      HookDeadlines
+	malformedInput MalformedInputAction
+	failures       *FailureCounts
+	shadow         *ShadowMode
+	tracer         *Tracer
+	auditSink      AuditSink
+	auditAll       bool
 }
 
 // NewAgentHandler creates a new handler for the given agent.
@@ -52,9 +107,133 @@ func NewAgentHandler(agent Agent) *AgentHandler {
 		requestBodies:  make(map[string][]byte),
 		responseBodies: make(map[string][]byte),
 		responseEvents: make(map[string]*ResponseHeadersEvent),
+		failurePolicy:  DefaultFailurePolicy(),
+		malformedInput: MalformedAllow,
+		failures:       &FailureCounts{},
 	}
 }
 
+// WithFailurePolicy sets the decision sent when a hook panics or misses its
+// deadline.
+func (h *AgentHandler) WithFailurePolicy(policy FailurePolicy) *AgentHandler {
+	h.failurePolicy = policy
+	return h
+}
+
+// WithDeadlines sets how long each hook may run.
+func (h *AgentHandler) WithDeadlines(deadlines HookDeadlines) *AgentHandler {
+	h.deadlines = deadlines
+	return h
+}
+
+// WithMalformedInput sets what is done with events that cannot be parsed.
+func (h *AgentHandler) WithMalformedInput(action MalformedInputAction) *AgentHandler {
+	h.malformedInput = action
+	return h
+}
+
+// WithShadowMode wraps the agent in shadow, which configure events switch.
+func (h *AgentHandler) WithShadowMode(shadow *ShadowMode) *AgentHandler {
+	h.shadow = shadow
+	h.agent = Wrap(h.agent, shadow.Middleware())
+	return h
+}
+
+// WithAudit writes the agent's decisions to sink; a nil sink disables it.
+func (h *AgentHandler) WithAudit(sink AuditSink, all bool) *AgentHandler {
+	if sink != nil {
+		h.agent = Wrap(h.agent, AuditMiddleware(sink, all))
+	}
+	h.auditSink, h.auditAll = sink, all
+	return h
+}
+
+// WithDebugControl dumps the payloads control selects; nil disables dumps.
+func (h *AgentHandler) WithDebugControl(control *DebugControl) *AgentHandler {
+	if control != nil {
+		h.agent = Wrap(h.agent, control.Middleware())
+	}
+	return h
+}
+
+// WithTracer starts a span per hook invocation; nil disables tracing.
+func (h *AgentHandler) WithTracer(tracer *Tracer) *AgentHandler {
+	h.tracer = tracer
+	if tracer != nil {
+		h.agent = Wrap(h.agent, tracer.Middleware())
+	}
+	return h
+}
+
+// Failures returns the number of failures the handler has seen, by class.
+func (h *AgentHandler) Failures() map[FailureClass]uint64 {
+	return h.failures.Snapshot()
+}
+
+// decide runs a decision hook for request under its deadline, with the
+// request's logger in its context. If it panics or times out, the failure
+// policy's decision is shadowed, audited and returned instead, tagged
+// "panic" or "timeout".
+func (h *AgentHandler) decide(ctx context.Context, hook Hook, request *Request, fn func(ctx context.Context) *Decision) *Decision {
+	ctx = requestContext(ctx, request)
+	decision, outcome := hooks.Run(ctx, string(hook), request.CorrelationID(), h.deadlines.Timeout(hook), fn)
+	h.countOutcome(outcome)
+	switch outcome {
+	case hooks.Panicked:
+		return h.fallback(ctx, hook, request, h.failurePolicy.Decision(hook).WithTag(string(FailurePanic)))
+	case hooks.TimedOut:
+		return h.fallback(ctx, hook, request, h.failurePolicy.Decision(hook).WithTag(string(FailureTimeout)))
+	}
+	return decision
+}
+
+// fallback applies shadow mode to a decision sent in place of the agent's
+// on a hook failure, which the agent's middleware never sees, then audits it.
+func (h *AgentHandler) fallback(ctx context.Context, hook Hook, request *Request, decision *Decision) *Decision {
+	if h.shadow != nil {
+		decision = h.shadow.Apply(ctx, hook, decision)
+	}
+	return h.audit(ctx, hook, request, decision)
+}
+
+// audit writes a decision sent in place of the agent's to the audit sink,
+// which the agent's middleware never sees, and returns it.
+func (h *AgentHandler) audit(ctx context.Context, hook Hook, request *Request, decision *Decision) *Decision {
+	if h.auditSink != nil {
+		AuditDecision(ctx, h.auditSink, h.auditAll, hook, request, decision)
+	}
+	return decision
+}
+
+// countOutcome counts a hook that panicked or timed out.
+func (h *AgentHandler) countOutcome(outcome hooks.Outcome) {
+	switch outcome {
+	case hooks.Panicked:
+		h.failures.Add(FailurePanic)
+	case hooks.TimedOut:
+		h.failures.Add(FailureTimeout)
+	}
+}
+
+// malformed counts an event that could not be used. It returns an error
+// wrapping ErrMalformedInput if the connection should be closed.
+func (h *AgentHandler) malformed(class FailureClass, eventType EventType, err error) error {
+	h.failures.Add(class)
+	if h.malformedInput == MalformedClose {
+		return fmt.Errorf("%w: %s event: %v", ErrMalformedInput, eventType, err)
+	}
+	return nil
+}
+
+// rejectMalformed answers a decision event that could not be used with the
+// malformed input action's decision.
+func (h *AgentHandler) rejectMalformed(ctx context.Context, class FailureClass, eventType EventType, err error) (interface{}, error) {
+	if err := h.malformed(class, eventType, err); err != nil {
+		return nil, err
+	}
+	return h.audit(ctx, "", nil, h.malformedInput.Decision(class)).Build(), nil
+}
+
 // HandleEvent handles an incoming protocol event.
 func (h *AgentHandler) HandleEvent(ctx context.Context, event map[string]interface{}) (interface{}, error) {
 	eventType, _ := event["event_type"].(string)
@@ -76,8 +255,8 @@ func (h *AgentHandler) HandleEvent(ctx context.Context, event map[string]interfa
 	case EventTypeGuardrailInspect:
 		return h.handleGuardrailInspect(ctx, payload)
 	default:
-		log.Warn().Str("event_type", eventType).Msg("Unknown event type")
-		return Allow().Build(), nil
+		LoggerFrom(ctx).Warn().Str("event_type", eventType).Msg("Unknown event type")
+		return h.rejectMalformed(ctx, FailureUnknownMessage, EventType(eventType), errors.New("unknown event type"))
 	}
 }
 
@@ -85,12 +264,29 @@ func (h *AgentHandler) handleConfigure(ctx context.Context, payload map[string]i
 	agentID, _ := payload["agent_id"].(string)
 	config, _ := payload["config"].(map[string]interface{})
 
-	if err := h.agent.OnConfigure(ctx, config); err != nil {
-		log.Error().Err(err).Msg("Configuration failed")
+	var err error
+	if h.shadow != nil {
+		err = h.shadow.Configure(ctx, config)
+	}
+	if err == nil {
+		var outcome hooks.Outcome
+		err, outcome = hooks.Run(ctx, string(HookConfigure), agentID, h.deadlines.Timeout(HookConfigure), func(ctx context.Context) error {
+			return h.agent.OnConfigure(ctx, config)
+		})
+		h.countOutcome(outcome)
+		switch outcome {
+		case hooks.Panicked:
+			err = errors.New("configuration handler panicked")
+		case hooks.TimedOut:
+			err = errors.New("configuration handler timed out")
+		}
+	}
+	if err != nil {
+		LoggerFrom(ctx).Error().Err(err).Msg("Configuration failed")
 		return map[string]interface{}{"success": false, "error": err.Error()}, nil
 	}
 
-	log.Info().Str("agent_id", agentID).Msg("Agent configured")
+	LoggerFrom(ctx).Info().Str("agent_id", agentID).Msg("Agent configured")
 	return map[string]interface{}{"success": true}, nil
 }
 
@@ -99,8 +295,8 @@ func (h *AgentHandler) handleRequestHeaders(ctx context.Context, payload map[str
 	jsonBytes, _ := json.Marshal(payload)
 	var event RequestHeadersEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		log.Error().Err(err).Msg("Failed to parse request headers event")
-		return Allow().Build(), nil
+		LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse request headers event")
+		return h.rejectMalformed(ctx, FailureMalformedPayload, EventTypeRequestHeaders, err)
 	}
 
 	request := NewRequest(&event, nil)
@@ -112,7 +308,9 @@ func (h *AgentHandler) handleRequestHeaders(ctx context.Context, payload map[str
 	h.requestBodies[correlationID] = []byte{}
 	h.mu.Unlock()
 
-	decision := h.agent.OnRequest(ctx, request)
+	decision := h.decide(ctx, HookRequest, request, func(ctx context.Context) *Decision {
+		return h.agent.OnRequest(ctx, request)
+	})
 	return decision.Build(), nil
 }
 
@@ -120,24 +318,32 @@ func (h *AgentHandler) handleRequestBodyChunk(ctx context.Context, payload map[s
 	jsonBytes, _ := json.Marshal(payload)
 	var event RequestBodyChunkEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		log.Error().Err(err).Msg("Failed to parse request body chunk event")
-		return Allow().Build(), nil
+		LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse request body chunk event")
+		return h.rejectMalformed(ctx, FailureMalformedPayload, EventTypeRequestBodyChunk, err)
 	}
 
 	correlationID := event.CorrelationID
-	data, _ := event.DecodedData()
+	data, err := event.DecodedData()
+	if err != nil {
+		LoggerFrom(ctx).Error().Err(err).Msg("Failed to decode body chunk data")
+		return h.rejectMalformed(ctx, FailureInvalidBody, EventTypeRequestBodyChunk, err)
+	}
 
-	// Accumulate body chunks
+	// Chunks for unknown or cancelled requests are dropped, not accumulated
 	h.mu.Lock()
-	h.requestBodies[correlationID] = append(h.requestBodies[correlationID], data...)
-	body := h.requestBodies[correlationID]
 	request := h.requests[correlationID]
+	if request != nil {
+		h.requestBodies[correlationID] = append(h.requestBodies[correlationID], data...)
+	}
+	body := h.requestBodies[correlationID]
 	h.mu.Unlock()
 
 	// Only call handler on last chunk
 	if event.IsLast && request != nil {
 		requestWithBody := request.WithBody(body)
-		decision := h.agent.OnRequestBody(ctx, requestWithBody)
+		decision := h.decide(ctx, HookRequestBody, requestWithBody, func(ctx context.Context) *Decision {
+			return h.agent.OnRequestBody(ctx, requestWithBody)
+		})
 		return decision.Build(), nil
 	}
 
@@ -149,8 +355,8 @@ func (h *AgentHandler) handleResponseHeaders(ctx context.Context, payload map[st
 	jsonBytes, _ := json.Marshal(payload)
 	var event ResponseHeadersEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		log.Error().Err(err).Msg("Failed to parse response headers event")
-		return Allow().Build(), nil
+		LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse response headers event")
+		return h.rejectMalformed(ctx, FailureMalformedPayload, EventTypeResponseHeaders, err)
 	}
 
 	correlationID := event.CorrelationID
@@ -161,7 +367,7 @@ func (h *AgentHandler) handleResponseHeaders(ctx context.Context, payload map[st
 	h.mu.RUnlock()
 
 	if request == nil {
-		log.Warn().Str("correlation_id", correlationID).Msg("No cached request for correlation_id")
+		LoggerFrom(ctx).Warn().Str("correlation_id", correlationID).Msg("No cached request for correlation_id")
 		return Allow().Build(), nil
 	}
 
@@ -173,7 +379,9 @@ func (h *AgentHandler) handleResponseHeaders(ctx context.Context, payload map[st
 	h.responseBodies[correlationID] = []byte{}
 	h.mu.Unlock()
 
-	decision := h.agent.OnResponse(ctx, request, response)
+	decision := h.decide(ctx, HookResponse, request, func(ctx context.Context) *Decision {
+		return h.agent.OnResponse(ctx, request, response)
+	})
 	return decision.Build(), nil
 }
 
@@ -181,25 +389,33 @@ func (h *AgentHandler) handleResponseBodyChunk(ctx context.Context, payload map[
 	jsonBytes, _ := json.Marshal(payload)
 	var event ResponseBodyChunkEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		log.Error().Err(err).Msg("Failed to parse response body chunk event")
-		return Allow().Build(), nil
+		LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse response body chunk event")
+		return h.rejectMalformed(ctx, FailureMalformedPayload, EventTypeResponseBodyChunk, err)
 	}
 
 	correlationID := event.CorrelationID
-	data, _ := event.DecodedData()
+	data, err := event.DecodedData()
+	if err != nil {
+		LoggerFrom(ctx).Error().Err(err).Msg("Failed to decode body chunk data")
+		return h.rejectMalformed(ctx, FailureInvalidBody, EventTypeResponseBodyChunk, err)
+	}
 
-	// Accumulate body chunks
+	// Chunks for unknown or cancelled responses are dropped, not accumulated
 	h.mu.Lock()
-	h.responseBodies[correlationID] = append(h.responseBodies[correlationID], data...)
-	body := h.responseBodies[correlationID]
 	request := h.requests[correlationID]
 	responseEvent := h.responseEvents[correlationID]
+	if request != nil && responseEvent != nil {
+		h.responseBodies[correlationID] = append(h.responseBodies[correlationID], data...)
+	}
+	body := h.responseBodies[correlationID]
 	h.mu.Unlock()
 
 	// Only call handler on last chunk
 	if event.IsLast && request != nil && responseEvent != nil {
 		response := NewResponse(responseEvent, body)
-		decision := h.agent.OnResponseBody(ctx, request, response)
+		decision := h.decide(ctx, HookResponseBody, request, func(ctx context.Context) *Decision {
+			return h.agent.OnResponseBody(ctx, request, response)
+		})
 		return decision.Build(), nil
 	}
 
@@ -210,7 +426,10 @@ func (h *AgentHandler) handleRequestComplete(ctx context.Context, payload map[st
 	jsonBytes, _ := json.Marshal(payload)
 	var event RequestCompleteEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		log.Error().Err(err).Msg("Failed to parse request complete event")
+		LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse request complete event")
+		if err := h.malformed(FailureMalformedPayload, EventTypeRequestComplete, err); err != nil {
+			return nil, err
+		}
 		return map[string]interface{}{"success": true}, nil
 	}
 
@@ -226,7 +445,15 @@ func (h *AgentHandler) handleRequestComplete(ctx context.Context, payload map[st
 	h.mu.Unlock()
 
 	if request != nil {
-		h.agent.OnRequestComplete(ctx, request, event.Status, event.DurationMS)
+		ctx := requestContext(ctx, request)
+		ctx, span := h.tracer.Start(ctx, HookRequestComplete, request)
+		_, outcome := hooks.Run(ctx, string(HookRequestComplete), correlationID, h.deadlines.Timeout(HookRequestComplete), func(ctx context.Context) struct{} {
+			h.agent.OnRequestComplete(ctx, request, event.Status, event.DurationMS)
+			return struct{}{}
+		})
+		h.tracer.End(span, nil)
+		h.countOutcome(outcome)
+		request.State().Clear()
 	}
 
 	return map[string]interface{}{"success": true}, nil
@@ -236,11 +463,27 @@ func (h *AgentHandler) handleGuardrailInspect(ctx context.Context, payload map[s
 	jsonBytes, _ := json.Marshal(payload)
 	var event GuardrailInspectEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		log.Error().Err(err).Msg("Failed to parse guardrail inspect event")
+		LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse guardrail inspect event")
+		if err := h.malformed(FailureMalformedPayload, EventTypeGuardrailInspect, err); err != nil {
+			return nil, err
+		}
+		if h.malformedInput == MalformedBlock {
+			return NewGuardrailResponseWithDetection(
+				NewGuardrailDetection(string(FailureMalformedPayload), "guardrail inspect event could not be parsed").
+					WithSeverity(DetectionSeverityHigh)), nil
+		}
 		return NewGuardrailResponse(), nil
 	}
 
-	response := h.agent.OnGuardrailInspect(ctx, &event)
+	ctx = LoggerFrom(ctx).With().Str("correlation_id", event.CorrelationID).Logger().WithContext(ctx)
+	timeout := h.deadlines.Timeout(HookGuardrailInspect)
+	response, outcome := hooks.Run(ctx, string(HookGuardrailInspect), event.CorrelationID, timeout, func(ctx context.Context) *GuardrailResponse {
+		return h.agent.OnGuardrailInspect(ctx, &event)
+	})
+	h.countOutcome(outcome)
+	if outcome != hooks.Completed {
+		response = h.failurePolicy.GuardrailResponse()
+	}
 	return response, nil
 }
 
@@ -250,6 +493,16 @@ type AgentRunner struct {
 	config   RunnerConfig
 	listener net.Listener
 	shutdown chan struct{}
+	capture  *Capture
+	connID   atomic.Uint64
+	failures FailureCounts
+	shadow   *ShadowMode
+	tracer   *Tracer
+	audit    AuditSink
+	logger   *zerolog.Logger
+	debug    *DebugControl
+
+	middleware []Middleware
 }
 
 // NewAgentRunner creates a new runner for the given agent.
@@ -260,6 +513,8 @@ func NewAgentRunner(agent Agent) *AgentRunner {
 		agent:    agent,
 		config:   config,
 		shutdown: make(chan struct{}),
+		shadow:   NewShadowMode(config.Shadow),
+		debug:    NewDebugControl(config.DebugTTL),
 	}
 }
 
@@ -287,38 +542,138 @@ func (r *AgentRunner) WithLogLevel(level string) *AgentRunner {
 	return r
 }
 
+// WithLogger sets the logger the runner logs to, overriding the log format
+// and level configuration. Hooks find it, with request fields attached,
+// through LoggerFrom.
+func (r *AgentRunner) WithLogger(logger zerolog.Logger) *AgentRunner {
+	r.logger = &logger
+	return r
+}
+
+// WithSlogHandler logs through handler, as WithLogger does with a zerolog
+// logger.
+func (r *AgentRunner) WithSlogHandler(handler slog.Handler) *AgentRunner {
+	return r.WithLogger(NewSlogLogger(handler).With().Str("agent", r.config.Name).Logger())
+}
+
+// Logger returns the runner's logger. Until Run sets it up from the
+// configuration, or one is given to WithLogger, it is the global logger.
+func (r *AgentRunner) Logger() *zerolog.Logger {
+	if r.logger == nil {
+		return &log.Logger
+	}
+	return r.logger
+}
+
+// DebugControl returns the runner's control of its log level and payload
+// dumps.
+func (r *AgentRunner) DebugControl() *DebugControl {
+	return r.debug
+}
+
+// WithCapture records every inbound event and its response to capture.
+func (r *AgentRunner) WithCapture(capture *Capture) *AgentRunner {
+	r.capture = capture
+	return r
+}
+
+// WithFailurePolicy sets the decision sent when a hook panics or misses its
+// deadline.
+func (r *AgentRunner) WithFailurePolicy(policy FailurePolicy) *AgentRunner {
+	r.config.FailurePolicy = policy
+	return r
+}
+
+// WithDeadlines sets how long each hook may run.
+func (r *AgentRunner) WithDeadlines(deadlines HookDeadlines) *AgentRunner {
+	r.config.Deadlines = deadlines
+	return r
+}
+
+// WithMalformedInput sets what is done with events that cannot be parsed.
+func (r *AgentRunner) WithMalformedInput(action MalformedInputAction) *AgentRunner {
+	r.config.MalformedInput = action
+	return r
+}
+
+// WithMiddleware adds middleware around the agent's decision hooks. The
+// first middleware added is the outermost. Tracing, payload dumps, audit and
+// shadow mode wrap all of it, in that order from the outside.
+func (r *AgentRunner) WithMiddleware(mws ...Middleware) *AgentRunner {
+	r.middleware = append(r.middleware, mws...)
+	return r
+}
+
+// WithShadowMode sets shadow mode at startup. Configure events carrying
+// ShadowConfigKey switch it later.
+func (r *AgentRunner) WithShadowMode(config ShadowConfig) *AgentRunner {
+	r.config.Shadow = config
+	r.shadow.Set(config)
+	return r
+}
+
+// ShadowMode returns the runner's shadow mode, shared by all connections.
+func (r *AgentRunner) ShadowMode() *ShadowMode {
+	return r.shadow
+}
+
+// WithAuditSink writes decisions to sink instead of the audit log in the
+// configuration. Config.Audit.AllDecisions still decides which are written.
+func (r *AgentRunner) WithAuditSink(sink AuditSink) *AgentRunner {
+	r.audit = sink
+	return r
+}
+
+// WithTracerProvider traces every hook invocation with spans from
+// provider, overriding the tracing configuration.
+func (r *AgentRunner) WithTracerProvider(provider trace.TracerProvider) *AgentRunner {
+	r.tracer = NewTracer(provider)
+	return r
+}
+
+// Failures returns the number of failures seen across all connections, by
+// class.
+func (r *AgentRunner) Failures() map[FailureClass]uint64 {
+	return r.failures.Snapshot()
+}
+
 // WithConfig sets the full runner configuration.
 func (r *AgentRunner) WithConfig(config RunnerConfig) *AgentRunner {
 	r.config = config
+	r.shadow.Set(config.Shadow)
 	return r
 }
 
+// setupLogging builds the runner's logger from the configuration, unless
+// one was given to WithLogger, and puts its level under the debug control.
+// The global logger is left alone.
 func (r *AgentRunner) setupLogging() {
-	// Parse log level
-	level, err := zerolog.ParseLevel(r.config.LogLevel)
-	if err != nil {
-		level = zerolog.InfoLevel
-	}
-	zerolog.SetGlobalLevel(level)
-
-	if r.config.JSONLogs {
-		log.Logger = zerolog.New(os.Stdout).With().
-			Timestamp().
-			Str("agent", r.config.Name).
-			Logger()
-	} else {
-		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout}).With().
-			Timestamp().
+	if r.logger == nil {
+		logger := NewLogger(r.config.LogBackend, r.config.JSONLogs, r.config.LogLevel).With().
 			Str("agent", r.config.Name).
 			Logger()
+		r.logger = &logger
 	}
+
+	logger := r.debug.WithTTL(r.config.DebugTTL).Logger(*r.logger)
+	r.logger = &logger
 }
 
 func (r *AgentRunner) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	handler := NewAgentHandler(r.agent)
-	ctx := context.Background()
+	handler := NewAgentHandler(Wrap(r.agent, r.middleware...)).
+		WithFailurePolicy(r.config.FailurePolicy).
+		WithDeadlines(r.config.Deadlines).
+		WithMalformedInput(r.config.MalformedInput).
+		WithShadowMode(r.shadow).
+		WithAudit(r.audit, r.config.Audit.AllDecisions).
+		WithDebugControl(r.debug).
+		WithTracer(r.tracer)
+	handler.failures = &r.failures
+	stream := fmt.Sprintf("conn-%d", r.connID.Add(1))
+	logger := r.Logger().With().Str("stream_id", stream).Logger()
+	ctx := logger.WithContext(context.Background())
 
 	for {
 		select {
@@ -330,7 +685,7 @@ func (r *AgentRunner) handleConnection(conn net.Conn) {
 		msg, err := ReadMessage(conn)
 		if err != nil {
 			if err != io.EOF {
-				log.Error().Err(err).Msg("Failed to read message")
+				logger.Error().Err(err).Msg("Failed to read message")
 			}
 			return
 		}
@@ -339,13 +694,23 @@ func (r *AgentRunner) handleConnection(conn net.Conn) {
 		}
 
 		response, err := handler.HandleEvent(ctx, msg)
+		if errors.Is(err, ErrMalformedInput) {
+			logger.Warn().Err(err).Msg("Closing connection after malformed event")
+			return
+		}
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to handle event")
+			logger.Error().Err(err).Msg("Failed to handle event")
 			response = Allow().Build()
 		}
 
+		if r.capture != nil {
+			if err := r.capture.RecordV1(stream, msg, response); err != nil {
+				logger.Warn().Err(err).Msg("Failed to capture event")
+			}
+		}
+
 		if err := WriteMessage(conn, response); err != nil {
-			log.Error().Err(err).Msg("Failed to write response")
+			logger.Error().Err(err).Msg("Failed to write response")
 			return
 		}
 	}
@@ -355,6 +720,45 @@ func (r *AgentRunner) handleConnection(conn net.Conn) {
 func (r *AgentRunner) Run() error {
 	r.setupLogging()
 
+	if r.capture == nil && r.config.CapturePath != "" {
+		capture, err := CreateCapture(r.config.CapturePath)
+		if err != nil {
+			return err
+		}
+		defer capture.Close()
+		r.capture = capture
+	}
+
+	if r.audit == nil && r.config.Audit.Path != "" {
+		audit, err := NewAuditLog(r.config.Audit)
+		if err != nil {
+			return err
+		}
+		audit.WithLogger(*r.Logger())
+		defer audit.Close()
+		r.audit = audit
+	}
+
+	if r.tracer == nil && r.config.Tracing.Exporter != "" {
+		provider, err := NewTracerProvider(context.Background(), r.config.Tracing, r.config.Name)
+		if err != nil {
+			return err
+		}
+		defer shutdownTracerProvider(provider, r.Logger())
+		r.tracer = NewTracer(provider)
+	}
+
+	if r.config.AdminAddress != "" {
+		admin := NewAdminServer(r.config.AdminAddress).Handle("/debug/logging", r.debug)
+		if err := admin.Start(r.Logger()); err != nil {
+			return err
+		}
+		defer admin.Close()
+	}
+
+	stopSignals := r.debug.WatchSignals(r.Logger())
+	defer stopSignals()
+
 	// Clean up existing socket
 	if _, err := os.Stat(r.config.SocketPath); err == nil {
 		if err := os.Remove(r.config.SocketPath); err != nil {
@@ -371,7 +775,7 @@ func (r *AgentRunner) Run() error {
 
 	// Set socket permissions
 	if err := os.Chmod(r.config.SocketPath, 0660); err != nil {
-		log.Warn().Err(err).Msg("Failed to set socket permissions")
+		r.Logger().Warn().Err(err).Msg("Failed to set socket permissions")
 	}
 
 	// Set up signal handling
@@ -380,12 +784,12 @@ func (r *AgentRunner) Run() error {
 
 	go func() {
 		<-sigChan
-		log.Info().Msg("Shutdown signal received")
+		r.Logger().Info().Msg("Shutdown signal received")
 		close(r.shutdown)
 		r.listener.Close()
 	}()
 
-	log.Info().
+	r.Logger().Info().
 		Str("socket", r.config.SocketPath).
 		Str("name", r.config.Name).
 		Msg("Agent listening")
@@ -398,7 +802,7 @@ func (r *AgentRunner) Run() error {
 			case <-r.shutdown:
 				break
 			default:
-				log.Error().Err(err).Msg("Failed to accept connection")
+				r.Logger().Error().Err(err).Msg("Failed to accept connection")
 				continue
 			}
 			break
@@ -409,7 +813,7 @@ func (r *AgentRunner) Run() error {
 
 	// Cleanup
 	os.Remove(r.config.SocketPath)
-	log.Info().Msg("Agent shutdown complete")
+	r.Logger().Info().Msg("Agent shutdown complete")
 
 	return nil
 }
@@ -421,6 +825,25 @@ func ParseArgs() RunnerConfig {
 	pflag.StringVar(&config.SocketPath, "socket", config.SocketPath, "Unix socket path")
 	pflag.BoolVar(&config.JSONLogs, "json-logs", config.JSONLogs, "Enable JSON log format")
 	pflag.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Log level (debug, info, warn, error)")
+	pflag.StringVar(&config.LogBackend, "log-backend", config.LogBackend, "Logging backend (zerolog, slog)")
+	pflag.DurationVar(&config.DebugTTL, "debug-ttl", config.DebugTTL, "How long runtime log level and payload dump changes last (0 for no limit)")
+	pflag.StringVar(&config.AdminAddress, "admin-addr", "", "Serve admin endpoints over HTTP on this address")
+	pflag.StringVar(&config.CapturePath, "capture", "", "Append inbound events and responses to this JSONL file")
+	pflag.Var(&config.FailurePolicy.Default, "failure-mode", "Decision when a hook panics or times out (open, closed)")
+	pflag.DurationVar(&config.Deadlines.Default, "hook-timeout", 0, "Maximum time a hook may run (0 for no limit)")
+	pflag.Var(&config.MalformedInput, "malformed-input", "Action for events that cannot be parsed (allow, block, close)")
+	pflag.BoolVar(&config.Shadow.Enabled, "shadow-mode", false, "Allow every request, recording what the agent would have blocked")
+	pflag.BoolVar(&config.Shadow.SuppressMutations, "shadow-suppress-mutations", false, "In shadow mode, also drop header and body mutations")
+	pflag.StringVar(&config.Audit.Path, "audit-log", "", "Append blocking decisions to this JSONL audit log")
+	pflag.BoolVar(&config.Audit.AllDecisions, "audit-all", false, "Also write allow decisions to the audit log")
+	pflag.Int64Var(&config.Audit.MaxSize, "audit-max-size", 0, "Rotate the audit log at this many bytes (0 for no limit)")
+	pflag.DurationVar(&config.Audit.RotateEvery, "audit-rotate-every", 0, "Rotate the audit log at this interval (0 for never)")
+	pflag.IntVar(&config.Audit.MaxBackups, "audit-max-backups", 0, "Rotated audit logs to keep (0 keeps all)")
+	pflag.BoolVar(&config.Audit.Compress, "audit-compress", false, "Gzip rotated audit logs")
+	pflag.StringVar(&config.Tracing.Exporter, "otel-exporter", "", "Export hook spans (otlp, stdout, file)")
+	pflag.StringVar(&config.Tracing.Endpoint, "otel-endpoint", "", "OTLP collector address (host:port)")
+	pflag.BoolVar(&config.Tracing.Insecure, "otel-insecure", false, "Connect to the OTLP collector without TLS")
+	pflag.StringVar(&config.Tracing.File, "otel-file", "", "File the file exporter writes spans to")
 	pflag.Parse()
 
 	return config
@@ -441,6 +864,6 @@ func RunAgent(agent Agent) {
 	runner := NewAgentRunner(agent).WithConfig(config)
 
 	if err := runner.Run(); err != nil {
-		log.Fatal().Err(err).Msg("Agent failed")
+		runner.Logger().Fatal().Err(err).Msg("Agent failed")
 	}
 }
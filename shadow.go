@@ -0,0 +1,124 @@
+package zentinel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// ShadowConfigKey is the configuration key that switches shadow mode at
+// runtime. Its value is either a boolean or an object in the form of
+// ShadowConfig:
+//
+//	{"shadow_mode": {"enabled": true, "suppress_mutations": true}}
+const ShadowConfigKey = "shadow_mode"
+
+// ShadowConfig configures shadow mode.
+type ShadowConfig struct {
+	// Enabled turns shadow mode on.
+	Enabled bool `json:"enabled"`
+
+	// SuppressMutations also drops header operations, routing metadata and
+	// body mutations from every decision.
+	SuppressMutations bool `json:"suppress_mutations"`
+}
+
+// ShadowMode runs an agent in monitor-only mode: its decisions are
+// computed, but every request is allowed. A decision that would not have
+// allowed the request is logged, counted and recorded in the audit metadata
+// of the allow sent instead, tagged "would_block" with the original decision
+// under the "would_block" metadata key. It is safe for concurrent use and can
+// be switched at any time.
+//
+// The runners apply shadow mode to every decision hook, including the
+// failure policy's decision for a hook that panics or times out, and switch
+// it when a configure event carries ShadowConfigKey. The malformed input
+// action's decisions are not the agent's and are sent as configured. To
+// shadow a single route, wrap the route's agent with Middleware.
+type ShadowMode struct {
+	config     atomic.Pointer[ShadowConfig]
+	wouldBlock atomic.Uint64
+}
+
+// NewShadowMode creates a shadow mode with config.
+func NewShadowMode(config ShadowConfig) *ShadowMode {
+	s := &ShadowMode{}
+	s.Set(config)
+	return s
+}
+
+// Config returns the current configuration.
+func (s *ShadowMode) Config() ShadowConfig {
+	return *s.config.Load()
+}
+
+// Set replaces the configuration.
+func (s *ShadowMode) Set(config ShadowConfig) {
+	s.config.Store(&config)
+}
+
+// WouldBlock returns the number of requests allowed that the agent would
+// not have allowed.
+func (s *ShadowMode) WouldBlock() uint64 {
+	return s.wouldBlock.Load()
+}
+
+// Configure applies the ShadowConfigKey entry of a configure event's config,
+// if there is one, logging the change to ctx's logger.
+func (s *ShadowMode) Configure(ctx context.Context, config map[string]interface{}) error {
+	value, ok := config[ShadowConfigKey]
+	if !ok {
+		return nil
+	}
+
+	next := s.Config()
+	if enabled, ok := value.(bool); ok {
+		next.Enabled = enabled
+	} else {
+		data, _ := json.Marshal(value)
+		if err := json.Unmarshal(data, &next); err != nil {
+			return fmt.Errorf("invalid %s: %w", ShadowConfigKey, err)
+		}
+	}
+	s.Set(next)
+	LoggerFrom(ctx).Info().
+		Bool("enabled", next.Enabled).
+		Bool("suppress_mutations", next.SuppressMutations).
+		Msg("Shadow mode configured")
+	return nil
+}
+
+// Middleware returns middleware that applies shadow mode to the hooks it
+// wraps.
+func (s *ShadowMode) Middleware() Middleware {
+	return func(ctx context.Context, call *HookCall, next HookHandler) *Decision {
+		return s.Apply(ctx, call.Hook, next(ctx, call))
+	}
+}
+
+// Apply applies shadow mode to a decision made for hook and returns it.
+func (s *ShadowMode) Apply(ctx context.Context, hook Hook, decision *Decision) *Decision {
+	config := s.Config()
+	if !config.Enabled || decision == nil {
+		return decision
+	}
+
+	if !decision.IsAllow() {
+		s.wouldBlock.Add(1)
+		LoggerFrom(ctx).Info().
+			Str("hook", string(hook)).
+			Interface("decision", decision.decision).
+			Msg("Shadow mode allowed a request the agent would have blocked")
+		decision.WithMetadata("would_block", decision.decision).WithTag("would_block")
+		decision.decision = "allow"
+	}
+	if config.SuppressMutations {
+		decision.requestHeaders = []HeaderOp{}
+		decision.responseHeaders = []HeaderOp{}
+		decision.routingMetadata = map[string]string{}
+		decision.requestBodyMutation = nil
+		decision.responseBodyMutation = nil
+	}
+	return decision
+}
@@ -0,0 +1,103 @@
+package zentinel
+
+import (
+	"context"
+	"testing"
+)
+
+func TestShadowMode_AllowsAndRecords(t *testing.T) {
+	quietLogs(t)
+	shadow := NewShadowMode(ShadowConfig{Enabled: true})
+	agent := Wrap(&CustomAgent{}, shadow.Middleware())
+
+	response := agent.OnRequest(context.Background(), newTestRequest("GET", "/blocked")).Build()
+	if response.Decision != "allow" {
+		t.Fatalf("expected allow in shadow mode, got %v", response.Decision)
+	}
+	if len(response.Audit.Tags) == 0 || response.Audit.Tags[len(response.Audit.Tags)-1] != "would_block" {
+		t.Errorf("expected would_block tag, got %v", response.Audit.Tags)
+	}
+	original, _ := response.Audit.Custom["would_block"].(map[string]interface{})
+	if block, _ := original["block"].(map[string]interface{}); block["status"] != 403 {
+		t.Errorf("expected the original decision in audit metadata, got %v", response.Audit.Custom)
+	}
+	if shadow.WouldBlock() != 1 {
+		t.Errorf("expected one would-block count, got %d", shadow.WouldBlock())
+	}
+
+	shadow.Set(ShadowConfig{})
+	if response := agent.OnRequest(context.Background(), newTestRequest("GET", "/blocked")).Build(); response.Decision == "allow" {
+		t.Error("expected the real decision with shadow mode off")
+	}
+}
+
+func TestShadowMode_SuppressMutations(t *testing.T) {
+	shadow := NewShadowMode(ShadowConfig{Enabled: true, SuppressMutations: true})
+	next := func(ctx context.Context, call *HookCall) *Decision {
+		return Allow().AddRequestHeader("X-Test", "1").WithRoutingMetadata("pool", "a").WithTag("kept")
+	}
+
+	response := shadow.Middleware()(context.Background(), &HookCall{Hook: HookRequest, Request: newTestRequest("GET", "/")}, next).Build()
+	if len(response.RequestHeaders) != 0 || len(response.RoutingMetadata) != 0 {
+		t.Errorf("expected mutations to be dropped, got %v and %v", response.RequestHeaders, response.RoutingMetadata)
+	}
+	if len(response.Audit.Tags) != 1 {
+		t.Errorf("expected audit tags to be kept, got %v", response.Audit.Tags)
+	}
+}
+
+func TestShadowMode_Configure(t *testing.T) {
+	quietLogs(t)
+	shadow := NewShadowMode(ShadowConfig{})
+
+	if err := shadow.Configure(context.Background(), map[string]interface{}{"rate_limit": 100}); err != nil || shadow.Config().Enabled {
+		t.Errorf("expected no change without the key, got %+v, %v", shadow.Config(), err)
+	}
+	if err := shadow.Configure(context.Background(), map[string]interface{}{ShadowConfigKey: true}); err != nil || !shadow.Config().Enabled {
+		t.Errorf("expected shadow mode on, got %+v, %v", shadow.Config(), err)
+	}
+	err := shadow.Configure(context.Background(), map[string]interface{}{ShadowConfigKey: map[string]interface{}{"enabled": false, "suppress_mutations": true}})
+	if err != nil || shadow.Config() != (ShadowConfig{SuppressMutations: true}) {
+		t.Errorf("expected the object form to apply, got %+v, %v", shadow.Config(), err)
+	}
+	if err := shadow.Configure(context.Background(), map[string]interface{}{ShadowConfigKey: "yes"}); err == nil {
+		t.Error("expected an error for an invalid value")
+	}
+}
+
+func TestAgentHandler_ShadowModeFromConfigure(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandler(&CustomAgent{}).WithShadowMode(NewShadowMode(ShadowConfig{}))
+	ctx := context.Background()
+
+	if _, err := handler.HandleEvent(ctx, mustDecode(`{"event_type":"configure","payload":{"agent_id":"a","config":{"shadow_mode":true}}}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	response, err := handler.HandleEvent(ctx, mustDecode(`{"event_type":"request_headers","payload":{"metadata":{"correlation_id":"req-1"},"method":"GET","uri":"/blocked","headers":{}}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decision := response.(AgentResponse).Decision; decision != "allow" {
+		t.Errorf("expected allow after enabling shadow mode, got %v", decision)
+	}
+}
+
+func TestAgentHandler_ShadowModeFailClosed(t *testing.T) {
+	quietLogs(t)
+	shadow := NewShadowMode(ShadowConfig{Enabled: true})
+	handler := NewAgentHandler(&panickingAgent{}).
+		WithFailurePolicy(FailurePolicy{Default: FailClosed}).
+		WithShadowMode(shadow)
+
+	response, err := handler.HandleEvent(context.Background(), mustDecode(fuzzEvents[1]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	agentResponse := response.(AgentResponse)
+	if agentResponse.Decision != "allow" || agentResponse.Audit.Tags[1] != "would_block" {
+		t.Errorf("expected the fail-closed block to be shadowed, got %+v", agentResponse)
+	}
+	if shadow.WouldBlock() != 1 {
+		t.Errorf("expected one would-block request, got %d", shadow.WouldBlock())
+	}
+}
@@ -0,0 +1,202 @@
+package zentinel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Log backends for RunnerConfig.LogBackend.
+const (
+	LogBackendZerolog = "zerolog"
+	LogBackendSlog    = "slog"
+)
+
+// NewSlogLogger returns a zerolog logger that writes through handler, so
+// the SDK, which logs with zerolog, can log to an application's slog setup.
+// Every zerolog field becomes an attribute of the same name, with integers
+// kept exact; the level and message become the record's own, and the record
+// is timed when the event is written, at full precision.
+//
+// Example:
+//
+//	runner.WithLogger(zentinel.NewSlogLogger(slog.Default().Handler()))
+func NewSlogLogger(handler slog.Handler) zerolog.Logger {
+	return zerolog.New(&slogWriter{handler: handler})
+}
+
+// newSlogHandler creates the slog handler for the runners' slog backend. It
+// passes every level, leaving the logger's level, which a DebugControl may
+// change, to filter.
+func newSlogHandler(jsonLogs bool) slog.Handler {
+	options := &slog.HandlerOptions{Level: slogLevel(zerolog.TraceLevel)}
+	if jsonLogs {
+		return slog.NewJSONHandler(os.Stdout, options)
+	}
+	return slog.NewTextHandler(os.Stdout, options)
+}
+
+// SlogFrom returns LoggerFrom(ctx) as a slog logger, for agents that log
+// with slog. Records carry the same request fields.
+func SlogFrom(ctx context.Context) *slog.Logger {
+	return slog.New(&zerologHandler{logger: LoggerFrom(ctx)})
+}
+
+// slogWriter turns zerolog's JSON events into slog records.
+type slogWriter struct {
+	handler slog.Handler
+}
+
+func (w *slogWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *slogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	ctx := context.Background()
+	if !w.handler.Enabled(ctx, slogLevel(level)) {
+		return len(p), nil
+	}
+
+	// Decode field by field to keep their order
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	if _, err := decoder.Token(); err != nil {
+		return 0, err
+	}
+	timestamp := time.Now()
+	var message string
+	var attrs []slog.Attr
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, err
+		}
+		key, _ := token.(string)
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return 0, err
+		}
+
+		switch key {
+		case zerolog.LevelFieldName:
+		case zerolog.MessageFieldName:
+			message, _ = value.(string)
+		case zerolog.TimestampFieldName:
+			// The record's own time is more precise than zerolog's formatted one
+		default:
+			if number, ok := value.(json.Number); ok {
+				if i, err := number.Int64(); err == nil {
+					value = i
+				} else if u, err := strconv.ParseUint(number.String(), 10, 64); err == nil {
+					value = u
+				} else if f, err := number.Float64(); err == nil {
+					value = f
+				}
+			}
+			attrs = append(attrs, slog.Any(key, value))
+		}
+	}
+
+	record := slog.NewRecord(timestamp, slogLevel(level), message, 0)
+	record.AddAttrs(attrs...)
+	return len(p), w.handler.Handle(ctx, record)
+}
+
+// zerologHandler is a slog handler that writes to a zerolog logger.
+type zerologHandler struct {
+	logger *zerolog.Logger
+	group  string
+}
+
+func (h *zerologHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	l := zerologLevel(level)
+	return l >= h.logger.GetLevel() && l >= zerolog.GlobalLevel()
+}
+
+func (h *zerologHandler) Handle(ctx context.Context, record slog.Record) error {
+	event := h.logger.WithLevel(zerologLevel(record.Level))
+	if event == nil {
+		return nil
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		addSlogAttr(h.group, attr, func(key string, value interface{}) { event.Interface(key, value) })
+		return true
+	})
+	event.Msg(record.Message)
+	return nil
+}
+
+func (h *zerologHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	logCtx := h.logger.With()
+	for _, attr := range attrs {
+		addSlogAttr(h.group, attr, func(key string, value interface{}) { logCtx = logCtx.Interface(key, value) })
+	}
+	logger := logCtx.Logger()
+	return &zerologHandler{logger: &logger, group: h.group}
+}
+
+func (h *zerologHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &zerologHandler{logger: h.logger, group: h.group + name + "."}
+}
+
+// addSlogAttr flattens attr into fields, joining group names with dots.
+func addSlogAttr(prefix string, attr slog.Attr, add func(key string, value interface{})) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "."
+		}
+		for _, member := range attr.Value.Group() {
+			addSlogAttr(prefix, member, add)
+		}
+		return
+	}
+	if attr.Key != "" {
+		add(prefix+attr.Key, attr.Value.Any())
+	}
+}
+
+// slogLevel maps a zerolog level to slog's.
+func slogLevel(level zerolog.Level) slog.Level {
+	switch level {
+	case zerolog.TraceLevel:
+		return slog.LevelDebug - 4
+	case zerolog.DebugLevel:
+		return slog.LevelDebug
+	case zerolog.WarnLevel:
+		return slog.LevelWarn
+	case zerolog.ErrorLevel:
+		return slog.LevelError
+	case zerolog.FatalLevel:
+		return slog.LevelError + 4
+	case zerolog.PanicLevel:
+		return slog.LevelError + 8
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// zerologLevel maps a slog level to zerolog's.
+func zerologLevel(level slog.Level) zerolog.Level {
+	switch {
+	case level < slog.LevelDebug:
+		return zerolog.TraceLevel
+	case level < slog.LevelInfo:
+		return zerolog.DebugLevel
+	case level < slog.LevelWarn:
+		return zerolog.InfoLevel
+	case level < slog.LevelError:
+		return zerolog.WarnLevel
+	default:
+		return zerolog.ErrorLevel
+	}
+}
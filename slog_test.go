@@ -0,0 +1,88 @@
+package zentinel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	logger.Debug().Msg("hidden")
+	logger.Warn().Str("correlation_id", "req-1").Int("status", 403).Msg("blocked")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected one record, got %q", buf.String())
+	}
+	if record["level"] != "WARN" || record["msg"] != "blocked" {
+		t.Errorf("unexpected level or message in %v", record)
+	}
+	if record["correlation_id"] != "req-1" || record["status"] != float64(403) {
+		t.Errorf("expected the zerolog fields as attributes, got %v", record)
+	}
+}
+
+func TestNewSlogLogger_KeepsFieldOrder(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.NewTextHandler(&buf, nil))
+
+	logger.Info().Str("b", "1").Str("a", "2").Msg("ordered")
+	if line := buf.String(); !strings.Contains(line, "b=1 a=2") {
+		t.Errorf("expected fields in order, got %q", line)
+	}
+}
+
+func TestNewSlogLogger_KeepsPrecision(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.NewJSONHandler(&buf, nil))
+
+	before := time.Now()
+	logger.Info().Uint64("bytes", math.MaxUint64).Int64("offset", math.MinInt64).Msg("counted")
+
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected one record, got %q", buf.String())
+	}
+	if string(record["bytes"]) != "18446744073709551615" || string(record["offset"]) != "-9223372036854775808" {
+		t.Errorf("expected exact integers, got %s and %s", record["bytes"], record["offset"])
+	}
+	var timestamp time.Time
+	if err := json.Unmarshal(record["time"], &timestamp); err != nil || timestamp.Before(before) {
+		t.Errorf("expected the record timed when written, got %s", record["time"])
+	}
+}
+
+func TestSlogFrom(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).With().Str("correlation_id", "req-1").Logger()
+	ctx := logger.WithContext(context.Background())
+
+	SlogFrom(ctx).WithGroup("rule").Info("matched", "id", "sqli-1")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one entry, got %q", buf.String())
+	}
+	if entry["correlation_id"] != "req-1" || entry["rule.id"] != "sqli-1" || entry["message"] != "matched" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestNewLogger_Backends(t *testing.T) {
+	if logger := NewLogger(LogBackendSlog, true, "warn"); logger.GetLevel() != zerolog.WarnLevel {
+		t.Errorf("expected warn level, got %v", logger.GetLevel())
+	}
+	if logger := NewLogger(LogBackendZerolog, false, "bogus"); logger.GetLevel() != zerolog.InfoLevel {
+		t.Errorf("expected info level for an unknown level, got %v", logger.GetLevel())
+	}
+}
@@ -0,0 +1,98 @@
+package zentinel
+
+import "sync"
+
+// State holds values an agent carries between the phases of one request,
+// for example a matched rule in OnRequest read back in OnResponse. Every
+// phase of a request sees the same State, and the handlers clear it once
+// OnRequestComplete or OnCancel has returned. It is safe for concurrent use.
+//
+// StateKey gives typed access to individual values.
+type State struct {
+	mu     sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// Get returns the value stored under key.
+func (s *State) Get(key interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Set stores value under key.
+func (s *State) Set(key, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.values == nil {
+		s.values = make(map[interface{}]interface{})
+	}
+	s.values[key] = value
+}
+
+// Delete removes the value stored under key.
+func (s *State) Delete(key interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.values, key)
+}
+
+// Clear removes every value. The handlers call it when a request ends.
+func (s *State) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values = nil
+}
+
+// StateKey is a typed key into a request's State. Keys are compared by
+// identity, so create each once, typically as a package variable.
+//
+// Example:
+//
+//	var startKey = zentinel.NewStateKey[time.Time]("start")
+//
+//	func (a *MyAgent) OnRequest(ctx context.Context, req *zentinel.Request) *zentinel.Decision {
+//	    startKey.Set(req, time.Now())
+//	    return zentinel.Allow()
+//	}
+//
+//	func (a *MyAgent) OnRequestComplete(ctx context.Context, req *zentinel.Request, status, durationMS int) {
+//	    if start, ok := startKey.Get(req); ok {
+//	        observe(time.Since(start))
+//	    }
+//	}
+type StateKey[T any] struct {
+	name string
+}
+
+// NewStateKey creates a key. The name is for debugging only.
+func NewStateKey[T any](name string) *StateKey[T] {
+	return &StateKey[T]{name: name}
+}
+
+// Name returns the key's name.
+func (k *StateKey[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value stored under the key for request.
+func (k *StateKey[T]) Get(request *Request) (T, bool) {
+	value, ok := request.State().Get(k)
+	typed, _ := value.(T)
+	return typed, ok
+}
+
+// Set stores value under the key for request.
+func (k *StateKey[T]) Set(request *Request, value T) {
+	request.State().Set(k, value)
+}
+
+// Delete removes the value stored under the key for request.
+func (k *StateKey[T]) Delete(request *Request) {
+	request.State().Delete(k)
+}
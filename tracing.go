@@ -0,0 +1,223 @@
+package zentinel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the SDK's spans.
+const tracerName = "github.com/zentinelproxy/zentinel-agent-go-sdk"
+
+// noopSpan is returned by a nil Tracer.
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// Span attribute keys set by Tracer.
+const (
+	AttrHook          = attribute.Key("zentinel.hook")
+	AttrCorrelationID = attribute.Key("zentinel.correlation_id")
+	AttrRouteID       = attribute.Key("zentinel.route_id")
+	AttrUpstreamID    = attribute.Key("zentinel.upstream_id")
+	AttrDecision      = attribute.Key("zentinel.decision")
+	AttrBlockStatus   = attribute.Key("zentinel.block.status")
+	AttrRuleIDs       = attribute.Key("zentinel.rule_ids")
+	AttrTags          = attribute.Key("zentinel.tags")
+)
+
+// Tracer creates an OpenTelemetry span for each hook invocation. Spans are
+// children of the proxy's span, taken from the request's traceparent, and
+// the context passed to the hook carries the span, so agents can start
+// spans of their own beneath it.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer creates a tracer that starts spans with provider.
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// Start starts the span for a call of hook for request. The span is
+// parented on the request's traceparent if it has one, and on the span in
+// ctx otherwise. request may be nil for hooks without a request. On a nil
+// Tracer it returns ctx and a span that records nothing.
+func (t *Tracer) Start(ctx context.Context, hook Hook, request *Request) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noopSpan
+	}
+
+	attrs := []attribute.KeyValue{AttrHook.String(string(hook))}
+	if request != nil {
+		metadata := request.Metadata()
+		if metadata.Traceparent != nil {
+			carrier := propagation.MapCarrier{"traceparent": *metadata.Traceparent}
+			ctx = t.propagator.Extract(ctx, carrier)
+		}
+		attrs = append(attrs,
+			AttrCorrelationID.String(metadata.CorrelationID),
+			attribute.String("http.request.method", request.Method()),
+			attribute.String("url.path", request.PathOnly()))
+		if metadata.RouteID != nil {
+			attrs = append(attrs, AttrRouteID.String(*metadata.RouteID))
+		}
+		if metadata.UpstreamID != nil {
+			attrs = append(attrs, AttrUpstreamID.String(*metadata.UpstreamID))
+		}
+	}
+
+	return t.tracer.Start(ctx, "zentinel.agent."+string(hook),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+}
+
+// End records decision on span and ends it. decision may be nil for hooks
+// that do not decide.
+func (t *Tracer) End(span trace.Span, decision *Decision) {
+	if decision != nil && span.IsRecording() {
+		action, status := decision.action()
+		span.SetAttributes(AttrDecision.String(action))
+		if status != 0 {
+			span.SetAttributes(AttrBlockStatus.Int(status))
+		}
+		if len(decision.audit.RuleIDs) > 0 {
+			span.SetAttributes(AttrRuleIDs.StringSlice(decision.audit.RuleIDs))
+		}
+		if len(decision.audit.Tags) > 0 {
+			span.SetAttributes(AttrTags.StringSlice(decision.audit.Tags))
+		}
+	}
+	span.End()
+}
+
+// Middleware returns middleware that traces the decision hooks it wraps. A
+// panic in the hook is recorded on the span before it continues up the
+// stack.
+func (t *Tracer) Middleware() Middleware {
+	return func(ctx context.Context, call *HookCall, next HookHandler) (decision *Decision) {
+		ctx, span := t.Start(ctx, call.Hook, call.Request)
+		defer func() {
+			if r := recover(); r != nil {
+				span.SetStatus(codes.Error, fmt.Sprint("panic: ", r))
+				span.End()
+				panic(r)
+			}
+			t.End(span, decision)
+		}()
+		return next(ctx, call)
+	}
+}
+
+// action returns the decision's action, e.g. "allow" or "block", and the
+// block status if it blocks.
+func (d *Decision) action() (string, int) {
+	if action, ok := d.decision.(string); ok {
+		return action, 0
+	}
+	decision, _ := d.decision.(map[string]interface{})
+	for action, value := range decision {
+		if params, ok := value.(map[string]interface{}); ok && action == "block" {
+			status, _ := params["status"].(int)
+			return action, status
+		}
+		return action, 0
+	}
+	return "unknown", 0
+}
+
+// TracingConfig configures where spans are exported.
+type TracingConfig struct {
+	// Exporter is "otlp" to send spans to an OTLP/gRPC collector, "stdout" to
+	// print them, "file" to append them to File, or empty to disable tracing.
+	Exporter string `json:"exporter"`
+
+	// Endpoint is the collector's host:port for the otlp exporter. Empty uses
+	// the OTEL_EXPORTER_OTLP_ENDPOINT environment variable or localhost:4317.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Insecure disables TLS for the otlp exporter.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// File is the path spans are written to by the file exporter.
+	File string `json:"file,omitempty"`
+}
+
+// NewTracerProvider creates a tracer provider that batches spans to the
+// exporter in config, identifying them with serviceName. Shut it down to
+// flush the last spans before exiting.
+func NewTracerProvider(ctx context.Context, config TracingConfig, serviceName string) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "otlp":
+		options := []otlptracegrpc.Option{}
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		if config.File == "" {
+			return nil, fmt.Errorf("file exporter requires a file path")
+		}
+		var file *os.File
+		file, err = os.OpenFile(config.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		exporter = &closingExporter{SpanExporter: exporter, file: file}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	), nil
+}
+
+// shutdownTracerProvider flushes and stops provider when a runner exits.
+func shutdownTracerProvider(provider *sdktrace.TracerProvider, logger *zerolog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		logger.Warn().Err(err).Msg("Failed to flush spans")
+	}
+}
+
+// closingExporter closes the file a stdout exporter writes to on shutdown.
+type closingExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e *closingExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package zentinel
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanContextAgent records the span in the context each hook is called with.
+type spanContextAgent struct {
+	CustomAgent
+	spans []trace.SpanContext
+}
+
+func (a *spanContextAgent) OnRequest(ctx context.Context, request *Request) *Decision {
+	a.spans = append(a.spans, trace.SpanContextFromContext(ctx))
+	return a.CustomAgent.OnRequest(ctx, request).WithRuleID("rule-1")
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) (string, bool) {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value.Emit(), true
+		}
+	}
+	return "", false
+}
+
+func TestTracer_HandlerSpans(t *testing.T) {
+	quietLogs(t)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	agent := &spanContextAgent{}
+	handler := NewAgentHandler(agent).WithTracer(NewTracer(provider))
+
+	ctx := context.Background()
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	_, err := handler.HandleEvent(ctx, map[string]interface{}{
+		"event_type": "request_headers",
+		"payload": map[string]interface{}{
+			"metadata": map[string]interface{}{"correlation_id": "req-1", "route_id": "api", "traceparent": traceparent},
+			"method":   "GET",
+			"uri":      "/blocked",
+			"headers":  map[string]interface{}{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := handler.HandleEvent(ctx, map[string]interface{}{
+		"event_type": "request_complete",
+		"payload":    map[string]interface{}{"correlation_id": "req-1", "status": 403, "duration_ms": 1},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	request := spans[0]
+	if request.Name() != "zentinel.agent.request" {
+		t.Errorf("unexpected span name %q", request.Name())
+	}
+	if request.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || request.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the span to be parented on the traceparent, got %v", request.Parent())
+	}
+	for key, want := range map[string]string{
+		"zentinel.decision":     "block",
+		"zentinel.block.status": "403",
+		"zentinel.route_id":     "api",
+		"zentinel.rule_ids":     `["rule-1"]`,
+	} {
+		if got, _ := spanAttribute(request, key); got != want {
+			t.Errorf("expected %s %s, got %q", key, want, got)
+		}
+	}
+	if len(agent.spans) != 1 || agent.spans[0].SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("expected the hook context to carry the hook span")
+	}
+
+	complete := spans[1]
+	if complete.Name() != "zentinel.agent.request_complete" || complete.Parent().TraceID() != request.Parent().TraceID() {
+		t.Errorf("unexpected request complete span %q in trace %v", complete.Name(), complete.Parent().TraceID())
+	}
+}
+
+func TestTracer_Nil(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), HookRequest, newTestRequest("GET", "/"))
+	if span.IsRecording() || trace.SpanFromContext(ctx).IsRecording() {
+		t.Error("expected a nil tracer to record nothing")
+	}
+	tracer.End(span, Allow())
+}
+
+func TestNewTracerProvider_UnknownExporter(t *testing.T) {
+	if _, err := NewTracerProvider(context.Background(), TracingConfig{Exporter: "zipkin"}, "agent"); err == nil {
+		t.Error("expected an error for an unknown exporter")
+	}
+}
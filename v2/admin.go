@@ -0,0 +1,228 @@
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+// requestProgress is when an in-flight request arrived and the phase it has
+// reached.
+type requestProgress struct {
+	started time.Time
+	phase   zentinel.Hook
+}
+
+// setPhase records the phase a request has reached. h.mu must be held.
+func (h *AgentHandlerV2) setPhase(key requestKey, phase zentinel.Hook) {
+	if progress := h.progress[key]; progress != nil {
+		progress.phase = phase
+	}
+}
+
+// InFlightRequest describes a request the handler holds state for.
+type InFlightRequest struct {
+	ID            uint64 `json:"id"`
+	Stream        string `json:"stream,omitempty"`
+	CorrelationID string `json:"correlation_id"`
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+
+	// Phase is the hook of the last message seen for the request.
+	Phase zentinel.Hook `json:"phase"`
+
+	// AgeMS is how long ago the request's headers arrived.
+	AgeMS int64 `json:"age_ms"`
+
+	// The body bytes buffered so far.
+	RequestBodyBytes  int `json:"request_body_bytes"`
+	ResponseBodyBytes int `json:"response_body_bytes"`
+}
+
+// InFlight returns the requests the handler holds state for, by ID and
+// stream.
+func (h *AgentHandlerV2) InFlight() []InFlightRequest {
+	now := time.Now()
+
+	h.mu.RLock()
+	requests := make([]InFlightRequest, 0, len(h.requests))
+	for key, request := range h.requests {
+		inFlight := InFlightRequest{
+			ID:                key.id,
+			Stream:            key.stream,
+			CorrelationID:     request.CorrelationID(),
+			Method:            request.Method(),
+			Path:              request.PathOnly(),
+			RequestBodyBytes:  len(h.requestBodies[key]),
+			ResponseBodyBytes: len(h.responseBodies[key]),
+		}
+		if progress := h.progress[key]; progress != nil {
+			inFlight.Phase = progress.phase
+			inFlight.AgeMS = now.Sub(progress.started).Milliseconds()
+		}
+		requests = append(requests, inFlight)
+	}
+	h.mu.RUnlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].ID != requests[j].ID {
+			return requests[i].ID < requests[j].ID
+		}
+		return requests[i].Stream < requests[j].Stream
+	})
+	return requests
+}
+
+// LastHealth returns the status of the last health check the proxy asked
+// for, or nil if there has been none.
+func (h *AgentHandlerV2) LastHealth() *HealthStatus {
+	return h.health.Load()
+}
+
+// StreamInfo describes a connection or gRPC stream the runner is serving.
+type StreamInfo struct {
+	ID        string        `json:"id"`
+	Transport TransportType `json:"transport"`
+	Opened    time.Time     `json:"opened"`
+
+	// Protocol is "v1" for a UDS connection from a proxy that speaks the v1
+	// JSON protocol, "v2" otherwise.
+	Protocol string `json:"protocol"`
+}
+
+// Streams returns the connections and streams the runner is serving, oldest
+// first.
+func (r *AgentRunnerV2) Streams() []StreamInfo {
+	r.streamsMu.Lock()
+	streams := make([]StreamInfo, 0, len(r.streams))
+	for _, stream := range r.streams {
+		streams = append(streams, stream)
+	}
+	r.streamsMu.Unlock()
+
+	sort.Slice(streams, func(i, j int) bool {
+		if !streams[i].Opened.Equal(streams[j].Opened) {
+			return streams[i].Opened.Before(streams[j].Opened)
+		}
+		return streams[i].ID < streams[j].ID
+	})
+	return streams
+}
+
+// openStream records a stream until the returned function is called.
+func (r *AgentRunnerV2) openStream(id string, transport TransportType) (closed func()) {
+	r.streamsMu.Lock()
+	r.streams[id] = StreamInfo{ID: id, Transport: transport, Opened: time.Now(), Protocol: protocolV2}
+	r.streamsMu.Unlock()
+	r.handler.metrics.RecordStreamOpened(transport)
+
+	return func() {
+		r.streamsMu.Lock()
+		delete(r.streams, id)
+		r.streamsMu.Unlock()
+		r.handler.metrics.RecordStreamClosed(transport)
+	}
+}
+
+// setStreamProtocol records the protocol an open stream speaks.
+func (r *AgentRunnerV2) setStreamProtocol(id, protocol string) {
+	r.streamsMu.Lock()
+	if stream, ok := r.streams[id]; ok {
+		stream.Protocol = protocol
+		r.streams[id] = stream
+	}
+	r.streamsMu.Unlock()
+}
+
+// redacted replaces secrets in the configuration the admin endpoint shows.
+const redacted = "[REDACTED]"
+
+// secretKeys are parts of configuration keys whose values are redacted.
+var secretKeys = []string{"secret", "password", "passwd", "token", "apikey", "api_key", "credential", "private", "auth"}
+
+// adminConfig is the configuration the admin endpoint shows.
+type adminConfig struct {
+	Runner RunnerConfigV2 `json:"runner"`
+
+	// TLS is whether gRPC is served over TLS, in place of the TLS config.
+	TLS bool `json:"tls"`
+
+	// Agent is the configuration last applied to the agent.
+	Agent interface{} `json:"agent,omitempty"`
+}
+
+// redactedConfig returns the runner's and agent's configuration with
+// secrets replaced.
+func (r *AgentRunnerV2) redactedConfig() *adminConfig {
+	config := &adminConfig{Runner: r.config, TLS: r.config.TLSConfig != nil}
+	config.Runner.TLSConfig = nil
+	if config.Runner.AuthToken != "" {
+		config.Runner.AuthToken = redacted
+	}
+	if agent := r.handler.config.Load(); agent != nil {
+		config.Agent = redact(*agent)
+	}
+	return config
+}
+
+// redact returns a copy of value with the values of secret-looking keys
+// replaced, at any depth.
+func redact(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			if isSecretKey(key) {
+				copied[key] = redacted
+			} else {
+				copied[key] = redact(v)
+			}
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, v := range value {
+			copied[i] = redact(v)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerAdmin adds the runner's introspection endpoints to admin.
+func (r *AgentRunnerV2) registerAdmin(admin *zentinel.AdminServer) {
+	admin.Handle("/debug/logging", r.debug).
+		Handle("/debug/requests", adminJSON(func() interface{} { return r.handler.InFlight() })).
+		Handle("/debug/streams", adminJSON(func() interface{} { return r.Streams() })).
+		Handle("/debug/config", adminJSON(func() interface{} { return r.redactedConfig() })).
+		Handle("/debug/health", adminJSON(func() interface{} { return r.handler.LastHealth() })).
+		Handle("/debug/capabilities", adminJSON(func() interface{} { return r.agent.Capabilities() }))
+}
+
+// adminJSON serves the value fn returns as JSON to GET requests.
+func adminJSON(fn func() interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fn())
+	})
+}
@@ -0,0 +1,104 @@
+package v2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+func TestAgentHandlerV2_InFlight(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandlerV2(&TestAgentV2Impl{})
+	messages := fuzzMessages()
+
+	decide(t, handler, messages[1])
+	chunk, _ := NewV2Message(MsgTypeRequestBodyChunk, &V2RequestBodyChunk{
+		RequestID: 123,
+		Data:      base64.StdEncoding.EncodeToString([]byte("hello")),
+	})
+	decide(t, handler, chunk)
+
+	inFlight := handler.InFlight()
+	if len(inFlight) != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", len(inFlight))
+	}
+	request := inFlight[0]
+	if request.ID != 123 || request.Method != "POST" || request.Path != "/api/users" {
+		t.Errorf("unexpected request %+v", request)
+	}
+	if request.Phase != zentinel.HookRequestBody || request.RequestBodyBytes != 5 {
+		t.Errorf("expected 5 body bytes in the request body phase, got %+v", request)
+	}
+
+	handler.HandleMessage(context.Background(), messages[5])
+	if inFlight := handler.InFlight(); len(inFlight) != 0 {
+		t.Errorf("expected no requests after completion, got %v", inFlight)
+	}
+}
+
+func adminGet(t *testing.T, admin *zentinel.AdminServer, path string) string {
+	t.Helper()
+	resp, err := http.Get("http://" + admin.Addr().String() + path)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s returned %d: %s", path, resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+func TestAgentRunnerV2_Admin(t *testing.T) {
+	quietLogs(t)
+	config := DefaultRunnerConfigV2()
+	config.AuthToken = "token-value"
+	runner := NewAgentRunnerV2(&TestAgentV2Impl{}).WithConfig(config)
+	err := runner.handler.configure(context.Background(), map[string]interface{}{
+		"threshold": 5,
+		"upstream":  map[string]interface{}{"api_key": "key-value"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer runner.openStream("uds-1", TransportUDS)()
+
+	admin := zentinel.NewAdminServer("127.0.0.1:0")
+	runner.registerAdmin(admin)
+	logger := zerolog.Nop()
+	if err := admin.Start(&logger); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer admin.Close()
+
+	body := adminGet(t, admin, "/debug/config")
+	if strings.Contains(body, "token-value") || strings.Contains(body, "key-value") {
+		t.Errorf("expected secrets to be redacted, got %s", body)
+	}
+	var shown adminConfig
+	json.Unmarshal([]byte(body), &shown)
+	if agent, _ := shown.Agent.(map[string]interface{}); agent["threshold"] != float64(5) {
+		t.Errorf("expected the agent configuration, got %v", shown.Agent)
+	}
+
+	var streams []StreamInfo
+	json.Unmarshal([]byte(adminGet(t, admin, "/debug/streams")), &streams)
+	if len(streams) != 1 || streams[0].ID != "uds-1" || streams[0].Transport != TransportUDS {
+		t.Errorf("unexpected streams %v", streams)
+	}
+
+	if body := adminGet(t, admin, "/debug/capabilities"); !strings.Contains(body, "handles_request_headers") {
+		t.Errorf("expected the capabilities, got %s", body)
+	}
+	for _, path := range []string{"/debug/requests", "/debug/health", "/debug/logging", "/debug/pprof/", "/debug/vars"} {
+		adminGet(t, admin, path)
+	}
+}
@@ -2,6 +2,7 @@ package v2
 
 import (
 	"context"
+	"sync/atomic"
 
 	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
 )
@@ -172,6 +173,7 @@ type ConfigurableAgentV2Base[T any] struct {
 	*zentinel.ConfigurableAgentBase[T]
 	caps    *AgentCapabilities
 	metrics *MetricsCollector
+	canary  atomic.Pointer[CanaryConfig[T]]
 }
 
 // NewConfigurableAgentV2 creates a new ConfigurableAgentV2Base with default config.
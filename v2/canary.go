@@ -0,0 +1,188 @@
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+// CanaryConfigKey is the configuration key that starts a policy canary on a
+// ConfigurableAgentV2Base. Its value is a CanaryConfig. A configuration
+// without it stops any canary in progress.
+//
+//	{"enabled": true, "policy_canary": {"percent": 10, "config": {"enabled": true}}}
+const CanaryConfigKey = "policy_canary"
+
+// PolicyVariant names the configuration a request was evaluated with.
+type PolicyVariant string
+
+const (
+	// VariantStable is the current configuration.
+	VariantStable PolicyVariant = "stable"
+
+	// VariantCandidate is the configuration being canaried.
+	VariantCandidate PolicyVariant = "candidate"
+)
+
+// CanaryConfig evaluates a share of traffic with a candidate configuration.
+type CanaryConfig[T any] struct {
+	// Config is the candidate configuration.
+	Config T `json:"config"`
+
+	// Percent is the share of requests, from 0 to 100, evaluated with Config.
+	Percent float64 `json:"percent"`
+
+	// Header names the request header whose value buckets requests. Requests
+	// without it, or all requests if Header is empty, are bucketed by client
+	// IP.
+	Header string `json:"header,omitempty"`
+
+	// Compare also evaluates every request with the variant it was not
+	// assigned, to count disagreements. Hooks then run twice per request, so
+	// enable it only for agents whose hooks have no side effects.
+	Compare bool `json:"compare,omitempty"`
+}
+
+// canaryVariantKey forces the variant ConfigFor returns for a request.
+var canaryVariantKey = zentinel.NewStateKey[PolicyVariant]("canary.variant")
+
+// StartCanary starts evaluating a share of requests with a candidate
+// configuration, replacing any canary in progress.
+func (a *ConfigurableAgentV2Base[T]) StartCanary(canary CanaryConfig[T]) {
+	a.canary.Store(&canary)
+}
+
+// StopCanary evaluates every request with the stable configuration again.
+func (a *ConfigurableAgentV2Base[T]) StopCanary() {
+	a.canary.Store(nil)
+}
+
+// PromoteCanary makes the candidate configuration the stable one and stops
+// the canary. It does nothing if there is no canary.
+func (a *ConfigurableAgentV2Base[T]) PromoteCanary() {
+	if canary := a.canary.Swap(nil); canary != nil {
+		a.SetConfig(canary.Config)
+	}
+}
+
+// Canary returns the canary in progress, if any.
+func (a *ConfigurableAgentV2Base[T]) Canary() (CanaryConfig[T], bool) {
+	if canary := a.canary.Load(); canary != nil {
+		return *canary, true
+	}
+	return CanaryConfig[T]{}, false
+}
+
+// Variant returns the configuration variant request is evaluated with.
+// Bucketing is deterministic, so every phase of a request, and every request
+// with the same bucketing key, gets the same variant.
+func (a *ConfigurableAgentV2Base[T]) Variant(request *zentinel.Request) PolicyVariant {
+	if variant, ok := canaryVariantKey.Get(request); ok {
+		return variant
+	}
+	canary := a.canary.Load()
+	if canary == nil {
+		return VariantStable
+	}
+	return canaryBucket(request, canary.Header, canary.Percent)
+}
+
+// ConfigFor returns the configuration to evaluate request with: the
+// candidate for requests in the canary, the stable configuration otherwise.
+// Use it instead of Config in hooks that should take part in canaries.
+func (a *ConfigurableAgentV2Base[T]) ConfigFor(request *zentinel.Request) T {
+	if a.Variant(request) == VariantCandidate {
+		if canary := a.canary.Load(); canary != nil {
+			return canary.Config
+		}
+	}
+	return a.Config()
+}
+
+// OnConfigure applies the configuration and starts or stops a canary
+// according to its CanaryConfigKey entry.
+func (a *ConfigurableAgentV2Base[T]) OnConfigure(ctx context.Context, configMap map[string]interface{}) error {
+	value, ok := configMap[CanaryConfigKey]
+	if !ok || value == nil {
+		a.StopCanary()
+		return a.ConfigurableAgentBase.OnConfigure(ctx, configMap)
+	}
+
+	var canary CanaryConfig[T]
+	data, _ := json.Marshal(value)
+	if err := json.Unmarshal(data, &canary); err != nil {
+		return fmt.Errorf("invalid %s: %w", CanaryConfigKey, err)
+	}
+	if err := a.ConfigurableAgentBase.OnConfigure(ctx, configMap); err != nil {
+		return err
+	}
+	a.StartCanary(canary)
+	return nil
+}
+
+// CanaryMiddleware returns middleware that tags each decision with the
+// variant it was made under, as the "policy_variant:<variant>" audit tag and
+// the "policy_variant" audit metadata key, and counts requests per variant
+// in the agent's metrics. With CanaryConfig.Compare it also counts
+// disagreements between the variants.
+//
+// Example:
+//
+//	agent := NewMyAgent()
+//	v2.NewAgentRunnerV2(agent).WithMiddleware(agent.CanaryMiddleware())
+func (a *ConfigurableAgentV2Base[T]) CanaryMiddleware() zentinel.Middleware {
+	return func(ctx context.Context, call *zentinel.HookCall, next zentinel.HookHandler) *zentinel.Decision {
+		canary := a.canary.Load()
+		if canary == nil {
+			return next(ctx, call)
+		}
+
+		variant := a.Variant(call.Request)
+		decision := next(ctx, call)
+		if decision == nil {
+			return nil
+		}
+
+		metrics := a.MetricsCollectorRef()
+		if call.Hook == zentinel.HookRequest {
+			metrics.RecordCanaryRequest(variant)
+		}
+		if canary.Compare {
+			other := VariantCandidate
+			if variant == VariantCandidate {
+				other = VariantStable
+			}
+			canaryVariantKey.Set(call.Request, other)
+			alternative := next(ctx, call)
+			canaryVariantKey.Delete(call.Request)
+
+			disagree := alternative != nil && !reflect.DeepEqual(decision.Build().Decision, alternative.Build().Decision)
+			metrics.RecordCanaryComparison(disagree)
+		}
+
+		return decision.
+			WithTag("policy_variant:"+string(variant)).
+			WithMetadata("policy_variant", string(variant))
+	}
+}
+
+// canaryBucket assigns request to a variant by hashing its bucketing key.
+func canaryBucket(request *zentinel.Request, header string, percent float64) PolicyVariant {
+	key := request.ClientIP()
+	if header != "" {
+		if value := request.Header(header); value != "" {
+			key = value
+		}
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	if float64(hash.Sum32()%10000) < percent*100 {
+		return VariantCandidate
+	}
+	return VariantStable
+}
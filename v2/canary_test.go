@@ -0,0 +1,125 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+type canaryTestConfig struct {
+	BlockAdmin bool `json:"block_admin"`
+}
+
+// canaryTestAgent blocks /admin when its configuration for the request says
+// so.
+type canaryTestAgent struct {
+	*ConfigurableAgentV2Base[canaryTestConfig]
+}
+
+func (a *canaryTestAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	if a.ConfigFor(request).BlockAdmin && request.PathStartsWith("/admin") {
+		return zentinel.Deny()
+	}
+	return zentinel.Allow()
+}
+
+func newCanaryTestAgent() *canaryTestAgent {
+	return &canaryTestAgent{NewConfigurableAgentV2(canaryTestConfig{})}
+}
+
+func canaryRequest(clientIP, user string) *zentinel.Request {
+	return zentinel.NewRequest(&zentinel.RequestHeadersEvent{
+		Metadata: zentinel.RequestMetadata{ClientIP: clientIP},
+		Method:   "GET",
+		URI:      "/admin",
+		Headers:  map[string][]string{"x-user": {user}},
+	}, nil)
+}
+
+func TestCanary_Bucketing(t *testing.T) {
+	agent := newCanaryTestAgent()
+	if agent.Variant(canaryRequest("10.0.0.1", "")) != VariantStable {
+		t.Error("expected the stable variant without a canary")
+	}
+
+	agent.StartCanary(CanaryConfig[canaryTestConfig]{Percent: 25})
+	candidates := 0
+	for i := 0; i < 1000; i++ {
+		request := canaryRequest(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "")
+		variant := agent.Variant(request)
+		if variant != agent.Variant(request) {
+			t.Fatal("expected bucketing to be deterministic")
+		}
+		if variant == VariantCandidate {
+			candidates++
+		}
+	}
+	if candidates < 150 || candidates > 350 {
+		t.Errorf("expected about 25%% candidates, got %d of 1000", candidates)
+	}
+
+	agent.StartCanary(CanaryConfig[canaryTestConfig]{Percent: 100, Header: "x-user"})
+	if agent.Variant(canaryRequest("10.0.0.1", "alice")) != VariantCandidate {
+		t.Error("expected every request in the canary at 100%")
+	}
+	agent.StartCanary(CanaryConfig[canaryTestConfig]{Percent: 0, Header: "x-user"})
+	if agent.Variant(canaryRequest("10.0.0.1", "alice")) != VariantStable {
+		t.Error("expected no request in the canary at 0%")
+	}
+}
+
+func TestCanary_MiddlewareTagsAndCompares(t *testing.T) {
+	agent := newCanaryTestAgent()
+	agent.StartCanary(CanaryConfig[canaryTestConfig]{
+		Config:  canaryTestConfig{BlockAdmin: true},
+		Percent: 100,
+		Compare: true,
+	})
+	wrapped := Wrap(agent, agent.CanaryMiddleware())
+
+	response := wrapped.OnRequest(context.Background(), canaryRequest("10.0.0.1", "")).Build()
+	if response.Decision == "allow" {
+		t.Error("expected the candidate configuration to block")
+	}
+	if response.Audit.Custom["policy_variant"] != "candidate" || response.Audit.Tags[0] != "policy_variant:candidate" {
+		t.Errorf("expected the candidate variant in audit, got %+v", response.Audit)
+	}
+
+	canary := agent.Metrics(context.Background()).Canary
+	if canary == nil || canary.Requests[VariantCandidate] != 1 || canary.Disagreements != 1 || canary.DisagreementRate != 1 {
+		t.Errorf("expected one disagreeing candidate request, got %+v", canary)
+	}
+}
+
+func TestCanary_ConfigureAndPromote(t *testing.T) {
+	agent := newCanaryTestAgent()
+	ctx := context.Background()
+
+	err := agent.OnConfigure(ctx, map[string]interface{}{
+		CanaryConfigKey: map[string]interface{}{"percent": 10, "config": map[string]interface{}{"block_admin": true}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if canary, ok := agent.Canary(); !ok || canary.Percent != 10 || !canary.Config.BlockAdmin {
+		t.Errorf("expected the canary from configuration, got %+v", canary)
+	}
+
+	agent.PromoteCanary()
+	if _, ok := agent.Canary(); ok || !agent.Config().BlockAdmin {
+		t.Error("expected the candidate to become the stable configuration")
+	}
+
+	agent.StartCanary(CanaryConfig[canaryTestConfig]{Percent: 10})
+	if err := agent.OnConfigure(ctx, map[string]interface{}{"block_admin": false}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := agent.Canary(); ok {
+		t.Error("expected configuration without a canary to stop it")
+	}
+	if err := agent.OnConfigure(ctx, map[string]interface{}{CanaryConfigKey: "oops"}); err == nil {
+		t.Error("expected an error for an invalid canary")
+	}
+}
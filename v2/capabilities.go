@@ -35,6 +35,11 @@ type AgentCapabilities struct {
 
 	// SupportedFeatures lists additional features the agent supports.
 	SupportedFeatures []string `json:"supported_features,omitempty"`
+
+	// MinProtocolVersion and MaxProtocolVersion bound the protocol versions
+	// the agent accepts in the handshake. Zero means the SDK's own bound.
+	MinProtocolVersion uint32 `json:"min_protocol_version,omitempty"`
+	MaxProtocolVersion uint32 `json:"max_protocol_version,omitempty"`
 }
 
 // NewAgentCapabilities creates a new AgentCapabilities with default values.
@@ -112,6 +117,45 @@ func (c *AgentCapabilities) WithFeatures(features ...string) *AgentCapabilities
 	return c
 }
 
+// WithProtocolVersions sets the range of protocol versions the agent accepts.
+func (c *AgentCapabilities) WithProtocolVersions(min, max uint32) *AgentCapabilities {
+	c.MinProtocolVersion = min
+	c.MaxProtocolVersion = max
+	return c
+}
+
+// ProtocolVersions returns the range of protocol versions the agent accepts,
+// within those the SDK speaks.
+func (c *AgentCapabilities) ProtocolVersions() (min, max uint32) {
+	min, max = MinProtocolVersion, MaxProtocolVersion
+	if c == nil {
+		return min, max
+	}
+	if c.MinProtocolVersion > min {
+		min = c.MinProtocolVersion
+	}
+	if c.MaxProtocolVersion != 0 && c.MaxProtocolVersion < max {
+		max = c.MaxProtocolVersion
+	}
+	return min, max
+}
+
+// wantedFeatures returns the features the agent asks for in the handshake.
+func (c *AgentCapabilities) wantedFeatures() []string {
+	if c == nil {
+		return []string{FeatureRawBody}
+	}
+	var features []string
+	if c.SupportsStreaming && !c.HasFeature(FeatureStreaming) {
+		features = append(features, FeatureStreaming)
+	}
+	features = append(features, c.SupportedFeatures...)
+	if !c.HasFeature(FeatureRawBody) {
+		features = append(features, FeatureRawBody)
+	}
+	return features
+}
+
 // All enables all processing capabilities.
 func (c *AgentCapabilities) All() *AgentCapabilities {
 	return c.
@@ -132,6 +176,8 @@ func (c *AgentCapabilities) Clone() *AgentCapabilities {
 		HandlesResponseBody:    c.HandlesResponseBody,
 		SupportsStreaming:      c.SupportsStreaming,
 		SupportsCancellation:   c.SupportsCancellation,
+		MinProtocolVersion:     c.MinProtocolVersion,
+		MaxProtocolVersion:     c.MaxProtocolVersion,
 	}
 	if c.MaxConcurrentRequests != nil {
 		max := *c.MaxConcurrentRequests
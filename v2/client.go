@@ -0,0 +1,571 @@
+package v2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"google.golang.org/grpc"
+)
+
+// Decision actions as they appear in a v2 Decision message.
+const (
+	ActionAllow     = "allow"
+	ActionBlock     = "block"
+	ActionRedirect  = "redirect"
+	ActionChallenge = "challenge"
+)
+
+// ErrClientClosed is returned for calls on a closed Client and for calls that
+// were waiting when the connection went away.
+var ErrClientClosed = errors.New("client closed")
+
+// ClientDecision is a decision received by a Client.
+type ClientDecision struct {
+	// RequestID is the request the decision belongs to.
+	RequestID uint64
+
+	// Action is one of ActionAllow, ActionBlock, ActionRedirect or ActionChallenge.
+	Action string
+
+	// NeedsMore is set when the agent asked for more body data before deciding.
+	NeedsMore bool
+
+	// Status is the block or redirect status code.
+	Status int
+
+	// Body is the block response body.
+	Body string
+
+	// BlockHeaders are the headers to send with a block response.
+	BlockHeaders map[string]string
+
+	// RedirectURL is the redirect target.
+	RedirectURL string
+
+	// ChallengeType and ChallengeParams describe a challenge.
+	ChallengeType   string
+	ChallengeParams map[string]interface{}
+
+	// RequestHeaders are the header operations for the upstream request.
+	RequestHeaders []V2HeaderOp
+
+	// ResponseHeaders are the header operations for the client response.
+	ResponseHeaders []V2HeaderOp
+
+	// Audit is the audit metadata attached to the decision.
+	Audit zentinel.AuditMetadata
+
+	// RequestBodyMutation and ResponseBodyMutation replace a body chunk. They
+	// are set only if the handshake negotiated FeatureBodyMutation.
+	RequestBodyMutation  map[string]interface{}
+	ResponseBodyMutation map[string]interface{}
+}
+
+// IsAllow returns true if the request may proceed.
+func (d *ClientDecision) IsAllow() bool {
+	return d.Action == ActionAllow
+}
+
+// ParseDecision decodes the payload of a v2 Decision message.
+func ParseDecision(payload []byte) (*ClientDecision, error) {
+	var wire struct {
+		RequestID       uint64                 `json:"request_id"`
+		Decision        json.RawMessage        `json:"decision"`
+		RequestHeaders  []V2HeaderOp           `json:"request_headers"`
+		ResponseHeaders []V2HeaderOp           `json:"response_headers"`
+		Audit           zentinel.AuditMetadata `json:"audit"`
+
+		RequestBodyMutation  map[string]interface{} `json:"request_body_mutation"`
+		ResponseBodyMutation map[string]interface{} `json:"response_body_mutation"`
+	}
+	if err := json.Unmarshal(payload, &wire); err != nil {
+		return nil, fmt.Errorf("failed to parse decision: %w", err)
+	}
+
+	d := &ClientDecision{
+		RequestID:       wire.RequestID,
+		RequestHeaders:  wire.RequestHeaders,
+		ResponseHeaders: wire.ResponseHeaders,
+		Audit:           wire.Audit,
+
+		RequestBodyMutation:  wire.RequestBodyMutation,
+		ResponseBodyMutation: wire.ResponseBodyMutation,
+	}
+
+	// The decision is either the string "allow" or an object keyed by action.
+	var action string
+	if err := json.Unmarshal(wire.Decision, &action); err == nil {
+		d.Action = action
+		return d, nil
+	}
+
+	var obj struct {
+		NeedsMore bool `json:"needs_more"`
+		Block     *struct {
+			Status  int               `json:"status"`
+			Body    string            `json:"body"`
+			Headers map[string]string `json:"headers"`
+		} `json:"block"`
+		Redirect *struct {
+			URL    string `json:"url"`
+			Status int    `json:"status"`
+		} `json:"redirect"`
+		Challenge *struct {
+			ChallengeType string                 `json:"challenge_type"`
+			Params        map[string]interface{} `json:"params"`
+		} `json:"challenge"`
+	}
+	if err := json.Unmarshal(wire.Decision, &obj); err != nil {
+		return nil, fmt.Errorf("failed to parse decision %s: %w", string(wire.Decision), err)
+	}
+
+	switch {
+	case obj.NeedsMore:
+		d.Action = ActionAllow
+		d.NeedsMore = true
+	case obj.Block != nil:
+		d.Action = ActionBlock
+		d.Status = obj.Block.Status
+		d.Body = obj.Block.Body
+		d.BlockHeaders = obj.Block.Headers
+	case obj.Redirect != nil:
+		d.Action = ActionRedirect
+		d.Status = obj.Redirect.Status
+		d.RedirectURL = obj.Redirect.URL
+	case obj.Challenge != nil:
+		d.Action = ActionChallenge
+		d.ChallengeType = obj.Challenge.ChallengeType
+		d.ChallengeParams = obj.Challenge.Params
+	default:
+		return nil, fmt.Errorf("unknown decision: %s", string(wire.Decision))
+	}
+	return d, nil
+}
+
+// Client is the proxy side of the v2 protocol. It is safe for concurrent use:
+// requests are multiplexed over a single connection and decisions are matched
+// to callers by request ID.
+//
+// Example:
+//
+//	client, err := v2.DialClientUDS(ctx, "/tmp/my-agent.sock", "my-gateway")
+//	if err != nil {
+//	    return err
+//	}
+//	defer client.Close()
+//
+//	decision, err := client.RequestHeaders(ctx, &v2.V2RequestHeaders{
+//	    Method: "GET",
+//	    URI:    "/api/users",
+//	})
+type Client struct {
+	conn      ProxyConn
+	handshake *HandshakeResponse
+	nextID    atomic.Uint64
+
+	mu        sync.Mutex
+	decisions map[uint64]chan *V2Message
+	replies   map[byte][]chan *V2Message
+	closed    chan struct{}
+	closeErr  error
+	closeOnce sync.Once
+}
+
+// NewClient creates a client on an established connection and starts reading
+// from it. No handshake is performed; call Handshake before sending requests.
+func NewClient(conn ProxyConn) *Client {
+	c := &Client{
+		conn:      conn,
+		decisions: make(map[uint64]chan *V2Message),
+		replies:   make(map[byte][]chan *V2Message),
+		closed:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// DialClientUDS connects to an agent on a Unix socket and performs the
+// handshake.
+func DialClientUDS(ctx context.Context, socketPath, clientName string) (*Client, error) {
+	conn, err := DialUDS(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return handshakeClient(ctx, conn, clientName)
+}
+
+// DialClientGRPC connects to an agent serving gRPC and performs the
+// handshake. Health and metrics requests are not available over gRPC. As
+// with DialGRPC, the stream lives until Close is called or ctx is cancelled.
+func DialClientGRPC(ctx context.Context, address, clientName string, opts ...grpc.DialOption) (*Client, error) {
+	conn, err := DialGRPC(ctx, address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return handshakeClient(ctx, conn, clientName)
+}
+
+func handshakeClient(ctx context.Context, conn ProxyConn, clientName string) (*Client, error) {
+	c := NewClient(conn)
+	resp, err := c.Handshake(ctx, NewHandshakeRequest(clientName).WithFeatures(FeatureRawBody, FeatureBodyMutation))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !resp.Accepted {
+		c.Close()
+		return nil, fmt.Errorf("handshake rejected: %s", resp.Error)
+	}
+	return c, nil
+}
+
+// Handshake sends a handshake request and returns the agent's response.
+func (c *Client) Handshake(ctx context.Context, req *HandshakeRequest) (*HandshakeResponse, error) {
+	reply, err := c.call(ctx, MsgTypeHandshakeRequest, MsgTypeHandshakeResponse, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := UnmarshalHandshakeResponse(reply.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.handshake = resp
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// HandshakeResponse returns the response to the last handshake, or nil.
+func (c *Client) HandshakeResponse() *HandshakeResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.handshake
+}
+
+// NextRequestID returns a request ID not yet used by this client.
+func (c *Client) NextRequestID() uint64 {
+	return c.nextID.Add(1)
+}
+
+// RequestHeaders sends request headers and waits for the decision. A zero
+// RequestID is replaced with NextRequestID, and the ID used is written back
+// to headers.
+func (c *Client) RequestHeaders(ctx context.Context, headers *V2RequestHeaders) (*ClientDecision, error) {
+	if headers.RequestID == 0 {
+		headers.RequestID = c.NextRequestID()
+	}
+	if headers.Headers == nil {
+		headers.Headers = map[string][]string{}
+	}
+	if headers.Metadata.CorrelationID == "" {
+		headers.Metadata.CorrelationID = fmt.Sprintf("%d", headers.RequestID)
+	}
+	return c.decide(ctx, MsgTypeRequestHeaders, headers.RequestID, headers)
+}
+
+// RequestBodyChunk sends a request body chunk and waits for the decision.
+// Chunks before the last are usually answered with NeedsMore.
+func (c *Client) RequestBodyChunk(ctx context.Context, chunk *V2RequestBodyChunk) (*ClientDecision, error) {
+	return c.decide(ctx, MsgTypeRequestBodyChunk, chunk.RequestID, chunk)
+}
+
+// RequestBodyChunkRaw sends a request body chunk and waits for the decision.
+// The chunk goes in a raw frame if the handshake negotiated FeatureRawBody,
+// and base64-encoded in JSON otherwise.
+func (c *Client) RequestBodyChunkRaw(ctx context.Context, chunk *RawBodyChunk) (*ClientDecision, error) {
+	return c.decideChunk(ctx, MsgTypeRequestBodyChunkRaw, MsgTypeRequestBodyChunk, chunk)
+}
+
+// ResponseHeaders sends response headers and waits for the decision.
+func (c *Client) ResponseHeaders(ctx context.Context, headers *V2ResponseHeaders) (*ClientDecision, error) {
+	if headers.Headers == nil {
+		headers.Headers = map[string][]string{}
+	}
+	return c.decide(ctx, MsgTypeResponseHeaders, headers.RequestID, headers)
+}
+
+// ResponseBodyChunk sends a response body chunk and waits for the decision.
+func (c *Client) ResponseBodyChunk(ctx context.Context, chunk *V2ResponseBodyChunk) (*ClientDecision, error) {
+	return c.decide(ctx, MsgTypeResponseBodyChunk, chunk.RequestID, chunk)
+}
+
+// ResponseBodyChunkRaw sends a response body chunk as RequestBodyChunkRaw
+// does.
+func (c *Client) ResponseBodyChunkRaw(ctx context.Context, chunk *RawBodyChunk) (*ClientDecision, error) {
+	return c.decideChunk(ctx, MsgTypeResponseBodyChunkRaw, MsgTypeResponseBodyChunk, chunk)
+}
+
+// decideChunk sends chunk as a rawType frame if the handshake negotiated
+// FeatureRawBody, or as a jsonType message otherwise.
+func (c *Client) decideChunk(ctx context.Context, rawType, jsonType byte, chunk *RawBodyChunk) (*ClientDecision, error) {
+	if hs := c.HandshakeResponse(); hs != nil && hs.hasFeature(FeatureRawBody) {
+		return c.decideMessage(ctx, chunk.RequestID, NewRawBodyChunkMessage(rawType, chunk))
+	}
+	return c.decide(ctx, jsonType, chunk.RequestID, &V2RequestBodyChunk{
+		RequestID:  chunk.RequestID,
+		ChunkIndex: chunk.ChunkIndex,
+		Data:       base64.StdEncoding.EncodeToString(chunk.Data),
+		IsLast:     chunk.IsLast,
+	})
+}
+
+// RequestComplete tells the agent the request has finished. The agent does
+// not reply.
+func (c *Client) RequestComplete(ctx context.Context, complete *V2RequestComplete) error {
+	return c.send(MsgTypeRequestComplete, complete)
+}
+
+// Cancel cancels a request. A caller waiting for its decision gets
+// context.Canceled.
+func (c *Client) Cancel(ctx context.Context, requestID uint64, reason string) error {
+	msg := CancelRequestMessage{RequestID: requestID}
+	if reason != "" {
+		msg.Reason = &reason
+	}
+
+	c.mu.Lock()
+	if ch, ok := c.decisions[requestID]; ok {
+		delete(c.decisions, requestID)
+		close(ch)
+	}
+	c.mu.Unlock()
+
+	return c.send(MsgTypeCancelRequest, msg)
+}
+
+// Ping sends a ping and returns the round-trip time.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if _, err := c.call(ctx, MsgTypePing, MsgTypePong, PingMessage{Timestamp: start.UnixMilli()}); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Health requests the agent's health status.
+func (c *Client) Health(ctx context.Context) (*HealthStatus, error) {
+	reply, err := c.call(ctx, MsgTypeHealthRequest, MsgTypeHealthResponse, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	var status HealthStatus
+	if err := reply.ParsePayload(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse health status: %w", err)
+	}
+	return &status, nil
+}
+
+// Metrics requests the agent's metrics report.
+func (c *Client) Metrics(ctx context.Context) (*MetricsReport, error) {
+	reply, err := c.call(ctx, MsgTypeMetricsRequest, MsgTypeMetricsResponse, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	var report MetricsReport
+	if err := reply.ParsePayload(&report); err != nil {
+		return nil, fmt.Errorf("failed to parse metrics report: %w", err)
+	}
+	return &report, nil
+}
+
+// Close closes the connection. Calls still waiting return ErrClientClosed.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	c.shutdown(ErrClientClosed)
+	return err
+}
+
+// Done returns a channel that is closed when the connection is gone.
+func (c *Client) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Err returns why the connection is gone, or nil while it is open.
+func (c *Client) Err() error {
+	select {
+	case <-c.closed:
+		return c.closeErr
+	default:
+		return nil
+	}
+}
+
+func (c *Client) send(msgType byte, payload interface{}) error {
+	msg, err := NewV2Message(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage(msg)
+}
+
+func (c *Client) sendMessage(msg *V2Message) error {
+	select {
+	case <-c.closed:
+		return c.closeErr
+	default:
+	}
+	return c.conn.Send(msg)
+}
+
+// decide sends a request event and waits for the decision with the same
+// request ID. If ctx ends first, the request is cancelled on the agent.
+func (c *Client) decide(ctx context.Context, msgType byte, requestID uint64, payload interface{}) (*ClientDecision, error) {
+	msg, err := NewV2Message(msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.decideMessage(ctx, requestID, msg)
+}
+
+// decideMessage is decide for a message already built.
+func (c *Client) decideMessage(ctx context.Context, requestID uint64, msg *V2Message) (*ClientDecision, error) {
+	ch := make(chan *V2Message, 1)
+
+	c.mu.Lock()
+	if _, ok := c.decisions[requestID]; ok {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("request %d is already waiting for a decision", requestID)
+	}
+	c.decisions[requestID] = ch
+	c.mu.Unlock()
+
+	if err := c.sendMessage(msg); err != nil {
+		c.forget(requestID, ch)
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			if err := c.Err(); err != nil {
+				return nil, err
+			}
+			return nil, context.Canceled
+		}
+		if reply.Type == MsgTypeProtocolError {
+			var protocolErr ProtocolErrorMessage
+			if err := reply.ParsePayload(&protocolErr); err != nil {
+				return nil, fmt.Errorf("failed to parse protocol error: %w", err)
+			}
+			return nil, &protocolErr
+		}
+		return ParseDecision(reply.Payload)
+	case <-ctx.Done():
+		c.forget(requestID, ch)
+		c.Cancel(context.Background(), requestID, ctx.Err().Error())
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) forget(requestID uint64, ch chan *V2Message) {
+	c.mu.Lock()
+	if c.decisions[requestID] == ch {
+		delete(c.decisions, requestID)
+	}
+	c.mu.Unlock()
+}
+
+// call sends a message without a request ID and waits for the next reply of
+// the given type.
+func (c *Client) call(ctx context.Context, msgType, replyType byte, payload interface{}) (*V2Message, error) {
+	ch := make(chan *V2Message, 1)
+
+	c.mu.Lock()
+	c.replies[replyType] = append(c.replies[replyType], ch)
+	c.mu.Unlock()
+
+	if err := c.send(msgType, payload); err != nil {
+		c.dropReply(replyType, ch)
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, c.Err()
+		}
+		return reply, nil
+	case <-ctx.Done():
+		c.dropReply(replyType, ch)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) dropReply(replyType byte, ch chan *V2Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waiters := c.replies[replyType]
+	for i, w := range waiters {
+		if w == ch {
+			c.replies[replyType] = append(waiters[:i:i], waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Client) readLoop() {
+	for {
+		msg, err := c.conn.Recv()
+		if err != nil {
+			c.shutdown(fmt.Errorf("%w: %v", ErrClientClosed, err))
+			return
+		}
+		c.dispatch(msg)
+	}
+}
+
+func (c *Client) dispatch(msg *V2Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if msg.Type == MsgTypeDecision || msg.Type == MsgTypeProtocolError {
+		var header struct {
+			RequestID *uint64 `json:"request_id"`
+		}
+		if err := json.Unmarshal(msg.Payload, &header); err != nil || header.RequestID == nil {
+			return
+		}
+		// Replies for cancelled or unknown requests are dropped, as are
+		// protocol errors that name no request.
+		if ch, ok := c.decisions[*header.RequestID]; ok {
+			delete(c.decisions, *header.RequestID)
+			ch <- msg
+		}
+		return
+	}
+
+	waiters := c.replies[msg.Type]
+	if len(waiters) == 0 {
+		return
+	}
+	waiters[0] <- msg
+	c.replies[msg.Type] = waiters[1:]
+}
+
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.closeErr = err
+		close(c.closed)
+		for id, ch := range c.decisions {
+			delete(c.decisions, id)
+			close(ch)
+		}
+		for msgType, waiters := range c.replies {
+			for _, ch := range waiters {
+				close(ch)
+			}
+			delete(c.replies, msgType)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+// Compose runs several agents as one. Each decision hook calls the agents in
+// order and stops at the first that does not allow the request; the header
+// operations, routing metadata and audit tags of the agents called are merged
+// in order (see zentinel.Decision.Merge). The composed capabilities are the
+// union of the agents' own. Agents that do not implement AgentV2 are assumed
+// to handle request and response headers and bodies.
+//
+// Configuration, completion, guardrail and lifecycle hooks go to every agent.
+// Each agent receives the whole configuration.
+//
+// Example:
+//
+//	agent := v2.Compose(&IPAllowlist{}, &AuthAgent{}, &WAFAgent{})
+//	v2.NewAgentRunnerV2(agent).Run()
+func Compose(agents ...zentinel.Agent) AgentV2 {
+	return &composedAgent{
+		BaseAgentV2: NewBaseAgentV2(),
+		agents:      agents,
+	}
+}
+
+// composedAgent is an AgentV2 made of several agents.
+type composedAgent struct {
+	*BaseAgentV2
+	agents []zentinel.Agent
+}
+
+// Name joins the agents' names with "+".
+func (a *composedAgent) Name() string {
+	names := make([]string, len(a.agents))
+	for i, agent := range a.agents {
+		names[i] = agent.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+// OnConfigure configures each agent in turn, stopping at the first error.
+func (a *composedAgent) OnConfigure(ctx context.Context, config map[string]interface{}) error {
+	for _, agent := range a.agents {
+		if err := agent.OnConfigure(ctx, config); err != nil {
+			return fmt.Errorf("%s: %w", agent.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (a *composedAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	return a.decide(func(agent zentinel.Agent) *zentinel.Decision {
+		return agent.OnRequest(ctx, request)
+	})
+}
+
+func (a *composedAgent) OnRequestBody(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	return a.decide(func(agent zentinel.Agent) *zentinel.Decision {
+		return agent.OnRequestBody(ctx, request)
+	})
+}
+
+func (a *composedAgent) OnResponse(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	return a.decide(func(agent zentinel.Agent) *zentinel.Decision {
+		return agent.OnResponse(ctx, request, response)
+	})
+}
+
+func (a *composedAgent) OnResponseBody(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	return a.decide(func(agent zentinel.Agent) *zentinel.Decision {
+		return agent.OnResponseBody(ctx, request, response)
+	})
+}
+
+// decide calls hook for each agent, merging the decisions until one does
+// not allow the request.
+func (a *composedAgent) decide(hook func(agent zentinel.Agent) *zentinel.Decision) *zentinel.Decision {
+	decision := zentinel.Allow()
+	for _, agent := range a.agents {
+		next := hook(agent)
+		if next == nil {
+			continue
+		}
+		decision.Merge(next)
+		if !next.IsAllow() {
+			break
+		}
+	}
+	return decision
+}
+
+func (a *composedAgent) OnRequestComplete(ctx context.Context, request *zentinel.Request, status int, durationMS int) {
+	for _, agent := range a.agents {
+		agent.OnRequestComplete(ctx, request, status, durationMS)
+	}
+}
+
+// OnGuardrailInspect collects the detections of every agent. The redacted
+// content is that of the last agent to provide one.
+func (a *composedAgent) OnGuardrailInspect(ctx context.Context, event *zentinel.GuardrailInspectEvent) *zentinel.GuardrailResponse {
+	result := zentinel.NewGuardrailResponse()
+	for _, agent := range a.agents {
+		response := agent.OnGuardrailInspect(ctx, event)
+		if response == nil {
+			continue
+		}
+		for _, detection := range response.Detections {
+			result.AddDetection(detection)
+		}
+		if response.Detected && response.Confidence > result.Confidence {
+			result.Confidence = response.Confidence
+		}
+		if response.RedactedContent != nil {
+			result.RedactedContent = response.RedactedContent
+		}
+	}
+	return result
+}
+
+// Capabilities returns the union of the agents' capabilities. The
+// concurrency limit is the lowest of the agents' limits, and the protocol
+// versions are those every agent accepts. An agent that returns no
+// capabilities adds none.
+func (a *composedAgent) Capabilities() *AgentCapabilities {
+	caps := &AgentCapabilities{SupportedFeatures: []string{}}
+	for _, agent := range a.agents {
+		v2agent, ok := agent.(AgentV2)
+		if !ok {
+			caps.HandlesRequestHeaders = true
+			caps.HandlesRequestBody = true
+			caps.HandlesResponseHeaders = true
+			caps.HandlesResponseBody = true
+			continue
+		}
+		other := v2agent.Capabilities()
+		if other == nil {
+			continue
+		}
+		caps.HandlesRequestHeaders = caps.HandlesRequestHeaders || other.HandlesRequestHeaders
+		caps.HandlesRequestBody = caps.HandlesRequestBody || other.HandlesRequestBody
+		caps.HandlesResponseHeaders = caps.HandlesResponseHeaders || other.HandlesResponseHeaders
+		caps.HandlesResponseBody = caps.HandlesResponseBody || other.HandlesResponseBody
+		caps.SupportsStreaming = caps.SupportsStreaming || other.SupportsStreaming
+		caps.SupportsCancellation = caps.SupportsCancellation || other.SupportsCancellation
+		if other.MaxConcurrentRequests != nil &&
+			(caps.MaxConcurrentRequests == nil || *other.MaxConcurrentRequests < *caps.MaxConcurrentRequests) {
+			caps.WithMaxConcurrentRequests(*other.MaxConcurrentRequests)
+		}
+		for _, feature := range other.SupportedFeatures {
+			if !caps.HasFeature(feature) {
+				caps.WithFeature(feature)
+			}
+		}
+		if other.MinProtocolVersion > caps.MinProtocolVersion {
+			caps.MinProtocolVersion = other.MinProtocolVersion
+		}
+		if other.MaxProtocolVersion != 0 &&
+			(caps.MaxProtocolVersion == 0 || other.MaxProtocolVersion < caps.MaxProtocolVersion) {
+			caps.MaxProtocolVersion = other.MaxProtocolVersion
+		}
+	}
+	return caps
+}
+
+// HealthCheck reports each AgentV2's health as a check named after the
+// agent, or as unhealthy if it reports nothing. The overall state is the
+// worst of them.
+func (a *composedAgent) HealthCheck(ctx context.Context) *HealthStatus {
+	status := NewHealthStatus()
+	for _, agent := range a.v2Agents() {
+		health := agent.HealthCheck(ctx)
+		if health == nil {
+			health = Unhealthy("no health status reported")
+		}
+		status.WithCheck(HealthCheck{Name: agent.Name(), State: health.State, Message: health.Message})
+	}
+	return status
+}
+
+func (a *composedAgent) OnShutdown(ctx context.Context) {
+	for _, agent := range a.v2Agents() {
+		agent.OnShutdown(ctx)
+	}
+}
+
+func (a *composedAgent) OnDrain(ctx context.Context) {
+	for _, agent := range a.v2Agents() {
+		agent.OnDrain(ctx)
+	}
+}
+
+func (a *composedAgent) OnStreamClosed(ctx context.Context, streamID string) {
+	for _, agent := range a.v2Agents() {
+		agent.OnStreamClosed(ctx, streamID)
+	}
+}
+
+func (a *composedAgent) OnCancel(ctx context.Context, requestID uint64) {
+	for _, agent := range a.v2Agents() {
+		agent.OnCancel(ctx, requestID)
+	}
+}
+
+// v2Agents returns the agents that implement AgentV2.
+func (a *composedAgent) v2Agents() []AgentV2 {
+	var agents []AgentV2
+	for _, agent := range a.agents {
+		if v2agent, ok := agent.(AgentV2); ok {
+			agents = append(agents, v2agent)
+		}
+	}
+	return agents
+}
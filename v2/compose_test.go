@@ -0,0 +1,109 @@
+package v2
+
+import (
+	"context"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+// stepAgent returns a fixed decision from OnRequest and counts its calls.
+type stepAgent struct {
+	BaseAgentV2
+	name     string
+	decision func() *zentinel.Decision
+	caps     *AgentCapabilities
+	calls    int
+}
+
+func (a *stepAgent) Name() string { return a.name }
+
+func (a *stepAgent) Capabilities() *AgentCapabilities { return a.caps }
+
+func (a *stepAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	a.calls++
+	return a.decision()
+}
+
+func TestCompose_ShortCircuits(t *testing.T) {
+	first := &stepAgent{name: "first", caps: NewAgentCapabilities(), decision: func() *zentinel.Decision {
+		return zentinel.Allow().AddRequestHeader("X-First", "1").WithTag("first")
+	}}
+	second := &stepAgent{name: "second", caps: NewAgentCapabilities(), decision: func() *zentinel.Decision {
+		return zentinel.Deny().WithTag("second")
+	}}
+	third := &stepAgent{name: "third", caps: NewAgentCapabilities(), decision: zentinel.Allow}
+
+	agent := Compose(first, second, third)
+	if agent.Name() != "first+second+third" {
+		t.Errorf("unexpected name %q", agent.Name())
+	}
+
+	decision := decide(t, NewAgentHandlerV2(agent), fuzzMessages()[1])
+	if _, ok := decision.Decision.(map[string]interface{}); !ok {
+		t.Errorf("expected block, got %v", decision.Decision)
+	}
+	if third.calls != 0 {
+		t.Error("expected the third agent not to be called")
+	}
+	if tags, _ := decision.Audit["tags"].([]interface{}); len(decision.RequestHeaders) != 1 || len(tags) != 2 {
+		t.Errorf("expected merged header ops and tags, got %v and %v", decision.RequestHeaders, decision.Audit)
+	}
+}
+
+func TestCompose_Capabilities(t *testing.T) {
+	agent := Compose(
+		&stepAgent{caps: NewAgentCapabilities().HandleRequestBody().WithMaxConcurrentRequests(100).WithFeature("a")},
+		&stepAgent{caps: NewAgentCapabilities().HandleResponseHeaders().WithMaxConcurrentRequests(10).WithFeatures("a", "b")},
+	)
+	caps := agent.Capabilities()
+
+	if !caps.HandlesRequestHeaders || !caps.HandlesRequestBody || !caps.HandlesResponseHeaders || caps.HandlesResponseBody {
+		t.Errorf("unexpected phases %+v", caps)
+	}
+	if caps.MaxConcurrentRequests == nil || *caps.MaxConcurrentRequests != 10 {
+		t.Errorf("expected the lowest concurrency limit, got %v", caps.MaxConcurrentRequests)
+	}
+	if len(caps.SupportedFeatures) != 2 {
+		t.Errorf("expected features a and b, got %v", caps.SupportedFeatures)
+	}
+
+	if caps := Compose(&zentinel.BaseAgent{}).Capabilities(); !caps.HandlesResponseBody {
+		t.Error("expected a v1 agent to handle every phase")
+	}
+
+	caps = Compose(&stepAgent{}, &stepAgent{caps: NewAgentCapabilities().HandleRequestBody()}).Capabilities()
+	if !caps.HandlesRequestHeaders || !caps.HandlesRequestBody || caps.HandlesResponseHeaders {
+		t.Errorf("expected an agent without capabilities to add none, got %+v", caps)
+	}
+}
+
+func TestCompose_HealthCheck(t *testing.T) {
+	agent := Compose(NewBaseAgentV2(), &unhealthyAgent{})
+	if status := agent.HealthCheck(context.Background()); !status.IsUnhealthy() || len(status.Checks) != 2 {
+		t.Errorf("expected the worst health of two checks, got %+v", status)
+	}
+
+	agent = Compose(NewBaseAgentV2(), &silentHealthAgent{})
+	status := agent.HealthCheck(context.Background())
+	if !status.IsUnhealthy() || len(status.Checks) != 2 || status.Checks[1].State != HealthStateUnhealthy {
+		t.Errorf("expected an agent without health to be unhealthy, got %+v", status)
+	}
+}
+
+type unhealthyAgent struct {
+	BaseAgentV2
+}
+
+func (a *unhealthyAgent) HealthCheck(ctx context.Context) *HealthStatus {
+	return Unhealthy("down")
+}
+
+// silentHealthAgent reports no health status.
+type silentHealthAgent struct {
+	BaseAgentV2
+}
+
+func (a *silentHealthAgent) HealthCheck(ctx context.Context) *HealthStatus {
+	return nil
+}
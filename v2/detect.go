@@ -0,0 +1,118 @@
+package v2
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+// Protocol versions a UDS connection can speak.
+const (
+	protocolV1 = "v1"
+	protocolV2 = "v2"
+)
+
+// sniffProtocol returns the protocol of a connection from its first frame,
+// without consuming it. Both protocols prefix frames with a 4-byte length; a
+// v2 connection opens with a handshake request, whose type byte follows the
+// length, while a v1 frame holds a JSON object.
+func sniffProtocol(reader *bufio.Reader) (string, error) {
+	header, err := reader.Peek(5)
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(header) == 0 {
+			return "", io.EOF
+		}
+		return "", fmt.Errorf("failed to read first frame: %w", err)
+	}
+
+	switch header[4] {
+	case MsgTypeHandshakeRequest:
+		return protocolV2, nil
+	case '{', ' ', '\t', '\r', '\n':
+		return protocolV1, nil
+	default:
+		// Let the v2 handshake reject it
+		return protocolV2, nil
+	}
+}
+
+// sniffedConn is a connection whose first bytes have been peeked at.
+type sniffedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// handleLegacyConnection serves a UDS connection from a proxy that speaks
+// the v1 JSON protocol, passing its events to HandleLegacyEvent.
+func (r *AgentRunnerV2) handleLegacyConnection(ctx context.Context, conn net.Conn, streamID string) {
+	logger := zentinel.LoggerFrom(ctx)
+	logger.Debug().Msg("Connection established (v1 protocol)")
+
+	for {
+		select {
+		case <-r.shutdown:
+			r.agent.OnStreamClosed(ctx, streamID)
+			return
+		default:
+		}
+
+		// Check if draining
+		r.mu.RLock()
+		draining := r.draining
+		r.mu.RUnlock()
+		if draining {
+			r.agent.OnStreamClosed(ctx, streamID)
+			return
+		}
+
+		event, err := zentinel.ReadMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				logger.Error().Err(err).Msg("Failed to read message")
+				r.handler.metrics.RecordTransportError(TransportUDS)
+			}
+			r.agent.OnStreamClosed(ctx, streamID)
+			return
+		}
+		if event == nil {
+			r.agent.OnStreamClosed(ctx, streamID)
+			return
+		}
+		r.handler.metrics.RecordTransportMessage(TransportUDS)
+
+		response, err := r.handler.HandleLegacyEvent(ctx, event)
+		if errors.Is(err, zentinel.ErrMalformedInput) {
+			logger.Warn().Err(err).Msg("Closing connection after malformed event")
+			r.handler.metrics.RecordTransportError(TransportUDS)
+			r.agent.OnStreamClosed(ctx, streamID)
+			return
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to handle event")
+			r.handler.metrics.RecordTransportError(TransportUDS)
+			response = zentinel.Allow().Build()
+		}
+
+		if r.capture != nil {
+			if err := r.capture.RecordV1(streamID, event, response); err != nil {
+				logger.Warn().Err(err).Msg("Failed to capture event")
+			}
+		}
+
+		if err := zentinel.WriteMessage(conn, response); err != nil {
+			logger.Error().Err(err).Msg("Failed to write response")
+			r.handler.metrics.RecordTransportError(TransportUDS)
+			r.agent.OnStreamClosed(ctx, streamID)
+			return
+		}
+	}
+}
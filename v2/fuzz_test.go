@@ -0,0 +1,214 @@
+package v2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// fuzzMessages are seed messages in the shapes used by the protocol tests.
+func fuzzMessages() []*V2Message {
+	reason := "client disconnected"
+	payloads := []struct {
+		msgType byte
+		payload interface{}
+	}{
+		{MsgTypeHandshakeRequest, NewHandshakeRequest("proxy-1").WithFeatures("streaming", "cancellation")},
+		{MsgTypeRequestHeaders, &V2RequestHeaders{
+			RequestID: 123,
+			Method:    "POST",
+			URI:       "/api/users?include=profile",
+			Headers:   map[string][]string{"content-type": {"application/json"}},
+			HasBody:   true,
+			Metadata:  V2RequestMetadata{CorrelationID: "req-123", ClientIP: "192.168.1.1", ClientPort: 54321, Protocol: "HTTP/2"},
+		}},
+		{MsgTypeRequestBodyChunk, &V2RequestBodyChunk{RequestID: 123, Data: base64.StdEncoding.EncodeToString([]byte(`{"name":"test"}`)), IsLast: true}},
+		{MsgTypeResponseHeaders, &V2ResponseHeaders{RequestID: 123, StatusCode: 200, Headers: map[string][]string{"content-type": {"text/html"}}, HasBody: true}},
+		{MsgTypeResponseBodyChunk, &V2ResponseBodyChunk{RequestID: 123, Data: "PGh0bWw+", IsLast: true}},
+		{MsgTypeRequestComplete, &V2RequestComplete{RequestID: 123, StatusCode: 200, DurationMS: 150}},
+		{MsgTypeCancelRequest, &CancelRequestMessage{RequestID: 123, Reason: &reason}},
+		{MsgTypeCancelAll, &CancelAllMessage{}},
+		{MsgTypePing, &PingMessage{Timestamp: 1}},
+		{MsgTypeHealthRequest, struct{}{}},
+		{MsgTypeMetricsRequest, struct{}{}},
+	}
+
+	msgs := make([]*V2Message, 0, len(payloads))
+	for _, p := range payloads {
+		msg, err := NewV2Message(p.msgType, p.payload)
+		if err != nil {
+			panic(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// quietLogs silences the handler's logging for the duration of a test.
+func quietLogs(tb testing.TB) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	tb.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+}
+
+func FuzzReadMessageV2(f *testing.F) {
+	for _, msg := range fuzzMessages() {
+		var buf bytes.Buffer
+		WriteMessageV2(&buf, msg)
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0x01, 0x00, 0x00, 0x00, MsgTypePing}) // 16MB prefix, then EOF
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadMessageV2(bytes.NewReader(data))
+		if err != nil || msg == nil {
+			return
+		}
+		if len(msg.Payload)+5 > len(data) {
+			t.Fatalf("message of %d bytes read from %d bytes of input", len(msg.Payload)+5, len(data))
+		}
+
+		var buf bytes.Buffer
+		if err := WriteMessageV2(&buf, msg); err != nil {
+			t.Fatalf("failed to re-encode accepted message: %v", err)
+		}
+		again, err := ReadMessageV2(&buf)
+		if err != nil {
+			t.Fatalf("failed to re-read message: %v", err)
+		}
+		// Empty payloads are written as {}.
+		want := msg.Payload
+		if want == nil {
+			want = []byte("{}")
+		}
+		if again.Type != msg.Type || !bytes.Equal(again.Payload, want) {
+			t.Fatalf("round trip changed message: %+v != %+v", msg, again)
+		}
+	})
+}
+
+func FuzzGRPCProxyToV2Message(f *testing.F) {
+	for _, msg := range fuzzMessages() {
+		data, err := v2MessageToGRPCRequest(msg, func(id uint64) string { return "req-123" })
+		if err == nil {
+			f.Add(data)
+		}
+	}
+	f.Add([]byte(`{"configure":{"agent_id":"a","config_json":"{}"}}`))
+	f.Add([]byte(`{"request_headers":{"metadata":null}}`))
+	f.Add([]byte(`{}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := grpcProxyToV2Message(data)
+		// Configure events are applied by the service and convert to nil.
+		if err != nil || msg == nil {
+			return
+		}
+		if len(msg.Payload) > 0 && !json.Valid(msg.Payload) {
+			t.Fatalf("converted payload is not valid JSON: %s", msg.Payload)
+		}
+	})
+}
+
+func FuzzUnmarshalHandshakeRequest(f *testing.F) {
+	for _, req := range []*HandshakeRequest{
+		NewHandshakeRequest("proxy-1"),
+		NewHandshakeRequest("proxy-1").WithFeatures("streaming", "cancellation", "metrics"),
+		{ProtocolVersion: 1, ClientName: "old-proxy"},
+	} {
+		data, _ := MarshalHandshakeRequest(req)
+		f.Add(data)
+	}
+	f.Add([]byte(`null`))
+	f.Add([]byte(`{"protocol_version":-1}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := UnmarshalHandshakeRequest(data)
+		if err != nil {
+			return
+		}
+		if req == nil {
+			t.Fatal("nil request without error")
+		}
+
+		encoded, err := MarshalHandshakeRequest(req)
+		if err != nil {
+			t.Fatalf("failed to re-encode request: %v", err)
+		}
+		again, err := UnmarshalHandshakeRequest(encoded)
+		if err != nil {
+			t.Fatalf("failed to re-read request: %v", err)
+		}
+		if reencoded, _ := MarshalHandshakeRequest(again); !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("round trip changed request: %s != %s", encoded, reencoded)
+		}
+	})
+}
+
+func FuzzHandleMessage(f *testing.F) {
+	for _, msg := range fuzzMessages() {
+		f.Add(msg.Type, []byte(msg.Payload))
+	}
+	f.Add(MsgTypeRequestBodyChunk, []byte(`{"request_id":999,"data":"AAAA","is_last":false}`))
+	f.Add(MsgTypeRequestHeaders, []byte(`{"request_id":"x"}`))
+	f.Add(MsgTypeRequestBodyChunkRaw, []byte(NewRawBodyChunkMessage(MsgTypeRequestBodyChunkRaw, &RawBodyChunk{RequestID: 123, Data: []byte("AAAA")}).Payload))
+	f.Add(MsgTypeResponseBodyChunkRaw, []byte{0, 0, 0, 0, 0, 0, 0, 123})
+	quietLogs(f)
+
+	headers := fuzzMessages()[1]
+	ctx := rawBodyContext(f)
+	f.Fuzz(func(t *testing.T, msgType byte, payload []byte) {
+		handler := NewAgentHandlerV2(NewBaseAgentV2())
+		msg := &V2Message{Type: msgType, Payload: payload}
+
+		// Send the message on its own and after a request it may refer to.
+		for _, msgs := range [][]*V2Message{{msg}, {headers, msg, msg}} {
+			for _, m := range msgs {
+				response, err := handler.HandleMessage(ctx, m)
+				if err != nil || response == nil {
+					continue
+				}
+				if !json.Valid(response.Payload) {
+					t.Fatalf("response payload is not valid JSON: %s", response.Payload)
+				}
+			}
+		}
+
+		// Chunks for unknown requests must not be retained.
+		handler.mu.RLock()
+		defer handler.mu.RUnlock()
+		for key := range handler.requestBodies {
+			if handler.requests[key] == nil {
+				t.Fatalf("retained body for unknown request %d", key.id)
+			}
+		}
+	})
+}
+
+func TestReadMessageV2_TruncatedPayloadDoesNotPreallocate(t *testing.T) {
+	data := make([]byte, 5)
+	binary.BigEndian.PutUint32(data, MaxMessageSizeV2)
+	data[4] = MsgTypeRequestHeaders
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, err := ReadMessageV2(bytes.NewReader(append(data, '{')))
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes for a 1 byte payload", allocated)
+	}
+}
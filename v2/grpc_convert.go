@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -36,6 +37,7 @@ type grpcHandshakeRequest struct {
 	ProxyID           string   `json:"proxy_id"`
 	ProxyVersion      string   `json:"proxy_version"`
 	ConfigJSON        string   `json:"config_json,omitempty"`
+	SupportedFeatures []string `json:"supported_features,omitempty"`
 }
 
 // grpcHandshakeResponse maps to the proto HandshakeResponse.
@@ -44,6 +46,7 @@ type grpcHandshakeResponse struct {
 	Capabilities    *grpcAgentCapabilities  `json:"capabilities,omitempty"`
 	Success         bool                    `json:"success"`
 	Error           *string                 `json:"error,omitempty"`
+	Features        []string                `json:"features,omitempty"`
 }
 
 // grpcAgentCapabilities maps to the proto AgentCapabilities.
@@ -167,6 +170,9 @@ type grpcAgentResponse struct {
 	Audit           map[string]interface{} `json:"audit,omitempty"`
 	ProcessingTimeMs *uint64               `json:"processing_time_ms,omitempty"`
 	NeedsMore       bool                   `json:"needs_more"`
+
+	RequestBodyMutation  map[string]interface{} `json:"request_body_mutation,omitempty"`
+	ResponseBodyMutation map[string]interface{} `json:"response_body_mutation,omitempty"`
 }
 
 // grpcHeaderOp maps to the proto HeaderOp.
@@ -224,9 +230,26 @@ func grpcProxyToV2Message(data []byte) (*V2Message, error) {
 }
 
 func convertHandshakeToV2(req *grpcHandshakeRequest) (*V2Message, error) {
+	// Proxies that send no versions predate version negotiation and speak v2.
+	// Otherwise the handler negotiates from the versions offered.
+	version := uint32(ProtocolVersionV2)
+	if len(req.SupportedVersions) > 0 {
+		version = req.SupportedVersions[0]
+	}
+
+	// Raw body frames are a UDS framing; gRPC carries body chunks as they are.
+	var features []string
+	for _, feature := range req.SupportedFeatures {
+		if feature != FeatureRawBody {
+			features = append(features, feature)
+		}
+	}
+
 	hsReq := HandshakeRequest{
-		ProtocolVersion: ProtocolVersionV2,
-		ClientName:      req.ProxyID,
+		ProtocolVersion:   version,
+		SupportedVersions: req.SupportedVersions,
+		SupportedFeatures: features,
+		ClientName:        req.ProxyID,
 	}
 	return NewV2Message(MsgTypeHandshakeRequest, hsReq)
 }
@@ -353,12 +376,13 @@ func convertPingToV2(ping *grpcPing) (*V2Message, error) {
 }
 
 func convertRequestCompleteToV2(event *grpcRequestCompleteEvent) (*V2Message, error) {
-	// Request complete doesn't have a direct V2Message equivalent in the existing handler,
-	// but we can handle it as a health request or a no-op. The handler ignores unknown types
-	// by returning an allow decision. We create a ping-like message that the handler can process.
-	// Actually, looking at the handler, it doesn't handle request complete directly via V2,
-	// so we return nil to indicate no response is needed.
-	return nil, nil
+	complete := V2RequestComplete{
+		RequestID:  hashString(event.CorrelationID),
+		StatusCode: uint16(event.StatusCode),
+		DurationMS: event.DurationMs,
+		Error:      event.Error,
+	}
+	return NewV2Message(MsgTypeRequestComplete, complete)
 }
 
 // v2MessageToGRPCResponse converts a V2Message (output from handler.HandleMessage) into
@@ -431,6 +455,7 @@ func convertHandshakeResponseToGRPC(resp *HandshakeResponse) *grpcHandshakeRespo
 	grpcResp := &grpcHandshakeResponse{
 		ProtocolVersion: resp.ProtocolVersion,
 		Success:         resp.Accepted,
+		Features:        resp.Features,
 	}
 	if resp.Error != "" {
 		grpcResp.Error = &resp.Error
@@ -466,6 +491,8 @@ func convertHandshakeResponseToGRPC(resp *HandshakeResponse) *grpcHandshakeRespo
 		}
 		grpcCaps.Features = &grpcFeatures{
 			StreamingBody:      caps.SupportsStreaming,
+			Websocket:          caps.HasFeature(FeatureWebSocket),
+			Guardrails:         caps.HasFeature(FeatureGuardrails),
 			Cancellation:       caps.SupportsCancellation,
 			ConcurrentRequests: concurrency,
 			HealthReporting:    true,
@@ -485,9 +512,11 @@ func convertDecisionToGRPC(decision *V2Decision) *grpcAgentResponse {
 	correlationID := fmt.Sprintf("%d", decision.RequestID)
 
 	resp := &grpcAgentResponse{
-		CorrelationID: correlationID,
-		Decision:      decision.Decision,
-		Audit:         decision.Audit,
+		CorrelationID:        correlationID,
+		Decision:             decision.Decision,
+		Audit:                decision.Audit,
+		RequestBodyMutation:  decision.RequestBodyMutation,
+		ResponseBodyMutation: decision.ResponseBodyMutation,
 	}
 
 	// Check if this is a needs_more decision
@@ -543,3 +572,259 @@ func convertDecisionToGRPC(decision *V2Decision) *grpcAgentResponse {
 
 	return resp
 }
+
+// The functions below perform the reverse conversions, for the proxy side of a
+// gRPC connection. gRPC events are keyed by correlation ID while V2Message
+// payloads are keyed by request ID, so the caller supplies the lookups between
+// the two.
+
+// v2MessageToGRPCRequest converts a V2Message sent by a proxy into a gRPC
+// ProxyToAgent JSON message. correlationFor returns the correlation ID of a
+// request announced by an earlier RequestHeaders message.
+func v2MessageToGRPCRequest(msg *V2Message, correlationFor func(uint64) string) ([]byte, error) {
+	request := &grpcProxyToAgentMessage{}
+	now := uint64(time.Now().UnixMilli())
+
+	switch msg.Type {
+	case MsgTypeHandshakeRequest:
+		var hsReq HandshakeRequest
+		if err := msg.ParsePayload(&hsReq); err != nil {
+			return nil, fmt.Errorf("failed to parse handshake request: %w", err)
+		}
+		versions := hsReq.SupportedVersions
+		if len(versions) == 0 {
+			versions = []uint32{hsReq.ProtocolVersion}
+		}
+		request.Handshake = &grpcHandshakeRequest{
+			SupportedVersions: versions,
+			ProxyID:           hsReq.ClientName,
+			SupportedFeatures: hsReq.SupportedFeatures,
+		}
+
+	case MsgTypeRequestHeaders:
+		var event V2RequestHeaders
+		if err := msg.ParsePayload(&event); err != nil {
+			return nil, fmt.Errorf("failed to parse request headers: %w", err)
+		}
+		md := event.Metadata
+		request.RequestHeaders = &grpcRequestHeadersEvent{
+			Metadata: &grpcRequestMetadata{
+				CorrelationID: md.CorrelationID,
+				RequestID:     md.CorrelationID,
+				ClientIP:      md.ClientIP,
+				ClientPort:    uint32(md.ClientPort),
+				ServerName:    md.ServerName,
+				Protocol:      md.Protocol,
+				TLSVersion:    md.TLSVersion,
+				RouteID:       md.RouteID,
+				UpstreamID:    md.UpstreamID,
+				TimestampMs:   now,
+				Traceparent:   md.Traceparent,
+			},
+			Method:      event.Method,
+			URI:         event.URI,
+			HTTPVersion: md.Protocol,
+			Headers:     flattenHeaders(event.Headers),
+		}
+
+	case MsgTypeRequestBodyChunk:
+		var chunk V2RequestBodyChunk
+		if err := msg.ParsePayload(&chunk); err != nil {
+			return nil, fmt.Errorf("failed to parse request body chunk: %w", err)
+		}
+		request.RequestBody = &grpcBodyChunkEvent{
+			CorrelationID: correlationFor(chunk.RequestID),
+			ChunkIndex:    chunk.ChunkIndex,
+			Data:          chunk.Data,
+			IsLast:        chunk.IsLast,
+			TimestampMs:   now,
+		}
+
+	case MsgTypeResponseHeaders:
+		var event V2ResponseHeaders
+		if err := msg.ParsePayload(&event); err != nil {
+			return nil, fmt.Errorf("failed to parse response headers: %w", err)
+		}
+		request.ResponseHeaders = &grpcResponseHeadersEvent{
+			CorrelationID: correlationFor(event.RequestID),
+			StatusCode:    uint32(event.StatusCode),
+			Headers:       flattenHeaders(event.Headers),
+		}
+
+	case MsgTypeResponseBodyChunk:
+		var chunk V2ResponseBodyChunk
+		if err := msg.ParsePayload(&chunk); err != nil {
+			return nil, fmt.Errorf("failed to parse response body chunk: %w", err)
+		}
+		request.ResponseBody = &grpcBodyChunkEvent{
+			CorrelationID: correlationFor(chunk.RequestID),
+			ChunkIndex:    chunk.ChunkIndex,
+			Data:          chunk.Data,
+			IsLast:        chunk.IsLast,
+			TimestampMs:   now,
+		}
+
+	case MsgTypeRequestComplete:
+		var complete V2RequestComplete
+		if err := msg.ParsePayload(&complete); err != nil {
+			return nil, fmt.Errorf("failed to parse request complete: %w", err)
+		}
+		request.RequestComplete = &grpcRequestCompleteEvent{
+			CorrelationID: correlationFor(complete.RequestID),
+			StatusCode:    uint32(complete.StatusCode),
+			DurationMs:    complete.DurationMS,
+			Error:         complete.Error,
+		}
+
+	case MsgTypeCancelRequest:
+		var cancel CancelRequestMessage
+		if err := msg.ParsePayload(&cancel); err != nil {
+			return nil, fmt.Errorf("failed to parse cancel request: %w", err)
+		}
+		request.Cancel = &grpcCancelRequest{
+			CorrelationID: correlationFor(cancel.RequestID),
+			TimestampMs:   now,
+		}
+
+	case MsgTypePing:
+		var ping PingMessage
+		if err := msg.ParsePayload(&ping); err != nil {
+			return nil, fmt.Errorf("failed to parse ping: %w", err)
+		}
+		request.Ping = &grpcPing{TimestampMs: uint64(ping.Timestamp)}
+
+	default:
+		return nil, fmt.Errorf("message type %s is not supported over gRPC", msg.TypeName())
+	}
+
+	return json.Marshal(request)
+}
+
+// grpcResponseToV2Message converts a gRPC AgentToProxy JSON message received
+// by a proxy into a V2Message. requestIDFor maps the correlation ID of an
+// agent response back to the request ID the proxy used.
+func grpcResponseToV2Message(data []byte, requestIDFor func(string) uint64) (*V2Message, error) {
+	var msg grpcAgentToProxyMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal AgentToProxy: %w", err)
+	}
+
+	switch {
+	case msg.Handshake != nil:
+		hs := msg.Handshake
+		resp := &HandshakeResponse{
+			ProtocolVersion: hs.ProtocolVersion,
+			Accepted:        hs.Success,
+			Features:        hs.Features,
+		}
+		if hs.Error != nil {
+			resp.Error = *hs.Error
+		}
+		if hs.Capabilities != nil {
+			resp.AgentName = hs.Capabilities.Name
+			resp.Capabilities = convertCapabilitiesFromGRPC(hs.Capabilities)
+		}
+		return NewV2Message(MsgTypeHandshakeResponse, resp)
+
+	case msg.Response != nil:
+		return NewV2Message(MsgTypeDecision, convertDecisionFromGRPC(msg.Response, requestIDFor))
+
+	case msg.Pong != nil:
+		return NewV2Message(MsgTypePong, PongMessage{Timestamp: int64(msg.Pong.PingTimestampMs)})
+
+	case msg.Health != nil:
+		health := &HealthStatus{
+			State:     HealthStateHealthy,
+			Message:   msg.Health.Message,
+			Timestamp: time.UnixMilli(int64(msg.Health.TimestampMs)),
+		}
+		switch msg.Health.State {
+		case 2:
+			health.State = HealthStateDegraded
+		case 4:
+			health.State = HealthStateUnhealthy
+		}
+		return NewV2Message(MsgTypeHealthResponse, health)
+
+	case msg.Metrics != nil:
+		return &V2Message{Type: MsgTypeMetricsResponse, Payload: msg.Metrics}, nil
+	}
+
+	return nil, fmt.Errorf("empty AgentToProxy message: no oneof field set")
+}
+
+func convertCapabilitiesFromGRPC(grpcCaps *grpcAgentCapabilities) *AgentCapabilities {
+	caps := &AgentCapabilities{SupportedFeatures: []string{}}
+	for _, event := range grpcCaps.SupportedEvents {
+		switch event {
+		case 1:
+			caps.HandlesRequestHeaders = true
+		case 2:
+			caps.HandlesRequestBody = true
+		case 3:
+			caps.HandlesResponseHeaders = true
+		case 4:
+			caps.HandlesResponseBody = true
+		}
+	}
+	if f := grpcCaps.Features; f != nil {
+		caps.SupportsStreaming = f.StreamingBody
+		caps.SupportsCancellation = f.Cancellation
+		if f.ConcurrentRequests > 0 {
+			concurrency := f.ConcurrentRequests
+			caps.MaxConcurrentRequests = &concurrency
+		}
+	}
+	return caps
+}
+
+func convertDecisionFromGRPC(resp *grpcAgentResponse, requestIDFor func(string) uint64) *V2Decision {
+	decision := &V2Decision{
+		RequestID:            requestIDFor(resp.CorrelationID),
+		Decision:             resp.Decision,
+		Audit:                resp.Audit,
+		RequestBodyMutation:  resp.RequestBodyMutation,
+		ResponseBodyMutation: resp.ResponseBodyMutation,
+	}
+	if resp.NeedsMore {
+		decision.Decision = map[string]interface{}{"needs_more": true}
+	}
+	decision.RequestHeaders = convertHeaderOpsFromGRPC(resp.RequestHeaders)
+	decision.ResponseHeaders = convertHeaderOpsFromGRPC(resp.ResponseHeaders)
+	return decision
+}
+
+func convertHeaderOpsFromGRPC(ops []grpcHeaderOp) []V2HeaderOp {
+	var result []V2HeaderOp
+	for _, op := range ops {
+		switch {
+		case op.Set != nil:
+			value := op.Set.Value
+			result = append(result, V2HeaderOp{Operation: "set", Name: op.Set.Name, Value: &value})
+		case op.Add != nil:
+			value := op.Add.Value
+			result = append(result, V2HeaderOp{Operation: "add", Name: op.Add.Name, Value: &value})
+		case op.Remove != "":
+			result = append(result, V2HeaderOp{Operation: "remove", Name: op.Remove})
+		}
+	}
+	return result
+}
+
+// flattenHeaders converts a header map into the flat gRPC header list, in a
+// stable order.
+func flattenHeaders(headers map[string][]string) []grpcHeader {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []grpcHeader
+	for _, name := range names {
+		for _, value := range headers[name] {
+			result = append(result, grpcHeader{Name: name, Value: value})
+		}
+	}
+	return result
+}
@@ -3,16 +3,18 @@ package v2
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	grpcencoding "google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
 )
 
@@ -22,6 +24,30 @@ import (
 type agentGRPCService struct {
 	runner   *AgentRunnerV2
 	streamID atomic.Uint64
+
+	// The unary calls of each connection, by stream ID
+	unaryMu      sync.Mutex
+	unaryStreams map[string]*unaryStream
+}
+
+// unaryStream is the stream the unary calls on one connection share, opened
+// by the first of them and closed with the connection.
+type unaryStream struct {
+	// Features negotiated by a unary handshake; nil before one
+	features []string
+	closed   func()
+}
+
+// unaryStreamKey holds the ID of the unary stream of a connection in the
+// connection's context.
+type unaryStreamKey struct{}
+
+// newAgentGRPCService creates the AgentServiceV2 service for runner.
+func newAgentGRPCService(runner *AgentRunnerV2) *agentGRPCService {
+	return &agentGRPCService{
+		runner:       runner,
+		unaryStreams: make(map[string]*unaryStream),
+	}
 }
 
 // jsonMessage is a raw JSON container used as the gRPC message type.
@@ -63,6 +89,10 @@ func (jsonCodec) Name() string {
 	return "json"
 }
 
+// agentServiceServer is the handler type of agentServiceDesc. gRPC requires an
+// interface here; the handlers assert the concrete service type themselves.
+type agentServiceServer interface{}
+
 // agentServiceDesc is the manually-constructed grpc.ServiceDesc for AgentServiceV2.
 // This matches the proto service definition:
 //
@@ -73,7 +103,7 @@ func (jsonCodec) Name() string {
 //	}
 var agentServiceDesc = grpc.ServiceDesc{
 	ServiceName: "zentinel.agent.v2.AgentServiceV2",
-	HandlerType: (*agentGRPCService)(nil),
+	HandlerType: (*agentServiceServer)(nil),
 	Methods: []grpc.MethodDesc{
 		{
 			MethodName: "ProcessEvent",
@@ -98,10 +128,7 @@ var agentServiceDesc = grpc.ServiceDesc{
 }
 
 // registerAgentService registers the AgentServiceV2 gRPC service on the given server.
-func registerAgentService(s *grpc.Server, runner *AgentRunnerV2) {
-	svc := &agentGRPCService{
-		runner: runner,
-	}
+func registerAgentService(s *grpc.Server, svc *agentGRPCService) {
 	s.RegisterService(&agentServiceDesc, svc)
 }
 
@@ -129,8 +156,17 @@ func processEventHandler(srv interface{}, ctx context.Context, dec func(interfac
 	return interceptor(ctx, in, info, handler)
 }
 
-// processEvent handles a single unary ProxyToAgent message.
+// processEvent handles a single unary ProxyToAgent message. The unary calls
+// on a connection share its request state and the features negotiated by a
+// handshake among them, as if on a single stream.
 func (s *agentGRPCService) processEvent(ctx context.Context, in *jsonMessage) (*jsonMessage, error) {
+	streamID, features := s.openUnary(ctx)
+	ctx = withStream(ctx, streamID)
+	if features != nil {
+		ctx = context.WithValue(ctx, negotiatedKey{}, features)
+	}
+	s.runner.handler.metrics.RecordTransportMessage(TransportGRPC)
+
 	// Try to handle configure events directly
 	if s.handleConfigureEvent(ctx, in.Data) {
 		return &jsonMessage{Data: json.RawMessage(`{}`)}, nil
@@ -139,6 +175,8 @@ func (s *agentGRPCService) processEvent(ctx context.Context, in *jsonMessage) (*
 	// Convert gRPC message to V2Message
 	v2Msg, err := grpcProxyToV2Message(in.Data)
 	if err != nil {
+		s.runner.handler.metrics.RecordFailure(zentinel.FailureMalformedPayload)
+		s.runner.handler.metrics.RecordTransportError(TransportGRPC)
 		return nil, status.Errorf(codes.InvalidArgument, "failed to convert message: %v", err)
 	}
 
@@ -148,6 +186,16 @@ func (s *agentGRPCService) processEvent(ctx context.Context, in *jsonMessage) (*
 
 	// Process through the existing handler
 	response, err := s.runner.handler.HandleMessage(ctx, v2Msg)
+	s.runner.captureMessage(streamID, v2Msg, response)
+	if features, ok := NegotiatedFeatures(withNegotiated(ctx, response)); ok {
+		s.negotiateUnary(streamID, features)
+	}
+	if err != nil {
+		s.runner.handler.metrics.RecordTransportError(TransportGRPC)
+	}
+	if errors.Is(err, zentinel.ErrMalformedInput) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "handler error: %v", err)
 	}
@@ -165,6 +213,71 @@ func (s *agentGRPCService) processEvent(ctx context.Context, in *jsonMessage) (*
 	return &jsonMessage{Data: respData}, nil
 }
 
+// openUnary returns the ID of the unary stream of the connection ctx belongs
+// to, opening it on the connection's first call, and the features negotiated
+// on it. Calls on a connection the service was not told of share one stream.
+func (s *agentGRPCService) openUnary(ctx context.Context) (string, []string) {
+	streamID, ok := ctx.Value(unaryStreamKey{}).(string)
+	if !ok {
+		return "grpc-unary", nil
+	}
+
+	s.unaryMu.Lock()
+	defer s.unaryMu.Unlock()
+	stream, ok := s.unaryStreams[streamID]
+	if !ok {
+		stream = &unaryStream{closed: s.runner.openStream(streamID, TransportGRPC)}
+		s.unaryStreams[streamID] = stream
+	}
+	return streamID, stream.features
+}
+
+// negotiateUnary records the features a unary handshake negotiated.
+func (s *agentGRPCService) negotiateUnary(streamID string, features []string) {
+	s.unaryMu.Lock()
+	defer s.unaryMu.Unlock()
+	if stream, ok := s.unaryStreams[streamID]; ok {
+		stream.features = features
+	}
+}
+
+// closeUnary closes the unary stream of a connection that has ended, if its
+// calls opened one.
+func (s *agentGRPCService) closeUnary(ctx context.Context) {
+	streamID, _ := ctx.Value(unaryStreamKey{}).(string)
+	s.unaryMu.Lock()
+	stream, ok := s.unaryStreams[streamID]
+	delete(s.unaryStreams, streamID)
+	s.unaryMu.Unlock()
+	if !ok {
+		return
+	}
+
+	logger := s.runner.Logger().With().Str("stream_id", streamID).Logger()
+	ctx = withStream(logger.WithContext(context.Background()), streamID)
+	s.runner.handler.cancelStream(ctx)
+	s.runner.agent.OnStreamClosed(ctx, streamID)
+	stream.closed()
+}
+
+// TagConn gives each connection its own unary stream ID.
+func (s *agentGRPCService) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, unaryStreamKey{}, fmt.Sprintf("grpc-unary-%d", s.streamID.Add(1)))
+}
+
+// HandleConn closes a connection's unary stream when the connection ends.
+func (s *agentGRPCService) HandleConn(ctx context.Context, connStats stats.ConnStats) {
+	if _, ok := connStats.(*stats.ConnEnd); ok {
+		s.closeUnary(ctx)
+	}
+}
+
+func (s *agentGRPCService) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (s *agentGRPCService) HandleRPC(ctx context.Context, rpcStats stats.RPCStats) {}
+
 // processStreamHandler handles the bidirectional streaming ProcessStream RPC.
 func processStreamHandler(srv interface{}, stream grpc.ServerStream) error {
 	svc := srv.(*agentGRPCService)
@@ -180,12 +293,16 @@ func (s *agentGRPCService) processStream(stream grpc.ServerStream) error {
 
 	id := s.streamID.Add(1)
 	streamID := fmt.Sprintf("grpc-stream-%d", id)
-	ctx := stream.Context()
+	defer s.runner.openStream(streamID, TransportGRPC)()
+	logger := s.runner.Logger().With().Str("stream_id", streamID).Logger()
+	ctx := withStream(logger.WithContext(stream.Context()), streamID)
 
-	log.Debug().Str("stream_id", streamID).Msg("gRPC ProcessStream started")
+	logger.Debug().Msg("gRPC ProcessStream started")
 	defer func() {
+		// The stream's context is done by now; its requests still need OnCancel
+		s.runner.handler.cancelStream(context.WithoutCancel(ctx))
 		s.runner.agent.OnStreamClosed(ctx, streamID)
-		log.Debug().Str("stream_id", streamID).Msg("gRPC ProcessStream ended")
+		logger.Debug().Msg("gRPC ProcessStream ended")
 	}()
 
 	// Use a mutex for sending on the stream (gRPC streams are not safe for concurrent sends)
@@ -217,6 +334,7 @@ func (s *agentGRPCService) processStream(stream grpc.ServerStream) error {
 			}
 			return err
 		}
+		s.runner.handler.metrics.RecordTransportMessage(TransportGRPC)
 
 		// Try to handle configure events directly (they bypass the V2Message handler)
 		if handled := s.handleConfigureEvent(ctx, in.Data); handled {
@@ -226,7 +344,12 @@ func (s *agentGRPCService) processStream(stream grpc.ServerStream) error {
 		// Convert and process through the V2Message handler
 		v2Msg, err := grpcProxyToV2Message(in.Data)
 		if err != nil {
-			log.Error().Err(err).Str("stream_id", streamID).Msg("Failed to convert gRPC message")
+			logger.Error().Err(err).Msg("Failed to convert gRPC message")
+			s.runner.handler.metrics.RecordFailure(zentinel.FailureMalformedPayload)
+			s.runner.handler.metrics.RecordTransportError(TransportGRPC)
+			if s.runner.config.MalformedInput == zentinel.MalformedClose {
+				return status.Errorf(codes.InvalidArgument, "failed to convert message: %v", err)
+			}
 			continue
 		}
 
@@ -235,8 +358,16 @@ func (s *agentGRPCService) processStream(stream grpc.ServerStream) error {
 		}
 
 		response, err := s.runner.handler.HandleMessage(ctx, v2Msg)
+		s.runner.captureMessage(streamID, v2Msg, response)
+		ctx = withNegotiated(ctx, response)
+		if errors.Is(err, zentinel.ErrMalformedInput) {
+			logger.Warn().Err(err).Msg("Closing stream after malformed message")
+			s.runner.handler.metrics.RecordTransportError(TransportGRPC)
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
 		if err != nil {
-			log.Error().Err(err).Str("stream_id", streamID).Msg("Failed to handle message")
+			logger.Error().Err(err).Msg("Failed to handle message")
+			s.runner.handler.metrics.RecordTransportError(TransportGRPC)
 			continue
 		}
 
@@ -247,7 +378,7 @@ func (s *agentGRPCService) processStream(stream grpc.ServerStream) error {
 
 		respData, err := v2MessageToGRPCResponse(response)
 		if err != nil {
-			log.Error().Err(err).Str("stream_id", streamID).Msg("Failed to convert response")
+			logger.Error().Err(err).Msg("Failed to convert response")
 			continue
 		}
 
@@ -256,7 +387,8 @@ func (s *agentGRPCService) processStream(stream grpc.ServerStream) error {
 		sendMu.Unlock()
 
 		if sendErr != nil {
-			log.Error().Err(sendErr).Str("stream_id", streamID).Msg("Failed to send response")
+			logger.Error().Err(sendErr).Msg("Failed to send response")
+			s.runner.handler.metrics.RecordTransportError(TransportGRPC)
 			return sendErr
 		}
 	}
@@ -275,15 +407,15 @@ func (s *agentGRPCService) handleConfigureEvent(ctx context.Context, data json.R
 	var config map[string]interface{}
 	if msg.Configure.ConfigJSON != "" {
 		if err := json.Unmarshal([]byte(msg.Configure.ConfigJSON), &config); err != nil {
-			log.Error().Err(err).Msg("Failed to parse configure event config JSON")
+			zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse configure event config JSON")
 			config = map[string]interface{}{}
 		}
 	}
 
-	if err := s.runner.agent.OnConfigure(ctx, config); err != nil {
-		log.Error().Err(err).Msg("Agent OnConfigure failed")
+	if err := s.runner.handler.configure(ctx, config); err != nil {
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Agent OnConfigure failed")
 	} else {
-		log.Debug().Msg("Agent configuration applied via gRPC")
+		zentinel.LoggerFrom(ctx).Debug().Msg("Agent configuration applied via gRPC")
 	}
 
 	return true
@@ -302,10 +434,12 @@ func (s *agentGRPCService) controlStream(stream grpc.ServerStream) error {
 
 	id := s.streamID.Add(1)
 	streamID := fmt.Sprintf("grpc-control-%d", id)
-	ctx := stream.Context()
+	defer s.runner.openStream(streamID, TransportGRPC)()
+	logger := s.runner.Logger().With().Str("stream_id", streamID).Logger()
+	ctx := logger.WithContext(stream.Context())
 
-	log.Debug().Str("stream_id", streamID).Msg("gRPC ControlStream started")
-	defer log.Debug().Str("stream_id", streamID).Msg("gRPC ControlStream ended")
+	logger.Debug().Msg("gRPC ControlStream started")
+	defer logger.Debug().Msg("gRPC ControlStream ended")
 
 	var sendMu sync.Mutex
 
@@ -325,6 +459,7 @@ func (s *agentGRPCService) controlStream(stream grpc.ServerStream) error {
 			}
 			return err
 		}
+		s.runner.handler.metrics.RecordTransportMessage(TransportGRPC)
 
 		// Parse the control message
 		var controlMsg struct {
@@ -334,13 +469,14 @@ func (s *agentGRPCService) controlStream(stream grpc.ServerStream) error {
 			Log        json.RawMessage `json:"log,omitempty"`
 		}
 		if err := json.Unmarshal(in.Data, &controlMsg); err != nil {
-			log.Error().Err(err).Str("stream_id", streamID).Msg("Failed to parse control message")
+			logger.Error().Err(err).Msg("Failed to parse control message")
+			s.runner.handler.metrics.RecordTransportError(TransportGRPC)
 			continue
 		}
 
 		// Handle health request - respond with current health
 		if controlMsg.Health != nil {
-			health := s.runner.agent.HealthCheck(ctx)
+			health := s.runner.handler.checkHealth(ctx)
 			state := int32(1)
 			switch health.State {
 			case HealthStateDegraded:
@@ -358,7 +494,7 @@ func (s *agentGRPCService) controlStream(stream grpc.ServerStream) error {
 			_ = state // health state tracked but control stream responds with ProxyControl
 			respData, err := json.Marshal(resp)
 			if err != nil {
-				log.Error().Err(err).Msg("Failed to marshal control response")
+				logger.Error().Err(err).Msg("Failed to marshal control response")
 				continue
 			}
 
@@ -373,7 +509,59 @@ func (s *agentGRPCService) controlStream(stream grpc.ServerStream) error {
 		// Handle metrics - respond with acknowledgment
 		if controlMsg.Metrics != nil {
 			// Metrics are fire-and-forget from the agent side
-			log.Debug().Str("stream_id", streamID).Msg("Received metrics report via control stream")
+			logger.Debug().Msg("Received metrics report via control stream")
+		}
+
+		// Handle log - switch the log level and payload dumps
+		if controlMsg.Log != nil {
+			if err := s.handleLogControl(ctx, controlMsg.Log); err != nil {
+				logger.Warn().Err(err).Msg("Ignoring log control message")
+			}
 		}
 	}
 }
+
+// logControl is a ControlStream log message, which changes the agent's
+// logging at runtime. Level is a LogLevel value, unspecified meaning the
+// configured level. CorrelationID selects a request to dump the payloads
+// of. Fields may carry "client_ip", to dump a client's requests, and "ttl",
+// a duration such as "5m" after which the change reverts.
+type logControl struct {
+	Level         int32             `json:"level"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Fields        map[string]string `json:"fields,omitempty"`
+}
+
+// logControlLevels maps LogLevel values to level names.
+var logControlLevels = map[int32]string{0: "", 1: "debug", 2: "info", 3: "warn", 4: "error"}
+
+// handleLogControl applies a log message to the runner's debug control.
+func (s *agentGRPCService) handleLogControl(ctx context.Context, data json.RawMessage) error {
+	var msg logControl
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return fmt.Errorf("invalid log message: %w", err)
+	}
+	level, ok := logControlLevels[msg.Level]
+	if !ok {
+		return fmt.Errorf("unknown log level %d", msg.Level)
+	}
+	var ttl time.Duration
+	if value := msg.Fields["ttl"]; value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid ttl %q", value)
+		}
+		ttl = parsed
+	}
+
+	settings := zentinel.DebugSettings{
+		Level:             level,
+		DumpCorrelationID: msg.CorrelationID,
+		DumpClientIP:      msg.Fields["client_ip"],
+	}
+	if err := s.runner.debug.Set(settings, ttl); err != nil {
+		return err
+	}
+	zentinel.LoggerFrom(ctx).Log().Interface("settings", settings).Msg("Debug settings changed")
+	return nil
+}
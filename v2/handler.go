@@ -1,14 +1,26 @@
 package v2
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
-	"github.com/rs/zerolog/log"
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/hooks"
+)
+
+// Hooks that exist only in the v2 protocol, for failure policies and logging.
+const (
+	HookCancel      zentinel.Hook = "cancel"
+	HookHealthCheck zentinel.Hook = "health_check"
+	HookMetrics     zentinel.Hook = "metrics"
 )
 
 // AgentHandlerV2 handles v2 protocol events and routes them to the agent.
@@ -16,17 +28,39 @@ type AgentHandlerV2 struct {
 	agent AgentV2
 
 	// Request state tracking
-	requests       map[uint64]*zentinel.Request
-	requestBodies  map[uint64][]byte
-	responseBodies map[uint64][]byte
-	responseEvents map[uint64]*V2ResponseHeaders
+	requests       map[requestKey]*zentinel.Request
+	requestBodies  map[requestKey][]byte
+	responseBodies map[requestKey][]byte
+	responseEvents map[requestKey]*V2ResponseHeaders
+	progress       map[requestKey]*requestProgress
 	mu             sync.RWMutex
 
 	// Metrics tracking
 	metrics *MetricsCollector
 
+	// Decision sent when a hook panics or misses its deadline
+	failurePolicy zentinel.FailurePolicy
+	deadlines     zentinel.HookDeadlines
+
+	// What is done with messages that cannot be parsed
+	malformedInput zentinel.MalformedInputAction
+
+	// Shadow mode, switched by configure messages
+	shadow *zentinel.ShadowMode
+
+	// Spans for hook invocations; nil disables tracing
+	tracer *zentinel.Tracer
+
+	// Audit sink for decisions sent in place of the agent's; nil disables it
+	auditSink zentinel.AuditSink
+	auditAll  bool
+
+	// The last health status reported and configuration applied
+	health atomic.Pointer[HealthStatus]
+	config atomic.Pointer[map[string]interface{}]
+
 	// Cancellation
-	cancelFuncs map[uint64]context.CancelFunc
+	cancelFuncs map[requestKey]context.CancelFunc
 	cancelMu    sync.Mutex
 }
 
@@ -34,13 +68,128 @@ type AgentHandlerV2 struct {
 func NewAgentHandlerV2(agent AgentV2) *AgentHandlerV2 {
 	return &AgentHandlerV2{
 		agent:          agent,
-		requests:       make(map[uint64]*zentinel.Request),
-		requestBodies:  make(map[uint64][]byte),
-		responseBodies: make(map[uint64][]byte),
-		responseEvents: make(map[uint64]*V2ResponseHeaders),
+		requests:       make(map[requestKey]*zentinel.Request),
+		requestBodies:  make(map[requestKey][]byte),
+		responseBodies: make(map[requestKey][]byte),
+		responseEvents: make(map[requestKey]*V2ResponseHeaders),
+		progress:       make(map[requestKey]*requestProgress),
 		metrics:        NewMetricsCollector(),
-		cancelFuncs:    make(map[uint64]context.CancelFunc),
+		failurePolicy:  zentinel.DefaultFailurePolicy(),
+		malformedInput: zentinel.MalformedAllow,
+		cancelFuncs:    make(map[requestKey]context.CancelFunc),
+	}
+}
+
+// WithFailurePolicy sets the policy that decides what is sent when a hook
+// panics or misses its deadline. The default fails open for every hook.
+func (h *AgentHandlerV2) WithFailurePolicy(policy zentinel.FailurePolicy) *AgentHandlerV2 {
+	h.failurePolicy = policy
+	return h
+}
+
+// WithDeadlines sets how long each hook may run.
+func (h *AgentHandlerV2) WithDeadlines(deadlines zentinel.HookDeadlines) *AgentHandlerV2 {
+	h.deadlines = deadlines
+	return h
+}
+
+// WithMalformedInput sets what is done with messages that cannot be parsed.
+func (h *AgentHandlerV2) WithMalformedInput(action zentinel.MalformedInputAction) *AgentHandlerV2 {
+	h.malformedInput = action
+	return h
+}
+
+// WithShadowMode wraps the agent in shadow, which configure messages switch.
+// Requests it let through are counted in the "shadow_would_block" metric.
+func (h *AgentHandlerV2) WithShadowMode(shadow *zentinel.ShadowMode) *AgentHandlerV2 {
+	h.shadow = shadow
+	h.agent = Wrap(h.agent, shadow.Middleware())
+	return h
+}
+
+// WithAudit writes the agent's decisions to sink; a nil sink disables it.
+func (h *AgentHandlerV2) WithAudit(sink zentinel.AuditSink, all bool) *AgentHandlerV2 {
+	if sink != nil {
+		h.agent = Wrap(h.agent, zentinel.AuditMiddleware(sink, all))
 	}
+	h.auditSink, h.auditAll = sink, all
+	return h
+}
+
+// WithDebugControl dumps the payloads control selects; nil disables dumps.
+func (h *AgentHandlerV2) WithDebugControl(control *zentinel.DebugControl) *AgentHandlerV2 {
+	if control != nil {
+		h.agent = Wrap(h.agent, control.Middleware())
+	}
+	return h
+}
+
+// WithTracer starts a span per hook invocation; nil disables tracing.
+func (h *AgentHandlerV2) WithTracer(tracer *zentinel.Tracer) *AgentHandlerV2 {
+	h.tracer = tracer
+	if tracer != nil {
+		h.agent = Wrap(h.agent, tracer.Middleware())
+	}
+	return h
+}
+
+// MetricsCollector returns the collector the handler records request
+// outcomes, latencies and hook failures in.
+func (h *AgentHandlerV2) MetricsCollector() *MetricsCollector {
+	return h.metrics
+}
+
+// runHook runs an agent hook under its deadline, recovering a panic in it. A
+// panic or timeout is counted as a failure.
+func runHook[T any](h *AgentHandlerV2, ctx context.Context, hook zentinel.Hook, correlationID string, fn func(ctx context.Context) T) (T, hooks.Outcome) {
+	value, outcome := hooks.Run(ctx, string(hook), correlationID, h.deadlines.Timeout(hook), fn)
+	switch outcome {
+	case hooks.Panicked:
+		h.metrics.RecordFailure(zentinel.FailurePanic)
+	case hooks.TimedOut:
+		h.metrics.RecordFailure(zentinel.FailureTimeout)
+	}
+	return value, outcome
+}
+
+// call runs a hook that returns nothing.
+func (h *AgentHandlerV2) call(ctx context.Context, hook zentinel.Hook, correlationID string, fn func(ctx context.Context)) {
+	runHook(h, ctx, hook, correlationID, func(ctx context.Context) struct{} {
+		fn(ctx)
+		return struct{}{}
+	})
+}
+
+// decide runs a hook on request that returns a decision. If the hook panics
+// or times out, the failure policy's decision for it is shadowed, audited and
+// returned instead, tagged "panic" or "timeout", and failed is true.
+func (h *AgentHandlerV2) decide(ctx context.Context, hook zentinel.Hook, request *zentinel.Request, fn func(ctx context.Context) *zentinel.Decision) (decision *zentinel.Decision, failed bool) {
+	decision, outcome := runHook(h, ctx, hook, request.CorrelationID(), fn)
+	switch outcome {
+	case hooks.Panicked:
+		return h.fallback(ctx, hook, request, h.failurePolicy.Decision(hook).WithTag(string(zentinel.FailurePanic))), true
+	case hooks.TimedOut:
+		return h.fallback(ctx, hook, request, h.failurePolicy.Decision(hook).WithTag(string(zentinel.FailureTimeout))), true
+	}
+	return decision, false
+}
+
+// fallback applies shadow mode to a decision sent in place of the agent's
+// on a hook failure, which the agent's middleware never sees, then audits it.
+func (h *AgentHandlerV2) fallback(ctx context.Context, hook zentinel.Hook, request *zentinel.Request, decision *zentinel.Decision) *zentinel.Decision {
+	if h.shadow != nil {
+		decision = h.shadow.Apply(ctx, hook, decision)
+	}
+	return h.audit(ctx, hook, request, decision)
+}
+
+// audit writes a decision sent in place of the agent's to the audit sink,
+// which the agent's middleware never sees, and returns it.
+func (h *AgentHandlerV2) audit(ctx context.Context, hook zentinel.Hook, request *zentinel.Request, decision *zentinel.Decision) *zentinel.Decision {
+	if h.auditSink != nil {
+		zentinel.AuditDecision(ctx, h.auditSink, h.auditAll, hook, request, decision)
+	}
+	return decision
 }
 
 // HandleMessage handles an incoming v2 protocol message.
@@ -52,10 +201,16 @@ func (h *AgentHandlerV2) HandleMessage(ctx context.Context, msg *V2Message) (*V2
 		return h.handleRequestHeaders(ctx, msg)
 	case MsgTypeRequestBodyChunk:
 		return h.handleRequestBodyChunk(ctx, msg)
+	case MsgTypeRequestBodyChunkRaw:
+		return h.handleRequestBodyChunkRaw(ctx, msg)
 	case MsgTypeResponseHeaders:
 		return h.handleResponseHeaders(ctx, msg)
 	case MsgTypeResponseBodyChunk:
 		return h.handleResponseBodyChunk(ctx, msg)
+	case MsgTypeResponseBodyChunkRaw:
+		return h.handleResponseBodyChunkRaw(ctx, msg)
+	case MsgTypeRequestComplete:
+		return h.handleRequestComplete(ctx, msg)
 	case MsgTypeCancelRequest:
 		return h.handleCancelRequest(ctx, msg)
 	case MsgTypeCancelAll:
@@ -67,39 +222,51 @@ func (h *AgentHandlerV2) HandleMessage(ctx context.Context, msg *V2Message) (*V2
 	case MsgTypeMetricsRequest:
 		return h.handleMetricsRequest(ctx, msg)
 	default:
-		log.Warn().Str("type", msg.TypeName()).Msg("Unknown v2 message type")
-		return h.buildAllowDecision(0)
+		zentinel.LoggerFrom(ctx).Warn().Str("type", msg.TypeName()).Msg("Unknown v2 message type")
+		h.metrics.RecordFailure(zentinel.FailureUnknownMessage)
+		return NewV2Message(MsgTypeProtocolError, &ProtocolErrorMessage{
+			MessageType: msg.Type,
+			Code:        string(zentinel.FailureUnknownMessage),
+			Message:     "unknown message type " + msg.TypeName(),
+		})
 	}
 }
 
 func (h *AgentHandlerV2) handleHandshake(ctx context.Context, msg *V2Message) (*V2Message, error) {
 	var req HandshakeRequest
 	if err := msg.ParsePayload(&req); err != nil {
-		log.Error().Err(err).Msg("Failed to parse handshake request")
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse handshake request")
+		h.metrics.RecordFailure(zentinel.FailureMalformedPayload)
 		resp := NewHandshakeResponseError(h.agent.Name(), "failed to parse handshake")
 		return NewV2Message(MsgTypeHandshakeResponse, resp)
 	}
 
-	// Validate protocol version
-	if req.ProtocolVersion != ProtocolVersionV2 {
-		resp := NewHandshakeResponseError(h.agent.Name(), "unsupported protocol version")
+	caps := h.agent.Capabilities()
+	version, err := negotiateVersion(&req, caps)
+	if err != nil {
+		zentinel.LoggerFrom(ctx).Warn().Err(err).Str("client", req.ClientName).Msg("Rejecting handshake")
+		resp := NewHandshakeResponseError(h.agent.Name(), err.Error())
 		return NewV2Message(MsgTypeHandshakeResponse, resp)
 	}
 
-	log.Info().
+	resp := NewHandshakeResponse(h.agent.Name(), caps)
+	resp.ProtocolVersion = version
+	resp.Features = negotiateFeatures(req.SupportedFeatures, caps)
+
+	zentinel.LoggerFrom(ctx).Info().
 		Str("client", req.ClientName).
-		Uint32("version", req.ProtocolVersion).
+		Uint32("version", version).
+		Strs("features", resp.Features).
 		Msg("Handshake request received")
 
-	resp := NewHandshakeResponse(h.agent.Name(), h.agent.Capabilities())
 	return NewV2Message(MsgTypeHandshakeResponse, resp)
 }
 
 func (h *AgentHandlerV2) handleRequestHeaders(ctx context.Context, msg *V2Message) (*V2Message, error) {
 	var headers V2RequestHeaders
 	if err := msg.ParsePayload(&headers); err != nil {
-		log.Error().Err(err).Msg("Failed to parse request headers")
-		return h.buildAllowDecision(0)
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse request headers")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureMalformedPayload, err, true)
 	}
 
 	startTime := time.Now()
@@ -107,13 +274,14 @@ func (h *AgentHandlerV2) handleRequestHeaders(ctx context.Context, msg *V2Messag
 	defer h.metrics.DecrementActive()
 
 	// Create cancellable context
+	key := keyOf(ctx, headers.RequestID)
 	reqCtx, cancel := context.WithCancel(ctx)
 	h.cancelMu.Lock()
-	h.cancelFuncs[headers.RequestID] = cancel
+	h.cancelFuncs[key] = cancel
 	h.cancelMu.Unlock()
 	defer func() {
 		h.cancelMu.Lock()
-		delete(h.cancelFuncs, headers.RequestID)
+		delete(h.cancelFuncs, key)
 		h.cancelMu.Unlock()
 	}()
 
@@ -140,46 +308,88 @@ func (h *AgentHandlerV2) handleRequestHeaders(ctx context.Context, msg *V2Messag
 
 	// Cache request for response correlation
 	h.mu.Lock()
-	h.requests[headers.RequestID] = request
-	h.requestBodies[headers.RequestID] = []byte{}
+	h.requests[key] = request
+	h.requestBodies[key] = []byte{}
+	h.progress[key] = &requestProgress{started: startTime, phase: zentinel.HookRequest}
 	h.mu.Unlock()
 
-	decision := h.agent.OnRequest(reqCtx, request)
+	reqCtx = requestContext(reqCtx, headers.RequestID, request)
+	decision, failed := h.decide(reqCtx, zentinel.HookRequest, request, func(ctx context.Context) *zentinel.Decision {
+		return h.agent.OnRequest(ctx, request)
+	})
 	elapsed := time.Since(startTime).Seconds() * 1000
 
-	// Record metrics
-	response := decision.Build()
-	isAllowed := response.Decision == "allow"
-	h.metrics.RecordRequest(isAllowed, elapsed)
+	// Record metrics; a failed hook was already counted as an error
+	if !failed {
+		response := decision.Build()
+		isAllowed := response.Decision == "allow"
+		h.metrics.RecordRequest(isAllowed, elapsed)
+	}
 
-	return h.buildDecisionMessage(headers.RequestID, decision)
+	return h.buildDecisionMessage(ctx, headers.RequestID, decision)
 }
 
 func (h *AgentHandlerV2) handleRequestBodyChunk(ctx context.Context, msg *V2Message) (*V2Message, error) {
 	var chunk V2RequestBodyChunk
 	if err := msg.ParsePayload(&chunk); err != nil {
-		log.Error().Err(err).Msg("Failed to parse request body chunk")
-		return h.buildAllowDecision(0)
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse request body chunk")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureMalformedPayload, err, true)
 	}
 
 	data, err := base64.StdEncoding.DecodeString(chunk.Data)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to decode body chunk data")
-		return h.buildAllowDecision(chunk.RequestID)
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to decode body chunk data")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureInvalidBody, err, true)
 	}
 
-	// Accumulate body chunks
+	return h.requestBodyChunk(ctx, RawBodyChunk{RequestID: chunk.RequestID, ChunkIndex: chunk.ChunkIndex, IsLast: chunk.IsLast, Data: data})
+}
+
+// errRawBodyNotNegotiated rejects a raw body frame on a connection whose
+// handshake did not agree to FeatureRawBody.
+var errRawBodyNotNegotiated = errors.New("raw body frames were not negotiated")
+
+func (h *AgentHandlerV2) handleRequestBodyChunkRaw(ctx context.Context, msg *V2Message) (*V2Message, error) {
+	if !FeatureEnabled(ctx, FeatureRawBody) {
+		zentinel.LoggerFrom(ctx).Warn().Msg("Raw request body chunk without raw_body negotiated")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureUnknownMessage, errRawBodyNotNegotiated, true)
+	}
+	chunk, err := ParseRawBodyChunk(msg.Payload)
+	if err != nil {
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse raw request body chunk")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureMalformedPayload, err, true)
+	}
+	return h.requestBodyChunk(ctx, *chunk)
+}
+
+// requestBodyChunk buffers a request body chunk, however it was framed, and
+// runs OnRequestBody once the body is complete or, if streaming, on every
+// chunk.
+func (h *AgentHandlerV2) requestBodyChunk(ctx context.Context, chunk RawBodyChunk) (*V2Message, error) {
+	data := chunk.Data
+	key := keyOf(ctx, chunk.RequestID)
+
+	// Chunks for unknown or cancelled requests are dropped, not accumulated
 	h.mu.Lock()
-	h.requestBodies[chunk.RequestID] = append(h.requestBodies[chunk.RequestID], data...)
-	body := h.requestBodies[chunk.RequestID]
-	request := h.requests[chunk.RequestID]
+	request := h.requests[key]
+	if request != nil {
+		h.requestBodies[key] = append(h.requestBodies[key], data...)
+		h.setPhase(key, zentinel.HookRequestBody)
+	}
+	body := h.requestBodies[key]
 	h.mu.Unlock()
 
-	// Only call handler on last chunk
-	if chunk.IsLast && request != nil {
+	// Only call handler on last chunk, unless streaming
+	if request != nil && (chunk.IsLast || FeatureEnabled(ctx, FeatureStreaming)) {
 		requestWithBody := request.WithBody(body)
-		decision := h.agent.OnRequestBody(ctx, requestWithBody)
-		return h.buildDecisionMessage(chunk.RequestID, decision)
+		ctx = requestContext(ctx, chunk.RequestID, request)
+		decision, _ := h.decide(ctx, zentinel.HookRequestBody, request, func(ctx context.Context) *zentinel.Decision {
+			return h.agent.OnRequestBody(ctx, requestWithBody)
+		})
+		if !chunk.IsLast && decision.Build().NeedsMore {
+			return h.buildNeedsMoreDecision(chunk.RequestID)
+		}
+		return h.buildDecisionMessage(ctx, chunk.RequestID, decision)
 	}
 
 	// For non-final chunks, return allow with needs_more
@@ -189,16 +399,17 @@ func (h *AgentHandlerV2) handleRequestBodyChunk(ctx context.Context, msg *V2Mess
 func (h *AgentHandlerV2) handleResponseHeaders(ctx context.Context, msg *V2Message) (*V2Message, error) {
 	var headers V2ResponseHeaders
 	if err := msg.ParsePayload(&headers); err != nil {
-		log.Error().Err(err).Msg("Failed to parse response headers")
-		return h.buildAllowDecision(0)
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse response headers")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureMalformedPayload, err, true)
 	}
 
+	key := keyOf(ctx, headers.RequestID)
 	h.mu.RLock()
-	request := h.requests[headers.RequestID]
+	request := h.requests[key]
 	h.mu.RUnlock()
 
 	if request == nil {
-		log.Warn().Uint64("request_id", headers.RequestID).Msg("No cached request for request_id")
+		zentinel.LoggerFrom(ctx).Warn().Uint64("request_id", headers.RequestID).Msg("No cached request for request_id")
 		return h.buildAllowDecision(headers.RequestID)
 	}
 
@@ -213,37 +424,67 @@ func (h *AgentHandlerV2) handleResponseHeaders(ctx context.Context, msg *V2Messa
 
 	// Cache response event for body processing
 	h.mu.Lock()
-	h.responseEvents[headers.RequestID] = &headers
-	h.responseBodies[headers.RequestID] = []byte{}
+	h.responseEvents[key] = &headers
+	h.responseBodies[key] = []byte{}
+	h.setPhase(key, zentinel.HookResponse)
 	h.mu.Unlock()
 
-	decision := h.agent.OnResponse(ctx, request, response)
-	return h.buildDecisionMessage(headers.RequestID, decision)
+	ctx = requestContext(ctx, headers.RequestID, request)
+	decision, _ := h.decide(ctx, zentinel.HookResponse, request, func(ctx context.Context) *zentinel.Decision {
+		return h.agent.OnResponse(ctx, request, response)
+	})
+	return h.buildDecisionMessage(ctx, headers.RequestID, decision)
 }
 
 func (h *AgentHandlerV2) handleResponseBodyChunk(ctx context.Context, msg *V2Message) (*V2Message, error) {
 	var chunk V2ResponseBodyChunk
 	if err := msg.ParsePayload(&chunk); err != nil {
-		log.Error().Err(err).Msg("Failed to parse response body chunk")
-		return h.buildAllowDecision(0)
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse response body chunk")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureMalformedPayload, err, true)
 	}
 
 	data, err := base64.StdEncoding.DecodeString(chunk.Data)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to decode response body chunk data")
-		return h.buildAllowDecision(chunk.RequestID)
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to decode response body chunk data")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureInvalidBody, err, true)
+	}
+
+	return h.responseBodyChunk(ctx, RawBodyChunk{RequestID: chunk.RequestID, ChunkIndex: chunk.ChunkIndex, IsLast: chunk.IsLast, Data: data})
+}
+
+func (h *AgentHandlerV2) handleResponseBodyChunkRaw(ctx context.Context, msg *V2Message) (*V2Message, error) {
+	if !FeatureEnabled(ctx, FeatureRawBody) {
+		zentinel.LoggerFrom(ctx).Warn().Msg("Raw response body chunk without raw_body negotiated")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureUnknownMessage, errRawBodyNotNegotiated, true)
+	}
+	chunk, err := ParseRawBodyChunk(msg.Payload)
+	if err != nil {
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse raw response body chunk")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureMalformedPayload, err, true)
 	}
+	return h.responseBodyChunk(ctx, *chunk)
+}
+
+// responseBodyChunk buffers a response body chunk, however it was framed,
+// and runs OnResponseBody once the body is complete or, if streaming, on
+// every chunk.
+func (h *AgentHandlerV2) responseBodyChunk(ctx context.Context, chunk RawBodyChunk) (*V2Message, error) {
+	data := chunk.Data
+	key := keyOf(ctx, chunk.RequestID)
 
-	// Accumulate body chunks
+	// Chunks for unknown or cancelled responses are dropped, not accumulated
 	h.mu.Lock()
-	h.responseBodies[chunk.RequestID] = append(h.responseBodies[chunk.RequestID], data...)
-	body := h.responseBodies[chunk.RequestID]
-	request := h.requests[chunk.RequestID]
-	responseEvent := h.responseEvents[chunk.RequestID]
+	request := h.requests[key]
+	responseEvent := h.responseEvents[key]
+	if request != nil && responseEvent != nil {
+		h.responseBodies[key] = append(h.responseBodies[key], data...)
+		h.setPhase(key, zentinel.HookResponseBody)
+	}
+	body := h.responseBodies[key]
 	h.mu.Unlock()
 
-	// Only call handler on last chunk
-	if chunk.IsLast && request != nil && responseEvent != nil {
+	// Only call handler on last chunk, unless streaming
+	if request != nil && responseEvent != nil && (chunk.IsLast || FeatureEnabled(ctx, FeatureStreaming)) {
 		event := &zentinel.ResponseHeadersEvent{
 			CorrelationID: request.CorrelationID(),
 			Status:        int(responseEvent.StatusCode),
@@ -251,67 +492,131 @@ func (h *AgentHandlerV2) handleResponseBodyChunk(ctx context.Context, msg *V2Mes
 		}
 		response := zentinel.NewResponse(event, body)
 
-		decision := h.agent.OnResponseBody(ctx, request, response)
-		return h.buildDecisionMessage(chunk.RequestID, decision)
+		ctx = requestContext(ctx, chunk.RequestID, request)
+		decision, _ := h.decide(ctx, zentinel.HookResponseBody, request, func(ctx context.Context) *zentinel.Decision {
+			return h.agent.OnResponseBody(ctx, request, response)
+		})
+		if !chunk.IsLast && decision.Build().NeedsMore {
+			return h.buildNeedsMoreDecision(chunk.RequestID)
+		}
+		return h.buildDecisionMessage(ctx, chunk.RequestID, decision)
 	}
 
 	return h.buildNeedsMoreDecision(chunk.RequestID)
 }
 
+func (h *AgentHandlerV2) handleRequestComplete(ctx context.Context, msg *V2Message) (*V2Message, error) {
+	var complete V2RequestComplete
+	if err := msg.ParsePayload(&complete); err != nil {
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse request complete")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureMalformedPayload, err, false)
+	}
+
+	key := keyOf(ctx, complete.RequestID)
+	h.mu.RLock()
+	request := h.requests[key]
+	h.mu.RUnlock()
+
+	h.cleanup(key)
+
+	if request != nil {
+		ctx := requestContext(ctx, complete.RequestID, request)
+		ctx, span := h.tracer.Start(ctx, zentinel.HookRequestComplete, request)
+		h.call(ctx, zentinel.HookRequestComplete, request.CorrelationID(), func(ctx context.Context) {
+			h.agent.OnRequestComplete(ctx, request, int(complete.StatusCode), int(complete.DurationMS))
+		})
+		h.tracer.End(span, nil)
+		request.State().Clear()
+	}
+
+	// No response for request complete
+	return nil, nil
+}
+
 func (h *AgentHandlerV2) handleCancelRequest(ctx context.Context, msg *V2Message) (*V2Message, error) {
 	var cancel CancelRequestMessage
 	if err := msg.ParsePayload(&cancel); err != nil {
-		log.Error().Err(err).Msg("Failed to parse cancel request")
-		return nil, nil
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse cancel request")
+		return h.rejectMalformed(ctx, msg, zentinel.FailureMalformedPayload, err, false)
 	}
 
-	log.Debug().Uint64("request_id", cancel.RequestID).Msg("Cancelling request")
+	zentinel.LoggerFrom(ctx).Debug().Uint64("request_id", cancel.RequestID).Msg("Cancelling request")
 
 	// Cancel the context
+	key := keyOf(ctx, cancel.RequestID)
 	h.cancelMu.Lock()
-	if cancelFunc, ok := h.cancelFuncs[cancel.RequestID]; ok {
+	if cancelFunc, ok := h.cancelFuncs[key]; ok {
 		cancelFunc()
-		delete(h.cancelFuncs, cancel.RequestID)
+		delete(h.cancelFuncs, key)
 	}
 	h.cancelMu.Unlock()
 
 	// Cleanup cached state
 	h.mu.Lock()
-	delete(h.requests, cancel.RequestID)
-	delete(h.requestBodies, cancel.RequestID)
-	delete(h.responseBodies, cancel.RequestID)
-	delete(h.responseEvents, cancel.RequestID)
+	request := h.requests[key]
+	h.forget(key)
 	h.mu.Unlock()
 
 	// Notify agent
-	h.agent.OnCancel(ctx, cancel.RequestID)
+	ctx = requestContext(ctx, cancel.RequestID, request)
+	h.call(ctx, HookCancel, correlationIDOf(request), func(ctx context.Context) {
+		h.agent.OnCancel(ctx, cancel.RequestID)
+	})
+	if request != nil {
+		request.State().Clear()
+	}
 
 	// No response for cancel
 	return nil, nil
 }
 
 func (h *AgentHandlerV2) handleCancelAll(ctx context.Context, msg *V2Message) (*V2Message, error) {
-	log.Debug().Msg("Cancelling all requests")
+	zentinel.LoggerFrom(ctx).Debug().Msg("Cancelling all requests")
+	h.cancelStream(ctx)
+
+	// No response for cancel all
+	return nil, nil
+}
 
-	// Cancel all contexts
+// cancelStream cancels the requests of the stream ctx belongs to and drops
+// their state. Requests on other streams are left alone.
+func (h *AgentHandlerV2) cancelStream(ctx context.Context) {
+	stream := streamOf(ctx)
+
+	// Cancel the stream's contexts
 	h.cancelMu.Lock()
-	for requestID, cancelFunc := range h.cancelFuncs {
-		cancelFunc()
-		h.agent.OnCancel(ctx, requestID)
+	var cancelled []requestKey
+	for key, cancelFunc := range h.cancelFuncs {
+		if key.stream == stream {
+			cancelFunc()
+			delete(h.cancelFuncs, key)
+			cancelled = append(cancelled, key)
+		}
 	}
-	h.cancelFuncs = make(map[uint64]context.CancelFunc)
 	h.cancelMu.Unlock()
 
-	// Cleanup all cached state
+	// Cleanup the stream's cached state
 	h.mu.Lock()
-	h.requests = make(map[uint64]*zentinel.Request)
-	h.requestBodies = make(map[uint64][]byte)
-	h.responseBodies = make(map[uint64][]byte)
-	h.responseEvents = make(map[uint64]*V2ResponseHeaders)
+	requests := make(map[requestKey]*zentinel.Request)
+	for key, request := range h.requests {
+		if key.stream == stream {
+			requests[key] = request
+			h.forget(key)
+		}
+	}
 	h.mu.Unlock()
 
-	// No response for cancel all
-	return nil, nil
+	// Notify agent; a panic for one request does not skip the rest
+	for _, key := range cancelled {
+		requestID := key.id
+		ctx := requestContext(ctx, requestID, requests[key])
+		h.call(ctx, HookCancel, correlationIDOf(requests[key]), func(ctx context.Context) {
+			h.agent.OnCancel(ctx, requestID)
+		})
+	}
+	for _, request := range requests {
+		request.State().Clear()
+	}
 }
 
 func (h *AgentHandlerV2) handlePing(ctx context.Context, msg *V2Message) (*V2Message, error) {
@@ -325,16 +630,48 @@ func (h *AgentHandlerV2) handlePing(ctx context.Context, msg *V2Message) (*V2Mes
 }
 
 func (h *AgentHandlerV2) handleHealthRequest(ctx context.Context, msg *V2Message) (*V2Message, error) {
-	health := h.agent.HealthCheck(ctx)
-	return NewV2Message(MsgTypeHealthResponse, health)
+	return NewV2Message(MsgTypeHealthResponse, h.checkHealth(ctx))
+}
+
+// checkHealth runs the agent's health check, reporting it unhealthy if the
+// check panics or times out, and keeps the result for LastHealth.
+func (h *AgentHandlerV2) checkHealth(ctx context.Context) *HealthStatus {
+	health, outcome := runHook(h, ctx, HookHealthCheck, "", h.agent.HealthCheck)
+	if outcome != hooks.Completed || health == nil {
+		health = Unhealthy("health check failed")
+	}
+	h.health.Store(health)
+	return health
 }
 
 func (h *AgentHandlerV2) handleMetricsRequest(ctx context.Context, msg *V2Message) (*V2Message, error) {
-	metrics := h.agent.Metrics(ctx)
+	metrics, outcome := runHook(h, ctx, HookMetrics, "", h.agent.Metrics)
+	handlerReport := h.metrics.Report()
+	if outcome != hooks.Completed {
+		metrics = handlerReport
+	}
+	if metrics != nil && metrics != handlerReport {
+		// The runner counts streams and messages in the handler's collector
+		metrics.Transports = handlerReport.Transports
+
+		// Failures are counted by the handler, on top of any the agent reports
+		if len(handlerReport.Failures) > 0 && metrics.Failures == nil {
+			metrics.Failures = make(map[string]uint64, len(handlerReport.Failures))
+		}
+		for class, n := range handlerReport.Failures {
+			metrics.Failures[class] += n
+		}
+	}
+	if h.shadow != nil && metrics != nil {
+		if metrics.Custom == nil {
+			metrics.Custom = make(map[string]interface{})
+		}
+		metrics.Custom["shadow_would_block"] = h.shadow.WouldBlock()
+	}
 	return NewV2Message(MsgTypeMetricsResponse, metrics)
 }
 
-func (h *AgentHandlerV2) buildDecisionMessage(requestID uint64, decision *zentinel.Decision) (*V2Message, error) {
+func (h *AgentHandlerV2) buildDecisionMessage(ctx context.Context, requestID uint64, decision *zentinel.Decision) (*V2Message, error) {
 	response := decision.Build()
 
 	v2Decision := V2Decision{
@@ -382,6 +719,15 @@ func (h *AgentHandlerV2) buildDecisionMessage(requestID uint64, decision *zentin
 		v2Decision.Audit = audit
 	}
 
+	if response.RequestBodyMutation != nil || response.ResponseBodyMutation != nil {
+		if FeatureEnabled(ctx, FeatureBodyMutation) {
+			v2Decision.RequestBodyMutation = response.RequestBodyMutation
+			v2Decision.ResponseBodyMutation = response.ResponseBodyMutation
+		} else {
+			zentinel.LoggerFrom(ctx).Debug().Msg("Dropping body mutation the proxy did not negotiate")
+		}
+	}
+
 	return NewV2Message(MsgTypeDecision, v2Decision)
 }
 
@@ -393,6 +739,71 @@ func (h *AgentHandlerV2) buildAllowDecision(requestID uint64) (*V2Message, error
 	return NewV2Message(MsgTypeDecision, v2Decision)
 }
 
+// rejectMalformed answers a message that could not be used and counts it
+// under class. Unless the connection is to be closed, a message that takes a
+// decision gets the malformed input action's decision for the request ID
+// recovered from its payload, or a protocol error if there is none; other
+// messages get no reply. For MalformedClose a protocol error is returned with
+// an error wrapping zentinel.ErrMalformedInput, and the runner closes the
+// connection after sending it.
+func (h *AgentHandlerV2) rejectMalformed(ctx context.Context, msg *V2Message, class zentinel.FailureClass, err error, takesDecision bool) (*V2Message, error) {
+	h.metrics.RecordFailure(class)
+
+	requestID, ok := recoverRequestID(msg.Payload)
+	protocolErr := &ProtocolErrorMessage{
+		MessageType: msg.Type,
+		Code:        string(class),
+		Message:     err.Error(),
+	}
+	if ok {
+		protocolErr.RequestID = &requestID
+	}
+
+	if h.malformedInput == zentinel.MalformedClose {
+		reply, buildErr := NewV2Message(MsgTypeProtocolError, protocolErr)
+		if buildErr != nil {
+			return nil, buildErr
+		}
+		return reply, fmt.Errorf("%w: %s: %v", zentinel.ErrMalformedInput, msg.TypeName(), err)
+	}
+	if !takesDecision {
+		return nil, nil
+	}
+	if !ok {
+		return NewV2Message(MsgTypeProtocolError, protocolErr)
+	}
+	h.mu.RLock()
+	request := h.requests[keyOf(ctx, requestID)]
+	h.mu.RUnlock()
+	decision := h.audit(ctx, "", request, h.malformedInput.Decision(class))
+	return h.buildDecisionMessage(context.Background(), requestID, decision)
+}
+
+// recoverRequestID extracts the top-level request_id from a payload that did
+// not parse as a whole. Fields are read in order until the payload breaks, so
+// a truncated payload still yields an ID that precedes the damage.
+func recoverRequestID(payload []byte) (uint64, bool) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return 0, false
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, false
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return 0, false
+		}
+		if tok == "request_id" {
+			requestID, err := strconv.ParseUint(string(value), 10, 64)
+			return requestID, err == nil
+		}
+	}
+	return 0, false
+}
+
 func (h *AgentHandlerV2) buildNeedsMoreDecision(requestID uint64) (*V2Message, error) {
 	v2Decision := V2Decision{
 		RequestID: requestID,
@@ -403,23 +814,36 @@ func (h *AgentHandlerV2) buildNeedsMoreDecision(requestID uint64) (*V2Message, e
 	return NewV2Message(MsgTypeDecision, v2Decision)
 }
 
-// Cleanup cleans up resources for a completed request.
+// Cleanup cleans up resources for a completed request. Requests that
+// arrived on a runner's stream are cleaned up when they complete.
 func (h *AgentHandlerV2) Cleanup(requestID uint64) {
+	h.cleanup(requestKey{id: requestID})
+}
+
+// cleanup cleans up resources for the request with key.
+func (h *AgentHandlerV2) cleanup(key requestKey) {
 	h.mu.Lock()
-	delete(h.requests, requestID)
-	delete(h.requestBodies, requestID)
-	delete(h.responseBodies, requestID)
-	delete(h.responseEvents, requestID)
+	h.forget(key)
 	h.mu.Unlock()
 
 	h.cancelMu.Lock()
-	if cancelFunc, ok := h.cancelFuncs[requestID]; ok {
+	if cancelFunc, ok := h.cancelFuncs[key]; ok {
 		cancelFunc()
-		delete(h.cancelFuncs, requestID)
+		delete(h.cancelFuncs, key)
 	}
 	h.cancelMu.Unlock()
 }
 
+// forget drops the state cached for the request with key. h.mu must be
+// held.
+func (h *AgentHandlerV2) forget(key requestKey) {
+	delete(h.requests, key)
+	delete(h.requestBodies, key)
+	delete(h.responseBodies, key)
+	delete(h.responseEvents, key)
+	delete(h.progress, key)
+}
+
 // HandleLegacyEvent handles a legacy protocol event for backward compatibility.
 func (h *AgentHandlerV2) HandleLegacyEvent(ctx context.Context, event map[string]interface{}) (interface{}, error) {
 	eventType, _ := event["event_type"].(string)
@@ -438,15 +862,44 @@ func (h *AgentHandlerV2) HandleLegacyEvent(ctx context.Context, event map[string
 		return h.handleLegacyResponseBodyChunk(ctx, payload)
 	case zentinel.EventTypeRequestComplete:
 		return h.handleLegacyRequestComplete(ctx, payload)
+	case zentinel.EventTypeGuardrailInspect:
+		return h.handleLegacyGuardrailInspect(ctx, payload)
 	default:
-		log.Warn().Str("event_type", eventType).Msg("Unknown legacy event type")
-		return zentinel.Allow().Build(), nil
+		zentinel.LoggerFrom(ctx).Warn().Str("event_type", eventType).Msg("Unknown legacy event type")
+		return h.rejectMalformedLegacy(ctx, zentinel.FailureUnknownMessage, fmt.Errorf("unknown event type %q", eventType))
 	}
 }
 
+func (h *AgentHandlerV2) handleLegacyGuardrailInspect(ctx context.Context, payload map[string]interface{}) (interface{}, error) {
+	jsonBytes, _ := json.Marshal(payload)
+	var event zentinel.GuardrailInspectEvent
+	if err := json.Unmarshal(jsonBytes, &event); err != nil {
+		zentinel.LoggerFrom(ctx).Error().Err(err).Msg("Failed to parse guardrail inspect event")
+		h.metrics.RecordFailure(zentinel.FailureMalformedPayload)
+		switch h.malformedInput {
+		case zentinel.MalformedClose:
+			return nil, fmt.Errorf("%w: %v", zentinel.ErrMalformedInput, err)
+		case zentinel.MalformedBlock:
+			return zentinel.NewGuardrailResponseWithDetection(
+				zentinel.NewGuardrailDetection(string(zentinel.FailureMalformedPayload), "guardrail inspect event could not be parsed").
+					WithSeverity(zentinel.DetectionSeverityHigh)), nil
+		}
+		return zentinel.NewGuardrailResponse(), nil
+	}
+
+	ctx = zentinel.LoggerFrom(ctx).With().Str("correlation_id", event.CorrelationID).Logger().WithContext(ctx)
+	response, outcome := runHook(h, ctx, zentinel.HookGuardrailInspect, event.CorrelationID, func(ctx context.Context) *zentinel.GuardrailResponse {
+		return h.agent.OnGuardrailInspect(ctx, &event)
+	})
+	if outcome != hooks.Completed {
+		response = h.failurePolicy.GuardrailResponse()
+	}
+	return response, nil
+}
+
 func (h *AgentHandlerV2) handleLegacyConfigure(ctx context.Context, payload map[string]interface{}) (interface{}, error) {
 	config, _ := payload["config"].(map[string]interface{})
-	if err := h.agent.OnConfigure(ctx, config); err != nil {
+	if err := h.configure(ctx, config); err != nil {
 		return map[string]interface{}{"success": false, "error": err.Error()}, nil
 	}
 	return map[string]interface{}{"success": true}, nil
@@ -456,7 +909,7 @@ func (h *AgentHandlerV2) handleLegacyRequestHeaders(ctx context.Context, payload
 	jsonBytes, _ := json.Marshal(payload)
 	var event zentinel.RequestHeadersEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		return zentinel.Allow().Build(), nil
+		return h.rejectMalformedLegacy(ctx, zentinel.FailureMalformedPayload, err)
 	}
 
 	request := zentinel.NewRequest(&event, nil)
@@ -464,13 +917,18 @@ func (h *AgentHandlerV2) handleLegacyRequestHeaders(ctx context.Context, payload
 
 	// Use correlation ID hash as request ID for legacy compatibility
 	requestID := hashString(correlationID)
+	key := keyOf(ctx, requestID)
 
 	h.mu.Lock()
-	h.requests[requestID] = request
-	h.requestBodies[requestID] = []byte{}
+	h.requests[key] = request
+	h.requestBodies[key] = []byte{}
+	h.progress[key] = &requestProgress{started: time.Now(), phase: zentinel.HookRequest}
 	h.mu.Unlock()
 
-	decision := h.agent.OnRequest(ctx, request)
+	ctx = requestContext(ctx, requestID, request)
+	decision, _ := h.decide(ctx, zentinel.HookRequest, request, func(ctx context.Context) *zentinel.Decision {
+		return h.agent.OnRequest(ctx, request)
+	})
 	return decision.Build(), nil
 }
 
@@ -478,21 +936,32 @@ func (h *AgentHandlerV2) handleLegacyRequestBodyChunk(ctx context.Context, paylo
 	jsonBytes, _ := json.Marshal(payload)
 	var event zentinel.RequestBodyChunkEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		return zentinel.Allow().Build(), nil
+		return h.rejectMalformedLegacy(ctx, zentinel.FailureMalformedPayload, err)
 	}
 
 	requestID := hashString(event.CorrelationID)
-	data, _ := event.DecodedData()
+	key := keyOf(ctx, requestID)
+	data, err := event.DecodedData()
+	if err != nil {
+		return h.rejectMalformedLegacy(ctx, zentinel.FailureInvalidBody, err)
+	}
 
+	// Chunks for unknown or cancelled requests are dropped, not accumulated
 	h.mu.Lock()
-	h.requestBodies[requestID] = append(h.requestBodies[requestID], data...)
-	body := h.requestBodies[requestID]
-	request := h.requests[requestID]
+	request := h.requests[key]
+	if request != nil {
+		h.requestBodies[key] = append(h.requestBodies[key], data...)
+		h.setPhase(key, zentinel.HookRequestBody)
+	}
+	body := h.requestBodies[key]
 	h.mu.Unlock()
 
 	if event.IsLast && request != nil {
 		requestWithBody := request.WithBody(body)
-		decision := h.agent.OnRequestBody(ctx, requestWithBody)
+		ctx = requestContext(ctx, requestID, request)
+		decision, _ := h.decide(ctx, zentinel.HookRequestBody, request, func(ctx context.Context) *zentinel.Decision {
+			return h.agent.OnRequestBody(ctx, requestWithBody)
+		})
 		return decision.Build(), nil
 	}
 
@@ -503,13 +972,14 @@ func (h *AgentHandlerV2) handleLegacyResponseHeaders(ctx context.Context, payloa
 	jsonBytes, _ := json.Marshal(payload)
 	var event zentinel.ResponseHeadersEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		return zentinel.Allow().Build(), nil
+		return h.rejectMalformedLegacy(ctx, zentinel.FailureMalformedPayload, err)
 	}
 
 	requestID := hashString(event.CorrelationID)
+	key := keyOf(ctx, requestID)
 
 	h.mu.RLock()
-	request := h.requests[requestID]
+	request := h.requests[key]
 	h.mu.RUnlock()
 
 	if request == nil {
@@ -519,15 +989,19 @@ func (h *AgentHandlerV2) handleLegacyResponseHeaders(ctx context.Context, payloa
 	response := zentinel.NewResponse(&event, nil)
 
 	h.mu.Lock()
-	h.responseEvents[requestID] = &V2ResponseHeaders{
+	h.responseEvents[key] = &V2ResponseHeaders{
 		RequestID:  requestID,
 		StatusCode: uint16(event.Status),
 		Headers:    event.Headers,
 	}
-	h.responseBodies[requestID] = []byte{}
+	h.responseBodies[key] = []byte{}
+	h.setPhase(key, zentinel.HookResponse)
 	h.mu.Unlock()
 
-	decision := h.agent.OnResponse(ctx, request, response)
+	ctx = requestContext(ctx, requestID, request)
+	decision, _ := h.decide(ctx, zentinel.HookResponse, request, func(ctx context.Context) *zentinel.Decision {
+		return h.agent.OnResponse(ctx, request, response)
+	})
 	return decision.Build(), nil
 }
 
@@ -535,17 +1009,25 @@ func (h *AgentHandlerV2) handleLegacyResponseBodyChunk(ctx context.Context, payl
 	jsonBytes, _ := json.Marshal(payload)
 	var event zentinel.ResponseBodyChunkEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
-		return zentinel.Allow().Build(), nil
+		return h.rejectMalformedLegacy(ctx, zentinel.FailureMalformedPayload, err)
 	}
 
 	requestID := hashString(event.CorrelationID)
-	data, _ := event.DecodedData()
+	key := keyOf(ctx, requestID)
+	data, err := event.DecodedData()
+	if err != nil {
+		return h.rejectMalformedLegacy(ctx, zentinel.FailureInvalidBody, err)
+	}
 
+	// Chunks for unknown or cancelled responses are dropped, not accumulated
 	h.mu.Lock()
-	h.responseBodies[requestID] = append(h.responseBodies[requestID], data...)
-	body := h.responseBodies[requestID]
-	request := h.requests[requestID]
-	responseEvent := h.responseEvents[requestID]
+	request := h.requests[key]
+	responseEvent := h.responseEvents[key]
+	if request != nil && responseEvent != nil {
+		h.responseBodies[key] = append(h.responseBodies[key], data...)
+		h.setPhase(key, zentinel.HookResponseBody)
+	}
+	body := h.responseBodies[key]
 	h.mu.Unlock()
 
 	if event.IsLast && request != nil && responseEvent != nil {
@@ -555,7 +1037,10 @@ func (h *AgentHandlerV2) handleLegacyResponseBodyChunk(ctx context.Context, payl
 			Headers:       responseEvent.Headers,
 		}
 		response := zentinel.NewResponse(zentinelEvent, body)
-		decision := h.agent.OnResponseBody(ctx, request, response)
+		ctx = requestContext(ctx, requestID, request)
+		decision, _ := h.decide(ctx, zentinel.HookResponseBody, request, func(ctx context.Context) *zentinel.Decision {
+			return h.agent.OnResponseBody(ctx, request, response)
+		})
 		return decision.Build(), nil
 	}
 
@@ -566,26 +1051,117 @@ func (h *AgentHandlerV2) handleLegacyRequestComplete(ctx context.Context, payloa
 	jsonBytes, _ := json.Marshal(payload)
 	var event zentinel.RequestCompleteEvent
 	if err := json.Unmarshal(jsonBytes, &event); err != nil {
+		if _, err := h.rejectMalformedLegacy(ctx, zentinel.FailureMalformedPayload, err); err != nil {
+			return nil, err
+		}
 		return map[string]interface{}{"success": true}, nil
 	}
 
 	requestID := hashString(event.CorrelationID)
+	key := keyOf(ctx, requestID)
 
 	h.mu.Lock()
-	request := h.requests[requestID]
-	delete(h.requests, requestID)
-	delete(h.requestBodies, requestID)
-	delete(h.responseBodies, requestID)
-	delete(h.responseEvents, requestID)
+	request := h.requests[key]
+	h.forget(key)
 	h.mu.Unlock()
 
 	if request != nil {
-		h.agent.OnRequestComplete(ctx, request, event.Status, event.DurationMS)
+		ctx := requestContext(ctx, requestID, request)
+		ctx, span := h.tracer.Start(ctx, zentinel.HookRequestComplete, request)
+		h.call(ctx, zentinel.HookRequestComplete, event.CorrelationID, func(ctx context.Context) {
+			h.agent.OnRequestComplete(ctx, request, event.Status, event.DurationMS)
+		})
+		h.tracer.End(span, nil)
+		request.State().Clear()
 	}
 
 	return map[string]interface{}{"success": true}, nil
 }
 
+// configure applies config to the agent. A panic or timeout in OnConfigure
+// is reported as an error.
+func (h *AgentHandlerV2) configure(ctx context.Context, config map[string]interface{}) error {
+	if h.shadow != nil {
+		if err := h.shadow.Configure(ctx, config); err != nil {
+			return err
+		}
+	}
+	err, outcome := runHook(h, ctx, zentinel.HookConfigure, "", func(ctx context.Context) error {
+		return h.agent.OnConfigure(ctx, config)
+	})
+	switch outcome {
+	case hooks.Panicked:
+		return errors.New("configuration handler panicked")
+	case hooks.TimedOut:
+		return errors.New("configuration handler timed out")
+	}
+	if err == nil {
+		h.config.Store(&config)
+	}
+	return err
+}
+
+// rejectMalformedLegacy answers a legacy event that could not be used with
+// the malformed input action's decision, or an error wrapping
+// zentinel.ErrMalformedInput for MalformedClose.
+func (h *AgentHandlerV2) rejectMalformedLegacy(ctx context.Context, class zentinel.FailureClass, err error) (interface{}, error) {
+	h.metrics.RecordFailure(class)
+	if h.malformedInput == zentinel.MalformedClose {
+		return nil, fmt.Errorf("%w: %v", zentinel.ErrMalformedInput, err)
+	}
+	return h.audit(ctx, "", nil, h.malformedInput.Decision(class)).Build(), nil
+}
+
+// requestKey identifies a request's state. The proxy assigns request IDs per
+// connection, so two streams may use the same ID at once.
+type requestKey struct {
+	stream string
+	id     uint64
+}
+
+// streamKey holds the ID of the stream a message arrived on in its context.
+type streamKey struct{}
+
+// withStream returns ctx for the messages of the stream with id.
+func withStream(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, streamKey{}, id)
+}
+
+// streamOf returns the ID of the stream ctx belongs to, or "" outside a
+// runner's stream.
+func streamOf(ctx context.Context) string {
+	id, _ := ctx.Value(streamKey{}).(string)
+	return id
+}
+
+// keyOf returns the key of the request with requestID on the stream ctx
+// belongs to.
+func keyOf(ctx context.Context, requestID uint64) requestKey {
+	return requestKey{stream: streamOf(ctx), id: requestID}
+}
+
+// requestContext returns ctx with a child logger for the request with id.
+// request is nil if the handler does not know the request.
+func requestContext(ctx context.Context, requestID uint64, request *zentinel.Request) context.Context {
+	logCtx := zentinel.LoggerFrom(ctx).With().Uint64("request_id", requestID)
+	if request != nil {
+		logCtx = logCtx.Str("correlation_id", request.CorrelationID())
+		if routeID := request.Metadata().RouteID; routeID != nil {
+			logCtx = logCtx.Str("route_id", *routeID)
+		}
+	}
+	return logCtx.Logger().WithContext(ctx)
+}
+
+// correlationIDOf returns the request's correlation ID, or "" for a request
+// that is no longer tracked.
+func correlationIDOf(request *zentinel.Request) string {
+	if request == nil {
+		return ""
+	}
+	return request.CorrelationID()
+}
+
 // hashString creates a simple uint64 hash from a string.
 func hashString(s string) uint64 {
 	var h uint64 = 5381
@@ -0,0 +1,546 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type panickingAgentV2 struct {
+	BaseAgentV2
+	cancelled []uint64
+}
+
+func (a *panickingAgentV2) Name() string {
+	return "panicking-agent"
+}
+
+func (a *panickingAgentV2) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	panic("boom")
+}
+
+func (a *panickingAgentV2) OnRequestBody(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	panic("boom")
+}
+
+func (a *panickingAgentV2) OnCancel(ctx context.Context, requestID uint64) {
+	a.cancelled = append(a.cancelled, requestID)
+	panic("boom")
+}
+
+func (a *panickingAgentV2) HealthCheck(ctx context.Context) *HealthStatus {
+	panic("boom")
+}
+
+// decide sends msg to handler and returns the decision it replies with.
+func decide(t *testing.T, handler *AgentHandlerV2, msg *V2Message) V2Decision {
+	t.Helper()
+	return decideIn(t, context.Background(), handler, msg)
+}
+
+// decideIn is decide on a connection whose context is ctx.
+func decideIn(t *testing.T, ctx context.Context, handler *AgentHandlerV2, msg *V2Message) V2Decision {
+	t.Helper()
+	response, err := handler.HandleMessage(ctx, msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var decision V2Decision
+	if err := response.ParsePayload(&decision); err != nil {
+		t.Fatalf("failed to parse decision: %v", err)
+	}
+	return decision
+}
+
+func TestAgentHandlerV2_RecoversPanic(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandlerV2(&panickingAgentV2{})
+
+	decision := decide(t, handler, fuzzMessages()[1])
+	if decision.Decision != "allow" {
+		t.Errorf("expected allow, got %v", decision.Decision)
+	}
+	if tags, _ := decision.Audit["tags"].([]interface{}); len(tags) != 1 || tags[0] != "panic" {
+		t.Errorf("expected panic tag, got %v", decision.Audit["tags"])
+	}
+
+	report := handler.MetricsCollector().Report()
+	if report.RequestsErrored != 1 || report.RequestsTotal != 1 {
+		t.Errorf("expected one errored request, got %d of %d", report.RequestsErrored, report.RequestsTotal)
+	}
+}
+
+func TestAgentHandlerV2_RecoversPanicFailClosed(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandlerV2(&panickingAgentV2{}).
+		WithFailurePolicy(zentinel.DefaultFailurePolicy().WithHook(zentinel.HookRequestBody, zentinel.FailClosed))
+
+	msgs := fuzzMessages()
+	if decision := decide(t, handler, msgs[1]); decision.Decision != "allow" {
+		t.Errorf("expected request hook to fail open, got %v", decision.Decision)
+	}
+
+	decision := decide(t, handler, msgs[2])
+	block, ok := decision.Decision.(map[string]interface{})["block"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected block decision, got %v", decision.Decision)
+	}
+	if block["status"] != float64(500) {
+		t.Errorf("expected status 500, got %v", block["status"])
+	}
+}
+
+// memoryAuditSink keeps the records written to it.
+type memoryAuditSink struct {
+	records []*zentinel.AuditRecord
+}
+
+func (s *memoryAuditSink) WriteAudit(record *zentinel.AuditRecord) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+func TestAgentHandlerV2_AuditsFallbacks(t *testing.T) {
+	quietLogs(t)
+	sink := &memoryAuditSink{}
+	handler := NewAgentHandlerV2(&panickingAgentV2{}).
+		WithFailurePolicy(zentinel.FailurePolicy{Default: zentinel.FailClosed}).
+		WithMalformedInput(zentinel.MalformedBlock).
+		WithAudit(sink, false)
+
+	decide(t, handler, fuzzMessages()[1])
+	decide(t, handler, &V2Message{Type: MsgTypeRequestBodyChunk, Payload: []byte(`{"request_id":123,"data":7}`)})
+
+	if len(sink.records) != 2 {
+		t.Fatalf("expected the panic and malformed blocks to be recorded, got %d records", len(sink.records))
+	}
+	if record := sink.records[0]; record.Hook != zentinel.HookRequest || record.CorrelationID == "" || record.Decision.Audit.Tags[0] != "panic" {
+		t.Errorf("unexpected panic record %+v", record)
+	}
+	if record := sink.records[1]; record.Hook != "" || record.CorrelationID != sink.records[0].CorrelationID || record.Decision.Audit.Tags[0] != "malformed" {
+		t.Errorf("unexpected malformed record %+v", record)
+	}
+}
+
+func TestAgentHandlerV2_RecoversCancelAndHealthPanics(t *testing.T) {
+	quietLogs(t)
+	agent := &panickingAgentV2{}
+	handler := NewAgentHandlerV2(agent)
+
+	// Register two in-flight requests whose cancellation will panic
+	handler.cancelFuncs[requestKey{id: 1}] = func() {}
+	handler.cancelFuncs[requestKey{id: 2}] = func() {}
+	cancelAll, _ := NewV2Message(MsgTypeCancelAll, &CancelAllMessage{})
+	if _, err := handler.HandleMessage(context.Background(), cancelAll); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(agent.cancelled) != 2 {
+		t.Errorf("expected both requests to be cancelled, got %v", agent.cancelled)
+	}
+
+	healthRequest, _ := NewV2Message(MsgTypeHealthRequest, struct{}{})
+	response, err := handler.HandleMessage(context.Background(), healthRequest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var health HealthStatus
+	if err := response.ParsePayload(&health); err != nil {
+		t.Fatalf("failed to parse health: %v", err)
+	}
+	if !health.IsUnhealthy() {
+		t.Errorf("expected unhealthy status, got %s", health.State)
+	}
+}
+
+// slowAgentV2 blocks in OnRequest until release is closed, ignoring its
+// context.
+type slowAgentV2 struct {
+	BaseAgentV2
+	release chan struct{}
+}
+
+func (a *slowAgentV2) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	<-a.release
+	return zentinel.Deny()
+}
+
+func TestAgentHandlerV2_DeadlineSendsFallback(t *testing.T) {
+	quietLogs(t)
+	agent := &slowAgentV2{release: make(chan struct{})}
+	defer close(agent.release)
+
+	handler := NewAgentHandlerV2(agent).
+		WithDeadlines(zentinel.HookDeadlines{Default: 20 * time.Millisecond})
+
+	start := time.Now()
+	decision := decide(t, handler, fuzzMessages()[1])
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fallback took %v", elapsed)
+	}
+	if decision.RequestID != 123 || decision.Decision != "allow" {
+		t.Errorf("expected allow for request 123, got %+v", decision)
+	}
+	if tags, _ := decision.Audit["tags"].([]interface{}); len(tags) != 1 || tags[0] != "timeout" {
+		t.Errorf("expected timeout tag, got %v", decision.Audit["tags"])
+	}
+	if report := handler.MetricsCollector().Report(); report.RequestsErrored != 1 {
+		t.Errorf("expected timeout to count as an error, got %d", report.RequestsErrored)
+	}
+}
+
+func TestRecoverRequestID(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    uint64
+		ok      bool
+	}{
+		{`{"request_id":42,"method":"GET"}`, 42, true},
+		{`{"method":"GET","request_id":42`, 42, true},
+		{`{"request_id":42,"method":`, 42, true},
+		{`{"request_id":"42"}`, 0, false},
+		{`{"method":`, 0, false},
+		{`{"metadata":{"request_id":42}}`, 0, false},
+		{`[42]`, 0, false},
+		{``, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := recoverRequestID([]byte(tt.payload))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("recoverRequestID(%q) = %d, %v; want %d, %v", tt.payload, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAgentHandlerV2_MalformedInput(t *testing.T) {
+	quietLogs(t)
+	truncated := &V2Message{Type: MsgTypeRequestHeaders, Payload: []byte(`{"request_id":7,"method":`)}
+	anonymous := &V2Message{Type: MsgTypeRequestHeaders, Payload: []byte(`{"method":`)}
+
+	t.Run("allow", func(t *testing.T) {
+		handler := NewAgentHandlerV2(NewBaseAgentV2())
+		decision := decide(t, handler, truncated)
+		if decision.RequestID != 7 || decision.Decision != "allow" {
+			t.Errorf("expected allow for request 7, got %+v", decision)
+		}
+		if tags, _ := decision.Audit["tags"].([]interface{}); len(tags) != 1 || tags[0] != "malformed" {
+			t.Errorf("expected malformed tag, got %v", decision.Audit["tags"])
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		handler := NewAgentHandlerV2(NewBaseAgentV2()).WithMalformedInput(zentinel.MalformedBlock)
+		decision := decide(t, handler, truncated)
+		block, ok := decision.Decision.(map[string]interface{})["block"].(map[string]interface{})
+		if decision.RequestID != 7 || !ok || block["status"] != float64(500) {
+			t.Errorf("expected block 500 for request 7, got %+v", decision)
+		}
+	})
+
+	t.Run("no request ID", func(t *testing.T) {
+		handler := NewAgentHandlerV2(NewBaseAgentV2()).WithMalformedInput(zentinel.MalformedBlock)
+		response, err := handler.HandleMessage(context.Background(), anonymous)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var protocolErr ProtocolErrorMessage
+		if response.Type != MsgTypeProtocolError || response.ParsePayload(&protocolErr) != nil {
+			t.Fatalf("expected ProtocolError, got %s", response.TypeName())
+		}
+		if protocolErr.RequestID != nil || protocolErr.Code != "malformed" || protocolErr.MessageType != MsgTypeRequestHeaders {
+			t.Errorf("unexpected protocol error %+v", protocolErr)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		handler := NewAgentHandlerV2(NewBaseAgentV2()).WithMalformedInput(zentinel.MalformedClose)
+		response, err := handler.HandleMessage(context.Background(), truncated)
+		if !errors.Is(err, zentinel.ErrMalformedInput) {
+			t.Fatalf("expected ErrMalformedInput, got %v", err)
+		}
+		if response == nil || response.Type != MsgTypeProtocolError {
+			t.Errorf("expected ProtocolError to send before closing, got %v", response)
+		}
+	})
+}
+
+func TestAgentHandlerV2_FailureCounters(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandlerV2(NewBaseAgentV2())
+	ctx := context.Background()
+
+	handler.HandleMessage(ctx, &V2Message{Type: MsgTypeRequestHeaders, Payload: []byte(`{`)})
+	handler.HandleMessage(ctx, &V2Message{Type: MsgTypeRequestBodyChunk, Payload: []byte(`{"request_id":1,"data":"!!"}`)})
+	handler.HandleMessage(ctx, &V2Message{Type: 0x7F, Payload: []byte(`{}`)})
+	handler.HandleMessage(ctx, &V2Message{Type: 0x7F, Payload: []byte(`{}`)})
+
+	report := handler.MetricsCollector().Report()
+	want := map[string]uint64{"malformed": 1, "invalid_body": 1, "unknown_message": 2}
+	for class, n := range want {
+		if report.Failures[class] != n {
+			t.Errorf("expected %d %s failures, got %d", n, class, report.Failures[class])
+		}
+	}
+	if report.RequestsErrored != 4 {
+		t.Errorf("expected 4 errors, got %d", report.RequestsErrored)
+	}
+
+	// The proxy sees the same counts in the metrics response
+	request, _ := NewV2Message(MsgTypeMetricsRequest, struct{}{})
+	response, err := handler.HandleMessage(ctx, request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var reply MetricsReport
+	if err := response.ParsePayload(&reply); err != nil {
+		t.Fatalf("failed to parse metrics: %v", err)
+	}
+	for class, n := range want {
+		if reply.Failures[class] != n {
+			t.Errorf("expected %d %s failures in the reply, got %d", n, class, reply.Failures[class])
+		}
+	}
+}
+
+// stateAgent stores a value in the request state and keeps the request.
+type stateAgent struct {
+	BaseAgentV2
+	request *zentinel.Request
+	seen    bool
+}
+
+var stateTestKey = zentinel.NewStateKey[string]("test")
+
+func (a *stateAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	a.request = request
+	stateTestKey.Set(request, "value")
+	return zentinel.Allow()
+}
+
+func (a *stateAgent) OnRequestComplete(ctx context.Context, request *zentinel.Request, status int, durationMS int) {
+	_, a.seen = stateTestKey.Get(request)
+}
+
+func TestAgentHandlerV2_RequestState(t *testing.T) {
+	msgs := fuzzMessages()
+	for _, end := range []*V2Message{msgs[5], msgs[6], msgs[7]} {
+		agent := &stateAgent{}
+		handler := NewAgentHandlerV2(agent)
+		decide(t, handler, msgs[1])
+		if _, err := handler.HandleMessage(context.Background(), end); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if end.Type == MsgTypeRequestComplete && !agent.seen {
+			t.Error("expected OnRequestComplete to see the state")
+		}
+		if _, ok := stateTestKey.Get(agent.request); ok {
+			t.Errorf("expected the state to be released after %s", end.TypeName())
+		}
+	}
+}
+
+// completeAgent records the OnRequestComplete calls it gets.
+type completeAgent struct {
+	BaseAgentV2
+	completed []string
+}
+
+func (a *completeAgent) OnRequestComplete(ctx context.Context, request *zentinel.Request, status int, durationMS int) {
+	a.completed = append(a.completed, fmt.Sprintf("%s %d %d", request.CorrelationID(), status, durationMS))
+}
+
+func TestAgentHandlerV2_RequestComplete(t *testing.T) {
+	quietLogs(t)
+	agent := &completeAgent{}
+	handler := NewAgentHandlerV2(agent)
+	msgs := fuzzMessages()
+
+	decide(t, handler, msgs[1])
+	response, err := handler.HandleMessage(context.Background(), msgs[5])
+	if err != nil || response != nil {
+		t.Fatalf("expected no reply, got %v, %v", response, err)
+	}
+	if len(agent.completed) != 1 || agent.completed[0] != "req-123 200 150" {
+		t.Errorf("expected OnRequestComplete for req-123, got %v", agent.completed)
+	}
+	if inFlight := handler.InFlight(); len(inFlight) != 0 {
+		t.Errorf("expected the request to be released, got %v", inFlight)
+	}
+
+	// A second completion, for a request the handler no longer knows, is
+	// ignored.
+	handler.HandleMessage(context.Background(), msgs[5])
+	if len(agent.completed) != 1 {
+		t.Errorf("expected no call for an unknown request, got %v", agent.completed)
+	}
+
+	malformed := &V2Message{Type: MsgTypeRequestComplete, Payload: []byte(`{"request_id":"x"}`)}
+	if response, err := handler.HandleMessage(context.Background(), malformed); err != nil || response != nil {
+		t.Errorf("expected a malformed completion to be dropped, got %v, %v", response, err)
+	}
+}
+
+func TestGRPCRequestCompleteToV2(t *testing.T) {
+	headers, err := grpcProxyToV2Message([]byte(`{"request_headers":{"metadata":{"correlation_id":"req-1"},"method":"GET","uri":"/"}}`))
+	if err != nil {
+		t.Fatalf("failed to convert request headers: %v", err)
+	}
+	var event V2RequestHeaders
+	headers.ParsePayload(&event)
+
+	msg, err := grpcProxyToV2Message([]byte(`{"request_complete":{"correlation_id":"req-1","status_code":502,"duration_ms":7}}`))
+	if err != nil {
+		t.Fatalf("failed to convert request complete: %v", err)
+	}
+	var complete V2RequestComplete
+	if msg.Type != MsgTypeRequestComplete || msg.ParsePayload(&complete) != nil {
+		t.Fatalf("expected a RequestComplete message, got %s", msg.TypeName())
+	}
+	if complete.RequestID != event.RequestID || complete.StatusCode != 502 || complete.DurationMS != 7 {
+		t.Errorf("expected completion of request %d, got %+v", event.RequestID, complete)
+	}
+}
+
+func TestAgentRunnerV2_ShadowMode(t *testing.T) {
+	quietLogs(t)
+	runner := NewAgentRunnerV2(&TestAgentV2Impl{}).
+		WithShadowMode(zentinel.ShadowConfig{Enabled: true}).
+		WithMiddleware(zentinel.LoggingMiddleware())
+
+	msg, _ := NewV2Message(MsgTypeRequestHeaders, &V2RequestHeaders{RequestID: 1, Method: "GET", URI: "/blocked"})
+	if decision := decide(t, runner.handler, msg); decision.Decision != "allow" {
+		t.Errorf("expected allow in shadow mode, got %v", decision.Decision)
+	}
+
+	response, err := runner.handler.HandleMessage(context.Background(), fuzzMessages()[10])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var report MetricsReport
+	if err := response.ParsePayload(&report); err != nil {
+		t.Fatalf("failed to parse metrics: %v", err)
+	}
+	if report.Custom["shadow_would_block"] != float64(1) {
+		t.Errorf("expected one would-block request in metrics, got %v", report.Custom)
+	}
+}
+
+func TestAgentHandlerV2_ShadowModeFailClosed(t *testing.T) {
+	quietLogs(t)
+	shadow := zentinel.NewShadowMode(zentinel.ShadowConfig{Enabled: true})
+	handler := NewAgentHandlerV2(&panickingAgentV2{}).
+		WithFailurePolicy(zentinel.FailurePolicy{Default: zentinel.FailClosed}).
+		WithShadowMode(shadow)
+
+	decision := decide(t, handler, fuzzMessages()[1])
+	if tags, _ := decision.Audit["tags"].([]interface{}); decision.Decision != "allow" || len(tags) != 2 || tags[1] != "would_block" {
+		t.Errorf("expected the fail-closed block to be shadowed, got %v tagged %v", decision.Decision, decision.Audit["tags"])
+	}
+	if shadow.WouldBlock() != 1 {
+		t.Errorf("expected one would-block request, got %d", shadow.WouldBlock())
+	}
+}
+
+func TestAgentRunnerV2_Tracing(t *testing.T) {
+	quietLogs(t)
+	recorder := tracetest.NewSpanRecorder()
+	runner := NewAgentRunnerV2(&TestAgentV2Impl{}).
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))).
+		WithMiddleware(zentinel.LoggingMiddleware())
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	msg, _ := NewV2Message(MsgTypeRequestHeaders, &V2RequestHeaders{
+		RequestID: 1,
+		Method:    "GET",
+		URI:       "/blocked",
+		Metadata:  V2RequestMetadata{CorrelationID: "req-1", Traceparent: &traceparent},
+	})
+	decide(t, runner.handler, msg)
+	complete, _ := NewV2Message(MsgTypeRequestComplete, &V2RequestComplete{RequestID: 1, StatusCode: 403})
+	if _, err := runner.handler.HandleMessage(context.Background(), complete); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	for _, span := range spans {
+		if span.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("expected span %q in the proxy's trace, got %v", span.Name(), span.Parent().TraceID())
+		}
+	}
+	if spans[0].Name() != "zentinel.agent.request" || spans[1].Name() != "zentinel.agent.request_complete" {
+		t.Errorf("unexpected spans %q, %q", spans[0].Name(), spans[1].Name())
+	}
+}
+
+// loggingAgentV2 logs from OnRequest through the context's logger.
+type loggingAgentV2 struct {
+	BaseAgentV2
+}
+
+func (a *loggingAgentV2) Name() string {
+	return "logging-agent"
+}
+
+func (a *loggingAgentV2) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	zentinel.LoggerFrom(ctx).Info().Msg("checked")
+	return zentinel.Allow()
+}
+
+func TestAgentHandlerV2_RequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).With().Str("stream_id", "uds-1").Logger()
+
+	handler := NewAgentHandlerV2(&loggingAgentV2{})
+	if _, err := handler.HandleMessage(logger.WithContext(context.Background()), fuzzMessages()[1]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one log entry, got %q", buf.String())
+	}
+	if entry["stream_id"] != "uds-1" || entry["correlation_id"] != "req-123" || entry["request_id"] != float64(123) {
+		t.Errorf("expected stream and request fields, got %v", entry)
+	}
+}
+
+func TestAgentRunnerV2_LogControl(t *testing.T) {
+	runner := NewAgentRunnerV2(&TestAgentV2Impl{}).WithLogger(zerolog.Nop())
+	runner.setupLogging()
+	svc := &agentGRPCService{runner: runner}
+	ctx := context.Background()
+
+	msg := json.RawMessage(`{"level": 1, "correlation_id": "req-123", "fields": {"client_ip": "10.0.0.1", "ttl": "5m"}}`)
+	if err := svc.handleLogControl(ctx, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	settings, expires := runner.DebugControl().Settings()
+	if settings.Level != "debug" || settings.DumpCorrelationID != "req-123" || settings.DumpClientIP != "10.0.0.1" {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+	if until := time.Until(expires); until <= 4*time.Minute || until > 5*time.Minute {
+		t.Errorf("expected the change to expire in 5m, got %v", until)
+	}
+
+	if err := svc.handleLogControl(ctx, json.RawMessage(`{"level": 0}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if settings, _ := runner.DebugControl().Settings(); settings.DumpCorrelationID != "" {
+		t.Errorf("expected an empty message to revert, got %+v", settings)
+	}
+	if err := svc.handleLogControl(ctx, json.RawMessage(`{"level": 9}`)); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
@@ -9,9 +9,13 @@ const ProtocolVersionV2 = 2
 
 // HandshakeRequest is sent by the proxy to initiate the v2 handshake.
 type HandshakeRequest struct {
-	// ProtocolVersion must be 2 for v2 protocol.
+	// ProtocolVersion is the protocol version the proxy prefers.
 	ProtocolVersion uint32 `json:"protocol_version"`
 
+	// SupportedVersions lists every protocol version the proxy speaks. If
+	// empty, it speaks only ProtocolVersion.
+	SupportedVersions []uint32 `json:"supported_versions,omitempty"`
+
 	// ClientName identifies the connecting proxy.
 	ClientName string `json:"client_name"`
 
@@ -21,7 +25,7 @@ type HandshakeRequest struct {
 
 // HandshakeResponse is sent by the agent in response to HandshakeRequest.
 type HandshakeResponse struct {
-	// ProtocolVersion confirms the protocol version.
+	// ProtocolVersion is the protocol version negotiated for the connection.
 	ProtocolVersion uint32 `json:"protocol_version"`
 
 	// AgentName identifies this agent.
@@ -30,6 +34,10 @@ type HandshakeResponse struct {
 	// Capabilities describes what the agent can process.
 	Capabilities *AgentCapabilities `json:"capabilities"`
 
+	// Features are the features negotiated for the connection: those the
+	// agent wants that the proxy listed as supported.
+	Features []string `json:"features,omitempty"`
+
 	// Error is set if the handshake failed.
 	Error string `json:"error,omitempty"`
 
@@ -52,12 +60,28 @@ func (r *HandshakeRequest) WithFeature(feature string) *HandshakeRequest {
 	return r
 }
 
+// WithVersions sets the protocol versions the proxy speaks.
+func (r *HandshakeRequest) WithVersions(versions ...uint32) *HandshakeRequest {
+	r.SupportedVersions = versions
+	return r
+}
+
 // WithFeatures adds multiple supported features to the handshake request.
 func (r *HandshakeRequest) WithFeatures(features ...string) *HandshakeRequest {
 	r.SupportedFeatures = append(r.SupportedFeatures, features...)
 	return r
 }
 
+// hasFeature reports whether feature was negotiated.
+func (r *HandshakeResponse) hasFeature(feature string) bool {
+	for _, f := range r.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
 // NewHandshakeResponse creates an accepted handshake response.
 func NewHandshakeResponse(agentName string, capabilities *AgentCapabilities) *HandshakeResponse {
 	return &HandshakeResponse{
@@ -1,7 +1,12 @@
 package v2
 
 import (
+	"context"
+	"encoding/base64"
+	"reflect"
 	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
 )
 
 func TestHandshakeRequest(t *testing.T) {
@@ -195,3 +200,100 @@ func TestRegistrationMarshalUnmarshal(t *testing.T) {
 		t.Error("expected accepted to be true")
 	}
 }
+
+// streamingAgent asks for more of the request body until it has ten bytes,
+// then replaces it.
+type streamingAgent struct {
+	BaseAgentV2
+	calls     int
+	streaming bool
+}
+
+func (a *streamingAgent) Capabilities() *AgentCapabilities {
+	return NewAgentCapabilities().All().WithFeature(FeatureBodyMutation)
+}
+
+func (a *streamingAgent) OnRequestBody(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	a.calls++
+	a.streaming = FeatureEnabled(ctx, FeatureStreaming)
+	if len(request.Body()) < 10 {
+		return zentinel.Allow().NeedsMoreData()
+	}
+	return zentinel.Allow().WithRequestBodyMutation([]byte("replaced"), 0)
+}
+
+func handshake(t *testing.T, handler *AgentHandlerV2, req *HandshakeRequest) (*V2Message, *HandshakeResponse) {
+	t.Helper()
+	msg, _ := NewV2Message(MsgTypeHandshakeRequest, req)
+	response, err := handler.HandleMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var resp HandshakeResponse
+	if err := response.ParsePayload(&resp); err != nil {
+		t.Fatalf("failed to parse handshake response: %v", err)
+	}
+	return response, &resp
+}
+
+func TestHandshake_VersionNegotiation(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandlerV2(&TestAgentV2Impl{})
+
+	if _, resp := handshake(t, handler, NewHandshakeRequest("proxy").WithVersions(1, 2, 3)); !resp.Accepted || resp.ProtocolVersion != 2 {
+		t.Errorf("expected version 2 from a range, got %+v", resp)
+	}
+	if _, resp := handshake(t, handler, &HandshakeRequest{ProtocolVersion: 3, ClientName: "proxy"}); resp.Accepted {
+		t.Error("expected a proxy speaking only version 3 to be rejected")
+	}
+
+	caps := NewAgentCapabilities().WithProtocolVersions(3, 4)
+	if min, max := caps.ProtocolVersions(); min <= max {
+		t.Errorf("expected no versions in common with the SDK, got %d to %d", min, max)
+	}
+}
+
+func TestHandshake_FeatureNegotiation(t *testing.T) {
+	quietLogs(t)
+	agent := &streamingAgent{}
+	handler := NewAgentHandlerV2(agent)
+
+	req := NewHandshakeRequest("proxy").WithFeatures(FeatureBodyMutation, FeatureWebSocket, FeatureStreaming)
+	response, resp := handshake(t, handler, req)
+	if want := []string{FeatureStreaming, FeatureBodyMutation}; !reflect.DeepEqual(resp.Features, want) {
+		t.Fatalf("expected features %v, got %v", want, resp.Features)
+	}
+	ctx := withNegotiated(context.Background(), response)
+	if features, ok := NegotiatedFeatures(ctx); !ok || len(features) != 2 {
+		t.Errorf("expected the features in the context, got %v", features)
+	}
+
+	chunk := func(data string, last bool) *V2Message {
+		msg, _ := NewV2Message(MsgTypeRequestBodyChunk, &V2RequestBodyChunk{
+			RequestID: 123,
+			Data:      base64.StdEncoding.EncodeToString([]byte(data)),
+			IsLast:    last,
+		})
+		return msg
+	}
+
+	decideIn(t, ctx, handler, fuzzMessages()[1])
+	decision := decideIn(t, ctx, handler, chunk("hello", false))
+	if more, _ := decision.Decision.(map[string]interface{}); more["needs_more"] != true || agent.calls != 1 || !agent.streaming {
+		t.Errorf("expected the hook to run on the first chunk and ask for more, got %v after %d calls", decision.Decision, agent.calls)
+	}
+	decision = decideIn(t, ctx, handler, chunk("world", false))
+	if decision.Decision != "allow" || decision.RequestBodyMutation == nil {
+		t.Errorf("expected allow with a body mutation, got %+v", decision)
+	}
+
+	// Without negotiation the body is buffered and mutations are dropped
+	agent.calls = 0
+	handler = NewAgentHandlerV2(agent)
+	decide(t, handler, fuzzMessages()[1])
+	decide(t, handler, chunk("hello", false))
+	decision = decide(t, handler, chunk("world", true))
+	if agent.calls != 1 || decision.RequestBodyMutation != nil {
+		t.Errorf("expected one call and no mutation, got %d calls and %+v", agent.calls, decision)
+	}
+}
@@ -2,7 +2,10 @@ package v2
 
 import (
 	"sort"
+	"sync"
 	"time"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
 )
 
 // HealthState represents the health state of an agent.
@@ -154,6 +157,17 @@ type MetricsReport struct {
 	// RequestsErrored is the number of requests that resulted in errors.
 	RequestsErrored uint64 `json:"requests_errored"`
 
+	// Failures breaks errors down by failure class, e.g. "malformed" or
+	// "timeout".
+	Failures map[string]uint64 `json:"failures,omitempty"`
+
+	// Canary reports a policy canary in progress, if any.
+	Canary *CanaryReport `json:"canary,omitempty"`
+
+	// Transports breaks streams and messages down by the transport they
+	// arrived on.
+	Transports map[TransportType]TransportReport `json:"transports,omitempty"`
+
 	// AverageLatencyMs is the average request processing latency in milliseconds.
 	AverageLatencyMs float64 `json:"average_latency_ms"`
 
@@ -176,6 +190,37 @@ type MetricsReport struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
+// CanaryReport contains policy canary metrics.
+type CanaryReport struct {
+	// Requests is the number of requests evaluated with each variant.
+	Requests map[PolicyVariant]uint64 `json:"requests"`
+
+	// Compared is the number of decisions evaluated with both variants.
+	Compared uint64 `json:"compared"`
+
+	// Disagreements is the number of compared decisions that differed.
+	Disagreements uint64 `json:"disagreements"`
+
+	// DisagreementRate is Disagreements divided by Compared.
+	DisagreementRate float64 `json:"disagreement_rate"`
+}
+
+// TransportReport contains the metrics of one transport.
+type TransportReport struct {
+	// Streams is the number of connections or streams opened.
+	Streams uint64 `json:"streams"`
+
+	// ActiveStreams is the number of connections or streams open now.
+	ActiveStreams uint32 `json:"active_streams"`
+
+	// Messages is the number of messages received.
+	Messages uint64 `json:"messages"`
+
+	// Errors is the number of messages that could not be read, handled or
+	// answered.
+	Errors uint64 `json:"errors"`
+}
+
 // NewMetricsReport creates a new empty metrics report.
 func NewMetricsReport() *MetricsReport {
 	return &MetricsReport{
@@ -193,14 +238,19 @@ func (m *MetricsReport) WithCustomMetric(name string, value interface{}) *Metric
 	return m
 }
 
-// MetricsCollector collects agent metrics over time.
+// MetricsCollector collects agent metrics over time. It is safe for
+// concurrent use.
 type MetricsCollector struct {
+	mu              sync.Mutex
 	startTime       time.Time
 	requestsTotal   uint64
 	requestsActive  uint32
 	requestsAllowed uint64
 	requestsBlocked uint64
 	requestsErrored uint64
+	failures        map[string]uint64
+	canary          *CanaryReport
+	transports      map[TransportType]*TransportReport
 	latencies       []float64
 	custom          map[string]interface{}
 }
@@ -216,6 +266,9 @@ func NewMetricsCollector() *MetricsCollector {
 
 // RecordRequest records a completed request.
 func (c *MetricsCollector) RecordRequest(allowed bool, latencyMs float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.requestsTotal++
 	if allowed {
 		c.requestsAllowed++
@@ -231,17 +284,120 @@ func (c *MetricsCollector) RecordRequest(allowed bool, latencyMs float64) {
 
 // RecordError records an error.
 func (c *MetricsCollector) RecordError() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.requestsTotal++
 	c.requestsErrored++
 }
 
+// RecordFailure records an error of the given class.
+func (c *MetricsCollector) RecordFailure(class zentinel.FailureClass) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.requestsTotal++
+	c.requestsErrored++
+	if c.failures == nil {
+		c.failures = make(map[string]uint64)
+	}
+	c.failures[string(class)]++
+}
+
+// RecordCanaryRequest records a request evaluated with variant.
+func (c *MetricsCollector) RecordCanaryRequest(variant PolicyVariant) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.canaryReport().Requests[variant]++
+}
+
+// RecordCanaryComparison records a decision evaluated with both variants and
+// whether they disagreed.
+func (c *MetricsCollector) RecordCanaryComparison(disagree bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	canary := c.canaryReport()
+	canary.Compared++
+	if disagree {
+		canary.Disagreements++
+	}
+	canary.DisagreementRate = float64(canary.Disagreements) / float64(canary.Compared)
+}
+
+// canaryReport returns the canary counters, creating them on first use.
+func (c *MetricsCollector) canaryReport() *CanaryReport {
+	if c.canary == nil {
+		c.canary = &CanaryReport{Requests: make(map[PolicyVariant]uint64)}
+	}
+	return c.canary
+}
+
+// RecordStreamOpened records a connection or stream opened on transport.
+func (c *MetricsCollector) RecordStreamOpened(transport TransportType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := c.transportReport(transport)
+	report.Streams++
+	report.ActiveStreams++
+}
+
+// RecordStreamClosed records a connection or stream on transport closing.
+func (c *MetricsCollector) RecordStreamClosed(transport TransportType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if report := c.transportReport(transport); report.ActiveStreams > 0 {
+		report.ActiveStreams--
+	}
+}
+
+// RecordTransportMessage records a message received on transport.
+func (c *MetricsCollector) RecordTransportMessage(transport TransportType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.transportReport(transport).Messages++
+}
+
+// RecordTransportError records a message on transport that could not be
+// read, handled or answered.
+func (c *MetricsCollector) RecordTransportError(transport TransportType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.transportReport(transport).Errors++
+}
+
+// transportReport returns the counters of transport, creating them on first
+// use.
+func (c *MetricsCollector) transportReport(transport TransportType) *TransportReport {
+	if c.transports == nil {
+		c.transports = make(map[TransportType]*TransportReport)
+	}
+	report := c.transports[transport]
+	if report == nil {
+		report = &TransportReport{}
+		c.transports[transport] = report
+	}
+	return report
+}
+
 // IncrementActive increments the active request count.
 func (c *MetricsCollector) IncrementActive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.requestsActive++
 }
 
 // DecrementActive decrements the active request count.
 func (c *MetricsCollector) DecrementActive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.requestsActive > 0 {
 		c.requestsActive--
 	}
@@ -249,11 +405,17 @@ func (c *MetricsCollector) DecrementActive() {
 
 // SetCustom sets a custom metric value.
 func (c *MetricsCollector) SetCustom(name string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.custom[name] = value
 }
 
 // Report generates a metrics report.
 func (c *MetricsCollector) Report() *MetricsReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	report := &MetricsReport{
 		RequestsTotal:   c.requestsTotal,
 		RequestsActive:  c.requestsActive,
@@ -261,10 +423,38 @@ func (c *MetricsCollector) Report() *MetricsReport {
 		RequestsBlocked: c.requestsBlocked,
 		RequestsErrored: c.requestsErrored,
 		UptimeSeconds:   time.Since(c.startTime).Seconds(),
-		Custom:          c.custom,
 		Timestamp:       time.Now(),
 	}
 
+	if len(c.failures) > 0 {
+		report.Failures = make(map[string]uint64, len(c.failures))
+		for class, n := range c.failures {
+			report.Failures[class] = n
+		}
+	}
+
+	if c.canary != nil {
+		canary := *c.canary
+		canary.Requests = make(map[PolicyVariant]uint64, len(c.canary.Requests))
+		for variant, n := range c.canary.Requests {
+			canary.Requests[variant] = n
+		}
+		report.Canary = &canary
+	}
+
+	if len(c.transports) > 0 {
+		report.Transports = make(map[TransportType]TransportReport, len(c.transports))
+		for transport, counters := range c.transports {
+			report.Transports[transport] = *counters
+		}
+	}
+
+	// Copy custom metrics so the report is not changed by later updates
+	report.Custom = make(map[string]interface{}, len(c.custom))
+	for name, value := range c.custom {
+		report.Custom[name] = value
+	}
+
 	if len(c.latencies) > 0 {
 		var sum float64
 		for _, l := range c.latencies {
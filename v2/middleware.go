@@ -0,0 +1,59 @@
+package v2
+
+import (
+	"context"
+	"time"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+// Wrap returns an agent whose decision hooks run through mws, as
+// zentinel.Wrap does, keeping the agent's v2 methods.
+//
+// Example:
+//
+//	agent := v2.Wrap(&MyAgent{},
+//	    zentinel.LoggingMiddleware(),
+//	    v2.MetricsMiddleware(collector))
+func Wrap(agent AgentV2, mws ...zentinel.Middleware) AgentV2 {
+	if len(mws) == 0 {
+		return agent
+	}
+	return &wrappedAgentV2{AgentV2: agent, hooks: zentinel.Wrap(agent, mws...)}
+}
+
+// wrappedAgentV2 takes its decision hooks from a wrapped base agent and
+// everything else from the v2 agent.
+type wrappedAgentV2 struct {
+	AgentV2
+	hooks zentinel.Agent
+}
+
+func (a *wrappedAgentV2) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	return a.hooks.OnRequest(ctx, request)
+}
+
+func (a *wrappedAgentV2) OnRequestBody(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	return a.hooks.OnRequestBody(ctx, request)
+}
+
+func (a *wrappedAgentV2) OnResponse(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	return a.hooks.OnResponse(ctx, request, response)
+}
+
+func (a *wrappedAgentV2) OnResponseBody(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	return a.hooks.OnResponseBody(ctx, request, response)
+}
+
+// MetricsMiddleware records each OnRequest call in collector: whether it
+// allowed the request and how long it took. Pass the agent's own collector,
+// e.g. BaseAgentV2.MetricsCollectorRef(), so the figures appear in the
+// agent's metrics report.
+func MetricsMiddleware(collector *MetricsCollector) zentinel.Middleware {
+	return zentinel.LatencyMiddleware(func(hook zentinel.Hook, elapsed time.Duration, decision *zentinel.Decision) {
+		if hook != zentinel.HookRequest {
+			return
+		}
+		collector.RecordRequest(decision.Build().Decision == "allow", elapsed.Seconds()*1000)
+	})
+}
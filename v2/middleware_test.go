@@ -0,0 +1,42 @@
+package v2
+
+import (
+	"context"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+func TestWrap_KeepsV2Methods(t *testing.T) {
+	agent := &TestAgentV2Impl{}
+	tag := func(ctx context.Context, call *zentinel.HookCall, next zentinel.HookHandler) *zentinel.Decision {
+		return next(ctx, call).WithTag("wrapped")
+	}
+	wrapped := Wrap(agent, tag)
+
+	if caps := wrapped.Capabilities(); caps.MaxConcurrentRequests == nil || *caps.MaxConcurrentRequests != 100 {
+		t.Errorf("expected the agent's capabilities, got %+v", caps)
+	}
+	request := zentinel.NewRequest(&zentinel.RequestHeadersEvent{Method: "GET", URI: "/"}, nil)
+	tags := wrapped.OnRequest(context.Background(), request).Build().Audit.Tags
+	if len(tags) == 0 || tags[len(tags)-1] != "wrapped" {
+		t.Errorf("expected wrapped tag, got %v", tags)
+	}
+}
+
+func TestAgentRunnerV2_WithMiddleware(t *testing.T) {
+	agent := NewBaseAgentV2()
+	deny := func(ctx context.Context, call *zentinel.HookCall, next zentinel.HookHandler) *zentinel.Decision {
+		return zentinel.Deny()
+	}
+	runner := NewAgentRunnerV2(agent).WithMiddleware(MetricsMiddleware(agent.MetricsCollectorRef()), deny)
+
+	decision := decide(t, runner.handler, fuzzMessages()[1])
+	if _, ok := decision.Decision.(map[string]interface{}); !ok {
+		t.Errorf("expected middleware to block, got %v", decision.Decision)
+	}
+	report := agent.Metrics(context.Background())
+	if report.RequestsTotal != 1 || report.RequestsBlocked != 1 {
+		t.Errorf("expected one blocked request in agent metrics, got %+v", report)
+	}
+}
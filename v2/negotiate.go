@@ -0,0 +1,126 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+)
+
+// The protocol versions this SDK speaks. An agent may narrow the range with
+// AgentCapabilities.WithProtocolVersions.
+const (
+	MinProtocolVersion uint32 = ProtocolVersionV2
+	MaxProtocolVersion uint32 = ProtocolVersionV2
+)
+
+// Features the proxy and agent can negotiate in the handshake. A feature is
+// used on a connection only if the proxy lists it in
+// HandshakeRequest.SupportedFeatures and the agent wants it, either in
+// AgentCapabilities.SupportedFeatures or, for FeatureStreaming, with
+// SupportsStreaming. FeatureRawBody is always wanted.
+const (
+	// FeatureStreaming runs the body hooks on every chunk, with the body
+	// received so far, instead of once on the last chunk. A hook asks for
+	// more with Decision.NeedsMoreData; any other decision ends inspection
+	// of the body.
+	FeatureStreaming = "streaming"
+
+	// FeatureBodyMutation sends body mutations set with
+	// Decision.WithRequestBodyMutation and WithResponseBodyMutation to the
+	// proxy. Without it they are dropped.
+	FeatureBodyMutation = "body_mutation"
+
+	// FeatureRawBody lets the proxy send body chunks as
+	// MsgTypeRequestBodyChunkRaw and MsgTypeResponseBodyChunkRaw frames.
+	// Every agent wants it, as the handler decodes them itself.
+	FeatureRawBody = "raw_body"
+
+	// FeatureWebSocket and FeatureGuardrails are negotiated but not acted on
+	// by the handler, as the v2 protocol has no WebSocket or guardrail
+	// messages. An agent checks them with FeatureEnabled.
+	FeatureWebSocket  = "websocket"
+	FeatureGuardrails = "guardrails"
+)
+
+// negotiateVersion returns the highest version both the proxy and the agent
+// speak. A proxy that lists no SupportedVersions speaks only its
+// ProtocolVersion.
+func negotiateVersion(req *HandshakeRequest, caps *AgentCapabilities) (uint32, error) {
+	offered := req.SupportedVersions
+	if len(offered) == 0 {
+		offered = []uint32{req.ProtocolVersion}
+	}
+
+	min, max := caps.ProtocolVersions()
+	var version uint32
+	for _, v := range offered {
+		if v >= min && v <= max && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("unsupported protocol version: proxy offers %v, agent supports %d to %d", offered, min, max)
+	}
+	return version, nil
+}
+
+// negotiateFeatures returns the features the agent wants that the proxy
+// supports, in the agent's order.
+func negotiateFeatures(proxy []string, caps *AgentCapabilities) []string {
+	supported := make(map[string]bool, len(proxy))
+	for _, feature := range proxy {
+		supported[feature] = true
+	}
+
+	features := []string{}
+	for _, feature := range caps.wantedFeatures() {
+		if supported[feature] {
+			features = append(features, feature)
+			delete(supported, feature)
+		}
+	}
+	return features
+}
+
+// negotiatedKey holds the features negotiated for a connection in its
+// context.
+type negotiatedKey struct{}
+
+// withNegotiated returns ctx with the features of an accepted handshake
+// response, for the requests that follow on the same connection. Other
+// messages leave ctx unchanged.
+func withNegotiated(ctx context.Context, response *V2Message) context.Context {
+	if response == nil || response.Type != MsgTypeHandshakeResponse {
+		return ctx
+	}
+	var hsResp HandshakeResponse
+	if err := response.ParsePayload(&hsResp); err != nil || !hsResp.Accepted {
+		return ctx
+	}
+	features := hsResp.Features
+	if features == nil {
+		features = []string{}
+	}
+	return context.WithValue(ctx, negotiatedKey{}, features)
+}
+
+// NegotiatedFeatures returns the features negotiated in the handshake of the
+// connection a hook's context belongs to, and whether there was one.
+func NegotiatedFeatures(ctx context.Context) ([]string, bool) {
+	features, ok := ctx.Value(negotiatedKey{}).([]string)
+	if !ok {
+		return nil, false
+	}
+	return append([]string(nil), features...), true
+}
+
+// FeatureEnabled reports whether feature was negotiated for the connection
+// ctx belongs to.
+func FeatureEnabled(ctx context.Context, feature string) bool {
+	features, _ := ctx.Value(negotiatedKey{}).([]string)
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
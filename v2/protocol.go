@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+
+	"github.com/zentinelproxy/zentinel-agent-go-sdk/internal/wire"
 )
 
 // MaxMessageSizeV2 is the maximum message size for v2 UDS protocol (16MB).
@@ -18,8 +20,10 @@ const (
 	MsgTypeRequestBodyChunk   byte = 0x11
 	MsgTypeResponseHeaders    byte = 0x12
 	MsgTypeResponseBodyChunk  byte = 0x13
+	MsgTypeRequestComplete    byte = 0x14
 	MsgTypeDecision           byte = 0x20
 	MsgTypeBodyMutation       byte = 0x21
+	MsgTypeProtocolError      byte = 0x22
 	MsgTypeCancelRequest      byte = 0x30
 	MsgTypeCancelAll          byte = 0x31
 	MsgTypePing               byte = 0xF0
@@ -66,6 +70,27 @@ type PongMessage struct {
 	Timestamp int64 `json:"timestamp"`
 }
 
+// ProtocolErrorMessage reports a message the agent could not process.
+type ProtocolErrorMessage struct {
+	// RequestID is the request the message referred to, if it could be
+	// recovered.
+	RequestID *uint64 `json:"request_id,omitempty"`
+
+	// MessageType is the type of the offending message.
+	MessageType byte `json:"message_type"`
+
+	// Code is the failure class, e.g. "malformed" or "unknown_message".
+	Code string `json:"code"`
+
+	// Message describes the failure.
+	Message string `json:"message"`
+}
+
+// Error implements error, so the client can return a protocol error as is.
+func (e *ProtocolErrorMessage) Error() string {
+	return fmt.Sprintf("agent protocol error (%s): %s", e.Code, e.Message)
+}
+
 // ReadMessageV2 reads a v2 length-prefixed message from a reader.
 // Format: [length:4][type:1][payload:variable]
 func ReadMessageV2(r io.Reader) (*V2Message, error) {
@@ -99,8 +124,8 @@ func ReadMessageV2(r io.Reader) (*V2Message, error) {
 	// Read payload (length - 1 for type byte)
 	payloadLength := length - 1
 	if payloadLength > 0 {
-		payloadBuf := make([]byte, payloadLength)
-		if _, err := io.ReadFull(r, payloadBuf); err != nil {
+		payloadBuf, err := wire.ReadN(r, int(payloadLength))
+		if err != nil {
 			return nil, fmt.Errorf("failed to read message payload: %w", err)
 		}
 		msg.Payload = payloadBuf
@@ -123,16 +148,12 @@ func WriteMessageV2(w io.Writer, msg *V2Message) error {
 		return fmt.Errorf("message size %d exceeds maximum %d", totalLength, MaxMessageSizeV2)
 	}
 
-	// Write length prefix
-	lengthBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lengthBuf, uint32(totalLength))
-	if _, err := w.Write(lengthBuf); err != nil {
-		return fmt.Errorf("failed to write message length: %w", err)
-	}
-
-	// Write type byte
-	if _, err := w.Write([]byte{msg.Type}); err != nil {
-		return fmt.Errorf("failed to write message type: %w", err)
+	// Write length prefix and type byte together
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(totalLength))
+	header[4] = msg.Type
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write message header: %w", err)
 	}
 
 	// Write payload
@@ -187,14 +208,22 @@ func (m *V2Message) TypeName() string {
 		return "RequestHeaders"
 	case MsgTypeRequestBodyChunk:
 		return "RequestBodyChunk"
+	case MsgTypeRequestBodyChunkRaw:
+		return "RequestBodyChunkRaw"
 	case MsgTypeResponseHeaders:
 		return "ResponseHeaders"
 	case MsgTypeResponseBodyChunk:
 		return "ResponseBodyChunk"
+	case MsgTypeResponseBodyChunkRaw:
+		return "ResponseBodyChunkRaw"
+	case MsgTypeRequestComplete:
+		return "RequestComplete"
 	case MsgTypeDecision:
 		return "Decision"
 	case MsgTypeBodyMutation:
 		return "BodyMutation"
+	case MsgTypeProtocolError:
+		return "ProtocolError"
 	case MsgTypeCancelRequest:
 		return "CancelRequest"
 	case MsgTypeCancelAll:
@@ -267,6 +296,19 @@ type V2ResponseBodyChunk struct {
 	IsLast     bool   `json:"is_last"`
 }
 
+// V2RequestComplete signals that the proxy has finished processing a request.
+// The agent does not reply to this message.
+//
+// It is the UDS counterpart of the gRPC RequestCompleteEvent. Without it a UDS
+// proxy had no way to run OnRequestComplete, and the handler held a finished
+// request's state until the request was cancelled.
+type V2RequestComplete struct {
+	RequestID  uint64  `json:"request_id"`
+	StatusCode uint16  `json:"status_code"`
+	DurationMS uint64  `json:"duration_ms"`
+	Error      *string `json:"error,omitempty"`
+}
+
 // V2Decision represents a decision in v2 format.
 type V2Decision struct {
 	RequestID       uint64                 `json:"request_id"`
@@ -274,6 +316,10 @@ type V2Decision struct {
 	RequestHeaders  []V2HeaderOp           `json:"request_headers,omitempty"`
 	ResponseHeaders []V2HeaderOp           `json:"response_headers,omitempty"`
 	Audit           map[string]interface{} `json:"audit,omitempty"`
+
+	// Body mutations are sent only if FeatureBodyMutation was negotiated.
+	RequestBodyMutation  map[string]interface{} `json:"request_body_mutation,omitempty"`
+	ResponseBodyMutation map[string]interface{} `json:"response_body_mutation,omitempty"`
 }
 
 // V2HeaderOp represents a header operation in v2 format.
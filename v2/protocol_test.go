@@ -16,6 +16,7 @@ func TestV2Message_TypeName(t *testing.T) {
 		{MsgTypeRequestBodyChunk, "RequestBodyChunk"},
 		{MsgTypeResponseHeaders, "ResponseHeaders"},
 		{MsgTypeResponseBodyChunk, "ResponseBodyChunk"},
+		{MsgTypeRequestComplete, "RequestComplete"},
 		{MsgTypeDecision, "Decision"},
 		{MsgTypeBodyMutation, "BodyMutation"},
 		{MsgTypeCancelRequest, "CancelRequest"},
@@ -0,0 +1,215 @@
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ProxyConn is the proxy side of a connection to an agent. It carries
+// V2Message values whatever the transport underneath, so proxies, tools and
+// test harnesses can talk to agents over UDS or gRPC the same way.
+type ProxyConn interface {
+	// Send writes a message to the agent.
+	Send(msg *V2Message) error
+
+	// Recv reads the next message from the agent. It returns io.EOF once the
+	// agent has closed the connection.
+	Recv() (*V2Message, error)
+
+	// Close closes the connection.
+	Close() error
+}
+
+// NewProxyConn wraps an established connection that speaks the v2 binary
+// protocol, such as a Unix socket connection or an accepted reverse
+// connection.
+func NewProxyConn(conn net.Conn) ProxyConn {
+	return &streamProxyConn{conn: conn}
+}
+
+// DialUDS connects to an agent listening on a Unix socket.
+func DialUDS(socketPath string) (ProxyConn, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", socketPath, err)
+	}
+	return NewProxyConn(conn), nil
+}
+
+// streamProxyConn speaks the length-prefixed v2 protocol over a net.Conn.
+type streamProxyConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+func (c *streamProxyConn) Send(msg *V2Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return WriteMessageV2(c.conn, msg)
+}
+
+func (c *streamProxyConn) Recv() (*V2Message, error) {
+	msg, err := ReadMessageV2(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+func (c *streamProxyConn) Close() error {
+	return c.conn.Close()
+}
+
+// DialGRPC opens a ProcessStream to an agent serving gRPC at address.
+// Without options the connection is made without transport security.
+// The stream lives until Close is called or ctx is cancelled.
+//
+// Messages are converted to and from the gRPC event format, so only the
+// message types that exist in the gRPC service are supported: handshake,
+// request and response events, cancel, ping and request complete.
+func DialGRPC(ctx context.Context, address string, opts ...grpc.DialOption) (ProxyConn, error) {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+
+	cc, err := grpc.NewClient(address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC client for %s: %w", address, err)
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := cc.NewStream(streamCtx, &agentServiceDesc.Streams[0],
+		"/zentinel.agent.v2.AgentServiceV2/ProcessStream", grpc.ForceCodec(jsonCodec{}))
+	if err != nil {
+		cancel()
+		cc.Close()
+		return nil, fmt.Errorf("failed to open ProcessStream: %w", err)
+	}
+
+	return &grpcProxyConn{
+		cc:           cc,
+		stream:       stream,
+		cancel:       cancel,
+		correlations: make(map[uint64]string),
+		requestIDs:   make(map[string]uint64),
+	}, nil
+}
+
+// grpcProxyConn speaks the JSON-encoded gRPC ProcessStream.
+type grpcProxyConn struct {
+	cc     *grpc.ClientConn
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	sendMu sync.Mutex
+
+	// The gRPC service keys requests by correlation ID and answers with the
+	// decimal hash of it, so both directions are mapped back to request IDs.
+	mu           sync.Mutex
+	correlations map[uint64]string
+	requestIDs   map[string]uint64
+}
+
+func (c *grpcProxyConn) Send(msg *V2Message) error {
+	if msg.Type == MsgTypeRequestHeaders {
+		c.track(msg)
+	}
+
+	data, err := v2MessageToGRPCRequest(msg, c.correlationFor)
+	if err != nil {
+		return err
+	}
+
+	c.sendMu.Lock()
+	err = c.stream.SendMsg(&jsonMessage{Data: data})
+	c.sendMu.Unlock()
+
+	if msg.Type != MsgTypeRequestHeaders {
+		c.track(msg)
+	}
+	return err
+}
+
+func (c *grpcProxyConn) Recv() (*V2Message, error) {
+	in := &jsonMessage{}
+	if err := c.stream.RecvMsg(in); err != nil {
+		return nil, err
+	}
+	return grpcResponseToV2Message(in.Data, c.requestIDFor)
+}
+
+func (c *grpcProxyConn) Close() error {
+	c.sendMu.Lock()
+	c.stream.CloseSend()
+	c.sendMu.Unlock()
+	c.cancel()
+	return c.cc.Close()
+}
+
+// track records the correlation ID of new requests and forgets it once the
+// request is complete or cancelled, since neither is answered by the agent.
+func (c *grpcProxyConn) track(msg *V2Message) {
+	var event struct {
+		RequestID uint64 `json:"request_id"`
+		Metadata  struct {
+			CorrelationID string `json:"correlation_id"`
+		} `json:"metadata"`
+	}
+
+	switch msg.Type {
+	case MsgTypeRequestHeaders:
+		if err := json.Unmarshal(msg.Payload, &event); err != nil {
+			return
+		}
+		correlationID := event.Metadata.CorrelationID
+		if correlationID == "" {
+			correlationID = strconv.FormatUint(event.RequestID, 10)
+		}
+
+		c.mu.Lock()
+		c.correlations[event.RequestID] = correlationID
+		c.requestIDs[strconv.FormatUint(hashString(correlationID), 10)] = event.RequestID
+		c.mu.Unlock()
+
+	case MsgTypeRequestComplete, MsgTypeCancelRequest:
+		if err := json.Unmarshal(msg.Payload, &event); err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		if correlationID, ok := c.correlations[event.RequestID]; ok {
+			delete(c.requestIDs, strconv.FormatUint(hashString(correlationID), 10))
+		}
+		delete(c.correlations, event.RequestID)
+		c.mu.Unlock()
+	}
+}
+
+func (c *grpcProxyConn) correlationFor(requestID uint64) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if correlationID, ok := c.correlations[requestID]; ok {
+		return correlationID
+	}
+	return strconv.FormatUint(requestID, 10)
+}
+
+func (c *grpcProxyConn) requestIDFor(correlationID string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if requestID, ok := c.requestIDs[correlationID]; ok {
+		return requestID
+	}
+	requestID, _ := strconv.ParseUint(correlationID, 10, 64)
+	return requestID
+}
@@ -0,0 +1,86 @@
+package v2
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// Raw body chunk message types. They carry the same fields as
+// MsgTypeRequestBodyChunk and MsgTypeResponseBodyChunk, but as a fixed binary
+// header followed by the body bytes, with no JSON or base64. A proxy sends
+// them only once FeatureRawBody has been negotiated.
+const (
+	MsgTypeRequestBodyChunkRaw  byte = 0x15
+	MsgTypeResponseBodyChunkRaw byte = 0x16
+)
+
+// Raw body chunk header: [request_id:8][chunk_index:4][flags:1], big-endian.
+const (
+	rawChunkHeaderSize = 13
+	rawChunkLast       = 0x01
+)
+
+// RawBodyChunk is a request or response body chunk in a raw frame.
+type RawBodyChunk struct {
+	RequestID  uint64
+	ChunkIndex uint32
+	IsLast     bool
+	Data       []byte
+}
+
+// NewRawBodyChunkMessage frames chunk as a message of msgType, which is
+// MsgTypeRequestBodyChunkRaw or MsgTypeResponseBodyChunkRaw.
+func NewRawBodyChunkMessage(msgType byte, chunk *RawBodyChunk) *V2Message {
+	payload := make([]byte, rawChunkHeaderSize+len(chunk.Data))
+	binary.BigEndian.PutUint64(payload[0:8], chunk.RequestID)
+	binary.BigEndian.PutUint32(payload[8:12], chunk.ChunkIndex)
+	if chunk.IsLast {
+		payload[12] = rawChunkLast
+	}
+	copy(payload[rawChunkHeaderSize:], chunk.Data)
+	return &V2Message{Type: msgType, Payload: payload}
+}
+
+// ParseRawBodyChunk parses the payload of a raw body chunk message. Data
+// shares payload's memory rather than copying it.
+func ParseRawBodyChunk(payload []byte) (*RawBodyChunk, error) {
+	if len(payload) < rawChunkHeaderSize {
+		return nil, fmt.Errorf("raw body chunk of %d bytes is shorter than its %d-byte header", len(payload), rawChunkHeaderSize)
+	}
+	return &RawBodyChunk{
+		RequestID:  binary.BigEndian.Uint64(payload[0:8]),
+		ChunkIndex: binary.BigEndian.Uint32(payload[8:12]),
+		IsLast:     payload[12]&rawChunkLast != 0,
+		Data:       payload[rawChunkHeaderSize:],
+	}, nil
+}
+
+// rawToJSON returns the JSON body chunk message equivalent to a raw one, for
+// captures, which store payloads as JSON. Other messages are returned as is.
+func rawToJSON(msg *V2Message) *V2Message {
+	var msgType byte
+	switch msg.Type {
+	case MsgTypeRequestBodyChunkRaw:
+		msgType = MsgTypeRequestBodyChunk
+	case MsgTypeResponseBodyChunkRaw:
+		msgType = MsgTypeResponseBodyChunk
+	default:
+		return msg
+	}
+
+	chunk, err := ParseRawBodyChunk(msg.Payload)
+	if err != nil {
+		return msg
+	}
+	converted, err := NewV2Message(msgType, &V2RequestBodyChunk{
+		RequestID:  chunk.RequestID,
+		ChunkIndex: chunk.ChunkIndex,
+		Data:       base64.StdEncoding.EncodeToString(chunk.Data),
+		IsLast:     chunk.IsLast,
+	})
+	if err != nil {
+		return msg
+	}
+	return converted
+}
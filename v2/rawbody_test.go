@@ -0,0 +1,243 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+func TestRawBodyChunk_RoundTrip(t *testing.T) {
+	chunk := &RawBodyChunk{RequestID: 123, ChunkIndex: 7, IsLast: true, Data: []byte{0x00, 0xff, '{'}}
+
+	var buf bytes.Buffer
+	if err := WriteMessageV2(&buf, NewRawBodyChunkMessage(MsgTypeRequestBodyChunkRaw, chunk)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	msg, err := ReadMessageV2(&buf)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if msg.Type != MsgTypeRequestBodyChunkRaw || msg.TypeName() != "RequestBodyChunkRaw" {
+		t.Errorf("unexpected message type %s", msg.TypeName())
+	}
+
+	parsed, err := ParseRawBodyChunk(msg.Payload)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if parsed.RequestID != 123 || parsed.ChunkIndex != 7 || !parsed.IsLast || !bytes.Equal(parsed.Data, chunk.Data) {
+		t.Errorf("round trip changed chunk: %+v", parsed)
+	}
+
+	if _, err := ParseRawBodyChunk(msg.Payload[:rawChunkHeaderSize-1]); err == nil {
+		t.Error("expected an error for a truncated header")
+	}
+}
+
+// rawBodyContext returns a context for a connection that negotiated
+// FeatureRawBody.
+func rawBodyContext(tb testing.TB) context.Context {
+	tb.Helper()
+	response, err := NewV2Message(MsgTypeHandshakeResponse, &HandshakeResponse{Accepted: true, Features: []string{FeatureRawBody}})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return withNegotiated(context.Background(), response)
+}
+
+func TestAgentHandlerV2_RawBodyChunk(t *testing.T) {
+	quietLogs(t)
+	handler := NewAgentHandlerV2(&TestAgentV2Impl{})
+	messages := fuzzMessages()
+	ctx := rawBodyContext(t)
+
+	decideIn(t, ctx, handler, messages[1])
+	first := NewRawBodyChunkMessage(MsgTypeRequestBodyChunkRaw, &RawBodyChunk{RequestID: 123, Data: []byte("hello ")})
+	if more, _ := decideIn(t, ctx, handler, first).Decision.(map[string]interface{}); more["needs_more"] != true {
+		t.Errorf("expected needs_more, got %v", more)
+	}
+	last := NewRawBodyChunkMessage(MsgTypeRequestBodyChunkRaw, &RawBodyChunk{RequestID: 123, ChunkIndex: 1, IsLast: true, Data: []byte("world")})
+	decideIn(t, ctx, handler, last)
+
+	if inFlight := handler.InFlight(); len(inFlight) != 1 || inFlight[0].RequestBodyBytes != 11 {
+		t.Errorf("expected 11 body bytes buffered, got %+v", inFlight)
+	}
+
+	response, err := handler.HandleMessage(ctx, &V2Message{Type: MsgTypeRequestBodyChunkRaw, Payload: []byte{1, 2}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.Type != MsgTypeProtocolError {
+		t.Errorf("expected a protocol error for a truncated chunk, got %s", response.TypeName())
+	}
+}
+
+func TestAgentHandlerV2_RawBodyChunkNotNegotiated(t *testing.T) {
+	quietLogs(t)
+	ctx := context.Background()
+	chunk := NewRawBodyChunkMessage(MsgTypeResponseBodyChunkRaw, &RawBodyChunk{RequestID: 123, IsLast: true, Data: []byte("<html>")})
+
+	handler := NewAgentHandlerV2(&TestAgentV2Impl{})
+	decide(t, handler, fuzzMessages()[1])
+	response, err := handler.HandleMessage(ctx, chunk)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var protocolErr ProtocolErrorMessage
+	if err := response.ParsePayload(&protocolErr); err != nil || response.Type != MsgTypeProtocolError {
+		t.Fatalf("expected a protocol error, got %s (%v)", response.TypeName(), err)
+	}
+	if protocolErr.Code != string(zentinel.FailureUnknownMessage) || protocolErr.MessageType != MsgTypeResponseBodyChunkRaw {
+		t.Errorf("unexpected protocol error %+v", protocolErr)
+	}
+	if got := handler.metrics.Report().Failures[string(zentinel.FailureUnknownMessage)]; got != 1 {
+		t.Errorf("expected the frame to be counted as unknown, got %d", got)
+	}
+	if inFlight := handler.InFlight(); len(inFlight) != 1 || inFlight[0].ResponseBodyBytes != 0 {
+		t.Errorf("expected the chunk not to be buffered, got %+v", inFlight)
+	}
+
+	closing := NewAgentHandlerV2(&TestAgentV2Impl{}).WithMalformedInput(zentinel.MalformedClose)
+	if _, err := closing.HandleMessage(ctx, chunk); !errors.Is(err, zentinel.ErrMalformedInput) {
+		t.Errorf("expected ErrMalformedInput under the close policy, got %v", err)
+	}
+}
+
+func TestRawToJSON(t *testing.T) {
+	raw := NewRawBodyChunkMessage(MsgTypeResponseBodyChunkRaw, &RawBodyChunk{RequestID: 5, IsLast: true, Data: []byte("<html>")})
+	converted := rawToJSON(raw)
+	if converted.Type != MsgTypeResponseBodyChunk {
+		t.Fatalf("expected ResponseBodyChunk, got %s", converted.TypeName())
+	}
+	var chunk V2ResponseBodyChunk
+	if err := converted.ParsePayload(&chunk); err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if chunk.RequestID != 5 || !chunk.IsLast || chunk.Data != "PGh0bWw+" {
+		t.Errorf("unexpected chunk %+v", chunk)
+	}
+
+	if ping := fuzzMessages()[8]; rawToJSON(ping) != ping {
+		t.Error("expected other messages to be returned as is")
+	}
+}
+
+func TestClient_RawBodyChunks(t *testing.T) {
+	ctx := context.Background()
+	client, err := DialClientUDS(ctx, startTestRunner(t, &clientTestAgent{}), "test-proxy")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	if !client.HandshakeResponse().hasFeature(FeatureRawBody) {
+		t.Fatalf("expected raw_body to be negotiated, got %v", client.HandshakeResponse().Features)
+	}
+
+	headers := &V2RequestHeaders{Method: "POST", URI: "/upload"}
+	if _, err := client.RequestHeaders(ctx, headers); err != nil {
+		t.Fatalf("request headers: %v", err)
+	}
+	decision, err := client.RequestBodyChunkRaw(ctx, &RawBodyChunk{RequestID: headers.RequestID, Data: []byte("hello ")})
+	if err != nil || !decision.NeedsMore {
+		t.Fatalf("expected needs_more, got %+v, %v", decision, err)
+	}
+	decision, err = client.RequestBodyChunkRaw(ctx, &RawBodyChunk{RequestID: headers.RequestID, ChunkIndex: 1, IsLast: true, Data: []byte("world")})
+	if err != nil {
+		t.Fatalf("request body chunk: %v", err)
+	}
+	if len(decision.RequestHeaders) != 1 || *decision.RequestHeaders[0].Value != "hello world" {
+		t.Errorf("expected x-body header with full body, got %+v", decision.RequestHeaders)
+	}
+}
+
+// benchmarkChunk is the body chunk size used by the framing benchmarks.
+const benchmarkChunk = 64 * 1024
+
+// BenchmarkBodyChunk compares writing, reading and decoding a body chunk as
+// base64 in JSON and as a raw frame.
+func BenchmarkBodyChunk(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), benchmarkChunk/16)
+
+	b.Run("json", func(b *testing.B) {
+		var buf bytes.Buffer
+		b.SetBytes(benchmarkChunk)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg, err := NewV2Message(MsgTypeRequestBodyChunk, &V2RequestBodyChunk{
+				RequestID: 123,
+				Data:      base64.StdEncoding.EncodeToString(data),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			buf.Reset()
+			WriteMessageV2(&buf, msg)
+			read, err := ReadMessageV2(&buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var chunk V2RequestBodyChunk
+			if err := read.ParsePayload(&chunk); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := base64.StdEncoding.DecodeString(chunk.Data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("raw", func(b *testing.B) {
+		var buf bytes.Buffer
+		b.SetBytes(benchmarkChunk)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg := NewRawBodyChunkMessage(MsgTypeRequestBodyChunkRaw, &RawBodyChunk{RequestID: 123, Data: data})
+			buf.Reset()
+			WriteMessageV2(&buf, msg)
+			read, err := ReadMessageV2(&buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := ParseRawBodyChunk(read.Payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkHandleBodyChunk compares the handler's cost for a body chunk in
+// each framing.
+func BenchmarkHandleBodyChunk(b *testing.B) {
+	quietLogs(b)
+	data := bytes.Repeat([]byte("0123456789abcdef"), benchmarkChunk/16)
+	headers := fuzzMessages()[1]
+	jsonChunk, _ := NewV2Message(MsgTypeRequestBodyChunk, &V2RequestBodyChunk{
+		RequestID: 123,
+		Data:      base64.StdEncoding.EncodeToString(data),
+		IsLast:    true,
+	})
+	rawChunk := NewRawBodyChunkMessage(MsgTypeRequestBodyChunkRaw, &RawBodyChunk{RequestID: 123, IsLast: true, Data: data})
+
+	for _, bench := range []struct {
+		name string
+		msg  *V2Message
+	}{{"json", jsonChunk}, {"raw", rawChunk}} {
+		b.Run(bench.name, func(b *testing.B) {
+			handler := NewAgentHandlerV2(&TestAgentV2Impl{})
+			ctx := rawBodyContext(b)
+			b.SetBytes(benchmarkChunk)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				handler.HandleMessage(ctx, headers)
+				if _, err := handler.HandleMessage(ctx, bench.msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package v2
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+// RouteMatch reports whether a request belongs to a route.
+type RouteMatch func(request *zentinel.Request) bool
+
+// MatchRouteID matches requests the proxy assigned to the route with id.
+func MatchRouteID(id string) RouteMatch {
+	return func(request *zentinel.Request) bool {
+		routeID := request.Metadata().RouteID
+		return routeID != nil && *routeID == id
+	}
+}
+
+// MatchHost matches requests whose Host header, without the port, matches
+// pattern, for example "*.example.com". Matching is case-insensitive and uses
+// path.Match syntax.
+func MatchHost(pattern string) RouteMatch {
+	pattern = strings.ToLower(pattern)
+	return func(request *zentinel.Request) bool {
+		host := strings.ToLower(request.Host())
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		matched, _ := path.Match(pattern, host)
+		return matched
+	}
+}
+
+// MatchPathPrefix matches requests whose path starts with prefix.
+func MatchPathPrefix(prefix string) RouteMatch {
+	return func(request *zentinel.Request) bool {
+		return request.PathStartsWith(prefix)
+	}
+}
+
+// MatchMethod matches requests with any of methods.
+func MatchMethod(methods ...string) RouteMatch {
+	return func(request *zentinel.Request) bool {
+		for _, method := range methods {
+			if strings.EqualFold(request.Method(), method) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// route pairs a match with the agent that handles its requests.
+type route struct {
+	match RouteMatch
+	agent zentinel.Agent
+}
+
+// Router is an agent that dispatches each request to one of several agents.
+// Routes are tried in the order they were added; requests matching none go
+// to the fallback agent. The agent chosen from the request headers handles
+// every later phase of the same request; the choice is kept in the request's
+// state.
+//
+// Configuration and lifecycle hooks go to every agent, and the capabilities
+// and health are combined as by Compose.
+//
+// Example:
+//
+//	router := v2.NewRouter(&DefaultAgent{}).
+//	    WithRouteID("payments", &PaymentsAgent{}).
+//	    WithHost("*.internal.example.com", &InternalAgent{}).
+//	    WithPathPrefix("/api/", &APIAgent{})
+type Router struct {
+	*composedAgent
+	routes   []route
+	fallback zentinel.Agent
+}
+
+// chosenAgentKey holds the agent a Router chose for a request.
+var chosenAgentKey = zentinel.NewStateKey[zentinel.Agent]("router.agent")
+
+// NewRouter creates a router that sends unmatched requests to fallback. A
+// nil fallback allows them.
+func NewRouter(fallback zentinel.Agent) *Router {
+	if fallback == nil {
+		fallback = NewBaseAgentV2()
+	}
+	return &Router{
+		composedAgent: &composedAgent{BaseAgentV2: NewBaseAgentV2(), agents: []zentinel.Agent{fallback}},
+		fallback:      fallback,
+	}
+}
+
+// WithRoute sends requests matching match to agent.
+func (r *Router) WithRoute(match RouteMatch, agent zentinel.Agent) *Router {
+	r.routes = append(r.routes, route{match: match, agent: agent})
+	for _, existing := range r.agents {
+		if existing == agent {
+			return r
+		}
+	}
+	r.agents = append(r.agents, agent)
+	return r
+}
+
+// WithRouteID sends requests for the proxy route with id to agent.
+func (r *Router) WithRouteID(id string, agent zentinel.Agent) *Router {
+	return r.WithRoute(MatchRouteID(id), agent)
+}
+
+// WithHost sends requests whose host matches pattern to agent.
+func (r *Router) WithHost(pattern string, agent zentinel.Agent) *Router {
+	return r.WithRoute(MatchHost(pattern), agent)
+}
+
+// WithPathPrefix sends requests whose path starts with prefix to agent.
+func (r *Router) WithPathPrefix(prefix string, agent zentinel.Agent) *Router {
+	return r.WithRoute(MatchPathPrefix(prefix), agent)
+}
+
+// WithMethod sends requests with any of methods to agent.
+func (r *Router) WithMethod(agent zentinel.Agent, methods ...string) *Router {
+	return r.WithRoute(MatchMethod(methods...), agent)
+}
+
+// Name returns "router".
+func (r *Router) Name() string {
+	return "router"
+}
+
+// Match returns the agent for request without remembering the choice.
+func (r *Router) Match(request *zentinel.Request) zentinel.Agent {
+	for _, route := range r.routes {
+		if route.match(request) {
+			return route.agent
+		}
+	}
+	return r.fallback
+}
+
+// agentFor returns the agent already chosen for the request, choosing one if
+// there is none yet.
+func (r *Router) agentFor(request *zentinel.Request) zentinel.Agent {
+	if agent, ok := chosenAgentKey.Get(request); ok {
+		return agent
+	}
+	agent := r.Match(request)
+	chosenAgentKey.Set(request, agent)
+	return agent
+}
+
+func (r *Router) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	return r.agentFor(request).OnRequest(ctx, request)
+}
+
+func (r *Router) OnRequestBody(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	return r.agentFor(request).OnRequestBody(ctx, request)
+}
+
+func (r *Router) OnResponse(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	return r.agentFor(request).OnResponse(ctx, request, response)
+}
+
+func (r *Router) OnResponseBody(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	return r.agentFor(request).OnResponseBody(ctx, request, response)
+}
+
+func (r *Router) OnRequestComplete(ctx context.Context, request *zentinel.Request, status int, durationMS int) {
+	r.agentFor(request).OnRequestComplete(ctx, request, status, durationMS)
+}
+
+// OnGuardrailInspect goes to the agent for the event's route ID, or the
+// fallback.
+func (r *Router) OnGuardrailInspect(ctx context.Context, event *zentinel.GuardrailInspectEvent) *zentinel.GuardrailResponse {
+	request := zentinel.NewRequest(&zentinel.RequestHeadersEvent{
+		Metadata: zentinel.RequestMetadata{CorrelationID: event.CorrelationID, RouteID: event.RouteID},
+	}, nil)
+	return r.Match(request).OnGuardrailInspect(ctx, event)
+}
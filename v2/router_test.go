@@ -0,0 +1,105 @@
+package v2
+
+import (
+	"context"
+	"testing"
+
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+)
+
+// namedAgent tags its decisions with its name and counts response calls.
+type namedAgent struct {
+	BaseAgentV2
+	name      string
+	responses int
+}
+
+func (a *namedAgent) Name() string { return a.name }
+
+func (a *namedAgent) OnRequest(ctx context.Context, request *zentinel.Request) *zentinel.Decision {
+	return zentinel.Allow().WithTag(a.name)
+}
+
+func (a *namedAgent) OnResponse(ctx context.Context, request *zentinel.Request, response *zentinel.Response) *zentinel.Decision {
+	a.responses++
+	return zentinel.Allow().WithTag(a.name)
+}
+
+func routerRequest(correlationID, method, uri, host, routeID string) *zentinel.Request {
+	event := &zentinel.RequestHeadersEvent{
+		Metadata: zentinel.RequestMetadata{CorrelationID: correlationID},
+		Method:   method,
+		URI:      uri,
+		Headers:  map[string][]string{"host": {host}},
+	}
+	if routeID != "" {
+		event.Metadata.RouteID = &routeID
+	}
+	return zentinel.NewRequest(event, nil)
+}
+
+func TestRouter_Match(t *testing.T) {
+	fallback := &namedAgent{name: "fallback"}
+	byRoute := &namedAgent{name: "route"}
+	byHost := &namedAgent{name: "host"}
+	byPath := &namedAgent{name: "path"}
+	byMethod := &namedAgent{name: "method"}
+	router := NewRouter(fallback).
+		WithRouteID("payments", byRoute).
+		WithHost("*.internal.example.com", byHost).
+		WithPathPrefix("/api/", byPath).
+		WithMethod(byMethod, "DELETE")
+
+	tests := []struct {
+		request *zentinel.Request
+		want    zentinel.Agent
+	}{
+		{routerRequest("", "GET", "/api/x", "app.internal.example.com", "payments"), byRoute},
+		{routerRequest("", "GET", "/api/x", "App.Internal.Example.com:8443", ""), byHost},
+		{routerRequest("", "GET", "/api/x", "example.com", ""), byPath},
+		{routerRequest("", "delete", "/", "example.com", ""), byMethod},
+		{routerRequest("", "GET", "/", "example.com", ""), fallback},
+	}
+	for _, tt := range tests {
+		if got := router.Match(tt.request); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.request, tt.want.Name(), got.Name())
+		}
+	}
+}
+
+func TestRouter_RemembersChoice(t *testing.T) {
+	fallback := &namedAgent{name: "fallback"}
+	api := &namedAgent{name: "api"}
+	router := NewRouter(fallback).WithPathPrefix("/api/", api)
+	ctx := context.Background()
+
+	request := routerRequest("req-1", "GET", "/api/users", "example.com", "")
+	if tags := router.OnRequest(ctx, request).Build().Audit.Tags; tags[0] != "api" {
+		t.Fatalf("expected the api agent, got %v", tags)
+	}
+
+	// A later phase reaches the same agent even if the request now matches
+	// another route.
+	router.routes = nil
+	response := zentinel.NewResponse(&zentinel.ResponseHeadersEvent{CorrelationID: "req-1", Status: 200}, nil)
+	router.OnResponse(ctx, request, response)
+	if api.responses != 1 || fallback.responses != 0 {
+		t.Errorf("expected the response at the api agent, got api=%d fallback=%d", api.responses, fallback.responses)
+	}
+
+	if agent, _ := chosenAgentKey.Get(request); agent != api {
+		t.Errorf("expected the choice in the request state, got %v", agent)
+	}
+}
+
+func TestRouter_Capabilities(t *testing.T) {
+	api := &stepAgent{caps: NewAgentCapabilities().HandleResponseBody()}
+	router := NewRouter(nil).WithPathPrefix("/api/", api).WithMethod(api, "POST")
+
+	if len(router.agents) != 2 {
+		t.Errorf("expected the fallback and one routed agent, got %d", len(router.agents))
+	}
+	if !router.Capabilities().HandlesResponseBody {
+		t.Error("expected the routed agent's capabilities")
+	}
+}
@@ -1,20 +1,26 @@
 package v2
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/pflag"
+	zentinel "github.com/zentinelproxy/zentinel-agent-go-sdk"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
@@ -41,6 +47,10 @@ type RunnerConfigV2 struct {
 	// Transport specifies the transport type.
 	Transport TransportType
 
+	// Transports, if set, are served together in place of Transport, sharing
+	// one handler and agent. Each may appear once.
+	Transports []TransportType
+
 	// SocketPath is the Unix socket path (for UDS transport).
 	SocketPath string
 
@@ -59,6 +69,9 @@ type RunnerConfigV2 struct {
 	// LogLevel sets the log level.
 	LogLevel string
 
+	// LogBackend is zentinel.LogBackendZerolog or zentinel.LogBackendSlog.
+	LogBackend string
+
 	// ShutdownTimeout is the maximum time to wait for graceful shutdown.
 	ShutdownTimeout time.Duration
 
@@ -73,6 +86,40 @@ type RunnerConfigV2 struct {
 
 	// AuthToken for reverse connection authentication.
 	AuthToken string
+
+	// CapturePath, if set, is a JSONL file that every inbound message and its
+	// reply are appended to.
+	CapturePath string
+
+	// FailurePolicy decides the decision sent when a hook panics or misses
+	// its deadline.
+	FailurePolicy zentinel.FailurePolicy
+
+	// Deadlines bounds how long each hook may run.
+	Deadlines zentinel.HookDeadlines
+
+	// MalformedInput is what is done with messages that cannot be parsed.
+	MalformedInput zentinel.MalformedInputAction
+
+	// Shadow configures shadow mode at startup.
+	Shadow zentinel.ShadowConfig
+
+	// Tracing configures the span exporter. Tracing is off unless an
+	// exporter is set or a tracer provider is given to the runner.
+	Tracing zentinel.TracingConfig
+
+	// Audit configures the local audit log of decisions.
+	Audit zentinel.AuditConfig
+
+	// DebugTTL is how long a runtime change of the log level or payload
+	// dumps lasts. Zero keeps changes until they are reverted.
+	DebugTTL time.Duration
+
+	// AdminAddress, if set, is the host:port an admin HTTP endpoint listens
+	// on. It serves the debug settings at /debug/logging, the in-flight
+	// requests, streams, configuration, last health status and capabilities
+	// under /debug/, and pprof and expvar.
+	AdminAddress string
 }
 
 // DefaultRunnerConfigV2 returns the default v2 runner configuration.
@@ -86,24 +133,45 @@ func DefaultRunnerConfigV2() RunnerConfigV2 {
 		TLSConfig:                nil,
 		JSONLogs:                 false,
 		LogLevel:                 "info",
+		LogBackend:               zentinel.LogBackendZerolog,
+		DebugTTL:                 15 * time.Minute,
 		ShutdownTimeout:          30 * time.Second,
 		DrainTimeout:             10 * time.Second,
 		HealthCheckInterval:      10 * time.Second,
 		ReverseReconnectInterval: 5 * time.Second,
 		AuthToken:                "",
+		CapturePath:              "",
+		FailurePolicy:            zentinel.DefaultFailurePolicy(),
+		MalformedInput:           zentinel.MalformedAllow,
 	}
 }
 
 // AgentRunnerV2 runs an agent server with v2 protocol support.
 type AgentRunnerV2 struct {
-	agent    AgentV2
-	config   RunnerConfigV2
-	handler  *AgentHandlerV2
-	listener net.Listener
-	shutdown chan struct{}
-	draining bool
-	mu       sync.RWMutex
-	wg       sync.WaitGroup
+	agent     AgentV2
+	config    RunnerConfigV2
+	handler   *AgentHandlerV2
+	listeners map[TransportType]net.Listener
+	shutdown  chan struct{}
+	ready     chan struct{}
+	capture   *zentinel.Capture
+	draining  bool
+	mu        sync.RWMutex
+	wg        sync.WaitGroup
+
+	middleware []zentinel.Middleware
+	shadow     *zentinel.ShadowMode
+	tracer     *zentinel.Tracer
+	audit      zentinel.AuditSink
+	logger     *zerolog.Logger
+	debug      *zentinel.DebugControl
+
+	streams   map[string]StreamInfo
+	streamsMu sync.Mutex
+	connID    atomic.Uint64
+
+	readyOnce sync.Once
+	stopOnce  sync.Once
 }
 
 // NewAgentRunnerV2 creates a new v2 runner for the given agent.
@@ -111,12 +179,19 @@ func NewAgentRunnerV2(agent AgentV2) *AgentRunnerV2 {
 	config := DefaultRunnerConfigV2()
 	config.Name = agent.Name()
 
-	return &AgentRunnerV2{
+	shadow := zentinel.NewShadowMode(config.Shadow)
+	r := &AgentRunnerV2{
 		agent:    agent,
 		config:   config,
-		handler:  NewAgentHandlerV2(agent),
+		handler:  NewAgentHandlerV2(agent).WithShadowMode(shadow),
 		shutdown: make(chan struct{}),
+		ready:    make(chan struct{}),
+		shadow:   shadow,
+		debug:    zentinel.NewDebugControl(config.DebugTTL),
+		streams:  make(map[string]StreamInfo),
 	}
+	r.wrapAgent()
+	return r
 }
 
 // WithName sets the agent name for logging.
@@ -162,6 +237,14 @@ func (r *AgentRunnerV2) WithReverseAuth(proxyAddress, authToken string) *AgentRu
 	return r
 }
 
+// WithTransports serves several transports at once, e.g. UDS for a local
+// proxy and gRPC for remote ones. Each uses the address set by WithSocket,
+// WithGRPC or WithReverse, or the default.
+func (r *AgentRunnerV2) WithTransports(transports ...TransportType) *AgentRunnerV2 {
+	r.config.Transports = transports
+	return r
+}
+
 // WithJSONLogs enables JSON log format.
 func (r *AgentRunnerV2) WithJSONLogs() *AgentRunnerV2 {
 	r.config.JSONLogs = true
@@ -186,88 +269,376 @@ func (r *AgentRunnerV2) WithDrainTimeout(timeout time.Duration) *AgentRunnerV2 {
 	return r
 }
 
+// WithReconnectInterval sets how often a reverse connection is retried.
+func (r *AgentRunnerV2) WithReconnectInterval(interval time.Duration) *AgentRunnerV2 {
+	r.config.ReverseReconnectInterval = interval
+	return r
+}
+
+// WithLogger sets the logger the runner logs to, overriding the log format
+// and level configuration. Hooks find it, with request fields attached,
+// through zentinel.LoggerFrom.
+func (r *AgentRunnerV2) WithLogger(logger zerolog.Logger) *AgentRunnerV2 {
+	r.logger = &logger
+	return r
+}
+
+// WithSlogHandler logs through handler, as WithLogger does with a zerolog
+// logger.
+func (r *AgentRunnerV2) WithSlogHandler(handler slog.Handler) *AgentRunnerV2 {
+	return r.WithLogger(zentinel.NewSlogLogger(handler).With().Str("agent", r.config.Name).Logger())
+}
+
+// Logger returns the runner's logger. Until Run sets it up from the
+// configuration, or one is given to WithLogger, it is the global logger.
+func (r *AgentRunnerV2) Logger() *zerolog.Logger {
+	if r.logger == nil {
+		return &log.Logger
+	}
+	return r.logger
+}
+
+// MetricsCollector returns the collector the runner's handler records
+// request outcomes, hook failures and transport counters in.
+func (r *AgentRunnerV2) MetricsCollector() *MetricsCollector {
+	return r.handler.metrics
+}
+
+// DebugControl returns the runner's control of its log level and payload
+// dumps.
+func (r *AgentRunnerV2) DebugControl() *zentinel.DebugControl {
+	return r.debug
+}
+
+// WithCapture records every inbound message and its reply to capture.
+func (r *AgentRunnerV2) WithCapture(capture *zentinel.Capture) *AgentRunnerV2 {
+	r.capture = capture
+	return r
+}
+
+// WithFailurePolicy sets the decision sent when a hook panics or misses its
+// deadline.
+func (r *AgentRunnerV2) WithFailurePolicy(policy zentinel.FailurePolicy) *AgentRunnerV2 {
+	r.config.FailurePolicy = policy
+	r.handler.WithFailurePolicy(policy)
+	return r
+}
+
+// WithDeadlines sets how long each hook may run.
+func (r *AgentRunnerV2) WithDeadlines(deadlines zentinel.HookDeadlines) *AgentRunnerV2 {
+	r.config.Deadlines = deadlines
+	r.handler.WithDeadlines(deadlines)
+	return r
+}
+
+// WithMalformedInput sets what is done with messages that cannot be parsed.
+func (r *AgentRunnerV2) WithMalformedInput(action zentinel.MalformedInputAction) *AgentRunnerV2 {
+	r.config.MalformedInput = action
+	r.handler.WithMalformedInput(action)
+	return r
+}
+
+// WithMiddleware adds middleware around the agent's decision hooks. The
+// first middleware added is the outermost. Tracing, payload dumps, audit and
+// shadow mode wrap all of it, in that order from the outside.
+func (r *AgentRunnerV2) WithMiddleware(mws ...zentinel.Middleware) *AgentRunnerV2 {
+	r.middleware = append(r.middleware, mws...)
+	r.wrapAgent()
+	return r
+}
+
+// WithAuditSink writes decisions to sink instead of the audit log in the
+// configuration. Config.Audit.AllDecisions still decides which are written.
+func (r *AgentRunnerV2) WithAuditSink(sink zentinel.AuditSink) *AgentRunnerV2 {
+	r.audit = sink
+	r.wrapAgent()
+	return r
+}
+
+// WithTracerProvider traces every hook invocation with spans from
+// provider, overriding the tracing configuration.
+func (r *AgentRunnerV2) WithTracerProvider(provider trace.TracerProvider) *AgentRunnerV2 {
+	r.tracer = zentinel.NewTracer(provider)
+	r.wrapAgent()
+	return r
+}
+
+// wrapAgent rebuilds the handler's agent from the tracer, payload dumps,
+// audit sink, shadow mode and middleware, outermost first.
+func (r *AgentRunnerV2) wrapAgent() {
+	mws := []zentinel.Middleware{}
+	if r.tracer != nil {
+		mws = append(mws, r.tracer.Middleware())
+	}
+	mws = append(mws, r.debug.Middleware())
+	if r.audit != nil {
+		mws = append(mws, zentinel.AuditMiddleware(r.audit, r.config.Audit.AllDecisions))
+	}
+	mws = append(mws, r.shadow.Middleware())
+	r.handler.agent = Wrap(r.agent, append(mws, r.middleware...)...)
+	r.handler.tracer = r.tracer
+	r.handler.auditSink, r.handler.auditAll = r.audit, r.config.Audit.AllDecisions
+}
+
+// WithShadowMode sets shadow mode at startup. Configure messages carrying
+// zentinel.ShadowConfigKey switch it later.
+func (r *AgentRunnerV2) WithShadowMode(config zentinel.ShadowConfig) *AgentRunnerV2 {
+	r.config.Shadow = config
+	r.shadow.Set(config)
+	return r
+}
+
+// ShadowMode returns the runner's shadow mode.
+func (r *AgentRunnerV2) ShadowMode() *zentinel.ShadowMode {
+	return r.shadow
+}
+
 // WithConfig sets the full runner configuration.
 func (r *AgentRunnerV2) WithConfig(config RunnerConfigV2) *AgentRunnerV2 {
 	r.config = config
+	r.shadow.Set(config.Shadow)
+	r.wrapAgent()
+	r.handler.WithFailurePolicy(config.FailurePolicy).
+		WithDeadlines(config.Deadlines).
+		WithMalformedInput(config.MalformedInput)
 	return r
 }
 
+// setupLogging builds the runner's logger from the configuration, unless
+// one was given to WithLogger, and puts its level under the debug control.
+// The global logger is left alone.
 func (r *AgentRunnerV2) setupLogging() {
-	level, err := zerolog.ParseLevel(r.config.LogLevel)
-	if err != nil {
-		level = zerolog.InfoLevel
+	if r.logger == nil {
+		logCtx := zentinel.NewLogger(r.config.LogBackend, r.config.JSONLogs, r.config.LogLevel).With().
+			Str("agent", r.config.Name)
+		if r.config.JSONLogs {
+			logCtx = logCtx.Str("protocol", "v2")
+		}
+		logger := logCtx.Logger()
+		r.logger = &logger
 	}
-	zerolog.SetGlobalLevel(level)
 
-	if r.config.JSONLogs {
-		log.Logger = zerolog.New(os.Stdout).With().
-			Timestamp().
-			Str("agent", r.config.Name).
-			Str("protocol", "v2").
-			Logger()
-	} else {
-		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout}).With().
-			Timestamp().
-			Str("agent", r.config.Name).
-			Logger()
-	}
+	logger := r.debug.WithTTL(r.config.DebugTTL).Logger(*r.logger)
+	r.logger = &logger
 }
 
 // Run starts the agent server.
 func (r *AgentRunnerV2) Run() error {
 	r.setupLogging()
 
-	log.Info().
-		Str("transport", string(r.config.Transport)).
+	if r.capture == nil && r.config.CapturePath != "" {
+		capture, err := zentinel.CreateCapture(r.config.CapturePath)
+		if err != nil {
+			return err
+		}
+		defer capture.Close()
+		r.capture = capture
+	}
+
+	if r.audit == nil && r.config.Audit.Path != "" {
+		audit, err := zentinel.NewAuditLog(r.config.Audit)
+		if err != nil {
+			return err
+		}
+		audit.WithLogger(*r.Logger())
+		defer audit.Close()
+		r.WithAuditSink(audit)
+	}
+
+	if r.tracer == nil && r.config.Tracing.Exporter != "" {
+		provider, err := zentinel.NewTracerProvider(context.Background(), r.config.Tracing, r.config.Name)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), r.config.ShutdownTimeout)
+			defer cancel()
+			if err := provider.Shutdown(ctx); err != nil {
+				r.Logger().Warn().Err(err).Msg("Failed to flush spans")
+			}
+		}()
+		r.WithTracerProvider(provider)
+	}
+
+	if r.config.AdminAddress != "" {
+		admin := zentinel.NewAdminServer(r.config.AdminAddress)
+		r.registerAdmin(admin)
+		if err := admin.Start(r.Logger()); err != nil {
+			return err
+		}
+		defer admin.Close()
+	}
+
+	stopSignals := r.debug.WatchSignals(r.Logger())
+	defer stopSignals()
+
+	transports := r.transports()
+	names := make([]string, len(transports))
+	for i, transport := range transports {
+		names[i] = string(transport)
+	}
+	r.Logger().Info().
+		Strs("transports", names).
 		Str("name", r.config.Name).
 		Msg("Starting agent with v2 protocol")
 
-	switch r.config.Transport {
+	listeners, err := r.listen(transports)
+	if err != nil {
+		return err
+	}
+
+	// Set up signal handling
+	r.setupSignalHandling()
+
+	// Serve every transport; the first to fail stops the rest
+	errs := make(chan error, len(transports))
+	ready := make([]chan struct{}, len(transports))
+	for i, transport := range transports {
+		ready[i] = make(chan struct{})
+		markReady := sync.OnceFunc(func() { close(ready[i]) })
+		go func() {
+			errs <- r.serve(transport, listeners[transport], markReady)
+		}()
+	}
+	go r.awaitReady(ready)
+
+	var serveErr error
+	for range transports {
+		if err := <-errs; err != nil && serveErr == nil {
+			serveErr = err
+			r.Shutdown()
+		}
+	}
+
+	// Wait for connections to drain
+	r.waitForDrain()
+
+	r.Logger().Info().Msg("Agent shutdown complete")
+	return serveErr
+}
+
+// transports returns the transports to serve: Config.Transports, or
+// Config.Transport if it is empty.
+func (r *AgentRunnerV2) transports() []TransportType {
+	if len(r.config.Transports) > 0 {
+		return r.config.Transports
+	}
+	return []TransportType{r.config.Transport}
+}
+
+// listen opens the listeners of the UDS and gRPC transports, so that an
+// address in use fails Run before anything is served. If one fails, those
+// already open are closed. Reverse transport has no listener.
+func (r *AgentRunnerV2) listen(transports []TransportType) (map[TransportType]net.Listener, error) {
+	listeners := make(map[TransportType]net.Listener, len(transports))
+	closeAll := func() {
+		for _, listener := range listeners {
+			if listener != nil {
+				listener.Close()
+			}
+		}
+	}
+
+	for _, transport := range transports {
+		if _, ok := listeners[transport]; ok {
+			closeAll()
+			return nil, fmt.Errorf("transport %s listed more than once", transport)
+		}
+
+		var listener net.Listener
+		var err error
+		switch transport {
+		case TransportUDS:
+			listener, err = r.listenUDS()
+		case TransportGRPC:
+			listener, err = r.listenGRPC()
+		case TransportReverse:
+			if r.config.ReverseAddress == "" {
+				err = fmt.Errorf("reverse address not configured")
+			}
+		default:
+			err = fmt.Errorf("unsupported transport: %s", transport)
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners[transport] = listener
+	}
+
+	r.mu.Lock()
+	r.listeners = listeners
+	r.mu.Unlock()
+
+	// Shutdown may have run before the listeners were recorded
+	select {
+	case <-r.shutdown:
+		closeAll()
+	default:
+	}
+	return listeners, nil
+}
+
+// serve runs transport until shutdown, calling markReady once it accepts
+// connections or, for reverse transport, has registered with the proxy.
+func (r *AgentRunnerV2) serve(transport TransportType, listener net.Listener, markReady func()) error {
+	switch transport {
 	case TransportUDS:
-		return r.runUDS()
+		return r.serveUDS(listener, markReady)
 	case TransportGRPC:
-		return r.runGRPC()
-	case TransportReverse:
-		return r.runReverse()
+		return r.serveGRPC(listener, markReady)
 	default:
-		return fmt.Errorf("unsupported transport: %s", r.config.Transport)
+		return r.serveReverse(markReady)
 	}
 }
 
-func (r *AgentRunnerV2) runUDS() error {
+// awaitReady marks the runner ready once every transport is.
+func (r *AgentRunnerV2) awaitReady(ready []chan struct{}) {
+	for _, transportReady := range ready {
+		select {
+		case <-transportReady:
+		case <-r.shutdown:
+			return
+		}
+	}
+	r.markReady()
+}
+
+func (r *AgentRunnerV2) listenUDS() (net.Listener, error) {
 	// Clean up existing socket
 	if _, err := os.Stat(r.config.SocketPath); err == nil {
 		if err := os.Remove(r.config.SocketPath); err != nil {
-			return fmt.Errorf("failed to remove existing socket: %w", err)
+			return nil, fmt.Errorf("failed to remove existing socket: %w", err)
 		}
 	}
 
 	// Create listener
 	listener, err := net.Listen("unix", r.config.SocketPath)
 	if err != nil {
-		return fmt.Errorf("failed to listen on socket: %w", err)
+		return nil, fmt.Errorf("failed to listen on socket: %w", err)
 	}
-	r.listener = listener
 
 	// Set socket permissions
 	if err := os.Chmod(r.config.SocketPath, 0660); err != nil {
-		log.Warn().Err(err).Msg("Failed to set socket permissions")
+		r.Logger().Warn().Err(err).Msg("Failed to set socket permissions")
 	}
 
-	// Set up signal handling
-	r.setupSignalHandling()
+	return listener, nil
+}
 
-	log.Info().Str("socket", r.config.SocketPath).Msg("Agent listening (UDS)")
+func (r *AgentRunnerV2) serveUDS(listener net.Listener, markReady func()) error {
+	r.Logger().Info().Str("socket", r.config.SocketPath).Msg("Agent listening (UDS)")
+	markReady()
 
 	// Accept connections
 	for {
-		conn, err := r.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-r.shutdown:
 				break
 			default:
-				log.Error().Err(err).Msg("Failed to accept connection")
+				r.Logger().Error().Err(err).Msg("Failed to accept connection")
 				continue
 			}
 			break
@@ -277,13 +648,8 @@ func (r *AgentRunnerV2) runUDS() error {
 		go r.handleUDSConnection(conn)
 	}
 
-	// Wait for connections to drain
-	r.waitForDrain()
-
 	// Cleanup
 	os.Remove(r.config.SocketPath)
-	log.Info().Msg("Agent shutdown complete")
-
 	return nil
 }
 
@@ -291,16 +657,38 @@ func (r *AgentRunnerV2) handleUDSConnection(conn net.Conn) {
 	defer r.wg.Done()
 	defer conn.Close()
 
-	streamID := fmt.Sprintf("uds-%s", conn.RemoteAddr().String())
-	ctx := context.Background()
+	// Clients of a UDS socket share a remote address, so number them
+	streamID := fmt.Sprintf("uds-%d", r.connID.Add(1))
+	defer r.openStream(streamID, TransportUDS)()
+	logger := r.Logger().With().Str("stream_id", streamID).Logger()
+	ctx := withStream(logger.WithContext(context.Background()), streamID)
+	// Requests still in flight when the connection closes will not complete
+	defer func() { r.handler.cancelStream(ctx) }()
+
+	// Serve proxies that still speak v1 on the same socket
+	reader := bufio.NewReader(conn)
+	protocol, err := sniffProtocol(reader)
+	if err != nil {
+		if err != io.EOF {
+			logger.Error().Err(err).Msg("Failed to detect protocol")
+		}
+		return
+	}
+	conn = &sniffedConn{Conn: conn, reader: reader}
+	if protocol == protocolV1 {
+		r.setStreamProtocol(streamID, protocolV1)
+		r.handleLegacyConnection(ctx, conn, streamID)
+		return
+	}
 
 	// Perform handshake
-	if err := r.performHandshake(conn); err != nil {
-		log.Error().Err(err).Msg("Handshake failed")
+	ctx, err = r.performHandshake(ctx, conn, streamID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Handshake failed")
 		return
 	}
 
-	log.Debug().Str("stream_id", streamID).Msg("Connection established")
+	logger.Debug().Msg("Connection established")
 
 	for {
 		select {
@@ -322,7 +710,8 @@ func (r *AgentRunnerV2) handleUDSConnection(conn net.Conn) {
 		msg, err := ReadMessageV2(conn)
 		if err != nil {
 			if err != io.EOF {
-				log.Error().Err(err).Msg("Failed to read message")
+				logger.Error().Err(err).Msg("Failed to read message")
+				r.handler.metrics.RecordTransportError(TransportUDS)
 			}
 			r.agent.OnStreamClosed(ctx, streamID)
 			return
@@ -331,10 +720,22 @@ func (r *AgentRunnerV2) handleUDSConnection(conn net.Conn) {
 			r.agent.OnStreamClosed(ctx, streamID)
 			return
 		}
+		r.handler.metrics.RecordTransportMessage(TransportUDS)
 
 		response, err := r.handler.HandleMessage(ctx, msg)
+		r.captureMessage(streamID, msg, response)
+		if errors.Is(err, zentinel.ErrMalformedInput) {
+			logger.Warn().Err(err).Msg("Closing connection after malformed message")
+			r.handler.metrics.RecordTransportError(TransportUDS)
+			if response != nil {
+				WriteMessageV2(conn, response)
+			}
+			r.agent.OnStreamClosed(ctx, streamID)
+			return
+		}
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to handle message")
+			logger.Error().Err(err).Msg("Failed to handle message")
+			r.handler.metrics.RecordTransportError(TransportUDS)
 			continue
 		}
 
@@ -344,47 +745,60 @@ func (r *AgentRunnerV2) handleUDSConnection(conn net.Conn) {
 		}
 
 		if err := WriteMessageV2(conn, response); err != nil {
-			log.Error().Err(err).Msg("Failed to write response")
+			logger.Error().Err(err).Msg("Failed to write response")
+			r.handler.metrics.RecordTransportError(TransportUDS)
 			r.agent.OnStreamClosed(ctx, streamID)
 			return
 		}
 	}
 }
 
-func (r *AgentRunnerV2) performHandshake(conn net.Conn) error {
+// performHandshake answers the proxy's handshake, returning ctx with the
+// features negotiated for the connection.
+func (r *AgentRunnerV2) performHandshake(ctx context.Context, conn net.Conn, streamID string) (context.Context, error) {
 	// Read handshake request
 	msg, err := ReadMessageV2(conn)
 	if err != nil {
-		return fmt.Errorf("failed to read handshake: %w", err)
+		return ctx, fmt.Errorf("failed to read handshake: %w", err)
 	}
 	if msg == nil {
-		return fmt.Errorf("connection closed during handshake")
+		return ctx, fmt.Errorf("connection closed during handshake")
 	}
 
 	if msg.Type != MsgTypeHandshakeRequest {
-		return fmt.Errorf("expected handshake request, got %s", msg.TypeName())
+		return ctx, fmt.Errorf("expected handshake request, got %s", msg.TypeName())
 	}
 
 	// Handle handshake
-	response, err := r.handler.HandleMessage(context.Background(), msg)
+	response, err := r.handler.HandleMessage(ctx, msg)
 	if err != nil {
-		return fmt.Errorf("handshake handling failed: %w", err)
+		return ctx, fmt.Errorf("handshake handling failed: %w", err)
 	}
+	r.captureMessage(streamID, msg, response)
 
 	// Send response
 	if err := WriteMessageV2(conn, response); err != nil {
-		return fmt.Errorf("failed to send handshake response: %w", err)
+		return ctx, fmt.Errorf("failed to send handshake response: %w", err)
 	}
 
-	return nil
+	// Close the connection if the handshake was rejected
+	var hsResp HandshakeResponse
+	if err := response.ParsePayload(&hsResp); err == nil && !hsResp.Accepted {
+		return ctx, fmt.Errorf("handshake rejected: %s", hsResp.Error)
+	}
+
+	return withNegotiated(ctx, response), nil
 }
 
-func (r *AgentRunnerV2) runGRPC() error {
+func (r *AgentRunnerV2) listenGRPC() (net.Listener, error) {
 	lis, err := net.Listen("tcp", r.config.GRPCAddress)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", r.config.GRPCAddress, err)
+		return nil, fmt.Errorf("failed to listen on %s: %w", r.config.GRPCAddress, err)
 	}
+	return lis, nil
+}
 
+func (r *AgentRunnerV2) serveGRPC(lis net.Listener, markReady func()) error {
 	var opts []grpc.ServerOption
 
 	// Add JSON codec so the service can use JSON marshaling instead of protobuf.
@@ -396,18 +810,32 @@ func (r *AgentRunnerV2) runGRPC() error {
 		opts = append(opts, grpc.Creds(credentials.NewTLS(r.config.TLSConfig)))
 	}
 
-	grpcServer := grpc.NewServer(opts...)
-	registerAgentService(grpcServer, r)
+	// The service learns of connections to scope their unary calls
+	svc := newAgentGRPCService(r)
+	opts = append(opts, grpc.StatsHandler(svc))
 
-	// Set up signal handling
-	r.setupSignalHandling()
+	grpcServer := grpc.NewServer(opts...)
+	registerAgentService(grpcServer, svc)
 
-	log.Info().Str("address", r.config.GRPCAddress).Msg("Agent listening (gRPC)")
+	r.Logger().Info().Str("address", lis.Addr().String()).Msg("Agent listening (gRPC)")
+	markReady()
 
 	go func() {
 		<-r.shutdown
-		log.Info().Msg("Stopping gRPC server...")
-		grpcServer.GracefulStop()
+		r.Logger().Info().Msg("Stopping gRPC server...")
+
+		// Streams stay open until the proxy ends them, so give up on a
+		// graceful stop once the drain timeout has passed.
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(r.config.DrainTimeout):
+			grpcServer.Stop()
+		}
 	}()
 
 	if err := grpcServer.Serve(lis); err != nil {
@@ -418,27 +846,15 @@ func (r *AgentRunnerV2) runGRPC() error {
 			return fmt.Errorf("gRPC server error: %w", err)
 		}
 	}
-
-	// Wait for in-flight requests to drain
-	r.waitForDrain()
-
-	log.Info().Msg("Agent shutdown complete")
 	return nil
 }
 
-func (r *AgentRunnerV2) runReverse() error {
-	if r.config.ReverseAddress == "" {
-		return fmt.Errorf("reverse address not configured")
-	}
-
-	r.setupSignalHandling()
-
-	log.Info().Str("address", r.config.ReverseAddress).Msg("Connecting to proxy (reverse)")
+func (r *AgentRunnerV2) serveReverse(markReady func()) error {
+	r.Logger().Info().Str("address", r.config.ReverseAddress).Msg("Connecting to proxy (reverse)")
 
 	for {
 		select {
 		case <-r.shutdown:
-			log.Info().Msg("Agent shutdown complete")
 			return nil
 		default:
 		}
@@ -446,10 +862,11 @@ func (r *AgentRunnerV2) runReverse() error {
 		// Connect to proxy
 		conn, err := r.connectReverse()
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to connect to proxy")
-			time.Sleep(r.config.ReverseReconnectInterval)
+			r.Logger().Error().Err(err).Msg("Failed to connect to proxy")
+			r.waitReconnect()
 			continue
 		}
+		markReady()
 
 		// Handle connection
 		r.wg.Add(1)
@@ -459,15 +876,22 @@ func (r *AgentRunnerV2) runReverse() error {
 		// Reconnect after disconnection
 		select {
 		case <-r.shutdown:
-			log.Info().Msg("Agent shutdown complete")
 			return nil
 		default:
-			log.Info().Msg("Connection lost, reconnecting...")
-			time.Sleep(r.config.ReverseReconnectInterval)
+			r.Logger().Info().Msg("Connection lost, reconnecting...")
+			r.waitReconnect()
 		}
 	}
 }
 
+// waitReconnect sleeps for the reconnect interval, returning early on shutdown.
+func (r *AgentRunnerV2) waitReconnect() {
+	select {
+	case <-r.shutdown:
+	case <-time.After(r.config.ReverseReconnectInterval):
+	}
+}
+
 func (r *AgentRunnerV2) connectReverse() (net.Conn, error) {
 	var conn net.Conn
 	var err error
@@ -505,6 +929,10 @@ func (r *AgentRunnerV2) connectReverse() (net.Conn, error) {
 		conn.Close()
 		return nil, fmt.Errorf("failed to read registration response: %w", err)
 	}
+	if respMsg == nil {
+		conn.Close()
+		return nil, fmt.Errorf("connection closed during registration")
+	}
 
 	if respMsg.Type != MsgTypeRegistrationAck {
 		conn.Close()
@@ -522,7 +950,7 @@ func (r *AgentRunnerV2) connectReverse() (net.Conn, error) {
 		return nil, fmt.Errorf("registration rejected: %s", resp.Error)
 	}
 
-	log.Info().Str("assigned_id", resp.AssignedID).Msg("Registered with proxy")
+	r.Logger().Info().Str("assigned_id", resp.AssignedID).Msg("Registered with proxy")
 
 	return conn, nil
 }
@@ -531,9 +959,24 @@ func (r *AgentRunnerV2) handleReverseConnection(conn net.Conn) {
 	defer conn.Close()
 
 	streamID := fmt.Sprintf("reverse-%s", conn.RemoteAddr().String())
-	ctx := context.Background()
+	defer r.openStream(streamID, TransportReverse)()
+	logger := r.Logger().With().Str("stream_id", streamID).Logger()
+	ctx := withStream(logger.WithContext(context.Background()), streamID)
+	// Requests still in flight when the connection closes will not complete
+	defer func() { r.handler.cancelStream(ctx) }()
+
+	// Unblock the read below on shutdown
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.shutdown:
+			conn.Close()
+		case <-done:
+		}
+	}()
 
-	log.Debug().Str("stream_id", streamID).Msg("Reverse connection established")
+	logger.Debug().Msg("Reverse connection established")
 
 	for {
 		select {
@@ -546,7 +989,8 @@ func (r *AgentRunnerV2) handleReverseConnection(conn net.Conn) {
 		msg, err := ReadMessageV2(conn)
 		if err != nil {
 			if err != io.EOF {
-				log.Error().Err(err).Msg("Failed to read message")
+				logger.Error().Err(err).Msg("Failed to read message")
+				r.handler.metrics.RecordTransportError(TransportReverse)
 			}
 			r.agent.OnStreamClosed(ctx, streamID)
 			return
@@ -555,10 +999,22 @@ func (r *AgentRunnerV2) handleReverseConnection(conn net.Conn) {
 			r.agent.OnStreamClosed(ctx, streamID)
 			return
 		}
+		r.handler.metrics.RecordTransportMessage(TransportReverse)
 
 		response, err := r.handler.HandleMessage(ctx, msg)
+		r.captureMessage(streamID, msg, response)
+		if errors.Is(err, zentinel.ErrMalformedInput) {
+			logger.Warn().Err(err).Msg("Closing connection after malformed message")
+			r.handler.metrics.RecordTransportError(TransportReverse)
+			if response != nil {
+				WriteMessageV2(conn, response)
+			}
+			r.agent.OnStreamClosed(ctx, streamID)
+			return
+		}
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to handle message")
+			logger.Error().Err(err).Msg("Failed to handle message")
+			r.handler.metrics.RecordTransportError(TransportReverse)
 			continue
 		}
 
@@ -567,7 +1023,8 @@ func (r *AgentRunnerV2) handleReverseConnection(conn net.Conn) {
 		}
 
 		if err := WriteMessageV2(conn, response); err != nil {
-			log.Error().Err(err).Msg("Failed to write response")
+			logger.Error().Err(err).Msg("Failed to write response")
+			r.handler.metrics.RecordTransportError(TransportReverse)
 			r.agent.OnStreamClosed(ctx, streamID)
 			return
 		}
@@ -579,9 +1036,22 @@ func (r *AgentRunnerV2) setupSignalHandling() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		sig := <-sigChan
-		log.Info().Str("signal", sig.String()).Msg("Shutdown signal received")
+		defer signal.Stop(sigChan)
+
+		select {
+		case sig := <-sigChan:
+			r.Logger().Info().Str("signal", sig.String()).Msg("Shutdown signal received")
+			r.Shutdown()
+		case <-r.shutdown:
+		}
+	}()
+}
 
+// Shutdown drains the agent and stops the runner, exactly as SIGINT or
+// SIGTERM would. Run returns once in-flight connections have drained.
+// It is safe to call Shutdown more than once.
+func (r *AgentRunnerV2) Shutdown() {
+	r.stopOnce.Do(func() {
 		// Start drain
 		r.mu.Lock()
 		r.draining = true
@@ -591,12 +1061,64 @@ func (r *AgentRunnerV2) setupSignalHandling() {
 		defer cancel()
 		r.agent.OnDrain(ctx)
 
-		// Close listener to stop accepting new connections
+		// Close listeners to stop accepting new connections
 		close(r.shutdown)
-		if r.listener != nil {
-			r.listener.Close()
+		r.mu.RLock()
+		for _, listener := range r.listeners {
+			if listener != nil {
+				listener.Close()
+			}
 		}
-	}()
+		r.mu.RUnlock()
+	})
+}
+
+// Ready returns a channel that is closed once the runner accepts connections,
+// or, for reverse transport, once it has registered with the proxy.
+func (r *AgentRunnerV2) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// Addr returns the address the runner listens on, for the first of its
+// transports. It returns nil before the runner is ready and for reverse
+// transport.
+func (r *AgentRunnerV2) Addr() net.Addr {
+	return r.AddrOf(r.transports()[0])
+}
+
+// AddrOf returns the address the runner listens on for transport, or nil if
+// it is not listening on it.
+func (r *AgentRunnerV2) AddrOf(transport TransportType) net.Addr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if listener := r.listeners[transport]; listener != nil {
+		return listener.Addr()
+	}
+	return nil
+}
+
+// captureMessage records an inbound message and the reply, if capturing.
+func (r *AgentRunnerV2) captureMessage(streamID string, msg, response *V2Message) {
+	if r.capture == nil {
+		return
+	}
+
+	// Captures hold JSON, so raw body chunks are recorded as JSON ones
+	msg = rawToJSON(msg)
+
+	var responseType byte
+	var responsePayload []byte
+	if response != nil {
+		responseType = response.Type
+		responsePayload = response.Payload
+	}
+	if err := r.capture.RecordV2(streamID, msg.Type, msg.Payload, responseType, responsePayload); err != nil {
+		r.Logger().Warn().Err(err).Msg("Failed to capture message")
+	}
+}
+
+func (r *AgentRunnerV2) markReady() {
+	r.readyOnce.Do(func() { close(r.ready) })
 }
 
 func (r *AgentRunnerV2) waitForDrain() {
@@ -609,9 +1131,9 @@ func (r *AgentRunnerV2) waitForDrain() {
 
 	select {
 	case <-done:
-		log.Info().Msg("All connections drained")
+		r.Logger().Info().Msg("All connections drained")
 	case <-time.After(r.config.DrainTimeout):
-		log.Warn().Msg("Drain timeout reached, forcing shutdown")
+		r.Logger().Warn().Msg("Drain timeout reached, forcing shutdown")
 	}
 
 	// Call shutdown hook
@@ -627,11 +1149,31 @@ func ParseArgsV2() RunnerConfigV2 {
 	pflag.StringVar(&config.SocketPath, "socket", config.SocketPath, "Unix socket path (for UDS transport)")
 	pflag.StringVar(&config.GRPCAddress, "grpc", "", "gRPC server address (enables gRPC transport)")
 	pflag.StringVar(&config.ReverseAddress, "reverse", "", "Proxy address for reverse connection")
+	transports := pflag.StringSlice("transports", nil, "Serve these transports together (uds, grpc, reverse)")
 	pflag.BoolVar(&config.JSONLogs, "json-logs", config.JSONLogs, "Enable JSON log format")
 	pflag.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Log level (debug, info, warn, error)")
+	pflag.StringVar(&config.LogBackend, "log-backend", config.LogBackend, "Logging backend (zerolog, slog)")
+	pflag.DurationVar(&config.DebugTTL, "debug-ttl", config.DebugTTL, "How long runtime log level and payload dump changes last (0 for no limit)")
+	pflag.StringVar(&config.AdminAddress, "admin-addr", "", "Serve admin endpoints over HTTP on this address")
 	pflag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "Shutdown timeout")
 	pflag.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout, "Drain timeout")
 	pflag.StringVar(&config.AuthToken, "auth-token", "", "Authentication token for reverse connections")
+	pflag.StringVar(&config.CapturePath, "capture", "", "Append inbound messages and replies to this JSONL file")
+	pflag.Var(&config.FailurePolicy.Default, "failure-mode", "Decision when a hook panics or times out (open, closed)")
+	pflag.DurationVar(&config.Deadlines.Default, "hook-timeout", 0, "Maximum time a hook may run (0 for no limit)")
+	pflag.Var(&config.MalformedInput, "malformed-input", "Action for messages that cannot be parsed (allow, block, close)")
+	pflag.BoolVar(&config.Shadow.Enabled, "shadow-mode", false, "Allow every request, recording what the agent would have blocked")
+	pflag.BoolVar(&config.Shadow.SuppressMutations, "shadow-suppress-mutations", false, "In shadow mode, also drop header and body mutations")
+	pflag.StringVar(&config.Audit.Path, "audit-log", "", "Append blocking decisions to this JSONL audit log")
+	pflag.BoolVar(&config.Audit.AllDecisions, "audit-all", false, "Also write allow decisions to the audit log")
+	pflag.Int64Var(&config.Audit.MaxSize, "audit-max-size", 0, "Rotate the audit log at this many bytes (0 for no limit)")
+	pflag.DurationVar(&config.Audit.RotateEvery, "audit-rotate-every", 0, "Rotate the audit log at this interval (0 for never)")
+	pflag.IntVar(&config.Audit.MaxBackups, "audit-max-backups", 0, "Rotated audit logs to keep (0 keeps all)")
+	pflag.BoolVar(&config.Audit.Compress, "audit-compress", false, "Gzip rotated audit logs")
+	pflag.StringVar(&config.Tracing.Exporter, "otel-exporter", "", "Export hook spans (otlp, stdout, file)")
+	pflag.StringVar(&config.Tracing.Endpoint, "otel-endpoint", "", "OTLP collector address (host:port)")
+	pflag.BoolVar(&config.Tracing.Insecure, "otel-insecure", false, "Connect to the OTLP collector without TLS")
+	pflag.StringVar(&config.Tracing.File, "otel-file", "", "File the file exporter writes spans to")
 	pflag.Parse()
 
 	// Determine transport based on flags
@@ -642,6 +1184,12 @@ func ParseArgsV2() RunnerConfigV2 {
 	} else {
 		config.Transport = TransportUDS
 	}
+	for _, transport := range *transports {
+		config.Transports = append(config.Transports, TransportType(transport))
+	}
+	if config.GRPCAddress == "" {
+		config.GRPCAddress = DefaultRunnerConfigV2().GRPCAddress
+	}
 
 	return config
 }
@@ -661,6 +1209,6 @@ func RunAgentV2(agent AgentV2) {
 	runner := NewAgentRunnerV2(agent).WithConfig(config)
 
 	if err := runner.Run(); err != nil {
-		log.Fatal().Err(err).Msg("Agent failed")
+		runner.Logger().Fatal().Err(err).Msg("Agent failed")
 	}
 }